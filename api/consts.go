@@ -1,5 +1,29 @@
 package api
 
+// 版本信息
+const (
+	LUA_VERSION_MAJOR   = "5"
+	LUA_VERSION_MINOR   = "3"
+	LUA_VERSION_RELEASE = "4"
+
+	LUA_VERSION   = "Lua " + LUA_VERSION_MAJOR + "." + LUA_VERSION_MINOR
+	LUA_RELEASE   = LUA_VERSION + "." + LUA_VERSION_RELEASE
+	LUA_COPYRIGHT = LUA_RELEASE + "  Copyright (C) 1994-2017 Lua.org, PUC-Rio"
+)
+
+// 语言版本号，Version()的返回值
+// 每个state可以选择5.3（默认）或5.4的语义，见state.WithVersion
+const (
+	LUA_VERSION_NUM    = 503
+	LUA_VERSION_NUM_54 = 504
+
+	LUA_VERSION_54 = "Lua 5.4"
+)
+
+// 注册表中的键，值为true时按Lua 5.1的规则编译vararg函数（带有局部变量arg），
+// 由compat51库设置
+const LUA_COMPAT51 = "_COMPAT51"
+
 const (
 	LUA_TNONE = iota - 1 // None指无效索引的返回值类型
 	LUA_TNIL
@@ -49,6 +73,25 @@ const (
 	LUA_MININTEGER = -1 << 63
 )
 
+// 注册表引用，Ref对nil值返回LUA_REFNIL，LUA_NOREF表示无效的引用
+const (
+	LUA_NOREF  = -2
+	LUA_REFNIL = -1
+)
+
+// GC的操作，collectgarbage的各个选项
+const (
+	LUA_GCSTOP       = 0
+	LUA_GCRESTART    = 1
+	LUA_GCCOLLECT    = 2
+	LUA_GCCOUNT      = 3
+	LUA_GCCOUNTB     = 4
+	LUA_GCSTEP       = 5
+	LUA_GCSETPAUSE   = 6
+	LUA_GCSETSTEPMUL = 7
+	LUA_GCISRUNNING  = 9
+)
+
 // 错误处理相关
 const (
 	LUA_OK = iota
@@ -6,6 +6,7 @@ type AuxLib interface {
 	/* Error-report functions */
 	Error2(fmt string, a ...interface{}) int
 	ArgError(arg int, extraMsg string) int
+	Where(level int)
 	/* Argument check functions */
 	CheckStack2(sz int, msg string)
 	ArgCheck(cond bool, arg int, extraMsg string)
@@ -35,4 +36,7 @@ type AuxLib interface {
 	NewLib(l FuncReg)
 	NewLibTable(l FuncReg)
 	SetFuncs(l FuncReg, nup int)
+	/* Reference system */
+	Ref(t int) int
+	Unref(t, ref int)
 }
@@ -0,0 +1,210 @@
+package api
+
+import "context"
+import "fmt"
+import "reflect"
+import "runtime"
+import "sync"
+
+var contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+
+// LuaError: 从Go调用Lua函数出错时返回的错误
+type LuaError struct {
+	Status  int         // PCall返回的错误码
+	Message string      // 错误信息，错误对象不是字符串时按lua.c的方式描述
+	Value   interface{} // 错误对象，按ToGoValue转换，是*LValueRef时用Release释放
+	Cause   error       // 调用因context结束而中断时为ctx.Err()
+}
+
+func (self *LuaError) Error() string {
+	if self.Cause != nil {
+		return self.Message + ": " + self.Cause.Error()
+	}
+	return self.Message
+}
+
+func (self *LuaError) Unwrap() error {
+	return self.Cause
+}
+
+// Release: 错误对象是表等需要句柄的值时释放它在注册表中的引用，重复调用没有影响
+func (self *LuaError) Release() {
+	if ref, ok := self.Value.(*LValueRef); ok {
+		ref.Release()
+	}
+}
+
+// PCallFunc: 以保护模式执行Go函数f，栈顶的nArgs个值是f的参数（在f中从索引1开始），调用后被弹出
+// 取函数、压入参数、调用和转换返回值都应在f中完成：其中的Lua错误包装成*LuaError返回，
+// f返回的error原样返回，ctx结束时中断f中执行的Lua代码
+func PCallFunc(ctx context.Context, ls LuaState, nArgs int, f func(ls LuaState) error) error {
+	var ferr error
+	ls.CheckStack(1)
+	ls.PushGoFunction(func(ls LuaState) int {
+		if ferr = f(ls); ferr != nil {
+			ls.PushString(ferr.Error())
+			ls.Error()
+		}
+		return 0
+	})
+	ls.Insert(-(nArgs + 1))
+	if err := ls.PCallContext(ctx, nArgs, 0); err != nil {
+		if ferr != nil {
+			return ferr
+		}
+		return err
+	}
+	return nil
+}
+
+// NewLuaError: 用栈顶的错误对象构造LuaError，不改变栈
+func NewLuaError(ls LuaState, status int) *LuaError {
+	msg, ok := toGoString(ls, -1)
+	if !ok {
+		msg = fmt.Sprintf("(error object is a %s value)", ls.TypeName2(-1))
+	}
+	return &LuaError{Status: status, Message: msg, Value: ToGoValue(ls, -1)}
+}
+
+// BindFunc: 把idx处的Lua函数绑定成F类型的Go函数，F必须是函数类型
+// 调用时参数和返回值按PushGoValue和ToGoValueAs自动转换；
+// F的第一个参数是context.Context时，用它控制这次调用，context结束时中断Lua代码的执行；
+// F的最后一个返回值是error时，调用出错通过它返回，否则直接panic
+// 绑定的函数通过注册表引用持有Lua函数，在它被Go回收之前Lua函数不会被回收；
+// 引用由清理函数交给state，在下次创建或调用同一个state的绑定函数时释放
+func BindFunc[F any](ls LuaState, idx int) (F, error) {
+	var f F
+	t := reflect.TypeOf(&f).Elem()
+	if t.Kind() != reflect.Func {
+		return f, fmt.Errorf("BindFunc: %s is not a function type", t)
+	}
+	if !ls.IsFunction(idx) {
+		return f, fmt.Errorf("BindFunc: attempt to bind a %s value", ls.TypeName2(idx))
+	}
+	reflect.ValueOf(&f).Elem().Set(bindFunc(ls, idx, t))
+	return f, nil
+}
+
+// releaseValues: 转换出错时释放已经转换好的返回值中的句柄
+func releaseValues(values []reflect.Value) {
+	for _, v := range values {
+		if v.IsValid() && v.CanInterface() {
+			if ref, ok := v.Interface().(*LValueRef); ok {
+				ref.Release()
+			}
+		}
+	}
+}
+
+// unrefs: 已经被Go回收的绑定函数留下的注册表引用
+// 清理函数在其他goroutine中执行，只把引用记下来，由state在自己的goroutine上释放
+var unrefs struct {
+	mu      sync.Mutex
+	lastID  int64
+	pending map[int64][]int // state的编号 -> 待释放的引用
+}
+
+const bindIDKey = "_BINDID" /* key of the state's number in the registry */
+
+// bindID: state在unrefs中的编号，第一次使用时分配并保存在注册表中
+func bindID(ls LuaState) int64 {
+	ls.CheckStack(1)
+	ls.GetField(LUA_REGISTRYINDEX, bindIDKey)
+	id := ls.ToInteger(-1)
+	ls.Pop(1)
+	if id == 0 {
+		unrefs.mu.Lock()
+		unrefs.lastID++
+		id = unrefs.lastID
+		unrefs.mu.Unlock()
+		ls.PushInteger(id)
+		ls.SetField(LUA_REGISTRYINDEX, bindIDKey)
+	}
+	return id
+}
+
+// deferUnref: 清理函数，记下编号为id的state中待释放的引用
+func deferUnref(id int64, ref int) {
+	unrefs.mu.Lock()
+	defer unrefs.mu.Unlock()
+	if unrefs.pending == nil {
+		unrefs.pending = map[int64][]int{}
+	}
+	unrefs.pending[id] = append(unrefs.pending[id], ref)
+}
+
+// releaseUnrefs: 释放编号为id的state中已经被回收的绑定函数的引用
+func releaseUnrefs(ls LuaState, id int64) {
+	unrefs.mu.Lock()
+	refs := unrefs.pending[id]
+	delete(unrefs.pending, id)
+	unrefs.mu.Unlock()
+	for _, ref := range refs {
+		ls.Unref(LUA_REGISTRYINDEX, ref)
+	}
+}
+
+func bindFunc(ls LuaState, idx int, ft reflect.Type) reflect.Value {
+	id := bindID(ls)
+	releaseUnrefs(ls, id)
+	ref := NewLValueRef(ls, idx)
+	runtime.AddCleanup(ref, func(r int) { deferUnref(id, r) }, ref.ref)
+	hasCtx := ft.NumIn() > 0 && ft.In(0) == contextType
+	nOut := ft.NumOut()
+	hasErr := nOut > 0 && ft.Out(nOut-1) == errorType
+	if hasErr {
+		nOut--
+	}
+
+	return reflect.MakeFunc(ft, func(in []reflect.Value) []reflect.Value {
+		ctx := context.Background()
+		if hasCtx {
+			if c, ok := in[0].Interface().(context.Context); ok && c != nil {
+				ctx = c
+			}
+			in = in[1:]
+		}
+		if ft.IsVariadic() {
+			last := in[len(in)-1]
+			in = in[:len(in)-1]
+			for i := 0; i < last.Len(); i++ {
+				in = append(in, last.Index(i))
+			}
+		}
+
+		results := make([]reflect.Value, ft.NumOut())
+		for i := range results {
+			results[i] = reflect.Zero(ft.Out(i))
+		}
+		base := ls.GetTop()
+		err := PCallFunc(ctx, ls, 0, func(ls LuaState) error {
+			releaseUnrefs(ls, id)
+			ls.CheckStack(len(in) + 1)
+			ref.Push()
+			for _, arg := range in {
+				if err := pushReflectValue(ls, arg, nil); err != nil {
+					return err
+				}
+			}
+			ls.Call(len(in), nOut)
+			for i := 0; i < nOut; i++ {
+				v, err := toReflectValue(ls, i+1, ft.Out(i))
+				if err != nil {
+					releaseValues(results[:i])
+					return err
+				}
+				results[i] = v
+			}
+			return nil
+		})
+		ls.SetTop(base)
+
+		if err != nil {
+			if !hasErr {
+				panic(err)
+			}
+			results[nOut] = reflect.ValueOf(&err).Elem()
+		}
+		return results
+	})
+}
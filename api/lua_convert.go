@@ -0,0 +1,400 @@
+package api
+
+import "fmt"
+import "reflect"
+
+// Go值和Lua值之间的自动转换
+// Go -> Lua: 布尔、整数、浮点数、字符串按对应的Lua类型压栈，[]byte压入字符串，
+//	切片和数组压入序列，map压入表，结构体按导出字段（可用`lua:"name"`标签改名）压入表，
+//	*LValueRef压入它引用的值，函数包装成Go函数，nil指针、切片、map和函数压入nil，
+//	有循环引用的值无法转换
+// Lua -> Go: 按目标类型转换，nil转换为零值，数字转换为整数时必须能精确表示且不溢出
+
+var (
+	refType        = reflect.TypeOf((*LValueRef)(nil))
+	goFunctionType = reflect.TypeOf(GoFunction(nil))
+	errorType      = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// PushGoValue: 把Go值转换后压入栈顶，无法转换时不改变栈并返回错误
+func PushGoValue(ls LuaState, v interface{}) error {
+	top := ls.GetTop()
+	if err := pushReflectValue(ls, reflect.ValueOf(v), nil); err != nil {
+		ls.SetTop(top)
+		return err
+	}
+	return nil
+}
+
+// ToGoValue: 把idx处的值转换成最自然的Go值，不改变栈
+// nil、布尔、整数、浮点数、字符串分别转换为nil、bool、int64、float64、string，
+// 表和函数等其他值转换为*LValueRef，不再使用时应调用Release释放
+func ToGoValue(ls LuaState, idx int) interface{} {
+	switch ls.Type(idx) {
+	case LUA_TNONE, LUA_TNIL:
+		return nil
+	case LUA_TBOOLEAN:
+		return ls.ToBoolean(idx)
+	case LUA_TNUMBER:
+		if ls.IsInteger(idx) {
+			return ls.ToInteger(idx)
+		}
+		return ls.ToNumber(idx)
+	case LUA_TSTRING:
+		s, _ := ls.ToStringX(idx)
+		return s
+	default:
+		return NewLValueRef(ls, idx)
+	}
+}
+
+// ToGoValueAs: 把idx处的值转换成typ类型的Go值，不改变栈
+func ToGoValueAs(ls LuaState, idx int, typ reflect.Type) (reflect.Value, error) {
+	return toReflectValue(ls, ls.AbsIndex(idx), typ)
+}
+
+// visit: 正在转换的指针、切片或map
+type visit struct {
+	ptr uintptr
+	typ reflect.Type
+	len int
+}
+
+// pushReflectValue: seen记录从最外层到v的路径上的指针、切片和map，用来发现循环引用
+func pushReflectValue(ls LuaState, v reflect.Value, seen map[visit]bool) error {
+	ls.CheckStack(3)
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Map:
+		if !v.IsNil() && v.Type() != refType {
+			key := visit{v.Pointer(), v.Type(), 0}
+			if v.Kind() == reflect.Slice {
+				key.len = v.Len()
+			}
+			if seen[key] {
+				return fmt.Errorf("cannot convert cyclic Go value of type %s", v.Type())
+			}
+			if seen == nil {
+				seen = map[visit]bool{}
+			}
+			seen[key] = true
+			defer delete(seen, key)
+		}
+	}
+	if !v.IsValid() {
+		ls.PushNil()
+		return nil
+	}
+	switch v.Type() {
+	case refType:
+		if v.IsNil() {
+			ls.PushNil()
+		} else {
+			v.Interface().(*LValueRef).Push()
+		}
+		return nil
+	case goFunctionType:
+		if v.IsNil() {
+			ls.PushNil()
+		} else {
+			ls.PushGoFunction(v.Interface().(GoFunction))
+		}
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		ls.PushBoolean(v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		ls.PushInteger(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		ls.PushInteger(int64(v.Uint())) /* wraps around like Lua integers */
+	case reflect.Float32, reflect.Float64:
+		ls.PushNumber(v.Float())
+	case reflect.String:
+		ls.PushString(v.String())
+	case reflect.Slice:
+		if v.IsNil() {
+			ls.PushNil()
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			ls.PushString(string(v.Bytes()))
+			return nil
+		}
+		return pushSequence(ls, v, seen)
+	case reflect.Array:
+		return pushSequence(ls, v, seen)
+	case reflect.Map:
+		if v.IsNil() {
+			ls.PushNil()
+			return nil
+		}
+		ls.CreateTable(0, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			if err := pushReflectValue(ls, iter.Key(), seen); err != nil {
+				return err
+			}
+			if err := pushReflectValue(ls, iter.Value(), seen); err != nil {
+				return err
+			}
+			ls.SetTable(-3)
+		}
+	case reflect.Struct:
+		t := v.Type()
+		ls.CreateTable(0, t.NumField())
+		for i := 0; i < t.NumField(); i++ {
+			name, ok := fieldName(t.Field(i))
+			if !ok {
+				continue
+			}
+			if err := pushReflectValue(ls, v.Field(i), seen); err != nil {
+				return err
+			}
+			ls.SetField(-2, name)
+		}
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			ls.PushNil()
+			return nil
+		}
+		return pushReflectValue(ls, v.Elem(), seen)
+	case reflect.Func:
+		if v.IsNil() {
+			ls.PushNil()
+		} else {
+			ls.PushGoFunction(wrapGoFunc(v))
+		}
+	default:
+		return fmt.Errorf("cannot convert Go value of type %s", v.Type())
+	}
+	return nil
+}
+
+func pushSequence(ls LuaState, v reflect.Value, seen map[visit]bool) error {
+	n := v.Len()
+	ls.CreateTable(n, 0)
+	for i := 0; i < n; i++ {
+		if err := pushReflectValue(ls, v.Index(i), seen); err != nil {
+			return err
+		}
+		ls.SetI(-2, int64(i+1))
+	}
+	return nil
+}
+
+// fieldName: 结构体字段对应的表键，未导出或标签为"-"的字段返回false
+func fieldName(f reflect.StructField) (string, bool) {
+	if f.PkgPath != "" { /* unexported */
+		return "", false
+	}
+	switch tag := f.Tag.Get("lua"); tag {
+	case "-":
+		return "", false
+	case "":
+		return f.Name, true
+	default:
+		return tag, true
+	}
+}
+
+// toReflectValue: idx必须是绝对索引
+func toReflectValue(ls LuaState, idx int, t reflect.Type) (reflect.Value, error) {
+	if t.Kind() == reflect.Interface {
+		v := ToGoValue(ls, idx)
+		if v == nil {
+			return reflect.Zero(t), nil
+		}
+		rv := reflect.ValueOf(v)
+		if !rv.Type().Implements(t) {
+			if ref, ok := v.(*LValueRef); ok {
+				ref.Release()
+			}
+			return convertError(ls, idx, t)
+		}
+		return rv.Convert(t), nil
+	}
+	if ls.IsNoneOrNil(idx) {
+		return reflect.Zero(t), nil
+	}
+	switch t {
+	case refType:
+		return reflect.ValueOf(NewLValueRef(ls, idx)), nil
+	case goFunctionType:
+		if f := ls.ToGoFunction(idx); f != nil {
+			return reflect.ValueOf(f), nil
+		}
+	}
+
+	rv := reflect.New(t).Elem()
+	switch t.Kind() {
+	case reflect.Bool:
+		rv.SetBool(ls.ToBoolean(idx))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, ok := ls.ToIntegerX(idx)
+		if !ok || rv.OverflowInt(n) {
+			return convertError(ls, idx, t)
+		}
+		rv.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, ok := ls.ToIntegerX(idx)
+		if !ok || n < 0 || rv.OverflowUint(uint64(n)) {
+			return convertError(ls, idx, t)
+		}
+		rv.SetUint(uint64(n))
+	case reflect.Float32, reflect.Float64:
+		n, ok := ls.ToNumberX(idx)
+		if !ok {
+			return convertError(ls, idx, t)
+		}
+		rv.SetFloat(n)
+	case reflect.String:
+		s, ok := toGoString(ls, idx)
+		if !ok {
+			return convertError(ls, idx, t)
+		}
+		rv.SetString(s)
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			if s, ok := toGoString(ls, idx); ok {
+				rv.SetBytes([]byte(s))
+				return rv, nil
+			}
+		}
+		if !ls.IsTable(idx) {
+			return convertError(ls, idx, t)
+		}
+		n := int(ls.RawLen(idx))
+		rv.Set(reflect.MakeSlice(t, n, n))
+		return rv, toSequence(ls, idx, rv)
+	case reflect.Array:
+		if !ls.IsTable(idx) {
+			return convertError(ls, idx, t)
+		}
+		return rv, toSequence(ls, idx, rv)
+	case reflect.Map:
+		if !ls.IsTable(idx) {
+			return convertError(ls, idx, t)
+		}
+		rv.Set(reflect.MakeMap(t))
+		ls.PushNil()
+		for ls.Next(idx) {
+			k, err := toReflectValue(ls, ls.AbsIndex(-2), t.Key())
+			if err != nil {
+				ls.Pop(2)
+				return rv, err
+			}
+			v, err := toReflectValue(ls, ls.AbsIndex(-1), t.Elem())
+			if err != nil {
+				ls.Pop(2)
+				return rv, err
+			}
+			rv.SetMapIndex(k, v)
+			ls.Pop(1)
+		}
+	case reflect.Struct:
+		if !ls.IsTable(idx) {
+			return convertError(ls, idx, t)
+		}
+		for i := 0; i < t.NumField(); i++ {
+			name, ok := fieldName(t.Field(i))
+			if !ok {
+				continue
+			}
+			ls.GetField(idx, name)
+			v, err := toReflectValue(ls, ls.GetTop(), t.Field(i).Type)
+			ls.Pop(1)
+			if err != nil {
+				return rv, err
+			}
+			rv.Field(i).Set(v)
+		}
+	case reflect.Ptr:
+		v, err := toReflectValue(ls, idx, t.Elem())
+		if err != nil {
+			return rv, err
+		}
+		rv.Set(reflect.New(t.Elem()))
+		rv.Elem().Set(v)
+	case reflect.Func:
+		if !ls.IsFunction(idx) {
+			return convertError(ls, idx, t)
+		}
+		return bindFunc(ls, idx, t), nil
+	default:
+		return convertError(ls, idx, t)
+	}
+	return rv, nil
+}
+
+func toSequence(ls LuaState, idx int, rv reflect.Value) error {
+	for i := 0; i < rv.Len(); i++ {
+		ls.GetI(idx, int64(i+1))
+		v, err := toReflectValue(ls, ls.GetTop(), rv.Type().Elem())
+		ls.Pop(1)
+		if err != nil {
+			return err
+		}
+		rv.Index(i).Set(v)
+	}
+	return nil
+}
+
+// toGoString: 只接受字符串和数字，在副本上转换以免改变栈上的数字（例如Next用到的键）
+func toGoString(ls LuaState, idx int) (string, bool) {
+	if !ls.IsString(idx) {
+		return "", false
+	}
+	ls.PushValue(idx)
+	s, ok := ls.ToStringX(-1)
+	ls.Pop(1)
+	return s, ok
+}
+
+func convertError(ls LuaState, idx int, t reflect.Type) (reflect.Value, error) {
+	return reflect.Zero(t), fmt.Errorf("cannot convert %s to %s", ls.TypeName2(idx), t)
+}
+
+// wrapGoFunc: 把任意签名的Go函数包装成GoFunction
+// 参数按形参类型从栈上转换，返回值依次压栈；最后一个返回值是error且不为nil时抛出Lua错误
+func wrapGoFunc(fv reflect.Value) GoFunction {
+	ft := fv.Type()
+	return func(ls LuaState) int {
+		nFixed := ft.NumIn()
+		if ft.IsVariadic() {
+			nFixed--
+		}
+		args := make([]reflect.Value, 0, ft.NumIn())
+		for i := 0; i < nFixed; i++ {
+			v, err := toReflectValue(ls, i+1, ft.In(i))
+			if err != nil {
+				ls.ArgError(i+1, err.Error())
+			}
+			args = append(args, v)
+		}
+		if ft.IsVariadic() {
+			elem := ft.In(nFixed).Elem()
+			for i := nFixed + 1; i <= ls.GetTop(); i++ {
+				v, err := toReflectValue(ls, i, elem)
+				if err != nil {
+					ls.ArgError(i, err.Error())
+				}
+				args = append(args, v)
+			}
+		}
+
+		results := fv.Call(args)
+		if n := len(results); n > 0 && ft.Out(n-1) == errorType {
+			if err := results[n-1]; !err.IsNil() {
+				ls.Error2("%s", err.Interface().(error).Error())
+			}
+			results = results[:n-1]
+		}
+		for _, r := range results {
+			if err := pushReflectValue(ls, r, nil); err != nil {
+				ls.Error2("%s", err.Error())
+			}
+		}
+		return len(results)
+	}
+}
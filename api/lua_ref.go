@@ -0,0 +1,36 @@
+package api
+
+// LValueRef: Go侧持有的Lua值句柄
+// 值本身保存在注册表中，只要句柄未被释放就不会被回收，之后可以随时重新压入栈
+type LValueRef struct {
+	ls  LuaState
+	ref int
+}
+
+// NewLValueRef: 为idx处的值创建一个句柄，不改变栈
+func NewLValueRef(ls LuaState, idx int) *LValueRef {
+	ls.PushValue(idx)
+	return &LValueRef{ls: ls, ref: ls.Ref(LUA_REGISTRYINDEX)}
+}
+
+// Ref: 返回句柄在注册表中的引用
+func (self *LValueRef) Ref() int {
+	return self.ref
+}
+
+// Push: 把句柄引用的值压入栈顶，nil或已释放的句柄压入nil
+func (self *LValueRef) Push() {
+	if self.ref == LUA_NOREF || self.ref == LUA_REFNIL {
+		self.ls.PushNil()
+	} else {
+		self.ls.RawGetI(LUA_REGISTRYINDEX, int64(self.ref))
+	}
+}
+
+// Release: 释放句柄，之后该句柄只会压入nil，重复释放没有影响
+func (self *LValueRef) Release() {
+	if self.ref != LUA_NOREF {
+		self.ls.Unref(LUA_REGISTRYINDEX, self.ref)
+		self.ref = LUA_NOREF
+	}
+}
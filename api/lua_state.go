@@ -1,5 +1,11 @@
 package api
 
+import "context"
+import "io"
+import "io/fs"
+import "math/rand"
+import "time"
+
 type LuaType = int
 type ArithOp = int
 type CompareOp = int
@@ -43,6 +49,7 @@ type BasicAPI interface {
 	ToNumberX(idx int) (float64, bool)
 	ToString(idx int) string
 	ToStringX(idx int) (string, bool)
+	ToPointer(idx int) interface{}
 	// Golang 访问 luaStack栈
 	PushNil()
 	PushBoolean(b bool)
@@ -103,9 +110,53 @@ type BasicAPI interface {
 	// 错误处理
 	Error() int
 	PCall(nArgs, nResult, msgh int) int
+	PCallContext(ctx context.Context, nArgs, nResults int) error
+	Interrupt()
+	ClearInterrupt()
+	SetGoPanics(enable bool)
+
+	// Go调用Lua函数，参数和返回值自动转换
+	CallGlobal(ctx context.Context, name string, args ...interface{}) ([]interface{}, error)
+	CallMethod(ctx context.Context, idx int, name string, args ...interface{}) ([]interface{}, error)
+
+	// 协程
+	NewThread() LuaState
+	PushThread() bool
+	ToThread(idx int) LuaState
+	XMove(to LuaState, n int)
+	Resume(from LuaState, nArgs int) int
+	Yield(nResults int) int
+	Status() int
+	IsYieldable() bool
+	CloseThread(from LuaState) int
 
 	// 转换
 	StringToNumber(s string) bool
+
+	// 垃圾回收
+	GC(what, data int) int
+
+	// 调试接口
+	GetStackFunc(level int) bool
+	GetUpvalue(funcIdx, n int) (string, bool)
+	SetUpvalue(funcIdx, n int) (string, bool)
+	UpvalueJoin(f1, n1, f2, n2 int)
+
+	// 语言版本
+	Version() int
+	Warning(msg string, toCont bool)
+
+	// 宿主环境，由state.NewState的选项配置
+	Stdout() io.Writer
+	Stderr() io.Writer
+	Stdin() io.Reader
+	SetStdout(w io.Writer)
+	SetStderr(w io.Writer)
+	SetStdin(r io.Reader)
+	FS() fs.FS
+	Now() time.Time
+	Rand() *rand.Rand
+	Close()
 }
 
 type LuaState interface {
@@ -10,5 +10,6 @@ type LuaVM interface {
 	RegisterCount() int  // 返回当前Lua函数所操作的寄存器数量
 	LoadVararg(n int)    // 传递给当前Lua函数的变长参数推入栈顶
 	LoadProto(idx int)   // 把当前Lua函数的子函数原型 实例化为闭包推入栈顶
-	CloseUpvalues(a int) // 闭合Upvalue，
+	CloseUpvalues(a int) // 闭合Upvalue，并关闭寄存器a-1及以上的待关闭变量
+	ToClose(idx int)     // 把idx处的值标记为待关闭变量
 }
@@ -1,5 +1,7 @@
 package binchunk
 
+import "fmt"
+
 const (
 	// 以下为头部信息的常量
 	LUA_SIGNATURE    = "\x1bLua"
@@ -24,6 +26,12 @@ const (
 	TAG_LONG_STR  = 0x14
 )
 
+// IsVararg的标志位
+const (
+	VARARG_ISVARARG = 1 // 有变长参数
+	VARARG_NEEDSARG = 4 // Lua 5.1兼容：调用时把变长参数打包成表放入局部变量arg（紧跟固定参数）
+)
+
 type binaryChunk struct {
 	header
 	sizeUpvalues byte
@@ -58,7 +66,7 @@ type Prototype struct {
 	LastLineDefined uint32 // LastLineDefined: 终止行号
 	// NumParams: 固定参数个数
 	NumParams byte
-	// IsVararg: 是否有变长参数 有则为1 无则为0
+	// IsVararg: 是否有变长参数 有则为1 无则为0，Lua 5.1兼容的函数还带有VARARG_NEEDSARG标志
 	IsVararg byte
 	// MaxStackSize: 寄存器数量，编译时计算
 	MaxStackSize byte
@@ -90,11 +98,25 @@ type LocVar struct {
 }
 
 // Undump:用于解析二进制chunk
-func Undump(data []byte) *Prototype {
-	reader := &reader{data}
+// chunk不完整或格式错误时返回error，例如"truncated precompiled chunk"
+func Undump(data []byte) (proto *Prototype, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if e, ok := r.(error); ok {
+				err = e
+			} else {
+				err = fmt.Errorf("%v", r)
+			}
+		}
+	}()
+
+	if len(data) > 4 && data[4] == LUAC_VERSION_54 {
+		return undump54(data), nil
+	}
+	reader := newReader(data)
 	reader.checkHeader()
 	reader.readByte()
-	return reader.readProto("")
+	return reader.readProto(""), nil
 }
 
 func IsBinaryChunk(data []byte) bool {
@@ -2,103 +2,179 @@ package binchunk
 
 import (
 	"encoding/binary"
+	"errors"
 	"math"
 )
 
+// reader: 按头部记录的字节序和各类型的大小读取chunk
+// 字节序由头部的LUAC_INT判断，cint、size_t、lua整数可以是4或8个字节，lua浮点数可以是float或double
 type reader struct {
-	data []byte
+	data        []byte
+	order       binary.ByteOrder
+	cintSize    int
+	sizetSize   int
+	integerSize int
+	numberSize  int
+}
+
+func newReader(data []byte) *reader {
+	return &reader{
+		data:        data,
+		order:       binary.LittleEndian,
+		cintSize:    CINT_SIZE,
+		sizetSize:   CSIZET_SIZE,
+		integerSize: LUA_INTEGER_SIZE,
+		numberSize:  LUA_NUMBER_SIZE,
+	}
+}
+
+// chunkError: 报告chunk格式错误，由Undump转换成error返回
+// lua-5.3.4/src/lundump.c#error()
+func chunkError(why string) {
+	panic(errors.New(why + " precompiled chunk"))
 }
 
 // 读取基本数据类型
 // readByte:读字节
 func (self *reader) readByte() byte {
-	b := self.data[0]
-	self.data = self.data[1:]
-	return b
+	return self.readBytes(1)[0]
 }
 
-// readUint32:读32位整数
+// readUint32:读32位整数（指令）
 func (self *reader) readUint32() uint32 {
-	i := binary.LittleEndian.Uint32(self.data)
-	self.data = self.data[4:]
-	return i
+	return self.order.Uint32(self.readBytes(4))
 }
 
-// readUint64:读64位整数
-func (self *reader) readUint64() uint64 {
-	i := binary.LittleEndian.Uint64(self.data)
-	self.data = self.data[8:]
-	return i
+// readUint: 读size个字节的无符号整数
+func (self *reader) readUint(size int) uint64 {
+	bytes := self.readBytes(uint(size))
+	if size == 4 {
+		return uint64(self.order.Uint32(bytes))
+	}
+	return self.order.Uint64(bytes)
+}
+
+// readCInt: 读一个C语言的int
+func (self *reader) readCInt() int {
+	return int(decodeInteger(self.readBytes(uint(self.cintSize)), self.order))
+}
+
+// readCount: 读表的长度，每个元素至少占一个字节，超过剩余的字节数说明chunk不完整
+func (self *reader) readCount() int {
+	return self.checkCount(self.readCInt())
+}
+
+// checkCount: 检查表的长度
+func (self *reader) checkCount(n int) int {
+	if n < 0 || n > len(self.data) {
+		chunkError("truncated")
+	}
+	return n
+}
+
+// readSizeT: 读一个size_t
+func (self *reader) readSizeT() uint64 {
+	return self.readUint(self.sizetSize)
 }
 
 // readLuaInteger:读一个Lua整数
 func (self *reader) readLuaInteger() int64 {
-	return int64(self.readUint64())
+	return decodeInteger(self.readBytes(uint(self.integerSize)), self.order)
+}
+
+// decodeInteger: 按字节序解码4或8个字节的有符号整数
+func decodeInteger(bytes []byte, order binary.ByteOrder) int64 {
+	if len(bytes) == 4 {
+		return int64(int32(order.Uint32(bytes)))
+	}
+	return int64(order.Uint64(bytes))
 }
 
 // readLuaNumber:读一个Lua浮点数Number类型
 func (self *reader) readLuaNumber() float64 {
-	return math.Float64frombits(self.readUint64())
+	if self.numberSize == 4 {
+		return float64(math.Float32frombits(uint32(self.readUint(4))))
+	}
+	return math.Float64frombits(self.readUint(8))
 }
 
 // readString: 根据首个字节长度标识判断为长字符串还是短字符串并读取
 func (self *reader) readString() string {
 	// 读取第一个字节
-	size := uint(self.readByte()) // 短字符串
+	size := uint64(self.readByte()) // 短字符串
 	if size == 0 {
 		return ""
 	}
 	if size == 0xFF {
-		size = uint(self.readUint64()) // 长字符串
+		size = self.readSizeT() // 长字符串
 	}
-	bytes := self.readBytes(size - 1)
+	if size-1 > uint64(len(self.data)) {
+		chunkError("truncated")
+	}
+	bytes := self.readBytes(uint(size - 1))
 	return string(bytes)
 }
 
 // readBytes: 从字节流中读取N个字节
 func (self *reader) readBytes(n uint) []byte {
+	if n > uint(len(self.data)) {
+		chunkError("truncated")
+	}
 	bytes := self.data[:n]
 	self.data = self.data[n:]
 	return bytes
 }
 
-// checkHeader: 检查头部
+// checkHeader: 检查头部，记录cint、size_t等类型的大小和字节序
+// lua-5.3.4/src/lundump.c#checkHeader()
 func (self *reader) checkHeader() {
 	if string(self.readBytes(4)) != LUA_SIGNATURE {
-		panic("not a precompiled chunk!")
+		chunkError("not a")
 	}
 	if self.readByte() != LUAC_VERSION {
-		panic("version mismatch!")
+		chunkError("version mismatch in")
 	}
 	if self.readByte() != LUAC_FORMAT {
-		panic("format mismatch!")
+		chunkError("format mismatch in")
 	}
 	if string(self.readBytes(6)) != LUAC_DATA {
-		panic("corrupted!")
-	}
-	if self.readByte() != CINT_SIZE {
-		panic("int size mismatch!")
-	}
-	if self.readByte() != CSIZET_SIZE {
-		panic("size_t size mismatch!")
-	}
-	if self.readByte() != INSTRUCTION_SIZE {
-		panic("instruction size mismatch!")
-	}
-	if self.readByte() != LUA_INTEGER_SIZE {
-		panic("lua_Integer size mismatch!")
+		chunkError("corrupted")
 	}
-	if self.readByte() != LUA_NUMBER_SIZE {
-		panic("lua_Number size mismatch!")
-	}
-	if self.readLuaInteger() != LUAC_INT {
-		panic("endianness mismatch!")
+	self.cintSize = self.checkSize("int", 4, 8)
+	self.sizetSize = self.checkSize("size_t", 4, 8)
+	self.checkNumFormat()
+}
+
+// checkNumFormat: 检查指令、lua整数和lua浮点数的大小，用LUAC_INT判断字节序，用LUAC_NUM检查浮点数格式
+// 5.3和5.4的头部都以这一部分结尾
+func (self *reader) checkNumFormat() {
+	self.checkSize("Instruction", INSTRUCTION_SIZE, INSTRUCTION_SIZE)
+	self.integerSize = self.checkSize("lua_Integer", 4, 8)
+	self.numberSize = self.checkSize("lua_Number", 4, 8)
+	luacInt := self.readBytes(uint(self.integerSize))
+	switch {
+	case decodeInteger(luacInt, binary.LittleEndian) == LUAC_INT:
+		self.order = binary.LittleEndian
+	case decodeInteger(luacInt, binary.BigEndian) == LUAC_INT:
+		self.order = binary.BigEndian
+	default:
+		chunkError("endianness mismatch in")
 	}
 	if self.readLuaNumber() != LUAC_NUM {
-		panic("float format mismatch!")
+		chunkError("float format mismatch in")
 	}
 }
 
+// checkSize: 读一个类型的大小，只接受size1或size2
+// lua-5.3.4/src/lundump.c#fchecksize()
+func (self *reader) checkSize(tname string, size1, size2 int) int {
+	size := int(self.readByte())
+	if size != size1 && size != size2 {
+		chunkError(tname + " size mismatch in")
+	}
+	return size
+}
+
 // readProto: 读取函数原型
 func (self *reader) readProto(parentSource string) *Prototype {
 	source := self.readString()
@@ -107,8 +183,8 @@ func (self *reader) readProto(parentSource string) *Prototype {
 	}
 	return &Prototype{
 		Source:          source,
-		LineDefined:     self.readUint32(),
-		LastLineDefined: self.readUint32(),
+		LineDefined:     uint32(self.readCInt()),
+		LastLineDefined: uint32(self.readCInt()),
 		NumParams:       self.readByte(),
 		IsVararg:        self.readByte(),
 		MaxStackSize:    self.readByte(),
@@ -124,7 +200,7 @@ func (self *reader) readProto(parentSource string) *Prototype {
 
 // readCode: 读取指令表
 func (self *reader) readCode() []uint32 {
-	code := make([]uint32, self.readUint32())
+	code := make([]uint32, self.readCount())
 	for i := range code {
 		code[i] = self.readUint32()
 	}
@@ -133,7 +209,7 @@ func (self *reader) readCode() []uint32 {
 
 // readConstants: 读取常量表
 func (self *reader) readConstants() []interface{} {
-	constants := make([]interface{}, self.readUint32())
+	constants := make([]interface{}, self.readCount())
 	for i := range constants {
 		constants[i] = self.readConstant()
 	}
@@ -154,13 +230,14 @@ func (self *reader) readConstant() interface{} {
 	case TAG_SHORT_STR, TAG_LONG_STR:
 		return self.readString()
 	default:
-		panic("corrupted!") // todo
+		chunkError("corrupted")
+		return nil
 	}
 }
 
 // readUpvalues: 读取Upvalue表
 func (self *reader) readUpvalues() []Upvalue {
-	upvalues := make([]Upvalue, self.readUint32())
+	upvalues := make([]Upvalue, self.readCount())
 	for i := range upvalues {
 		upvalues[i] = Upvalue{
 			Instack: self.readByte(),
@@ -172,7 +249,7 @@ func (self *reader) readUpvalues() []Upvalue {
 
 // readProtos: 读取内嵌函数原型
 func (self *reader) readProtos(parentSource string) []*Prototype {
-	protos := make([]*Prototype, self.readUint32())
+	protos := make([]*Prototype, self.readCount())
 	for i := range protos {
 		protos[i] = self.readProto(parentSource)
 	}
@@ -181,21 +258,21 @@ func (self *reader) readProtos(parentSource string) []*Prototype {
 
 // readLineInfo: 读取行号表
 func (self *reader) readLineInfo() []uint32 {
-	lineInfo := make([]uint32, self.readUint32())
+	lineInfo := make([]uint32, self.readCount())
 	for i := range lineInfo {
-		lineInfo[i] = self.readUint32()
+		lineInfo[i] = uint32(self.readCInt())
 	}
 	return lineInfo
 }
 
 // readLocVars: 读取局部变量表
 func (self *reader) readLocVars() []LocVar {
-	locVars := make([]LocVar, self.readUint32())
+	locVars := make([]LocVar, self.readCount())
 	for i := range locVars {
 		locVars[i] = LocVar{
 			VarName: self.readString(),
-			StartPC: self.readUint32(),
-			EndPC:   self.readUint32(),
+			StartPC: uint32(self.readCInt()),
+			EndPC:   uint32(self.readCInt()),
 		}
 	}
 	return locVars
@@ -203,7 +280,7 @@ func (self *reader) readLocVars() []LocVar {
 
 // readUpvalueNames: 读取Upvalue名字表
 func (self *reader) readUpvalueNames() []string {
-	names := make([]string, self.readUint32())
+	names := make([]string, self.readCount())
 	for i := range names {
 		names[i] = self.readString()
 	}
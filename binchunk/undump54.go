@@ -0,0 +1,764 @@
+package binchunk
+
+import (
+	"fmt"
+	"luago/vm"
+)
+
+// Lua 5.4的二进制chunk
+// 5.4的头部、变长编码的整数、常量tag和行号表都和5.3不同，指令集也不一样：
+// 读出的函数原型被翻译成等价的5.3指令（一条5.4指令可能对应零条或多条5.3指令），
+// 跳转目标、局部变量的有效范围和行号都按翻译后的位置重新计算，之后和5.3的chunk一样执行。
+// 没有对应的5.3写法的内容报错"unsupported Lua 5.4 chunk"，Load返回LUA_ERRSYNTAX。
+
+const (
+	LUAC_VERSION_54 = 0x54
+)
+
+// 5.4的常量tag
+const (
+	TAG54_NIL       = 0x00
+	TAG54_FALSE     = 0x01
+	TAG54_TRUE      = 0x11
+	TAG54_INTEGER   = 0x03
+	TAG54_NUMBER    = 0x13
+	TAG54_SHORT_STR = 0x04
+	TAG54_LONG_STR  = 0x14
+)
+
+const ABSLINEINFO = -0x80 /* lineinfo中的标记，这条指令的行号保存在abslineinfo中 */
+
+// 5.4的操作码
+// lua-5.4.6/src/lopcodes.h
+const (
+	OP54_MOVE = iota
+	OP54_LOADI
+	OP54_LOADF
+	OP54_LOADK
+	OP54_LOADKX
+	OP54_LOADFALSE
+	OP54_LFALSESKIP
+	OP54_LOADTRUE
+	OP54_LOADNIL
+	OP54_GETUPVAL
+	OP54_SETUPVAL
+	OP54_GETTABUP
+	OP54_GETTABLE
+	OP54_GETI
+	OP54_GETFIELD
+	OP54_SETTABUP
+	OP54_SETTABLE
+	OP54_SETI
+	OP54_SETFIELD
+	OP54_NEWTABLE
+	OP54_SELF
+	OP54_ADDI
+	OP54_ADDK
+	OP54_SUBK
+	OP54_MULK
+	OP54_MODK
+	OP54_POWK
+	OP54_DIVK
+	OP54_IDIVK
+	OP54_BANDK
+	OP54_BORK
+	OP54_BXORK
+	OP54_SHRI
+	OP54_SHLI
+	OP54_ADD
+	OP54_SUB
+	OP54_MUL
+	OP54_MOD
+	OP54_POW
+	OP54_DIV
+	OP54_IDIV
+	OP54_BAND
+	OP54_BOR
+	OP54_BXOR
+	OP54_SHL
+	OP54_SHR
+	OP54_MMBIN
+	OP54_MMBINI
+	OP54_MMBINK
+	OP54_UNM
+	OP54_BNOT
+	OP54_NOT
+	OP54_LEN
+	OP54_CONCAT
+	OP54_CLOSE
+	OP54_TBC
+	OP54_JMP
+	OP54_EQ
+	OP54_LT
+	OP54_LE
+	OP54_EQK
+	OP54_EQI
+	OP54_LTI
+	OP54_LEI
+	OP54_GTI
+	OP54_GEI
+	OP54_TEST
+	OP54_TESTSET
+	OP54_CALL
+	OP54_TAILCALL
+	OP54_RETURN
+	OP54_RETURN0
+	OP54_RETURN1
+	OP54_FORLOOP
+	OP54_FORPREP
+	OP54_TFORPREP
+	OP54_TFORCALL
+	OP54_TFORLOOP
+	OP54_SETLIST
+	OP54_CLOSURE
+	OP54_VARARG
+	OP54_VARARGPREP
+	OP54_EXTRAARG
+)
+
+/* 5.4 instruction format: op 7 bits, A 8 bits, k 1 bit, B 8 bits, C 8 bits */
+const (
+	MAXARG_C_54    = 1<<8 - 1
+	OFFSET_sC_54   = MAXARG_C_54 >> 1
+	OFFSET_sBx_54  = (1<<17 - 1) >> 1
+	OFFSET_sJ_54   = (1<<25 - 1) >> 1
+	TM_ADD         = 6 /* first arithmetic event in 5.4's TMS enum */
+	NUM_SCRATCH_54 = 2 /* registers appended to the frame for constants outside RK range */
+)
+
+// 元方法事件（TM_ADD到TM_SHR）对应的5.3指令
+var tmOpcodes = []int{
+	vm.OP_ADD, vm.OP_SUB, vm.OP_MUL, vm.OP_MOD, vm.OP_POW, vm.OP_DIV,
+	vm.OP_IDIV, vm.OP_BAND, vm.OP_BOR, vm.OP_BXOR, vm.OP_SHL, vm.OP_SHR,
+}
+
+type inst54 uint32
+
+func (self inst54) op() int   { return int(self & 0x7F) }
+func (self inst54) a() int    { return int(self >> 7 & 0xFF) }
+func (self inst54) k() int    { return int(self >> 15 & 1) }
+func (self inst54) b() int    { return int(self >> 16 & 0xFF) }
+func (self inst54) c() int    { return int(self >> 24 & 0xFF) }
+func (self inst54) sB() int   { return self.b() - OFFSET_sC_54 }
+func (self inst54) sC() int   { return self.c() - OFFSET_sC_54 }
+func (self inst54) bx() int   { return int(self >> 15) }
+func (self inst54) sBx() int  { return self.bx() - OFFSET_sBx_54 }
+func (self inst54) sJ() int   { return int(self>>7) - OFFSET_sJ_54 }
+func (self inst54) ax() int   { return int(self >> 7) }
+func (self inst54) isK() bool { return self.k() != 0 }
+
+func unsupported54(format string, a ...interface{}) {
+	panic(fmt.Errorf("unsupported Lua 5.4 chunk: "+format, a...))
+}
+
+// undump54: 解析5.4的二进制chunk，返回翻译成5.3指令的主函数原型
+// lua-5.4.6/src/lundump.c#luaU_undump()
+func undump54(data []byte) *Prototype {
+	reader := newReader(data)
+	reader.checkHeader54()
+	reader.readByte() /* sizeupvalues */
+	return reader.readProto54("")
+}
+
+// checkHeader54: 检查5.4的头部，5.4的头部不再记录int和size_t的大小
+// lua-5.4.6/src/lundump.c#checkHeader()
+func (self *reader) checkHeader54() {
+	if string(self.readBytes(4)) != LUA_SIGNATURE {
+		chunkError("not a")
+	}
+	if self.readByte() != LUAC_VERSION_54 {
+		chunkError("version mismatch in")
+	}
+	if self.readByte() != LUAC_FORMAT {
+		chunkError("format mismatch in")
+	}
+	if string(self.readBytes(6)) != LUAC_DATA {
+		chunkError("corrupted")
+	}
+	self.checkNumFormat()
+}
+
+// readSize54: 读变长编码的无符号整数，高位在前，每个字节7位，最后一个字节的最高位为1
+// lua-5.4.6/src/lundump.c#loadUnsigned()
+func (self *reader) readSize54(limit uint64) uint64 {
+	var x uint64
+	limit >>= 7
+	for {
+		b := self.readByte()
+		if x >= limit {
+			chunkError("integer overflow in")
+		}
+		x = x<<7 | uint64(b&0x7F)
+		if b&0x80 != 0 {
+			return x
+		}
+	}
+}
+
+// readInt54: 读一个变长编码的int
+func (self *reader) readInt54() int {
+	return int(self.readSize54(1<<31 - 1))
+}
+
+// readCount54: 读一个变长编码的表长度
+func (self *reader) readCount54() int {
+	return self.checkCount(self.readInt54())
+}
+
+// readString54: 读字符串，长度为0表示NULL（返回false）
+// lua-5.4.6/src/lundump.c#loadStringN()
+func (self *reader) readString54() (string, bool) {
+	size := self.readSize54(^uint64(0))
+	if size == 0 {
+		return "", false
+	}
+	return string(self.readBytes(uint(size - 1))), true
+}
+
+// readProto54: 读取5.4的函数原型并翻译成5.3指令
+// lua-5.4.6/src/lundump.c#loadFunction()
+func (self *reader) readProto54(parentSource string) *Prototype {
+	source, ok := self.readString54()
+	if !ok {
+		source = parentSource
+	}
+	proto := &Prototype{
+		Source:          source,
+		LineDefined:     uint32(self.readInt54()),
+		LastLineDefined: uint32(self.readInt54()),
+		NumParams:       self.readByte(),
+		IsVararg:        self.readByte(),
+		MaxStackSize:    self.readByte(),
+	}
+	code := make([]uint32, self.readCount54())
+	for i := range code {
+		code[i] = self.readUint32()
+	}
+	proto.Constants = self.readConstants54()
+	proto.Upvalues = self.readUpvalues54()
+	protos := make([]*Prototype, self.readCount54())
+	for i := range protos {
+		protos[i] = self.readProto54(source)
+	}
+	proto.Protos = protos
+	lines := self.readLineInfo54(int(proto.LineDefined), len(code))
+	proto.LocVars = self.readLocVars54()
+	proto.UpvalueNames = self.readUpvalueNames54()
+	newTranslator54(proto, code, lines).translate()
+	return proto
+}
+
+// readConstants54: 读取常量表，5.4的布尔值和数字的tag与5.3不同
+// lua-5.4.6/src/lundump.c#loadConstants()
+func (self *reader) readConstants54() []interface{} {
+	constants := make([]interface{}, self.readCount54())
+	for i := range constants {
+		switch tag := self.readByte(); tag {
+		case TAG54_NIL:
+			constants[i] = nil
+		case TAG54_FALSE:
+			constants[i] = false
+		case TAG54_TRUE:
+			constants[i] = true
+		case TAG54_INTEGER:
+			constants[i] = self.readLuaInteger()
+		case TAG54_NUMBER:
+			constants[i] = self.readLuaNumber()
+		case TAG54_SHORT_STR, TAG54_LONG_STR:
+			constants[i], _ = self.readString54()
+		default:
+			unsupported54("constant tag 0x%02x", tag)
+		}
+	}
+	return constants
+}
+
+// readUpvalues54: 读取Upvalue表，5.4多了一个表示变量种类的字节
+func (self *reader) readUpvalues54() []Upvalue {
+	upvalues := make([]Upvalue, self.readCount54())
+	for i := range upvalues {
+		upvalues[i] = Upvalue{
+			Instack: self.readByte(),
+			Idx:     self.readByte(),
+		}
+		self.readByte() /* kind */
+	}
+	return upvalues
+}
+
+// readLineInfo54: 读取行号表，把相对上一条指令的行号差和绝对行号还原成每条指令的行号
+// 去掉调试信息的chunk返回nil
+// lua-5.4.6/src/ldebug.c#luaG_getfuncline()
+func (self *reader) readLineInfo54(lineDefined, nCode int) []uint32 {
+	deltas := self.readBytes(uint(self.readInt54()))
+	absLines := map[int]int{}
+	for n := self.readCount54(); n > 0; n-- {
+		pc := self.readInt54()
+		absLines[pc] = self.readInt54()
+	}
+	if len(deltas) == 0 {
+		return nil
+	}
+	if len(deltas) != nCode {
+		chunkError("corrupted")
+	}
+	lines := make([]uint32, nCode)
+	line := lineDefined
+	for pc, d := range deltas {
+		if int8(d) == ABSLINEINFO {
+			line = absLines[pc]
+		} else {
+			line += int(int8(d))
+		}
+		lines[pc] = uint32(line)
+	}
+	return lines
+}
+
+// readLocVars54: 读取局部变量表，StartPC和EndPC是5.4指令的位置，翻译时再修正
+func (self *reader) readLocVars54() []LocVar {
+	locVars := make([]LocVar, self.readCount54())
+	for i := range locVars {
+		name, _ := self.readString54()
+		locVars[i] = LocVar{
+			VarName: name,
+			StartPC: uint32(self.readInt54()),
+			EndPC:   uint32(self.readInt54()),
+		}
+	}
+	return locVars
+}
+
+// readUpvalueNames54: 读取Upvalue名字表
+func (self *reader) readUpvalueNames54() []string {
+	names := make([]string, self.readCount54())
+	for i := range names {
+		names[i], _ = self.readString54()
+	}
+	return names
+}
+
+// inst53: 翻译得到的5.3指令，target >= 0时是跳转指令，target是目标5.4指令的位置
+type inst53 struct {
+	i      uint32
+	target int
+}
+
+// translator54: 把一个函数原型的5.4指令翻译成5.3指令
+type translator54 struct {
+	proto      *Prototype
+	code       []inst54   // 5.4指令
+	lines      []uint32   // 每条5.4指令的行号
+	blocks     [][]inst53 // 每条5.4指令翻译得到的5.3指令
+	constIdx   map[interface{}]int
+	scratch    int // 第一个临时寄存器，放不进RK操作数的常量先加载到临时寄存器
+	nScratch   int // 当前指令已经使用的临时寄存器数量
+	usedTmpReg bool
+}
+
+func newTranslator54(proto *Prototype, code []uint32, lines []uint32) *translator54 {
+	self := &translator54{
+		proto:    proto,
+		code:     make([]inst54, len(code)),
+		lines:    lines,
+		blocks:   make([][]inst53, len(code)),
+		constIdx: map[interface{}]int{},
+		scratch:  int(proto.MaxStackSize),
+	}
+	for i, c := range code {
+		self.code[i] = inst54(c)
+	}
+	for i, k := range proto.Constants {
+		if _, found := self.constIdx[k]; !found {
+			self.constIdx[k] = i
+		}
+	}
+	return self
+}
+
+// translate: 逐条翻译，再按翻译后的位置修正跳转、局部变量范围和行号
+func (self *translator54) translate() {
+	for pc := 0; pc < len(self.code); pc++ {
+		self.nScratch = 0
+		if self.translateInst(pc) { /* the EXTRAARG is consumed */
+			pc++
+		}
+	}
+	for pc, i := range self.code {
+		if isSkip54(i.op()) && pc+1 < len(self.code) && len(self.blocks[pc+1]) != 1 {
+			/* 'pc++' would skip only part of the next instruction: jump over it instead */
+			self.blocks[pc] = append(self.blocks[pc],
+				inst53{jmp53(0), pc + 1}, inst53{jmp53(0), pc + 2})
+		}
+	}
+	if self.usedTmpReg {
+		if self.scratch+NUM_SCRATCH_54 > 255 {
+			unsupported54("function needs too many registers")
+		}
+		self.proto.MaxStackSize = byte(self.scratch + NUM_SCRATCH_54)
+	}
+	self.layout()
+}
+
+// layout: 拼接全部5.3指令
+func (self *translator54) layout() {
+	start := make([]int, len(self.code)+2) /* position of each 5.4 instruction */
+	n := 0
+	for pc, block := range self.blocks {
+		start[pc] = n
+		n += len(block)
+	}
+	start[len(self.code)] = n
+	start[len(self.code)+1] = n
+
+	code := make([]uint32, 0, n)
+	var lines []uint32
+	for pc, block := range self.blocks {
+		for _, i := range block {
+			if i.target >= 0 {
+				if i.target > len(self.code) {
+					chunkError("corrupted")
+				}
+				sBx := start[i.target] - (len(code) + 1)
+				i.i |= uint32(sBx+vm.MAXARG_sBx) << 14
+			}
+			code = append(code, i.i)
+			if self.lines != nil {
+				lines = append(lines, self.lines[pc])
+			}
+		}
+	}
+	for i := range self.proto.LocVars {
+		locVar := &self.proto.LocVars[i]
+		if int(locVar.StartPC) > len(self.code) || int(locVar.EndPC) > len(self.code) {
+			chunkError("corrupted")
+		}
+		locVar.StartPC = uint32(start[locVar.StartPC])
+		locVar.EndPC = uint32(start[locVar.EndPC])
+	}
+	self.proto.Code = code
+	self.proto.LineInfo = lines
+}
+
+// isSkip54: 条件成立时跳过下一条指令的5.4指令
+func isSkip54(op int) bool {
+	switch op {
+	case OP54_LFALSESKIP, OP54_EQ, OP54_LT, OP54_LE, OP54_EQK, OP54_EQI,
+		OP54_LTI, OP54_LEI, OP54_GTI, OP54_GEI, OP54_TEST, OP54_TESTSET:
+		return true
+	}
+	return false
+}
+
+func abc53(op, a, b, c int) uint32 {
+	return uint32(b<<23 | c<<14 | a<<6 | op)
+}
+
+func abx53(op, a, bx int) uint32 {
+	return uint32(bx<<14 | a<<6 | op)
+}
+
+func jmp53(a int) uint32 {
+	return uint32(a<<6 | vm.OP_JMP) /* sBx is filled in by layout */
+}
+
+func (self *translator54) emit(pc int, i uint32) {
+	self.blocks[pc] = append(self.blocks[pc], inst53{i, -1})
+}
+
+func (self *translator54) emitABC(pc, op, a, b, c int) {
+	self.emit(pc, abc53(op, a, b, c))
+}
+
+// emitJump: 跳转到5.4指令target翻译后的位置
+func (self *translator54) emitJump(pc, op, a, target int) {
+	self.blocks[pc] = append(self.blocks[pc], inst53{abc53(op, a, 0, 0), target})
+}
+
+// indexOfConstant: 常量的索引，常量表中没有时追加
+func (self *translator54) indexOfConstant(k interface{}) int {
+	if idx, found := self.constIdx[k]; found {
+		return idx
+	}
+	idx := len(self.proto.Constants)
+	self.proto.Constants = append(self.proto.Constants, k)
+	self.constIdx[k] = idx
+	return idx
+}
+
+// loadK: 把第idx个常量加载到寄存器a
+func (self *translator54) loadK(pc, a, idx int) {
+	if idx <= vm.MAXARG_Bx {
+		self.emit(pc, abx53(vm.OP_LOADK, a, idx))
+	} else {
+		self.emit(pc, abx53(vm.OP_LOADKX, a, 0))
+		self.emit(pc, uint32(idx<<6|vm.OP_EXTRAARG))
+	}
+}
+
+// rkK: 第idx个常量作为RK操作数，索引太大时先加载到临时寄存器
+func (self *translator54) rkK(pc, idx int) int {
+	if idx < len(self.proto.Constants) && idx <= vm.MAXINDEXRK {
+		return idx | 0x100
+	}
+	if idx >= len(self.proto.Constants) {
+		chunkError("corrupted")
+	}
+	reg := self.scratch + self.nScratch
+	self.nScratch++
+	self.usedTmpReg = true
+	self.loadK(pc, reg, idx)
+	return reg
+}
+
+// rkConst: 常量k作为RK操作数
+func (self *translator54) rkConst(pc int, k interface{}) int {
+	return self.rkK(pc, self.indexOfConstant(k))
+}
+
+// rkX: 5.4的RK操作数，k为true时是常量索引，否则是寄存器
+func (self *translator54) rkX(pc, c int, k bool) int {
+	if k {
+		return self.rkK(pc, c)
+	}
+	return c
+}
+
+// imm: 指令中的立即数，isFloat为true时原来的操作数是浮点数
+func imm(n int, isFloat bool) interface{} {
+	if isFloat {
+		return float64(n)
+	}
+	return int64(n)
+}
+
+// translateInst: 翻译第pc条5.4指令，下一条EXTRAARG已经被这条指令用掉时返回true
+// lua-5.4.6/src/lvm.c#luaV_execute()
+func (self *translator54) translateInst(pc int) bool {
+	i := self.code[pc]
+	a, b, c := i.a(), i.b(), i.c()
+	switch op := i.op(); op {
+	case OP54_MOVE:
+		self.emitABC(pc, vm.OP_MOVE, a, b, 0)
+	case OP54_LOADI:
+		self.loadK(pc, a, self.indexOfConstant(int64(i.sBx())))
+	case OP54_LOADF:
+		self.loadK(pc, a, self.indexOfConstant(float64(i.sBx())))
+	case OP54_LOADK:
+		self.loadK(pc, a, i.bx())
+	case OP54_LOADKX:
+		self.emit(pc, abx53(vm.OP_LOADKX, a, 0))
+	case OP54_LOADFALSE:
+		self.emitABC(pc, vm.OP_LOADBOOL, a, 0, 0)
+	case OP54_LFALSESKIP:
+		self.emitABC(pc, vm.OP_LOADBOOL, a, 0, 1)
+	case OP54_LOADTRUE:
+		self.emitABC(pc, vm.OP_LOADBOOL, a, 1, 0)
+	case OP54_LOADNIL:
+		self.emitABC(pc, vm.OP_LOADNIL, a, b, 0)
+	case OP54_GETUPVAL:
+		self.emitABC(pc, vm.OP_GETUPVAL, a, b, 0)
+	case OP54_SETUPVAL:
+		self.emitABC(pc, vm.OP_SETUPVAL, a, b, 0)
+	case OP54_GETTABUP:
+		self.emitABC(pc, vm.OP_GETTABUP, a, b, self.rkK(pc, c))
+	case OP54_GETTABLE:
+		self.emitABC(pc, vm.OP_GETTABLE, a, b, c)
+	case OP54_GETI:
+		self.emitABC(pc, vm.OP_GETTABLE, a, b, self.rkConst(pc, int64(c)))
+	case OP54_GETFIELD:
+		self.emitABC(pc, vm.OP_GETTABLE, a, b, self.rkK(pc, c))
+	case OP54_SETTABUP:
+		self.emitABC(pc, vm.OP_SETTABUP, a, self.rkK(pc, b), self.rkX(pc, c, i.isK()))
+	case OP54_SETTABLE:
+		self.emitABC(pc, vm.OP_SETTABLE, a, b, self.rkX(pc, c, i.isK()))
+	case OP54_SETI:
+		self.emitABC(pc, vm.OP_SETTABLE, a, self.rkConst(pc, int64(b)), self.rkX(pc, c, i.isK()))
+	case OP54_SETFIELD:
+		self.emitABC(pc, vm.OP_SETTABLE, a, self.rkK(pc, b), self.rkX(pc, c, i.isK()))
+	case OP54_NEWTABLE:
+		nRec := 0
+		if b > 0 {
+			nRec = 1 << (b - 1)
+		}
+		nArr := c
+		if i.isK() {
+			nArr += self.extraArg(pc) * (MAXARG_C_54 + 1)
+		}
+		self.emitABC(pc, vm.OP_NEWTABLE, a, vm.Int2fb(nArr), vm.Int2fb(nRec))
+		return pc+1 < len(self.code) && self.code[pc+1].op() == OP54_EXTRAARG
+	case OP54_SELF:
+		self.emitABC(pc, vm.OP_SELF, a, b, self.rkX(pc, c, i.isK()))
+	case OP54_ADDI, OP54_SHRI, OP54_SHLI:
+		self.translateArithI(pc, i)
+	case OP54_ADDK, OP54_SUBK, OP54_MULK, OP54_MODK, OP54_POWK, OP54_DIVK,
+		OP54_IDIVK, OP54_BANDK, OP54_BORK, OP54_BXORK:
+		self.translateArithK(pc, i)
+	case OP54_ADD, OP54_SUB, OP54_MUL, OP54_MOD, OP54_POW, OP54_DIV,
+		OP54_IDIV, OP54_BAND, OP54_BOR, OP54_BXOR, OP54_SHL, OP54_SHR:
+		self.emitABC(pc, tmOpcodes[op-OP54_ADD], a, b, c)
+	case OP54_MMBIN, OP54_MMBINI, OP54_MMBINK:
+		/* 5.3 arithmetic instructions call metamethods themselves */
+	case OP54_UNM:
+		self.emitABC(pc, vm.OP_UNM, a, b, 0)
+	case OP54_BNOT:
+		self.emitABC(pc, vm.OP_BNOT, a, b, 0)
+	case OP54_NOT:
+		self.emitABC(pc, vm.OP_NOT, a, b, 0)
+	case OP54_LEN:
+		self.emitABC(pc, vm.OP_LEN, a, b, 0)
+	case OP54_CONCAT:
+		self.emitABC(pc, vm.OP_CONCAT, a, a, a+b-1)
+	case OP54_CLOSE:
+		self.emitJump(pc, vm.OP_JMP, a+1, pc+1)
+	case OP54_TBC:
+		self.emitABC(pc, vm.OP_TBC, a, 0, 0)
+	case OP54_JMP:
+		self.emitJump(pc, vm.OP_JMP, 0, pc+1+i.sJ())
+	case OP54_EQ:
+		self.emitABC(pc, vm.OP_EQ, i.k(), a, b)
+	case OP54_LT:
+		self.emitABC(pc, vm.OP_LT, i.k(), a, b)
+	case OP54_LE:
+		self.emitABC(pc, vm.OP_LE, i.k(), a, b)
+	case OP54_EQK:
+		self.emitABC(pc, vm.OP_EQ, i.k(), a, self.rkK(pc, b))
+	case OP54_EQI:
+		self.emitABC(pc, vm.OP_EQ, i.k(), a, self.rkConst(pc, imm(i.sB(), c != 0)))
+	case OP54_LTI:
+		self.emitABC(pc, vm.OP_LT, i.k(), a, self.rkConst(pc, imm(i.sB(), c != 0)))
+	case OP54_LEI:
+		self.emitABC(pc, vm.OP_LE, i.k(), a, self.rkConst(pc, imm(i.sB(), c != 0)))
+	case OP54_GTI: /* R[A] > sB  <=>  sB < R[A] */
+		self.emitABC(pc, vm.OP_LT, i.k(), self.rkConst(pc, imm(i.sB(), c != 0)), a)
+	case OP54_GEI: /* R[A] >= sB  <=>  sB <= R[A] */
+		self.emitABC(pc, vm.OP_LE, i.k(), self.rkConst(pc, imm(i.sB(), c != 0)), a)
+	case OP54_TEST:
+		self.emitABC(pc, vm.OP_TEST, a, 0, i.k())
+	case OP54_TESTSET:
+		self.emitABC(pc, vm.OP_TESTSET, a, b, i.k())
+	case OP54_CALL:
+		self.emitABC(pc, vm.OP_CALL, a, b, c)
+	case OP54_TAILCALL:
+		self.emitABC(pc, vm.OP_TAILCALL, a, b, 0)
+	case OP54_RETURN:
+		self.emitABC(pc, vm.OP_RETURN, a, b, 0)
+	case OP54_RETURN0:
+		self.emitABC(pc, vm.OP_RETURN, 0, 1, 0)
+	case OP54_RETURN1:
+		self.emitABC(pc, vm.OP_RETURN, a, 2, 0)
+	case OP54_FORLOOP: /* jumps back to the loop body */
+		self.emitJump(pc, vm.OP_FORLOOP, a, pc+1-i.bx())
+	case OP54_FORPREP: /* 5.3's FORPREP jumps to the FORLOOP, which decides whether to run */
+		self.emitJump(pc, vm.OP_FORPREP, a, pc+1+i.bx())
+	case OP54_TFORPREP:
+		/* R[A+3] is the closing value of the generic for */
+		self.emitABC(pc, vm.OP_TBC, a+3, 0, 0)
+		self.emitJump(pc, vm.OP_JMP, 0, pc+1+i.bx())
+	case OP54_TFORCALL:
+		/* 5.4 puts the results after the closing value: R[A+4], ... := R[A](R[A+1], R[A+2]) */
+		self.emitABC(pc, vm.OP_MOVE, a+4, a, 0)
+		self.emitABC(pc, vm.OP_MOVE, a+5, a+1, 0)
+		self.emitABC(pc, vm.OP_MOVE, a+6, a+2, 0)
+		self.emitABC(pc, vm.OP_CALL, a+4, 3, c+1)
+	case OP54_TFORLOOP:
+		/* if R[A+4] ~= nil then { R[A+2] = R[A+4]; pc -= Bx } */
+		self.emitABC(pc, vm.OP_EQ, 1, a+4, self.rkConst(pc, nil))
+		self.emitJump(pc, vm.OP_JMP, 0, pc+1)
+		self.emitABC(pc, vm.OP_MOVE, a+2, a+4, 0)
+		self.emitJump(pc, vm.OP_JMP, 0, pc+1-i.bx())
+	case OP54_SETLIST:
+		self.translateSetList(pc, i)
+		return i.isK()
+	case OP54_CLOSURE:
+		self.emit(pc, abx53(vm.OP_CLOSURE, a, i.bx()))
+	case OP54_VARARG:
+		self.emitABC(pc, vm.OP_VARARG, a, c, 0)
+	case OP54_VARARGPREP:
+		/* varargs are prepared when the function is called */
+	case OP54_EXTRAARG:
+		self.emit(pc, uint32(i.ax()<<6|vm.OP_EXTRAARG))
+	default:
+		unsupported54("opcode %d", op)
+	}
+	return false
+}
+
+// extraArg: 第pc条指令之后的EXTRAARG的参数
+func (self *translator54) extraArg(pc int) int {
+	if pc+1 >= len(self.code) || self.code[pc+1].op() != OP54_EXTRAARG {
+		chunkError("corrupted")
+	}
+	return self.code[pc+1].ax()
+}
+
+// mmbin: 第pc条指令之后的MMBIN*指令，没有时返回false
+// 5.4的算术指令后面总是跟着一条MMBIN*，记录了原来的运算（元方法事件）和操作数的顺序
+func (self *translator54) mmbin(pc, op int) (inst54, bool) {
+	if pc+1 < len(self.code) && self.code[pc+1].op() == op {
+		return self.code[pc+1], true
+	}
+	return 0, false
+}
+
+// tmOpcode: 元方法事件对应的5.3指令
+func tmOpcode(tm int) int {
+	if tm < TM_ADD || tm >= TM_ADD+len(tmOpcodes) {
+		unsupported54("metamethod event %d", tm)
+	}
+	return tmOpcodes[tm-TM_ADD]
+}
+
+// translateArithI: ADDI、SHRI、SHLI，运算和立即数取自后面的MMBINI
+// 比如x - 1被编译成ADDI x -1，x << 1被编译成SHRI x -1，1 + x的操作数顺序被交换
+func (self *translator54) translateArithI(pc int, i inst54) {
+	a, b := i.a(), i.b()
+	mm, ok := self.mmbin(pc, OP54_MMBINI)
+	if !ok {
+		switch i.op() {
+		case OP54_ADDI:
+			self.emitABC(pc, vm.OP_ADD, a, b, self.rkConst(pc, int64(i.sC())))
+		case OP54_SHRI:
+			self.emitABC(pc, vm.OP_SHR, a, b, self.rkConst(pc, int64(i.sC())))
+		case OP54_SHLI: /* R[A] := sC << R[B] */
+			self.emitABC(pc, vm.OP_SHL, a, self.rkConst(pc, int64(i.sC())), b)
+		}
+		return
+	}
+	op := tmOpcode(mm.c())
+	k := self.rkConst(pc, int64(mm.sB()))
+	if mm.isK() { /* flipped operands? */
+		self.emitABC(pc, op, a, k, b)
+	} else {
+		self.emitABC(pc, op, a, b, k)
+	}
+}
+
+// translateArithK: 第二个操作数是常量的算术和按位运算
+func (self *translator54) translateArithK(pc int, i inst54) {
+	a, b, c := i.a(), i.b(), i.c()
+	op := tmOpcodes[i.op()-OP54_ADDK]
+	mm, ok := self.mmbin(pc, OP54_MMBINK)
+	if ok && mm.isK() { /* 1 + x is compiled as x + 1 with flipped operands */
+		self.emitABC(pc, op, a, self.rkK(pc, c), b)
+	} else {
+		self.emitABC(pc, op, a, b, self.rkK(pc, c))
+	}
+}
+
+// translateSetList: 5.4的C是已经设置的元素个数，5.3的C是从1开始的批次
+func (self *translator54) translateSetList(pc int, i inst54) {
+	a, b, n := i.a(), i.b(), i.c()
+	if i.isK() {
+		n += self.extraArg(pc) * (MAXARG_C_54 + 1)
+	}
+	if n%vm.LFIELDS_PER_FLUSH != 0 {
+		unsupported54("SETLIST offset %d", n)
+	}
+	if block := n/vm.LFIELDS_PER_FLUSH + 1; block <= vm.MAXARG_C {
+		self.emitABC(pc, vm.OP_SETLIST, a, b, block)
+	} else {
+		self.emitABC(pc, vm.OP_SETLIST, a, b, 0)
+		self.emit(pc, uint32(block<<6|vm.OP_EXTRAARG))
+	}
+}
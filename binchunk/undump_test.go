@@ -0,0 +1,149 @@
+package binchunk_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "luago/api"
+	"luago/binchunk"
+	"luago/state"
+)
+
+// testdata中的chunk按lundump.c的格式构造：
+// lua54_*是Lua 5.4.6的chunk，加载时翻译成5.3的指令；
+// lua53_<字节序>_<int><size_t><lua_Integer><lua_Number>是不同字节序和类型大小的5.3 chunk，
+// 都计算40+2.5并返回"hi"
+func readChunk(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// runChunk: 加载并执行chunk，返回所有结果用','连接的字符串
+func runChunk(t *testing.T, data []byte) (string, error) {
+	t.Helper()
+	ls := state.NewState()
+	if ls.Load(data, "=golden", "b") != LUA_OK {
+		return "", NewLuaError(ls, LUA_ERRSYNTAX)
+	}
+	if status := ls.PCall(0, LUA_MULTRET, 0); status != LUA_OK {
+		return "", NewLuaError(ls, status)
+	}
+	var results []string
+	for i, n := 1, ls.GetTop(); i <= n; i++ {
+		results = append(results, ls.ToString2(i))
+		ls.Pop(1)
+	}
+	return strings.Join(results, ","), nil
+}
+
+func TestGoldenChunks(t *testing.T) {
+	tests := []struct {
+		file string
+		want string
+	}{
+		{"lua54_loops.luac", "110,108,109"},               /* FORPREP/FORLOOP, TFORPREP/TFORCALL/TFORLOOP, ADDI, MULK */
+		{"lua54_misc.luac", "big,2,3x,40,ABC,false,dflt"}, /* 闭包、vararg、SETLIST、SELF、CONCAT、比较和TEST */
+		{"lua54_skip.luac", "5,nil"},                      /* TEST跳过翻译成多条5.3指令的SETI */
+		{"lua53_le_4888.luac", "42.5,hi"},
+		{"lua53_be_4888.luac", "42.5,hi"},
+		{"lua53_le_8444.luac", "42.5,hi"},
+		{"lua53_be_8848.luac", "42.5,hi"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			got, err := runChunk(t, readChunk(t, tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGoldenChunkErrors(t *testing.T) {
+	tests := []struct {
+		file string
+		want string
+	}{
+		{"lua54_setlist.luac", "golden: unsupported Lua 5.4 chunk: SETLIST offset 7"},
+		{"lua54_opcode.luac", "golden: unsupported Lua 5.4 chunk: opcode 90"},
+		{"lua54_line.luac", "bad.lua:3: attempt to perform arithmetic on a nil value"}, /* 报告5.4的行号 */
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			_, err := runChunk(t, readChunk(t, tt.file))
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("got %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// 任何截断的chunk都返回错误，不能panic
+func TestTruncatedChunks(t *testing.T) {
+	files, _ := filepath.Glob(filepath.Join("testdata", "*.luac"))
+	for _, file := range files {
+		data := readChunk(t, filepath.Base(file))
+		for n := 0; n < len(data); n++ {
+			if _, err := binchunk.Undump(data[:n]); err == nil {
+				t.Errorf("%s: prefix of %d bytes accepted", file, n)
+			}
+		}
+	}
+}
+
+func TestHeaderErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		offset int
+		patch  []byte
+		want   string
+	}{
+		{"format", 5, []byte{7}, "format mismatch in precompiled chunk"},
+		{"data", 8, []byte{'x'}, "corrupted precompiled chunk"},
+		{"int", 12, []byte{2}, "int size mismatch in precompiled chunk"},
+		{"endianness", 17, []byte{1, 2, 3, 4, 5, 6, 7, 8}, "endianness mismatch in precompiled chunk"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := readChunk(t, "lua53_le_4888.luac")
+			copy(data[tt.offset:], tt.patch)
+			if _, err := binchunk.Undump(data); err == nil || err.Error() != tt.want {
+				t.Errorf("got %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// Dump写出的是本机的标准格式，和小端、4888的chunk逐字节相同
+func TestDumpRoundTrip(t *testing.T) {
+	data := readChunk(t, "lua53_le_4888.luac")
+	proto, err := binchunk.Undump(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dumped := binchunk.Dump(proto, false); string(dumped) != string(data) {
+		t.Errorf("Dump(Undump(chunk)) differs from chunk")
+	}
+	for _, file := range []string{"lua53_be_8848.luac", "lua54_misc.luac"} {
+		proto, err := binchunk.Undump(readChunk(t, file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := runChunk(t, binchunk.Dump(proto, false))
+		if err != nil {
+			t.Fatalf("%s: %v", file, err)
+		}
+		if want, _ := runChunk(t, readChunk(t, file)); got != want {
+			t.Errorf("%s: got %q, want %q", file, got, want)
+		}
+	}
+}
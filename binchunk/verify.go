@@ -0,0 +1,333 @@
+package binchunk
+
+import (
+	"fmt"
+	"luago/vm"
+	"strings"
+)
+
+// 二进制chunk的字节码检查
+// 虚拟机执行指令时不检查操作数，手工构造的chunk中越界的寄存器、常量、upvalue或子函数索引，
+// 或者跳出指令表的跳转会让指令的实现访问越界。Load在加载二进制chunk时先用Verify检查每个函数原型。
+// 参考lua-5.1.5/src/ldebug.c#symbexec()，5.2之后的官方实现去掉了这项检查。
+
+const MAXREGS = 255 /* 5.3: maximum number of registers in a Lua function */
+
+type verifier struct {
+	proto  *Prototype
+	code   []vm.Instruction
+	pc     int
+	paired []bool /* 指令是LOADKX或SETLIST之后的EXTRAARG */
+}
+
+// Verify: 检查函数原型和所有子函数原型的字节码，发现问题时返回error
+// lua-5.1.5/src/ldebug.c#luaG_checkcode()
+func Verify(proto *Prototype) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if e, ok := r.(error); ok {
+				err = e
+			} else {
+				err = fmt.Errorf("%v", r)
+			}
+		}
+	}()
+
+	verifyProto(proto, nil)
+	return nil
+}
+
+func verifyProto(proto *Prototype, parent *Prototype) {
+	code := make([]vm.Instruction, len(proto.Code))
+	for i, inst := range proto.Code {
+		code[i] = vm.Instruction(inst)
+	}
+	v := &verifier{proto: proto, code: code, pc: -1, paired: make([]bool, len(code))}
+	v.checkProto(parent)
+	for v.pc = 0; v.pc < len(code); v.pc++ {
+		v.checkInst(code[v.pc])
+	}
+	for _, p := range proto.Protos {
+		verifyProto(p, proto)
+	}
+}
+
+func (self *verifier) error(format string, a ...interface{}) {
+	where := fmt.Sprintf("function at line %d", self.proto.LineDefined)
+	if self.pc >= 0 {
+		where += fmt.Sprintf(", pc %d", self.pc+1)
+	}
+	panic(fmt.Errorf("bad code in precompiled chunk (%s: %s)", where, fmt.Sprintf(format, a...)))
+}
+
+func (self *verifier) check(cond bool, format string, a ...interface{}) {
+	if !cond {
+		self.error(format, a...)
+	}
+}
+
+// checkProto: 检查函数原型的头部、upvalue和调试信息
+// lua-5.1.5/src/ldebug.c#precheck()
+func (self *verifier) checkProto(parent *Prototype) {
+	proto := self.proto
+	maxStack := int(proto.MaxStackSize)
+	nParams := int(proto.NumParams)
+	if proto.IsVararg&VARARG_NEEDSARG != 0 {
+		self.check(proto.IsVararg&VARARG_ISVARARG != 0, "'arg' in a non-vararg function")
+		nParams++ /* 'arg' lives right after the fixed parameters */
+	}
+	self.check(maxStack <= MAXREGS, "too many registers")
+	self.check(nParams <= maxStack, "parameters exceed the stack size")
+	self.check(len(proto.Upvalues) <= MAXREGS, "too many upvalues")
+	self.check(len(proto.UpvalueNames) == 0 || len(proto.UpvalueNames) == len(proto.Upvalues),
+		"bad upvalue name list")
+	self.check(len(proto.LineInfo) == 0 || len(proto.LineInfo) == len(proto.Code), "bad line info")
+	for _, locVar := range proto.LocVars {
+		self.check(locVar.StartPC <= locVar.EndPC && int(locVar.EndPC) <= len(proto.Code),
+			"bad range of local variable '%s'", locVar.VarName)
+	}
+	if parent != nil {
+		for i, uv := range proto.Upvalues {
+			switch uv.Instack {
+			case 1:
+				self.check(uv.Idx < parent.MaxStackSize, "upvalue %d refers to a bad register", i)
+			case 0:
+				self.check(int(uv.Idx) < len(parent.Upvalues), "upvalue %d refers to a bad upvalue", i)
+			default:
+				self.error("upvalue %d has a bad instack flag %d", i, uv.Instack)
+			}
+		}
+	}
+	self.check(len(self.code) > 0 && self.code[len(self.code)-1].Opcode() == vm.OP_RETURN,
+		"missing final RETURN")
+}
+
+// checkInst: 检查一条指令的操作数
+// lua-5.1.5/src/ldebug.c#symbexec()
+func (self *verifier) checkInst(i vm.Instruction) {
+	self.check(i.IsValid(), "bad opcode %d", i.Opcode())
+	op := i.Opcode()
+	if self.paired[self.pc] {
+		return /* EXTRAARG already checked with its instruction */
+	}
+	self.check(op != vm.OP_EXTRAARG, "EXTRAARG without a preceding LOADKX or SETLIST")
+
+	switch i.OpMode() {
+	case vm.IABC:
+		a, b, c := i.ABC()
+		if i.TestAMode() {
+			self.checkReg(a)
+		}
+		self.checkArg(i.BMode(), b)
+		self.checkArg(i.CMode(), c)
+	case vm.IABx:
+		a, bx := i.ABx()
+		self.checkReg(a)
+		if i.BMode() == vm.OpArgK {
+			self.checkConst(bx)
+		}
+	case vm.IAsBx:
+		a, sBx := i.AsBx()
+		if op != vm.OP_JMP {
+			self.checkReg(a)
+		}
+		self.checkTarget(self.pc + 1 + sBx)
+	}
+	if i.TestTMode() {
+		self.check(self.pc+1 < len(self.code) && self.code[self.pc+1].Opcode() == vm.OP_JMP,
+			"%s not followed by JMP", opName(i))
+		self.checkTarget(self.pc + 2)
+	}
+
+	switch op {
+	case vm.OP_LOADKX:
+		self.checkConst(self.extraArg())
+	case vm.OP_LOADBOOL:
+		if _, _, c := i.ABC(); c != 0 {
+			self.checkTarget(self.pc + 2)
+		}
+	case vm.OP_LOADNIL:
+		a, b, _ := i.ABC()
+		self.checkReg(a + b)
+	case vm.OP_GETUPVAL, vm.OP_SETUPVAL, vm.OP_GETTABUP:
+		_, b, _ := i.ABC()
+		self.checkUpvalue(b)
+		if op == vm.OP_SETUPVAL {
+			a, _, _ := i.ABC()
+			self.checkReg(a)
+		}
+	case vm.OP_SETTABUP:
+		a, _, _ := i.ABC()
+		self.checkUpvalue(a)
+	case vm.OP_SETTABLE:
+		a, _, _ := i.ABC()
+		self.checkReg(a)
+	case vm.OP_SELF:
+		a, _, _ := i.ABC()
+		self.checkReg(a + 1)
+	case vm.OP_CONCAT:
+		_, b, c := i.ABC()
+		self.check(b <= c, "bad CONCAT range")
+	case vm.OP_JMP:
+		if a, _ := i.AsBx(); a > 0 {
+			self.checkReg(a - 1)
+		}
+	case vm.OP_TEST:
+		a, _, _ := i.ABC()
+		self.checkReg(a)
+	case vm.OP_CALL, vm.OP_TAILCALL:
+		a, b, c := i.ABC()
+		self.checkReg(a)
+		if b == 0 {
+			self.checkOpenUse()
+		} else {
+			self.checkReg(a + b - 1)
+		}
+		if op == vm.OP_CALL {
+			if c == 0 {
+				self.checkOpenResults()
+			} else if c > 1 {
+				self.checkReg(a + c - 2)
+			}
+		}
+	case vm.OP_RETURN:
+		a, b, _ := i.ABC()
+		if b == 0 {
+			self.checkReg(a)
+			self.checkOpenUse()
+		} else if b > 1 {
+			self.checkReg(a + b - 2)
+		}
+	case vm.OP_FORLOOP, vm.OP_FORPREP:
+		a, _ := i.AsBx()
+		self.checkReg(a + 3)
+	case vm.OP_TFORCALL:
+		a, _, c := i.ABC()
+		self.check(c >= 1, "TFORCALL without results")
+		self.checkReg(a + 2 + c)
+		self.check(self.pc+1 < len(self.code) && self.code[self.pc+1].Opcode() == vm.OP_TFORLOOP,
+			"TFORCALL not followed by TFORLOOP")
+	case vm.OP_TFORLOOP:
+		a, _ := i.AsBx()
+		self.checkReg(a + 1)
+	case vm.OP_SETLIST:
+		a, b, c := i.ABC()
+		self.checkReg(a)
+		if b == 0 {
+			self.checkOpenUse()
+		} else {
+			self.checkReg(a + b)
+		}
+		if c == 0 {
+			self.extraArg()
+		}
+	case vm.OP_CLOSURE:
+		_, bx := i.ABx()
+		self.check(bx < len(self.proto.Protos), "bad function index %d", bx)
+	case vm.OP_VARARG:
+		a, b, _ := i.ABC()
+		self.check(self.proto.IsVararg&VARARG_ISVARARG != 0, "VARARG in a non-vararg function")
+		if b == 0 {
+			self.checkOpenResults()
+		} else if b > 1 {
+			self.checkReg(a + b - 2)
+		}
+	case vm.OP_TBC:
+		a, _, _ := i.ABC()
+		self.checkReg(a)
+	}
+}
+
+// checkArg: 按操作数类型检查B或C
+// lua-5.1.5/src/ldebug.c#checkArgMode()
+func (self *verifier) checkArg(mode byte, arg int) {
+	switch mode {
+	case vm.OpArgR:
+		self.checkReg(arg)
+	case vm.OpArgK:
+		if arg > 0xFF {
+			self.checkConst(arg & 0xFF)
+		} else {
+			self.checkReg(arg)
+		}
+	}
+}
+
+func (self *verifier) checkReg(reg int) {
+	self.check(reg >= 0 && reg < int(self.proto.MaxStackSize), "register %d out of range", reg)
+}
+
+func (self *verifier) checkConst(idx int) {
+	self.check(idx < len(self.proto.Constants), "constant %d out of range", idx)
+}
+
+func (self *verifier) checkUpvalue(idx int) {
+	self.check(idx < len(self.proto.Upvalues), "upvalue %d out of range", idx)
+}
+
+// checkTarget: 跳转目标必须在指令表内，并且不能是LOADKX或SETLIST使用的EXTRAARG；
+// 也不能是使用不定个数的值（B为0）的指令，这些值只能由紧挨着的上一条指令产生
+func (self *verifier) checkTarget(pc int) {
+	self.check(pc >= 0 && pc < len(self.code), "jump to %d out of range", pc+1)
+	self.check(self.code[pc].Opcode() != vm.OP_EXTRAARG || pc == 0 || !self.usesExtraArg(pc-1),
+		"jump into EXTRAARG")
+	self.check(!isOpenUse(self.code[pc]), "jump to %s that uses open results", opName(self.code[pc]))
+}
+
+// extraArg: 下一条指令必须是EXTRAARG，返回它的参数
+func (self *verifier) extraArg() int {
+	next := self.pc + 1
+	self.check(next < len(self.code) && self.code[next].Opcode() == vm.OP_EXTRAARG,
+		"%s not followed by EXTRAARG", opName(self.code[self.pc]))
+	self.paired[next] = true
+	return self.code[next].Ax()
+}
+
+// usesExtraArg: 第pc条指令后面跟着它的EXTRAARG
+func (self *verifier) usesExtraArg(pc int) bool {
+	i := self.code[pc]
+	if i.Opcode() == vm.OP_LOADKX {
+		return true
+	}
+	_, _, c := i.ABC()
+	return i.Opcode() == vm.OP_SETLIST && c == 0
+}
+
+// checkOpenResults: 结果个数不定（CALL的C或VARARG的B为0）时，下一条指令必须使用全部结果
+// lua-5.1.5/src/ldebug.c#checkopenop()
+func (self *verifier) checkOpenResults() {
+	self.check(self.pc+1 < len(self.code) && isOpenUse(self.code[self.pc+1]),
+		"open results not used by the next instruction")
+}
+
+// checkOpenUse: 使用不定个数的值（B为0）时，上一条指令必须产生这些值
+func (self *verifier) checkOpenUse() {
+	self.check(self.pc > 0 && isOpenResults(self.code[self.pc-1]),
+		"%s uses open results not produced by the previous instruction", opName(self.code[self.pc]))
+}
+
+func isOpenResults(i vm.Instruction) bool {
+	_, b, c := i.ABC()
+	switch i.Opcode() {
+	case vm.OP_TAILCALL: /* followed by RETURN A 0 */
+		return true
+	case vm.OP_CALL:
+		return c == 0
+	case vm.OP_VARARG:
+		return b == 0
+	}
+	return false
+}
+
+func isOpenUse(i vm.Instruction) bool {
+	_, b, _ := i.ABC()
+	switch i.Opcode() {
+	case vm.OP_CALL, vm.OP_TAILCALL, vm.OP_RETURN, vm.OP_SETLIST:
+		return b == 0
+	}
+	return false
+}
+
+func opName(i vm.Instruction) string {
+	return strings.TrimSpace(i.OpName())
+}
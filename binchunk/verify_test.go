@@ -0,0 +1,107 @@
+package binchunk_test
+
+import (
+	"strings"
+	"testing"
+
+	"luago/binchunk"
+	. "luago/vm"
+)
+
+// 指令编码，和lopcodes.h中的CREATE_ABC、CREATE_ABx、CREATE_Ax相同
+func iABC(op, a, b, c int) uint32 { return uint32(op | a<<6 | c<<14 | b<<23) }
+func iABx(op, a, bx int) uint32   { return uint32(op | a<<6 | bx<<14) }
+func iAsBx(op, a, sbx int) uint32 { return iABx(op, a, sbx+MAXARG_sBx) }
+func iAx(op, ax int) uint32       { return uint32(op | ax<<6) }
+
+var ret = iABC(OP_RETURN, 0, 1, 0) /* RETURN 0 1 */
+
+// fn: 有slots个寄存器的vararg函数
+func fn(slots int, code ...uint32) *binchunk.Prototype {
+	return &binchunk.Prototype{IsVararg: binchunk.VARARG_ISVARARG, MaxStackSize: byte(slots), Code: code}
+}
+
+// withConsts: 给函数加上n个整数常量
+func withConsts(proto *binchunk.Prototype, n int) *binchunk.Prototype {
+	for i := 0; i < n; i++ {
+		proto.Constants = append(proto.Constants, int64(i+1))
+	}
+	return proto
+}
+
+func TestVerifyRejects(t *testing.T) {
+	child := fn(2, iABC(OP_MOVE, 9, 0, 0), ret)
+	withChild := fn(2, iABx(OP_CLOSURE, 0, 0), ret)
+	withChild.Protos = []*binchunk.Prototype{child}
+	badLocal := fn(2, ret)
+	badLocal.LocVars = []binchunk.LocVar{{VarName: "x", StartPC: 2, EndPC: 1}}
+	badParams := fn(2, ret)
+	badParams.NumParams = 3
+	badInstack := fn(2, iABx(OP_CLOSURE, 0, 0), ret)
+	badInstack.Protos = []*binchunk.Prototype{fn(2, ret)}
+	badInstack.Protos[0].Upvalues = []binchunk.Upvalue{{Instack: 2, Idx: 0}}
+
+	tests := []struct {
+		name  string
+		proto *binchunk.Prototype
+		want  string
+	}{
+		{"register", fn(2, iABC(OP_MOVE, 7, 0, 0), ret), "register 7 out of range"},
+		{"constant", withConsts(fn(2, iABx(OP_LOADK, 0, 9), ret), 1), "constant 9 out of range"},
+		{"rk", fn(2, iABC(OP_ADD, 0, 0, 0x100|200), ret), "constant 200 out of range"},
+		{"upvalue", fn(2, iABC(OP_GETUPVAL, 0, 3, 0), ret), "upvalue 3 out of range"},
+		{"closure", fn(2, iABx(OP_CLOSURE, 0, 0), ret), "bad function index 0"},
+		{"vararg", fn(2, iABC(OP_VARARG, 0, 5, 0), ret), "register 3 out of range"},
+		{"jump", fn(2, iAsBx(OP_JMP, 0, 99), ret), "jump to 101 out of range"},
+		{"back", fn(2, iAsBx(OP_JMP, 0, -2), ret), "jump to 0 out of range"},
+		{"no return", fn(2, iABC(OP_MOVE, 0, 1, 0)), "missing final RETURN"},
+		{"extraarg", fn(2, iAx(OP_EXTRAARG, 0), ret), "EXTRAARG without a preceding LOADKX or SETLIST"},
+		{"loadkx", fn(2, iABx(OP_LOADKX, 0, 0), ret), "LOADKX not followed by EXTRAARG"},
+		{"loadkx constant", fn(2, iABx(OP_LOADKX, 0, 0), iAx(OP_EXTRAARG, 77), ret), "constant 77 out of range"},
+		{"jump into extraarg", withConsts(fn(2, iAsBx(OP_JMP, 0, 1), iABx(OP_LOADKX, 0, 0), iAx(OP_EXTRAARG, 0), ret), 1),
+			"jump into EXTRAARG"},
+		{"test", fn(2, iABC(OP_TEST, 0, 0, 0), ret), "TEST not followed by JMP"},
+		{"open results", fn(2, iABC(OP_CALL, 0, 0, 1), ret), "CALL uses open results not produced by the previous instruction"},
+		{"local range", badLocal, "bad range of local variable 'x'"},
+		{"params", badParams, "parameters exceed the stack size"},
+		/* 使用不定个数结果的指令不能是跳转目标 */
+		{"jump to return", fn(2, iAsBx(OP_JMP, 0, 1), iABC(OP_VARARG, 0, 0, 0), iABC(OP_RETURN, 0, 0, 0)),
+			"jump to RETURN that uses open results"},
+		{"jump to call", fn(4, iAsBx(OP_JMP, 0, 1), iABC(OP_VARARG, 1, 0, 0), iABC(OP_CALL, 0, 0, 1), ret),
+			"jump to CALL that uses open results"},
+		{"loadbool skip", fn(4, iABC(OP_LOADBOOL, 0, 0, 1), iABC(OP_VARARG, 1, 0, 0), iABC(OP_SETLIST, 0, 0, 1), ret),
+			"jump to SETLIST that uses open results"},
+		{"child", withChild, "register 9 out of range"},
+		{"instack", badInstack, "upvalue 0 has a bad instack flag 2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := binchunk.Verify(tt.proto)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyBadOpcode(t *testing.T) {
+	proto := &binchunk.Prototype{MaxStackSize: 2, Code: []uint32{60, 38 | 1<<23}}
+	err := binchunk.Verify(proto)
+	if want := "bad code in precompiled chunk (function at line 0, pc 1: bad opcode 60)"; err == nil || err.Error() != want {
+		t.Errorf("got %v, want %q", err, want)
+	}
+}
+
+func TestVerifyAccepts(t *testing.T) {
+	tests := []*binchunk.Prototype{
+		fn(2, iABC(OP_VARARG, 0, 0, 0), iABC(OP_RETURN, 0, 0, 0)),
+		withConsts(fn(2, iABx(OP_LOADKX, 0, 0), iAx(OP_EXTRAARG, 1), iABC(OP_RETURN, 0, 2, 0)), 2),
+		fn(4, iABC(OP_VARARG, 1, 0, 0), iABC(OP_CALL, 0, 0, 1), ret),
+		fn(3, iABC(OP_LOADBOOL, 0, 1, 1), iABC(OP_LOADBOOL, 0, 0, 0), iABC(OP_RETURN, 0, 2, 0)),
+	}
+	for i, proto := range tests {
+		if err := binchunk.Verify(proto); err != nil {
+			t.Errorf("case %d: %v", i, err)
+		}
+	}
+}
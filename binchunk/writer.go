@@ -0,0 +1,156 @@
+package binchunk
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// writer: 按本机的格式（小端，cint 4字节，size_t、lua整数和lua浮点数8字节）写出5.3的二进制chunk
+type writer struct {
+	buf   []byte
+	strip bool
+}
+
+// Dump: 把函数原型写成二进制chunk，strip为true时不写调试信息（源文件名、行号、局部变量名和upvalue名）
+// lua-5.3.4/src/ldump.c#luaU_dump()
+func Dump(proto *Prototype, strip bool) []byte {
+	w := &writer{strip: strip}
+	w.writeHeader()
+	w.writeByte(byte(len(proto.Upvalues)))
+	w.writeProto(proto, "")
+	return w.buf
+}
+
+func (self *writer) writeByte(b byte) {
+	self.buf = append(self.buf, b)
+}
+
+func (self *writer) writeUint32(i uint32) {
+	self.buf = binary.LittleEndian.AppendUint32(self.buf, i)
+}
+
+func (self *writer) writeUint64(i uint64) {
+	self.buf = binary.LittleEndian.AppendUint64(self.buf, i)
+}
+
+func (self *writer) writeLuaInteger(i int64) {
+	self.writeUint64(uint64(i))
+}
+
+func (self *writer) writeLuaNumber(f float64) {
+	self.writeUint64(math.Float64bits(f))
+}
+
+// writeString: 短字符串用一个字节记录长度+1，长字符串用0xFF加size_t
+// lua-5.3.4/src/ldump.c#DumpString()
+func (self *writer) writeString(s string, null bool) {
+	if null {
+		self.writeByte(0)
+		return
+	}
+	if size := len(s) + 1; size < 0xFF {
+		self.writeByte(byte(size))
+	} else {
+		self.writeByte(0xFF)
+		self.writeUint64(uint64(size))
+	}
+	self.buf = append(self.buf, s...)
+}
+
+// lua-5.3.4/src/ldump.c#DumpHeader()
+func (self *writer) writeHeader() {
+	self.buf = append(self.buf, LUA_SIGNATURE...)
+	self.writeByte(LUAC_VERSION)
+	self.writeByte(LUAC_FORMAT)
+	self.buf = append(self.buf, LUAC_DATA...)
+	self.writeByte(CINT_SIZE)
+	self.writeByte(CSIZET_SIZE)
+	self.writeByte(INSTRUCTION_SIZE)
+	self.writeByte(LUA_INTEGER_SIZE)
+	self.writeByte(LUA_NUMBER_SIZE)
+	self.writeLuaInteger(LUAC_INT)
+	self.writeLuaNumber(LUAC_NUM)
+}
+
+// writeProto: 写函数原型，和父函数相同的源文件名不重复写出
+// lua-5.3.4/src/ldump.c#DumpFunction()
+func (self *writer) writeProto(proto *Prototype, parentSource string) {
+	self.writeString(proto.Source, self.strip || proto.Source == parentSource)
+	self.writeUint32(proto.LineDefined)
+	self.writeUint32(proto.LastLineDefined)
+	self.writeByte(proto.NumParams)
+	self.writeByte(proto.IsVararg)
+	self.writeByte(proto.MaxStackSize)
+	self.writeUint32(uint32(len(proto.Code)))
+	for _, i := range proto.Code {
+		self.writeUint32(i)
+	}
+	self.writeConstants(proto.Constants)
+	self.writeUint32(uint32(len(proto.Upvalues)))
+	for _, uv := range proto.Upvalues {
+		self.writeByte(uv.Instack)
+		self.writeByte(uv.Idx)
+	}
+	self.writeUint32(uint32(len(proto.Protos)))
+	for _, p := range proto.Protos {
+		self.writeProto(p, proto.Source)
+	}
+	self.writeDebug(proto)
+}
+
+// lua-5.3.4/src/ldump.c#DumpConstants()
+func (self *writer) writeConstants(constants []interface{}) {
+	self.writeUint32(uint32(len(constants)))
+	for _, k := range constants {
+		switch k := k.(type) {
+		case nil:
+			self.writeByte(TAG_NIL)
+		case bool:
+			self.writeByte(TAG_BOOLEAN)
+			if k {
+				self.writeByte(1)
+			} else {
+				self.writeByte(0)
+			}
+		case int64:
+			self.writeByte(TAG_INTEGER)
+			self.writeLuaInteger(k)
+		case float64:
+			self.writeByte(TAG_NUMBER)
+			self.writeLuaNumber(k)
+		case string:
+			if len(k) < 40 { /* LUAI_MAXSHORTLEN */
+				self.writeByte(TAG_SHORT_STR)
+			} else {
+				self.writeByte(TAG_LONG_STR)
+			}
+			self.writeString(k, false)
+		default:
+			panic("invalid constant type")
+		}
+	}
+}
+
+// lua-5.3.4/src/ldump.c#DumpDebug()
+func (self *writer) writeDebug(proto *Prototype) {
+	if self.strip {
+		self.writeUint32(0) /* lineinfo */
+		self.writeUint32(0) /* locvars */
+		self.writeUint32(0) /* upvalue names */
+		return
+	}
+	self.writeUint32(uint32(len(proto.LineInfo)))
+	for _, line := range proto.LineInfo {
+		self.writeUint32(line)
+	}
+	self.writeUint32(uint32(len(proto.LocVars)))
+	for _, locVar := range proto.LocVars {
+		self.writeString(locVar.VarName, false)
+		self.writeUint32(locVar.StartPC)
+		self.writeUint32(locVar.EndPC)
+	}
+	self.writeUint32(uint32(len(proto.UpvalueNames)))
+	for _, name := range proto.UpvalueNames {
+		self.writeString(name, false)
+	}
+}
@@ -0,0 +1,433 @@
+package asm
+
+import (
+	"fmt"
+	"luago/binchunk"
+	"luago/compiler/lexer"
+	"luago/number"
+	"luago/vm"
+	"strconv"
+	"strings"
+)
+
+// 文本形式的字节码汇编器
+// 格式和luac -l -l的列表对应，不经过编译器直接写出虚拟机指令，用于在指令级别重现和测试虚拟机的行为。
+// 每行一条指令或一个伪指令，';'之后是注释：
+//
+//	.params 0+                 ; 固定参数个数，'+'表示vararg（主函数默认为0+）
+//	.slots 3                   ; 寄存器数量（MaxStackSize），默认为2
+//	.upval _ENV 1 0            ; upvalue：名字 instack idx
+//	.const "print"             ; 常量：nil、true、false、整数、浮点数或带引号的字符串
+//	.local i 2 loop_end        ; 局部变量：名字 startpc endpc（从1开始的指令序号或标签）
+//	        GETTABUP 0 0 -1    ; 常量写成-1-索引，和luac的列表相同
+//	loop:   [3] ADD 1 1 -2     ; 指令前可以有标签、luac列表中的序号和方括号里的行号
+//	        JMP 0 loop         ; 跳转的sBx可以写标签
+//	.function <test.lua:5,7>   ; 子函数，到.end为止，按出现的顺序编号，CLOSURE用这个编号
+//	        RETURN 0 1
+//	.end
+//	        RETURN 0 1
+//
+// 操作数的个数和luac的列表相同：iABC模式不使用的B、C省略，LOADKX只写A。
+// 文件本身是主函数，主函数的源文件名是chunkName。
+
+type funcState struct {
+	parent   *funcState
+	proto    *binchunk.Prototype
+	line     int            /* .function所在的行 */
+	labels   map[string]int /* 标签 => 指令位置 */
+	jumps    []labelRef     /* 用标签作sBx的指令 */
+	locals   []localRef     /* 用标签表示范围的局部变量 */
+	lines    []uint32
+	hasLines bool
+}
+
+type labelRef struct {
+	pc    int
+	label string
+	line  int
+}
+
+type localRef struct {
+	idx        int
+	start, end string
+	line       int
+}
+
+type assembler struct {
+	chunkName string
+	line      int
+	fs        *funcState
+}
+
+// Assemble: 汇编src，返回主函数原型，可以用binchunk.Dump写成二进制chunk交给Load加载
+// 出错时返回"chunkName:行号: 错误信息"
+func Assemble(src, chunkName string) (proto *binchunk.Prototype, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	self := &assembler{chunkName: chunkName}
+	self.fs = newFuncState(nil, &binchunk.Prototype{
+		Source:       chunkName,
+		IsVararg:     binchunk.VARARG_ISVARARG,
+		MaxStackSize: 2,
+	})
+	for i, line := range strings.Split(src, "\n") {
+		self.line = i + 1
+		self.parseLine(line)
+	}
+	if self.fs.parent != nil {
+		self.line = self.fs.line
+		self.error("'.function' without '.end'")
+	}
+	self.finish(self.fs)
+	return self.fs.proto, nil
+}
+
+func newFuncState(parent *funcState, proto *binchunk.Prototype) *funcState {
+	return &funcState{parent: parent, proto: proto, labels: map[string]int{}}
+}
+
+func (self *assembler) error(f string, a ...interface{}) {
+	panic(fmt.Sprintf("%s:%d: %s", self.chunkName, self.line, fmt.Sprintf(f, a...)))
+}
+
+func (self *assembler) parseLine(line string) {
+	fields := self.splitFields(line)
+	for len(fields) > 0 && strings.HasSuffix(fields[0], ":") {
+		self.defineLabel(strings.TrimSuffix(fields[0], ":"))
+		fields = fields[1:]
+	}
+	if len(fields) == 0 {
+		return
+	}
+	if strings.HasPrefix(fields[0], ".") {
+		self.parseDirective(fields[0], fields[1:])
+	} else {
+		self.parseInst(fields)
+	}
+}
+
+// splitFields: 按空白分割一行，去掉';'之后的注释，带引号的字符串作为一个整体
+func (self *assembler) splitFields(line string) []string {
+	var fields []string
+	for i := 0; i < len(line); {
+		switch c := line[i]; {
+		case c == ';':
+			return fields
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == '"' || c == '\'':
+			j := i + 1
+			for j < len(line) && line[j] != c {
+				if line[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(line) {
+				self.error("unfinished string")
+			}
+			fields = append(fields, line[i:j+1])
+			i = j + 1
+		default:
+			j := i
+			for j < len(line) && !strings.ContainsRune(" \t\r;", rune(line[j])) {
+				j++
+			}
+			fields = append(fields, line[i:j])
+			i = j
+		}
+	}
+	return fields
+}
+
+func (self *assembler) defineLabel(name string) {
+	if !isName(name) {
+		self.error("bad label '%s'", name)
+	}
+	if _, found := self.fs.labels[name]; found {
+		self.error("label '%s' already defined", name)
+	}
+	self.fs.labels[name] = len(self.fs.proto.Code)
+}
+
+/* directives */
+
+func (self *assembler) parseDirective(name string, args []string) {
+	fs := self.fs
+	proto := fs.proto
+	switch name {
+	case ".function":
+		self.checkArgs(name, args, 0, 1)
+		child := &binchunk.Prototype{Source: proto.Source, MaxStackSize: 2}
+		if len(args) == 1 {
+			self.parseFuncHeader(child, args[0])
+		}
+		proto.Protos = append(proto.Protos, child)
+		self.fs = newFuncState(fs, child)
+		self.fs.line = self.line
+	case ".end":
+		self.checkArgs(name, args, 0, 0)
+		if fs.parent == nil {
+			self.error("'.end' without '.function'")
+		}
+		self.finish(fs)
+		self.fs = fs.parent
+	case ".params":
+		self.checkArgs(name, args, 1, 1)
+		n := args[0]
+		proto.IsVararg = 0
+		if strings.HasSuffix(n, "+") {
+			n = strings.TrimSuffix(n, "+")
+			proto.IsVararg = binchunk.VARARG_ISVARARG
+		}
+		proto.NumParams = byte(self.parseInt(n, 0, 0xFF))
+	case ".slots":
+		self.checkArgs(name, args, 1, 1)
+		proto.MaxStackSize = byte(self.parseInt(args[0], 0, 0xFF))
+	case ".upval":
+		self.checkArgs(name, args, 3, 3)
+		proto.UpvalueNames = append(proto.UpvalueNames, args[0])
+		proto.Upvalues = append(proto.Upvalues, binchunk.Upvalue{
+			Instack: byte(self.parseInt(args[1], 0, 1)),
+			Idx:     byte(self.parseInt(args[2], 0, 0xFF)),
+		})
+	case ".const":
+		self.checkArgs(name, args, 1, 1)
+		proto.Constants = append(proto.Constants, self.parseConst(args[0]))
+	case ".local":
+		self.checkArgs(name, args, 3, 3)
+		fs.locals = append(fs.locals, localRef{len(proto.LocVars), args[1], args[2], self.line})
+		proto.LocVars = append(proto.LocVars, binchunk.LocVar{VarName: args[0]})
+	default:
+		self.error("unknown directive '%s'", name)
+	}
+}
+
+func (self *assembler) checkArgs(name string, args []string, min, max int) {
+	if len(args) < min || len(args) > max {
+		self.error("wrong number of arguments to '%s'", name)
+	}
+}
+
+// parseFuncHeader: 解析luac列表中的函数头<source:linedefined,lastlinedefined>
+func (self *assembler) parseFuncHeader(proto *binchunk.Prototype, header string) {
+	if !strings.HasPrefix(header, "<") || !strings.HasSuffix(header, ">") {
+		self.error("bad function header '%s'", header)
+	}
+	header = header[1 : len(header)-1]
+	colon := strings.LastIndexByte(header, ':')
+	lines := strings.Split(header[colon+1:], ",")
+	if len(lines) != 2 {
+		self.error("bad function header '<%s>'", header)
+	}
+	if colon > 0 {
+		proto.Source = header[:colon]
+	}
+	proto.LineDefined = uint32(self.parseInt(lines[0], 0, 1<<31-1))
+	proto.LastLineDefined = uint32(self.parseInt(lines[1], 0, 1<<31-1))
+}
+
+// parseConst: 解析常量，字符串的写法和转义与Lua源代码相同
+func (self *assembler) parseConst(s string) interface{} {
+	switch s {
+	case "nil":
+		return nil
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	if s[0] == '"' || s[0] == '\'' {
+		return self.parseString(s)
+	}
+	if i, ok := number.ParseInteger(s); ok {
+		return i
+	}
+	if f, ok := number.ParseFloat(s); ok {
+		return f
+	}
+	self.error("bad constant '%s'", s)
+	return nil
+}
+
+// parseString: 用Lexer解析带引号的字符串，Lexer报告的位置是在s中的位置，改为汇编源代码中的行号
+func (self *assembler) parseString(s string) (str string) {
+	defer func() {
+		if r := recover(); r != nil {
+			d, ok := r.(*lexer.Diagnostic)
+			if !ok {
+				panic(r)
+			}
+			self.error("%s", d.Msg())
+		}
+	}()
+
+	_, kind, str := lexer.NewLexer(s, self.chunkName).NextToken()
+	if kind != lexer.TOKEN_STRING {
+		self.error("bad string constant %s", s)
+	}
+	return str
+}
+
+/* instructions */
+
+// parseInst: 解析一条指令，可以带luac列表中的序号和[行号]
+func (self *assembler) parseInst(fields []string) {
+	fs := self.fs
+	if _, err := strconv.Atoi(fields[0]); err == nil && len(fields) > 1 { /* index from luac listing */
+		fields = fields[1:]
+	}
+	line := len(fs.lines)
+	if strings.HasPrefix(fields[0], "[") && strings.HasSuffix(fields[0], "]") {
+		fs.hasLines = true
+		fs.lines = append(fs.lines, uint32(self.parseInt(fields[0][1:len(fields[0])-1], 0, 1<<31-1)))
+		fields = fields[1:]
+	} else if line > 0 {
+		fs.lines = append(fs.lines, fs.lines[line-1])
+	} else {
+		fs.lines = append(fs.lines, fs.proto.LineDefined)
+	}
+	if len(fields) == 0 {
+		self.error("missing opcode")
+	}
+
+	op, ok := vm.OpcodeByName(fields[0])
+	if !ok {
+		self.error("unknown opcode '%s'", fields[0])
+	}
+	args := fields[1:]
+	i := vm.Instruction(op)
+	var inst uint32
+	switch i.OpMode() {
+	case vm.IABC:
+		self.checkOperands(fields[0], args, 1+countArgs(i.BMode(), i.CMode()))
+		a := self.parseInt(args[0], 0, 0xFF)
+		b, c := 0, 0
+		args = args[1:]
+		if i.BMode() != vm.OpArgN {
+			b = self.parseRK(args[0])
+			args = args[1:]
+		}
+		if i.CMode() != vm.OpArgN {
+			c = self.parseRK(args[0])
+		}
+		inst = uint32(b<<23 | c<<14 | a<<6 | op)
+	case vm.IABx:
+		self.checkOperands(fields[0], args, 1+countArgs(i.BMode()))
+		a := self.parseInt(args[0], 0, 0xFF)
+		bx := 0
+		if i.BMode() == vm.OpArgK {
+			bx = -1 - self.parseInt(args[1], -1-vm.MAXARG_Bx, -1)
+		} else if i.BMode() == vm.OpArgU {
+			bx = self.parseInt(args[1], 0, vm.MAXARG_Bx)
+		}
+		inst = uint32(bx<<14 | a<<6 | op)
+	case vm.IAsBx:
+		self.checkOperands(fields[0], args, 2)
+		a := self.parseInt(args[0], 0, 0xFF)
+		sBx := 0
+		if isName(args[1]) {
+			fs.jumps = append(fs.jumps, labelRef{len(fs.proto.Code), args[1], self.line})
+		} else {
+			sBx = self.parseInt(args[1], -vm.MAXARG_sBx, vm.MAXARG_Bx-vm.MAXARG_sBx)
+		}
+		inst = uint32((sBx+vm.MAXARG_sBx)<<14 | a<<6 | op)
+	case vm.IAx:
+		self.checkOperands(fields[0], args, 1)
+		ax := self.parseInt(args[0], -1<<26, 1<<26-1)
+		if ax < 0 {
+			ax = -1 - ax
+		}
+		inst = uint32(ax<<6 | op)
+	}
+	fs.proto.Code = append(fs.proto.Code, inst)
+}
+
+func (self *assembler) checkOperands(name string, args []string, n int) {
+	if len(args) != n {
+		self.error("%s expects %d operands", strings.ToUpper(name), n)
+	}
+}
+
+// parseRK: 解析B或C，负数表示常量-1-索引
+func (self *assembler) parseRK(s string) int {
+	if n := self.parseInt(s, -1-0xFF, 0x1FF); n < 0 {
+		return 0x100 | (-1 - n)
+	} else {
+		return n
+	}
+}
+
+func (self *assembler) parseInt(s string, min, max int) int {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		self.error("bad number '%s'", s)
+	}
+	if n < min || n > max {
+		self.error("%d out of range [%d, %d]", n, min, max)
+	}
+	return n
+}
+
+// finish: 解析完一个函数后确定标签跳转的偏移、局部变量的范围和行号表
+func (self *assembler) finish(fs *funcState) {
+	proto := fs.proto
+	for _, ref := range fs.jumps {
+		self.line = ref.line
+		target := self.labelPC(fs, ref.label)
+		sBx := target - (ref.pc + 1)
+		i := vm.Instruction(proto.Code[ref.pc])
+		a, _ := i.ABx()
+		proto.Code[ref.pc] = uint32((sBx+vm.MAXARG_sBx)<<14 | a<<6 | i.Opcode())
+	}
+	for _, ref := range fs.locals {
+		self.line = ref.line
+		proto.LocVars[ref.idx].StartPC = uint32(self.localPC(fs, ref.start))
+		proto.LocVars[ref.idx].EndPC = uint32(self.localPC(fs, ref.end))
+	}
+	if fs.hasLines {
+		proto.LineInfo = fs.lines
+	}
+}
+
+func (self *assembler) labelPC(fs *funcState, label string) int {
+	pc, found := fs.labels[label]
+	if !found {
+		self.error("undefined label '%s'", label)
+	}
+	return pc
+}
+
+// localPC: 局部变量范围的端点，数字是luac列表中从1开始的序号
+func (self *assembler) localPC(fs *funcState, s string) int {
+	if isName(s) {
+		return self.labelPC(fs, s)
+	}
+	return self.parseInt(s, 1, len(fs.proto.Code)+1) - 1
+}
+
+func countArgs(modes ...byte) int {
+	n := 0
+	for _, mode := range modes {
+		if mode != vm.OpArgN {
+			n++
+		}
+	}
+	return n
+}
+
+func isName(s string) bool {
+	if s == "" || s[0] >= '0' && s[0] <= '9' {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c != '_' && !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,199 @@
+package asm_test
+
+import (
+	"strings"
+	"testing"
+
+	. "luago/api"
+	"luago/binchunk"
+	"luago/compiler/asm"
+	"luago/state"
+)
+
+// run: 汇编src，Dump成二进制chunk后Load并执行，返回所有结果用','连接的字符串
+func run(t *testing.T, src string) (string, error) {
+	t.Helper()
+	proto, err := asm.Assemble(src, "=asm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ls := state.NewState()
+	if ls.Load(binchunk.Dump(proto, false), "=asm", "b") != LUA_OK {
+		return "", NewLuaError(ls, LUA_ERRSYNTAX)
+	}
+	if status := ls.PCall(0, LUA_MULTRET, 0); status != LUA_OK {
+		return "", NewLuaError(ls, status)
+	}
+	var results []string
+	for i, n := 1, ls.GetTop(); i <= n; i++ {
+		results = append(results, ls.ToString2(i))
+	}
+	return strings.Join(results, ","), nil
+}
+
+func TestAssembleAndRun(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"basic", `
+.upval _ENV 1 0
+.const "_VERSION"
+.const 'x=%d; y\t'   ; string with separators
+.const 41
+.const 2.5
+.slots 4
+	1 [1] GETTABUP 0 0 -1 ; copied from a luac listing
+	LOADK 1 -2
+	LOADK 2 -3
+	ADD 2 2 -4
+	RETURN 0 4
+`, "Lua 5.3,x=%d; y\t,43.5"},
+		{"loop", `
+.slots 5
+.const 1
+.const 10
+.local sum 2 done
+	LOADK 0 -1         ; sum = 1
+	LOADK 1 -1
+	LOADK 2 -2
+	LOADK 3 -1
+	FORPREP 1 check
+body:
+	ADD 0 0 4
+check:
+	FORLOOP 1 body
+done:
+	RETURN 0 2
+`, "56"},
+		{"closure", `
+.slots 3
+.const 7
+	LOADK 0 -1
+	CLOSURE 1 0
+	MOVE 2 1
+	CALL 2 1 2
+	CALL 1 1 2
+	RETURN 1 3
+.function <asm:3,5>
+.upval n 1 0
+.slots 2
+	GETUPVAL 0 0
+	ADD 0 0 -1
+	SETUPVAL 0 0
+	RETURN 0 2
+.const 1
+.end
+`, "9,8"},
+		{"loadkx", `
+.const "big"
+	LOADKX 0
+	EXTRAARG -1
+	RETURN 0 2
+`, "big"},
+		{"vararg", `
+.params 1+
+.slots 4
+	VARARG 1 0
+	RETURN 0 0
+`, "nil"},
+		{"constants", `
+.const nil
+.const true
+.const 0x10
+.const 1e2
+.const "a\65\u{42}\z   c"
+.slots 5
+	LOADK 0 -1
+	LOADK 1 -2
+	LOADK 2 -3
+	LOADK 3 -4
+	LOADK 4 -5
+	RETURN 0 6
+`, "nil,true,16,100.0,aABc"},
+		/* Load给主函数的每个upvalue一个新的值为nil的upvalue，第一个是_ENV */
+		{"main upvalues", `
+.upval _ENV 1 0
+.upval x 1 1
+.const 7
+.slots 3
+	GETUPVAL 0 1       ; nil before the first assignment
+	LOADK 1 -1
+	SETUPVAL 1 1
+	GETUPVAL 2 1
+	RETURN 0 4
+`, "nil,7,7"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := run(t, tt.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"line info", `
+.upval _ENV 1 0
+.const "nope"
+	[7] GETTABUP 0 0 -1
+	[8] CALL 0 1 1
+	RETURN 0 1
+`, "asm:8: attempt to call a nil value (global 'nope')"},
+		{"verify", "MOVE 5 0\nRETURN 0 1", "register 5 out of range"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := run(t, tt.src)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestAssembleErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"opcode", "\n  FOO 1 2", "=asm:2: unknown opcode 'FOO'"},
+		{"operands", "MOVE 1", "=asm:1: MOVE expects 2 operands"},
+		{"undefined label", "JMP 0 nowhere\nRETURN 0 1", "=asm:1: undefined label 'nowhere'"},
+		{"duplicate label", "a: MOVE 0 1\na: RETURN 0 1", "=asm:2: label 'a' already defined"},
+		{"bad label", "1a: RETURN 0 1", "=asm:1: bad label '1a'"},
+		{"end", ".end", "=asm:1: '.end' without '.function'"},
+		{"function", "\n.function\nRETURN 0 1", "=asm:2: '.function' without '.end'"},
+		{"header", ".function asm:1\n.end", "=asm:1: bad function header 'asm:1'"},
+		{"directive", ".bogus", "=asm:1: unknown directive '.bogus'"},
+		{"arguments", ".slots", "=asm:1: wrong number of arguments to '.slots'"},
+		{"constant", ".const foo", "=asm:1: bad constant 'foo'"},
+		{"unfinished string", `.const "abc`, "=asm:1: unfinished string"},
+		/* 字符串常量中的词法错误报告在汇编源代码中的行号 */
+		{"escape", "RETURN 0 1\n\n.const \"a\\q\"", "=asm:3: invalid escape sequence near '\\q'"},
+		{"number", "MOVE x 1", "=asm:1: bad number 'x'"},
+		{"range", "LOADK 0 3", "=asm:1: 3 out of range [-262144, -1]"},
+		{"register", "MOVE 256 0", "=asm:1: 256 out of range [0, 255]"},
+		{"local", ".local x 1 9\nRETURN 0 1", "=asm:1: 9 out of range [1, 2]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := asm.Assemble(tt.src, "=asm")
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("got %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
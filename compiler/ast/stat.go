@@ -4,12 +4,24 @@ type Stat interface {
 }
 
 // 简单语句
-type EmptyStat struct{}              // `;`	无任何语义 分割作用
-type BreakStat struct{ Line int }    // break 跳转指令，记录行号
-type LabelStat struct{ Name string } // `::` Name `::`
-type GotoStat struct{ Name string }  // goto Name
-type DoStat struct{ Block *Block }   // do Block end
-type FuncCallStat = FuncCallExp      // function call
+type EmptyStat struct{}            // `;`	无任何语义 分割作用
+type BreakStat struct{ Line int }  // break 跳转指令，记录行号
+type DoStat struct{ Block *Block } // do Block end
+type FuncCallStat = FuncCallExp    // function call
+
+// `::` Name `::`，Line和Column是第一个`::`的位置
+type LabelStat struct {
+	Line   int
+	Column int
+	Name   string
+}
+
+// goto Name，Line和Column是goto的位置
+type GotoStat struct {
+	Line   int
+	Column int
+	Name   string
+}
 
 // 循环语句
 // while exp do block end
@@ -55,13 +67,15 @@ type ForInStat struct {
 }
 
 // 局部变量声明语句
-// local namelist ['=' explist]
-// namelist :: = Name{',' Name}
+// local attnamelist ['=' explist]
+// attnamelist ::= Name attrib {',' Name attrib}
+// attrib ::= ['<' Name '>']
 // explist :: = exp{',' exp}
 type LocalVarDeclStat struct {
-	LastLine int
-	NameList []string
-	ExpList  []Exp
+	LastLine   int
+	NameList   []string
+	ExpList    []Exp
+	AttribList []string // 变量的属性："const"、"close"，没有属性时为""；全部没有属性时可以为nil
 }
 
 // 赋值语句
@@ -7,14 +7,14 @@ func cgBlock(fi *funcInfo, node *Block) {
 		cgStat(fi, stat)
 	}
 	if node.RetExps != nil {
-		cgRetStat(fi, node.RetExps)
+		cgRetStat(fi, node.RetExps, node.LastLine)
 	}
 }
 
-func cgRetStat(fi *funcInfo, exps []Exp) {
+func cgRetStat(fi *funcInfo, exps []Exp, lastLine int) {
 	nExps := len(exps)
 	if nExps == 0 {
-		fi.emitReturn(0, 0)
+		fi.emitReturn(lastLine, 0, 0)
 		return
 	}
 
@@ -22,15 +22,16 @@ func cgRetStat(fi *funcInfo, exps []Exp) {
 	if nExps == 1 {
 		if nameExp, ok := exps[0].(*NameExp); ok {
 			if r := fi.slotOfLocVar(nameExp.Name); r >= 0 {
-				fi.emitReturn(r, 1)
+				fi.emitReturn(lastLine, r, 1)
 				return
 			}
 		}
-		if fcExp, ok := exps[0].(*FuncCallExp); ok {
+		// 有<close>变量时不能尾调用，调用返回后还要关闭这些变量
+		if fcExp, ok := exps[0].(*FuncCallExp); ok && !fi.hasTbcVars() {
 			r := fi.allocReg()
 			cgTailCallExp(fi, fcExp, r)
 			fi.freeReg()
-			fi.emitReturn(r, -1)
+			fi.emitReturn(lastLine, r, -1)
 			return
 		}
 	}
@@ -48,8 +49,8 @@ func cgRetStat(fi *funcInfo, exps []Exp) {
 
 	a := fi.usedRegs
 	if multRet {
-		fi.emitReturn(a, -1)
+		fi.emitReturn(lastLine, a, -1)
 	} else {
-		fi.emitReturn(a, nExps)
+		fi.emitReturn(lastLine, a, nExps)
 	}
 }
@@ -6,19 +6,22 @@ import . "luago/vm"
 
 // todo: rename to evalExp()?
 func cgExp(fi *funcInfo, node Exp, a, n int) {
+	if line := lineOf(node); line > 0 {
+		fi.nodeLine = line
+	}
 	switch exp := node.(type) {
 	case *NilExp:
-		fi.emitLoadNil(a, n)
+		fi.emitLoadNil(exp.Line, a, n)
 	case *FalseExp:
-		fi.emitLoadBool(a, 0, 0)
+		fi.emitLoadBool(exp.Line, a, 0, 0)
 	case *TrueExp:
-		fi.emitLoadBool(a, 1, 0)
+		fi.emitLoadBool(exp.Line, a, 1, 0)
 	case *IntegerExp:
-		fi.emitLoadK(a, exp.Val)
+		fi.emitLoadK(exp.Line, a, exp.Val)
 	case *FloatExp:
-		fi.emitLoadK(a, exp.Val)
+		fi.emitLoadK(exp.Line, a, exp.Val)
 	case *StringExp:
-		fi.emitLoadK(a, exp.Str)
+		fi.emitLoadK(exp.Line, a, exp.Str)
 	case *ParensExp:
 		cgExp(fi, exp.Exp, a, 1)
 	case *VarargExp:
@@ -45,9 +48,10 @@ func cgExp(fi *funcInfo, node Exp, a, n int) {
 // 变长参数表达式
 func cgVarargExp(fi *funcInfo, node *VarargExp, a, n int) {
 	if !fi.isVararg {
-		panic("cannot use '...' outside a vararg function")
+		fi.error(node.Line, "cannot use '...' outside a vararg function")
 	}
-	fi.emitVararg(a, n)
+	fi.needsArg = false /* 5.1: function uses '...' instead of 'arg' */
+	fi.emitVararg(node.Line, a, n)
 }
 
 // 函数定义表达式
@@ -58,12 +62,16 @@ func cgFuncDefExp(fi *funcInfo, node *FuncDefExp, a int) {
 	for _, param := range node.ParList {
 		subFI.addLocVar(param)
 	}
+	if subFI.compatArg && subFI.isVararg && fi.parent != nil { /* not the main function? */
+		subFI.addLocVar("arg") /* 5.1: local 'arg' follows the fixed parameters */
+		subFI.needsArg = true
+	}
 	cgBlock(subFI, node.Block)
 	subFI.exitScope()
-	subFI.emitReturn(0, 0)
+	subFI.emitReturn(node.LastLine, 0, 0)
 
 	bx := len(fi.subFuncs) - 1
-	fi.emitClosure(a, bx)
+	fi.emitClosure(node.LastLine, a, bx)
 }
 
 // 表构造表达式
@@ -77,7 +85,7 @@ func cgTableConstructorExp(fi *funcInfo, node *TableConstructorExp, a int) {
 	nExps := len(node.KeyExps)
 	multRet := nExps > 0 && isVarargOrFuncCall(node.ValExps[nExps-1])
 
-	fi.emitNewTable(a, nArr, nExps-nArr)
+	fi.emitNewTable(node.Line, a, nArr, nExps-nArr)
 
 	arrIdx := 0
 	for i, keyExp := range node.KeyExps {
@@ -98,10 +106,11 @@ func cgTableConstructorExp(fi *funcInfo, node *TableConstructorExp, a int) {
 				}
 				c := (arrIdx-1)/50 + 1
 				fi.freeRegs(n)
+				line := lastLineOf(valExp)
 				if i == nExps-1 && multRet {
-					fi.emitSetList(a, 0, c)
+					fi.emitSetList(line, a, 0, c)
 				} else {
-					fi.emitSetList(a, n, c)
+					fi.emitSetList(line, a, n, c)
 				}
 			}
 			continue
@@ -111,7 +120,7 @@ func cgTableConstructorExp(fi *funcInfo, node *TableConstructorExp, a int) {
 		c := fi.allocReg()
 		cgExp(fi, valExp, c, 1)
 		fi.freeRegs(2)
-		fi.emitSetTable(a, b, c)
+		fi.emitSetTable(lineOf(valExp), a, b, c)
 	}
 }
 
@@ -120,7 +129,7 @@ func cgTableConstructorExp(fi *funcInfo, node *TableConstructorExp, a int) {
 func cgUnopExp(fi *funcInfo, node *UnopExp, a int) {
 	b := fi.allocReg()
 	cgExp(fi, node.Exp, b, 1)
-	fi.emitUnaryOp(node.Op, a, b)
+	fi.emitUnaryOp(node.Line, node.Op, a, b)
 	fi.freeReg()
 }
 
@@ -134,7 +143,7 @@ func cgConcatExp(fi *funcInfo, node *ConcatExp, a int) {
 	c := fi.usedRegs - 1
 	b := c - len(node.Exps) + 1
 	fi.freeRegs(c - b + 1)
-	fi.emitABC(OP_CONCAT, a, b, c)
+	fi.emitABC(node.Line, OP_CONCAT, a, b, c)
 }
 
 // 逻辑运算
@@ -146,64 +155,86 @@ func cgBinopExp(fi *funcInfo, node *BinopExp, a int) {
 		cgExp(fi, node.Exp1, b, 1)
 		fi.freeReg()
 		if node.Op == TOKEN_OP_AND {
-			fi.emitTestSet(a, b, 0)
+			fi.emitTestSet(node.Line, a, b, 0)
 		} else {
-			fi.emitTestSet(a, b, 1)
+			fi.emitTestSet(node.Line, a, b, 1)
 		}
-		pcOfJmp := fi.emitJmp(0, 0)
+		pcOfJmp := fi.emitJmp(node.Line, 0, 0)
 
 		b = fi.allocReg()
 		cgExp(fi, node.Exp2, b, 1)
-		fi.emitMove(a, b)
+		fi.emitMove(node.Line, a, b)
 		fi.fixSbx(pcOfJmp, fi.pc()-pcOfJmp)
 	default:
 		b := fi.allocReg()
 		cgExp(fi, node.Exp1, b, 1)
 		c := fi.allocReg()
 		cgExp(fi, node.Exp2, c, 1)
-		fi.emitBinaryOp(node.Op, a, b, c)
+		fi.emitBinaryOp(node.Line, node.Op, a, b, c)
 		fi.freeRegs(2)
 	}
 }
 
 // 名字访问表达式
 func cgNameExp(fi *funcInfo, node *NameExp, a int) {
-	if r := fi.slotOfLocVar(node.Name); r >= 0 {
+	if exp := fi.constOfVar(node.Name); exp != nil {
+		// 编译期常量
+		cgConstExp(fi, exp, a, node.Line)
+	} else if r := fi.slotOfLocVar(node.Name); r >= 0 {
 		// 访问局部变量 move即可
-		fi.emitMove(a, r)
+		fi.emitMove(node.Line, a, r)
 	} else if idx := fi.indexOfUpval(node.Name); idx >= 0 {
 		// 访问的是Upval
-		fi.emitGetUpval(a, idx)
+		fi.emitGetUpval(node.Line, a, idx)
 	} else {
 		// 访问的是全局变量
 		taExp := &TableAccessExp{
-			PrefixExp: &NameExp{0, "_ENV"},
-			KeyExp:    &StringExp{0, node.Name},
+			LastLine:  node.Line,
+			PrefixExp: &NameExp{node.Line, "_ENV"},
+			KeyExp:    &StringExp{node.Line, node.Name},
 		}
 		cgTableAccessExp(fi, taExp, a)
 	}
 }
 
+// cgConstExp: 在引用编译期常量的地方直接加载它的值，行号使用引用处的行号
+func cgConstExp(fi *funcInfo, exp Exp, a, line int) {
+	switch x := exp.(type) {
+	case *NilExp:
+		fi.emitLoadNil(line, a, 1)
+	case *FalseExp:
+		fi.emitLoadBool(line, a, 0, 0)
+	case *TrueExp:
+		fi.emitLoadBool(line, a, 1, 0)
+	case *IntegerExp:
+		fi.emitLoadK(line, a, x.Val)
+	case *FloatExp:
+		fi.emitLoadK(line, a, x.Val)
+	case *StringExp:
+		fi.emitLoadK(line, a, x.Str)
+	}
+}
+
 // 表访问表达式
 func cgTableAccessExp(fi *funcInfo, node *TableAccessExp, a int) {
 	b := fi.allocReg()
 	cgExp(fi, node.PrefixExp, b, 1)
 	c := fi.allocReg()
 	cgExp(fi, node.KeyExp, c, 1)
-	fi.emitGetTable(a, b, c)
+	fi.emitGetTable(node.LastLine, a, b, c)
 	fi.freeRegs(2)
 }
 
 // 函数调用表达式
 func cgFuncCallExp(fi *funcInfo, node *FuncCallExp, a, n int) {
 	nArgs := prepFuncCall(fi, node, a)
-	fi.emitCall(a, nArgs, n)
+	fi.emitCall(node.Line, a, nArgs, n)
 }
 
 // return f(args)
 func cgTailCallExp(fi *funcInfo, node *FuncCallExp, a int) {
 	nArgs := prepFuncCall(fi, node, a)
-	fi.emitTailCall(a, nArgs)
+	fi.emitTailCall(node.Line, a, nArgs)
 }
 
 // TODO:函数调用结合self和call指令来理解
@@ -213,8 +244,12 @@ func prepFuncCall(fi *funcInfo, node *FuncCallExp, a int) int {
 
 	cgExp(fi, node.PrefixExp, a, 1)
 	if node.NameExp != nil {
-		c := 0x100 + fi.indexOfConstant(node.NameExp.Str)
-		fi.emitSelf(a, a, c)
+		fi.allocReg() // self放在r[a+1]，参数从r[a+2]开始
+		c, tmp := fi.constantRK(node.Line, node.NameExp.Str)
+		fi.emitSelf(node.Line, a, a, c)
+		if tmp {
+			fi.freeReg()
+		}
 	}
 	for i, arg := range node.Args {
 		tmp := fi.allocReg()
@@ -228,6 +263,7 @@ func prepFuncCall(fi *funcInfo, node *FuncCallExp, a int) int {
 	fi.freeRegs(nArgs)
 
 	if node.NameExp != nil {
+		fi.freeReg()
 		nArgs++
 	}
 	if lastArgIsVarargorFuncCall {
@@ -3,6 +3,9 @@ package codegen
 import . "luago/compiler/ast"
 
 func cgStat(fi *funcInfo, node Stat) {
+	if line := lineOfStat(node); line > 0 {
+		fi.nodeLine = line
+	}
 	switch stat := node.(type) {
 	case *FuncCallStat:
 		cgFuncCallStat(fi, stat)
@@ -26,9 +29,35 @@ func cgStat(fi *funcInfo, node Stat) {
 		cgLocalVarDeclStat(fi, stat)
 	case *LocalFuncDefStat:
 		cgLocalFuncDefStat(fi, stat)
-	case *LabelStat, *GotoStat:
+	case *LabelStat:
 		// TODO: Support it!
-		panic("label and goto statements are not supported!")
+		fi.errorAt(stat.Line, stat.Column, "::", "label and goto statements are not supported!")
+	case *GotoStat:
+		fi.errorAt(stat.Line, stat.Column, "goto", "label and goto statements are not supported!")
+	}
+}
+
+// lineOfStat: 语句中记录的行号，没有记录行号的语句返回0，由其中的表达式提供行号
+func lineOfStat(stat Stat) int {
+	switch x := stat.(type) {
+	case *BreakStat:
+		return x.Line
+	case *LabelStat:
+		return x.Line
+	case *GotoStat:
+		return x.Line
+	case *FuncCallStat:
+		return x.Line
+	case *ForNumStat:
+		return x.LineOfFor
+	case *ForInStat:
+		return x.LineOfDo
+	case *LocalVarDeclStat:
+		return x.LastLine
+	case *LocalFuncDefStat:
+		return x.Exp.Line
+	default:
+		return 0
 	}
 }
 
@@ -44,14 +73,14 @@ func cgFuncCallStat(fi *funcInfo, node *FuncCallStat) {
 }
 
 func cgBreakStat(fi *funcInfo, node *BreakStat) {
-	pc := fi.emitJmp(0, 0)
+	pc := fi.emitJmp(node.Line, 0, 0)
 	fi.addBreakJmp(pc)
 }
 
 func cgDoStat(fi *funcInfo, node *DoStat) {
 	fi.enterScope(false)
 	cgBlock(fi, node.Block)
-	fi.closeOpenUpvals()
+	fi.closeOpenUpvals(node.Block.LastLine)
 	fi.exitScope()
 }
 
@@ -70,14 +99,17 @@ func cgWhileStat(fi *funcInfo, node *WhileStat) {
 	// 第二步：分配寄存器，生成表达式，表达式求值
 	r := fi.allocReg()
 	cgExp(fi, node.Exp, r, 1)
+	fi.freeReg()
 	// 第三步：生成test和jump指令用于跳转
-	fi.emitTest(r, 0)
-	pcJmpToEnd := fi.emitJmp(0, 0)
+	line := lastLineOf(node.Exp)
+	fi.emitTest(line, r, 0)
+	pcJmpToEnd := fi.emitJmp(line, 0, 0)
 	// 第四步：进入循环体，参数用可break
 	fi.enterScope(true)
 	cgBlock(fi, node.Block)
-	fi.closeOpenUpvals()
-	fi.emitJmp(0, pcBeforeExp-fi.pc()-1) // 生成jmp指令跳转到最开始
+	fi.closeOpenUpvals(node.Block.LastLine)
+	fi.emitJmp(node.Block.LastLine, 0, pcBeforeExp-fi.pc()-1) // 生成jmp指令跳转到最开始
+	fi.exitScope() // 离开作用域时回填break对应的跳转
 	// 第五步：还原修复第一条jmp指令的偏移量
 	fi.fixSbx(pcJmpToEnd, fi.pc()-pcJmpToEnd)
 }
@@ -98,9 +130,10 @@ func cgRepeatStat(fi *funcInfo, node *RepeatStat) {
 	cgExp(fi, node.Exp, r, 1)
 	fi.freeReg()
 
-	fi.emitTest(r, 0)
-	fi.emitJmp(fi.getJmpArgA(), pcBeforeBlock-fi.pc()-1)
-	fi.closeOpenUpvals()
+	line := lastLineOf(node.Exp)
+	fi.emitTest(line, r, 0)
+	fi.emitJmp(line, fi.getJmpArgA(), pcBeforeBlock-fi.pc()-1)
+	fi.closeOpenUpvals(line)
 
 	fi.exitScope()
 }
@@ -116,16 +149,18 @@ func cgIfStat(fi *funcInfo, node *IfStat) {
 		r := fi.allocReg()
 		cgExp(fi, exp, r, 1)
 		fi.freeReg()
-		fi.emitTest(r, 0)
-		pcJmpToNextExp = fi.emitJmp(0, 0)
+		line := lastLineOf(exp)
+		fi.emitTest(line, r, 0)
+		pcJmpToNextExp = fi.emitJmp(line, 0, 0)
 
+		block := node.Blocks[i]
 		fi.enterScope(false)
-		cgBlock(fi, node.Blocks[i])
-		fi.closeOpenUpvals()
+		cgBlock(fi, block)
+		fi.closeOpenUpvals(block.LastLine)
 		fi.exitScope()
 
 		if i < len(node.Exps)-1 {
-			pcJmpToEnds[i] = fi.emitJmp(0, 0)
+			pcJmpToEnds[i] = fi.emitJmp(block.LastLine, 0, 0)
 		} else {
 			pcJmpToEnds[i] = pcJmpToNextExp
 		}
@@ -140,16 +175,17 @@ func cgForNumStat(fi *funcInfo, node *ForNumStat) {
 	fi.enterScope(true)
 	// 第一步 声明三个局部变量
 	cgLocalVarDeclStat(fi, &LocalVarDeclStat{
+		LastLine: node.LineOfFor,
 		NameList: []string{"(for index)", "(for limit)", "(for step)"},
 		ExpList:  []Exp{node.InitExp, node.LimitExp, node.StepExp},
 	})
 	fi.addLocVar(node.VarName)
 	// 第二步：生成forprep指令
 	a := fi.usedRegs - 4
-	pcForPrep := fi.emitForPrep(a, 0)
+	pcForPrep := fi.emitForPrep(node.LineOfDo, a, 0)
 	cgBlock(fi, node.Block)
-	fi.closeOpenUpvals()
-	pcForLoop := fi.emitForLoop(a, 0)
+	fi.closeOpenUpvals(node.Block.LastLine)
+	pcForLoop := fi.emitForLoop(node.LineOfFor, a, 0)
 	// 第三步 偏移复原
 	fi.fixSbx(pcForPrep, pcForLoop-pcForPrep-1)
 	fi.fixSbx(pcForLoop, pcForPrep-pcForLoop)
@@ -161,6 +197,7 @@ func cgForInStat(fi *funcInfo, node *ForInStat) {
 	fi.enterScope(true)
 	// 第一步 声明局部变量
 	cgLocalVarDeclStat(fi, &LocalVarDeclStat{
+		LastLine: node.LineOfDo,
 		NameList: []string{"(for generator)", "(for state)", "(for control)"},
 		ExpList:  node.ExpList,
 	})
@@ -168,20 +205,37 @@ func cgForInStat(fi *funcInfo, node *ForInStat) {
 		fi.addLocVar(name)
 	}
 	// 第二步
-	pcJmpToTFC := fi.emitJmp(0, 0)
+	pcJmpToTFC := fi.emitJmp(node.LineOfDo, 0, 0)
 	cgBlock(fi, node.Block)
-	fi.closeOpenUpvals()
+	fi.closeOpenUpvals(node.Block.LastLine)
 	fi.fixSbx(pcJmpToTFC, fi.pc()-pcJmpToTFC)
 	// 第三步
 	rGenerator := fi.slotOfLocVar("(for generator)")
-	fi.emitTForCall(rGenerator, len(node.NameList))
-	fi.emitTForLoop(rGenerator+2, pcJmpToTFC-fi.pc()-1)
+	line := lineOf(node.ExpList[0])
+	fi.emitTForCall(line, rGenerator, len(node.NameList))
+	fi.emitTForLoop(line, rGenerator+2, pcJmpToTFC-fi.pc()-1)
 
 	fi.exitScope()
 }
 
 // TODO:以下两段代码仔细读下，针对可变参数和参数是函数调用的处理
 func cgLocalVarDeclStat(fi *funcInfo, node *LocalVarDeclStat) {
+	if n := len(node.NameList); n > 0 && n == len(node.ExpList) &&
+		attribOf(node, n-1) == "const" && isLiteralExp(node.ExpList[n-1]) {
+		// 和Lua 5.4一样，只有最后一个变量可以成为编译期常量，其余变量照常声明
+		rest := &LocalVarDeclStat{
+			LastLine: node.LastLine,
+			NameList: node.NameList[:n-1],
+			ExpList:  node.ExpList[:n-1],
+		}
+		if node.AttribList != nil {
+			rest.AttribList = node.AttribList[:n-1]
+		}
+		cgLocalVarDeclStat(fi, rest)
+		fi.addConstVar(node.NameList[n-1], node.ExpList[n-1])
+		return
+	}
+
 	exps := removeTailNils(node.ExpList)
 	nExps := len(exps)
 	nNames := len(node.NameList)
@@ -218,13 +272,30 @@ func cgLocalVarDeclStat(fi *funcInfo, node *LocalVarDeclStat) {
 		if !multRet {
 			n := nNames - nExps
 			a := fi.allocRegs(n)
-			fi.emitLoadNil(a, n)
+			fi.emitLoadNil(node.LastLine, a, n)
 		}
 	}
 	fi.usedRegs = oldRegs
-	for _, name := range node.NameList {
-		fi.addLocVar(name)
+	for i, name := range node.NameList {
+		a := fi.addLocVar(name)
+		switch attribOf(node, i) {
+		case "const":
+			fi.locNames[name].isConst = true
+		case "close":
+			locVar := fi.locNames[name]
+			locVar.isConst = true
+			locVar.tbc = true
+			fi.emitTbc(node.LastLine, a)
+		}
+	}
+}
+
+// attribOf: 第i个变量的属性
+func attribOf(node *LocalVarDeclStat, i int) string {
+	if i < len(node.AttribList) {
+		return node.AttribList[i]
 	}
+	return ""
 }
 
 func cgAssignStat(fi *funcInfo, node *AssignStat) {
@@ -275,27 +346,31 @@ func cgAssignStat(fi *funcInfo, node *AssignStat) {
 		if !multRet {
 			n := nVars - nExps
 			a := fi.allocRegs(n)
-			fi.emitLoadNil(a, n)
+			fi.emitLoadNil(node.LastLine, a, n)
 		}
 	}
 	for i, exp := range node.VarList {
 		if nameExp, ok := exp.(*NameExp); ok {
 			varName := nameExp.Name
+			fi.checkAssign(varName)
 			if a := fi.slotOfLocVar(varName); a >= 0 {
 				// 局部变量赋值用move
-				fi.emitMove(a, vRegs[i])
+				fi.emitMove(node.LastLine, a, vRegs[i])
 			} else if b := fi.indexOfUpval(varName); b >= 0 {
 				// upvalue赋值
-				fi.emitSetUpval(vRegs[i], b)
+				fi.emitSetUpval(node.LastLine, vRegs[i], b)
 			} else {
 				// 给全局变量赋值
 				a := fi.indexOfUpval("_ENV")
-				b := 0x100 + fi.indexOfConstant(varName)
-				fi.emitSetTabUp(a, b, vRegs[i])
+				b, tmp := fi.constantRK(node.LastLine, varName)
+				fi.emitSetTabUp(node.LastLine, a, b, vRegs[i])
+				if tmp {
+					fi.freeReg()
+				}
 			}
 		} else {
 			// 访问表赋值
-			fi.emitSetTable(tRegs[i], kRegs[i], vRegs[i])
+			fi.emitSetTable(node.LastLine, tRegs[i], kRegs[i], vRegs[i])
 		}
 	}
 	fi.usedRegs = oldRegs //释放所有临时变量
@@ -5,9 +5,11 @@ import (
 	. "luago/compiler/ast"
 )
 
-func GenProto(chunk *Block) *Prototype {
+// GenProto: 生成主函数原型，compatArg为true时vararg函数带有Lua 5.1的局部变量arg
+func GenProto(chunk *Block, compatArg bool) *Prototype {
 	fd := &FuncDefExp{IsVararg: true, Block: chunk}
 	fi := newFuncInfo(nil, fd)
+	fi.compatArg = compatArg
 	fi.addLocVar("_ENV")
 	cgFuncDefExp(fi, fd, 0)
 	return toProto(fi.subFuncs[0])
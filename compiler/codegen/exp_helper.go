@@ -10,6 +10,15 @@ func isVarargOrFuncCall(exp Exp) bool {
 	return false
 }
 
+// isLiteralExp: 可以作为编译期常量的字面量
+func isLiteralExp(exp Exp) bool {
+	switch exp.(type) {
+	case *NilExp, *TrueExp, *FalseExp, *IntegerExp, *FloatExp, *StringExp:
+		return true
+	}
+	return false
+}
+
 func removeTailNils(exps []Exp) []Exp {
 	for n := len(exps) - 1; n >= 0; n-- {
 		if _, ok := exps[n].(*NilExp); !ok {
@@ -18,3 +27,83 @@ func removeTailNils(exps []Exp) []Exp {
 	}
 	return nil
 }
+
+// lineOf: 表达式开始处的行号，用于生成调试信息
+func lineOf(exp Exp) int {
+	switch x := exp.(type) {
+	case *NilExp:
+		return x.Line
+	case *TrueExp:
+		return x.Line
+	case *FalseExp:
+		return x.Line
+	case *IntegerExp:
+		return x.Line
+	case *FloatExp:
+		return x.Line
+	case *StringExp:
+		return x.Line
+	case *VarargExp:
+		return x.Line
+	case *NameExp:
+		return x.Line
+	case *FuncDefExp:
+		return x.Line
+	case *FuncCallExp:
+		return x.Line
+	case *TableConstructorExp:
+		return x.Line
+	case *UnopExp:
+		return x.Line
+	case *TableAccessExp:
+		return lineOf(x.PrefixExp)
+	case *ConcatExp:
+		return lineOf(x.Exps[0])
+	case *BinopExp:
+		return lineOf(x.Exp1)
+	case *ParensExp:
+		return lineOf(x.Exp)
+	default:
+		panic("unreachable!")
+	}
+}
+
+// lastLineOf: 表达式结束处的行号
+func lastLineOf(exp Exp) int {
+	switch x := exp.(type) {
+	case *NilExp:
+		return x.Line
+	case *TrueExp:
+		return x.Line
+	case *FalseExp:
+		return x.Line
+	case *IntegerExp:
+		return x.Line
+	case *FloatExp:
+		return x.Line
+	case *StringExp:
+		return x.Line
+	case *VarargExp:
+		return x.Line
+	case *NameExp:
+		return x.Line
+	case *FuncDefExp:
+		return x.LastLine
+	case *FuncCallExp:
+		return x.LastLine
+	case *TableConstructorExp:
+		return x.LastLine
+	case *TableAccessExp:
+		return x.LastLine
+	case *ConcatExp:
+		return lastLineOf(x.Exps[len(x.Exps)-1])
+	case *BinopExp:
+		return lastLineOf(x.Exp2)
+	case *UnopExp:
+		return lastLineOf(x.Exp)
+	case *ParensExp:
+		return lastLineOf(x.Exp)
+	default:
+		panic("unreachable!")
+	}
+}
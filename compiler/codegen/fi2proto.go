@@ -4,22 +4,27 @@ import . "luago/binchunk"
 
 func toProto(fi *funcInfo) *Prototype {
 	proto := &Prototype{
-		NumParams:    byte(fi.numParams),
-		MaxStackSize: byte(fi.maxRegs),
-		Code:         fi.insts,
-		Constants:    getConstants(fi),
-		Upvalues:     getUpvalues(fi),
-		Protos:       toProtos(fi.subFuncs),
-		LineInfo:     []uint32{},
-		LocVars:      []LocVar{},
-		UpvalueNames: []string{},
+		LineDefined:     uint32(fi.line),
+		LastLineDefined: uint32(fi.lastLine),
+		NumParams:       byte(fi.numParams),
+		MaxStackSize:    byte(fi.maxRegs),
+		Code:            fi.insts,
+		Constants:       getConstants(fi),
+		Upvalues:        getUpvalues(fi),
+		Protos:          toProtos(fi.subFuncs),
+		LineInfo:        fi.lineNums,
+		LocVars:         getLocVars(fi),
+		UpvalueNames:    getUpvalueNames(fi),
 	}
 
 	if proto.MaxStackSize < 2 {
 		proto.MaxStackSize = 2 // todo
 	}
 	if fi.isVararg {
-		proto.IsVararg = 1
+		proto.IsVararg = VARARG_ISVARARG
+	}
+	if fi.needsArg {
+		proto.IsVararg |= VARARG_NEEDSARG
 	}
 	return proto
 }
@@ -52,3 +57,23 @@ func getUpvalues(fi *funcInfo) []Upvalue {
 	}
 	return upvals
 }
+
+func getLocVars(fi *funcInfo) []LocVar {
+	locVars := make([]LocVar, len(fi.locVars))
+	for i, locVar := range fi.locVars {
+		locVars[i] = LocVar{
+			VarName: locVar.name,
+			StartPC: uint32(locVar.startPC),
+			EndPC:   uint32(locVar.endPC),
+		}
+	}
+	return locVars
+}
+
+func getUpvalueNames(fi *funcInfo) []string {
+	names := make([]string, len(fi.upvalues))
+	for name, uv := range fi.upvalues {
+		names[uv.index] = name
+	}
+	return names
+}
@@ -1,11 +1,15 @@
 package codegen
 
 import (
+	"fmt"
+	. "luago/binchunk"
 	. "luago/compiler/ast"
 	. "luago/compiler/lexer"
 	. "luago/vm"
 )
 
+const MAXVARS = 200 /* 5.3: maximum number of local variables per function */
+
 var arithAndBitwiseBinops = map[int]int{
 	TOKEN_OP_ADD:  OP_ADD,
 	TOKEN_OP_SUB:  OP_SUB,
@@ -28,13 +32,21 @@ type funcInfo struct {
 	scopeLv   int                    // 作用域层次
 	locVars   []*locVarInfo          // 按顺序记录函数内部声明的全部局部变量
 	locNames  map[string]*locVarInfo // 记录当前生效的局部变量
+	nActVars  int                    // 当前生效并占用寄存器的局部变量数量
 	breaks    [][]int                // break表，记录跳转指令的地址记录
+	scopes    []scopeInfo            // 每层作用域开始时的状态，break时据此关闭upvalue和待关闭变量
 	insts     []uint32               // 指令表
+	lineNums  []uint32               // 每条指令对应的行号
 	parent    *funcInfo
 	upvalues  map[string]upvalInfo // uv表
 	subFuncs  []*funcInfo
 	numParams int
 	isVararg  bool
+	compatArg bool // Lua 5.1兼容：vararg函数带有局部变量arg
+	needsArg  bool // 声明了arg并且函数体中没有使用...，调用时需要创建arg表
+	line      int  // 函数定义的起止行号
+	lastLine  int
+	nodeLine  int // 正在生成代码的语法节点的行号，用于报告寄存器、常量和局部变量超出限制等错误
 }
 
 // 单链表串联同名的局部变量
@@ -43,7 +55,18 @@ type locVarInfo struct {
 	name     string
 	scopeLv  int
 	slot     int
+	startPC  int // 局部变量生效和失效的指令位置，写入调试信息
+	endPC    int
 	captured bool
+	isConst  bool // <const>或<close>变量，不能被赋值
+	tbc      bool // <close>变量，离开作用域时调用__close元方法
+	constExp Exp  // 编译期常量的值（字面量），这种变量不占用寄存器，slot为-1
+}
+
+// scopeInfo: 作用域开始时的寄存器和局部变量数量
+type scopeInfo struct {
+	firstReg    int
+	firstLocVar int
 }
 
 // UpValue表
@@ -60,12 +83,17 @@ func newFuncInfo(parent *funcInfo, fd *FuncDefExp) *funcInfo {
 		locVars:   make([]*locVarInfo, 0, 8),
 		locNames:  map[string]*locVarInfo{},
 		breaks:    make([][]int, 1),
+		scopes:    make([]scopeInfo, 1),
 		insts:     make([]uint32, 0, 8),
+		lineNums:  make([]uint32, 0, 8),
 		parent:    parent,
 		upvalues:  map[string]upvalInfo{},
 		subFuncs:  []*funcInfo{},
 		numParams: len(fd.ParList),
 		isVararg:  fd.IsVararg,
+		compatArg: parent != nil && parent.compatArg,
+		line:      fd.Line,
+		lastLine:  fd.LastLine,
 	}
 }
 
@@ -76,15 +104,30 @@ func (self *funcInfo) indexOfConstant(k interface{}) int {
 	}
 
 	idx := len(self.constants)
+	if idx > MAXARG_Ax {
+		self.error(self.curLine(), "constant table overflow")
+	}
 	self.constants[k] = idx
 	return idx
 }
 
+// constantRK: 返回常量的RK操作数，常量索引超过MAXINDEXRK时先用LOADK/LOADKX把常量加载到新分配的寄存器，
+// 这时tmp为true，调用者用完后需要释放这个寄存器
+// lua-5.3.4/src/lcode.c#luaK_exp2RK()
+func (self *funcInfo) constantRK(line int, k interface{}) (rk int, tmp bool) {
+	if idx := self.indexOfConstant(k); idx <= MAXINDEXRK {
+		return 0x100 + idx, false
+	}
+	a := self.allocReg()
+	self.emitLoadK(line, a, k)
+	return a, true
+}
+
 // allocReg:分配寄存器 返回的是寄存器的索引 所以需要-1
 func (self *funcInfo) allocReg() int {
 	self.usedRegs++
-	if self.usedRegs >= 255 {
-		panic("function or expression needs too many registers")
+	if self.usedRegs > MAXREGS {
+		self.error(self.curLine(), "function or expression needs too many registers")
 	}
 	if self.usedRegs > self.maxRegs {
 		self.maxRegs = self.usedRegs
@@ -120,21 +163,76 @@ func (self *funcInfo) enterScope(breakable bool) {
 	} else {
 		self.breaks = append(self.breaks, nil) // 非循环块
 	}
+	self.scopes = append(self.scopes, scopeInfo{self.usedRegs, len(self.locVars)})
 }
 
 // addLocVar:新增局部变量信息
 func (self *funcInfo) addLocVar(name string) int {
+	if self.nActVars >= MAXVARS {
+		self.errorLimit(MAXVARS, "local variables")
+	}
+	self.nActVars++
 	newVar := &locVarInfo{
 		prev:    self.locNames[name],
 		name:    name,
 		scopeLv: self.scopeLv,
 		slot:    self.allocReg(),
+		startPC: len(self.insts),
 	}
 	self.locVars = append(self.locVars, newVar)
 	self.locNames[name] = newVar
 	return newVar.slot
 }
 
+// addConstVar:新增编译期常量，不分配寄存器，引用它的地方直接使用常量的值
+func (self *funcInfo) addConstVar(name string, exp Exp) {
+	self.locNames[name] = &locVarInfo{
+		prev:     self.locNames[name],
+		name:     name,
+		scopeLv:  self.scopeLv,
+		slot:     -1,
+		isConst:  true,
+		constExp: exp,
+	}
+}
+
+// lookupVar:按作用域规则查找局部变量，包括外围函数中可以作为upvalue访问的局部变量
+func (self *funcInfo) lookupVar(name string) *locVarInfo {
+	for fi := self; fi != nil; fi = fi.parent {
+		if locVar, found := fi.locNames[name]; found {
+			return locVar
+		}
+	}
+	return nil
+}
+
+// constOfVar:名字引用的是编译期常量时返回它的值
+func (self *funcInfo) constOfVar(name string) Exp {
+	if locVar := self.lookupVar(name); locVar != nil {
+		return locVar.constExp
+	}
+	return nil
+}
+
+// checkAssign:不能给<const>和<close>变量赋值
+func (self *funcInfo) checkAssign(name string) {
+	if locVar := self.lookupVar(name); locVar != nil && locVar.isConst {
+		self.error(self.curLine(), "attempt to assign to const variable '%s'", name)
+	}
+}
+
+// hasTbcVars:函数中是否有还在作用域内的<close>变量
+func (self *funcInfo) hasTbcVars() bool {
+	for _, locVar := range self.locNames {
+		for v := locVar; v != nil; v = v.prev {
+			if v.tbc {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // slotOfLocVar:检查局部变量名是否已经和寄存器绑定
 func (self *funcInfo) slotOfLocVar(name string) int {
 	if locVar, found := self.locNames[name]; found {
@@ -148,10 +246,19 @@ func (self *funcInfo) exitScope() {
 	// 修复跳转指令
 	pendingBreakJmps := self.breaks[len(self.breaks)-1]
 	self.breaks = self.breaks[:len(self.breaks)-1]
-	a := self.getJmpArgA()
+	scope := self.scopes[len(self.scopes)-1]
+	self.scopes = self.scopes[:len(self.scopes)-1]
+	a := 0
+	// break跳出的是循环内声明的全部变量，不只是循环这一层作用域的变量
+	for _, locVar := range self.locVars[scope.firstLocVar:] {
+		if locVar.captured || locVar.tbc {
+			a = scope.firstReg + 1
+			break
+		}
+	}
 	for _, pc := range pendingBreakJmps {
 		sBx := self.pc() - pc
-		i := (sBx+MAXARG_sBx)<<14 | a<<16 | OP_JMP
+		i := (sBx+MAXARG_sBx)<<14 | a<<6 | OP_JMP
 		self.insts[pc] = uint32(i)
 	}
 	// 作用域数值-1
@@ -166,7 +273,11 @@ func (self *funcInfo) exitScope() {
 
 // removeLocVar:有同名局部变量且在同一作用域
 func (self *funcInfo) removeLocVar(locVar *locVarInfo) {
-	self.freeReg()
+	if locVar.slot >= 0 {
+		self.freeReg()
+		self.nActVars--
+	}
+	locVar.endPC = len(self.insts)
 	if locVar.prev == nil {
 		delete(self.locNames, locVar.name)
 	} else if locVar.prev.scopeLv == locVar.scopeLv {
@@ -176,6 +287,35 @@ func (self *funcInfo) removeLocVar(locVar *locVarInfo) {
 	}
 }
 
+// errorLimit: 超出函数的某项限制
+// lua-5.3.4/src/lparser.c#errorlimit()
+func (self *funcInfo) errorLimit(limit int, what string) {
+	where := "main function"
+	if self.line != 0 {
+		where = fmt.Sprintf("function at line %d", self.line)
+	}
+	self.error(self.curLine(), "too many %s (limit is %d) in %s", what, limit, where)
+}
+
+// error: 代码生成阶段的编译错误，chunk名由compiler.Compile补上
+// AST只记录了行号，所以这些错误没有列号和near部分
+func (self *funcInfo) error(line int, f string, a ...interface{}) {
+	panic(&Diagnostic{Line: line, Message: fmt.Sprintf(f, a...)})
+}
+
+// errorAt: 语法节点记录了位置时报告的错误，token是节点开始处的token
+func (self *funcInfo) errorAt(line, column int, token, f string, a ...interface{}) {
+	panic(&Diagnostic{Line: line, Column: column, Message: fmt.Sprintf(f, a...), Token: token})
+}
+
+// curLine: 正在生成代码的语法节点的行号，还没有处理任何节点时（如形参）是函数定义的行号
+func (self *funcInfo) curLine() int {
+	if self.nodeLine > 0 {
+		return self.nodeLine
+	}
+	return self.line
+}
+
 // addBreakJmp: 把break语句对应的跳转指令添加到最近的循环块中
 func (self *funcInfo) addBreakJmp(pc int) {
 	for i := self.scopeLv; i >= 0; i-- {
@@ -184,7 +324,8 @@ func (self *funcInfo) addBreakJmp(pc int) {
 			return
 		}
 	}
-	panic("<break> at line ? not inside a loop")
+	line := int(self.lineNums[pc])
+	self.error(line, "<break> at line %d not inside a loop", line)
 }
 
 // indexOfUpval：根据变量名获取upval所在的寄存器
@@ -212,10 +353,10 @@ func (self *funcInfo) indexOfUpval(name string) int {
 	return -1
 }
 
-func (self *funcInfo) closeOpenUpvals() {
+func (self *funcInfo) closeOpenUpvals(line int) {
 	a := self.getJmpArgA()
 	if a > 0 {
-		self.emitJmp(a, 0)
+		self.emitJmp(line, a, 0)
 	}
 }
 
@@ -225,10 +366,10 @@ func (self *funcInfo) getJmpArgA() int {
 	for _, locVar := range self.locNames {
 		if locVar.scopeLv == self.scopeLv {
 			for v := locVar; v != nil && v.scopeLv == self.scopeLv; v = v.prev {
-				if v.captured {
+				if v.captured || v.tbc {
 					hasCapturedLocVars = true
 				}
-				if v.slot < minSlotOfLocVars && v.name[0] != '(' {
+				if v.slot >= 0 && v.slot < minSlotOfLocVars && v.name[0] != '(' {
 					minSlotOfLocVars = v.slot
 				}
 			}
@@ -242,195 +383,215 @@ func (self *funcInfo) getJmpArgA() int {
 }
 
 // 指令发射emit
-func (self *funcInfo) emitABC(opcode, a, b, c int) {
+// 每条指令都记录所在的行号，供运行时报错使用
+func (self *funcInfo) emitABC(line, opcode, a, b, c int) {
 	i := b<<23 | c<<14 | a<<6 | opcode
-	self.insts = append(self.insts, uint32(i))
+	self.emit(line, uint32(i))
 }
 
-func (self *funcInfo) emitABx(opcode, a, bx int) {
+func (self *funcInfo) emitABx(line, opcode, a, bx int) {
 	i := bx<<14 | a<<6 | opcode
-	self.insts = append(self.insts, uint32(i))
+	self.emit(line, uint32(i))
 }
 
-func (self *funcInfo) emitAsBx(opcode, a, b int) {
+func (self *funcInfo) emitAsBx(line, opcode, a, b int) {
 	i := (b+MAXARG_sBx)<<14 | a<<6 | opcode
-	self.insts = append(self.insts, uint32(i))
+	self.emit(line, uint32(i))
 }
 
-func (self *funcInfo) emitAx(opcode, ax int) {
+func (self *funcInfo) emitAx(line, opcode, ax int) {
 	i := ax<<6 | opcode
-	self.insts = append(self.insts, uint32(i))
+	self.emit(line, uint32(i))
+}
+
+func (self *funcInfo) emit(line int, i uint32) {
+	self.insts = append(self.insts, i)
+	self.lineNums = append(self.lineNums, uint32(line))
 }
 
 // r[a] = r[b]
-func (self *funcInfo) emitMove(a, b int) {
-	self.emitABC(OP_MOVE, a, b, 0)
+func (self *funcInfo) emitMove(line, a, b int) {
+	self.emitABC(line, OP_MOVE, a, b, 0)
 }
 
 // r[a], r[a+1], ..., r[a+b] = nil
-func (self *funcInfo) emitLoadNil(a, n int) {
-	self.emitABC(OP_LOADNIL, a, n-1, 0)
+func (self *funcInfo) emitLoadNil(line, a, n int) {
+	self.emitABC(line, OP_LOADNIL, a, n-1, 0)
 }
 
 // r[a] = (bool)b; if (c) pc++
-func (self *funcInfo) emitLoadBool(a, b, c int) {
-	self.emitABC(OP_LOADBOOL, a, b, c)
+func (self *funcInfo) emitLoadBool(line, a, b, c int) {
+	self.emitABC(line, OP_LOADBOOL, a, b, c)
 }
 
 // r[a] = kst[bx]
-func (self *funcInfo) emitLoadK(a int, k interface{}) {
+func (self *funcInfo) emitLoadK(line, a int, k interface{}) {
 	idx := self.indexOfConstant(k)
-	if idx < (1 << 18) {
-		self.emitABx(OP_LOADK, a, idx)
+	if idx <= MAXARG_Bx {
+		self.emitABx(line, OP_LOADK, a, idx)
 	} else {
-		self.emitABx(OP_LOADKX, a, 0)
-		self.emitAx(OP_EXTRAARG, idx)
+		self.emitABx(line, OP_LOADKX, a, 0)
+		self.emitAx(line, OP_EXTRAARG, idx)
 	}
 }
 
 // r[a], r[a+1], ..., r[a+b-2] = vararg
-func (self *funcInfo) emitVararg(a, n int) {
-	self.emitABC(OP_VARARG, a, n+1, 0)
+func (self *funcInfo) emitVararg(line, a, n int) {
+	self.emitABC(line, OP_VARARG, a, n+1, 0)
 }
 
 // r[a] = emitClosure(proto[bx])
-func (self *funcInfo) emitClosure(a, bx int) {
-	self.emitABx(OP_CLOSURE, a, bx)
+func (self *funcInfo) emitClosure(line, a, bx int) {
+	self.emitABx(line, OP_CLOSURE, a, bx)
 }
 
 // r[a] = {}
-func (self *funcInfo) emitNewTable(a, nArr, nRec int) {
+func (self *funcInfo) emitNewTable(line, a, nArr, nRec int) {
 	// 这里用了浮点字节码
-	self.emitABC(OP_NEWTABLE,
+	self.emitABC(line, OP_NEWTABLE,
 		a, Int2fb(nArr), Int2fb(nRec))
 }
 
 // r[a][(c-1)*FPF+i] := r[a+i], 1 <= i <= b
-func (self *funcInfo) emitSetList(a, b, c int) {
-	self.emitABC(OP_SETLIST, a, b, c)
+// 批次数c超过MAXARG_C时指令的C为0，c放在下一条EXTRAARG指令里
+// lua-5.3.4/src/lcode.c#luaK_setlist()
+func (self *funcInfo) emitSetList(line, a, b, c int) {
+	if c <= MAXARG_C {
+		self.emitABC(line, OP_SETLIST, a, b, c)
+	} else if c <= MAXARG_Ax {
+		self.emitABC(line, OP_SETLIST, a, b, 0)
+		self.emitAx(line, OP_EXTRAARG, c)
+	} else {
+		self.error(line, "constructor too long")
+	}
 }
 
 // r[a] := r[b][rk(c)]
-func (self *funcInfo) emitGetTable(a, b, c int) {
-	self.emitABC(OP_GETTABLE, a, b, c)
+func (self *funcInfo) emitGetTable(line, a, b, c int) {
+	self.emitABC(line, OP_GETTABLE, a, b, c)
 }
 
 // r[a][rk(b)] = rk(c)
-func (self *funcInfo) emitSetTable(a, b, c int) {
-	self.emitABC(OP_SETTABLE, a, b, c)
+func (self *funcInfo) emitSetTable(line, a, b, c int) {
+	self.emitABC(line, OP_SETTABLE, a, b, c)
 }
 
 // r[a] = upval[b]
-func (self *funcInfo) emitGetUpval(a, b int) {
-	self.emitABC(OP_GETUPVAL, a, b, 0)
+func (self *funcInfo) emitGetUpval(line, a, b int) {
+	self.emitABC(line, OP_GETUPVAL, a, b, 0)
 }
 
 // upval[b] = r[a]
-func (self *funcInfo) emitSetUpval(a, b int) {
-	self.emitABC(OP_SETUPVAL, a, b, 0)
+func (self *funcInfo) emitSetUpval(line, a, b int) {
+	self.emitABC(line, OP_SETUPVAL, a, b, 0)
 }
 
 // r[a] = upval[b][rk(c)]
-func (self *funcInfo) emitGetTabUp(a, b, c int) {
-	self.emitABC(OP_GETTABUP, a, b, c)
+func (self *funcInfo) emitGetTabUp(line, a, b, c int) {
+	self.emitABC(line, OP_GETTABUP, a, b, c)
 }
 
 // upval[a][rk(b)] = rk(c)
-func (self *funcInfo) emitSetTabUp(a, b, c int) {
-	self.emitABC(OP_SETTABUP, a, b, c)
+func (self *funcInfo) emitSetTabUp(line, a, b, c int) {
+	self.emitABC(line, OP_SETTABUP, a, b, c)
 }
 
 // r[a], ..., r[a+c-2] = r[a](r[a+1], ..., r[a+b-1])
-func (self *funcInfo) emitCall(a, nArgs, nRet int) {
-	self.emitABC(OP_CALL, a, nArgs+1, nRet+1)
+func (self *funcInfo) emitCall(line, a, nArgs, nRet int) {
+	self.emitABC(line, OP_CALL, a, nArgs+1, nRet+1)
 }
 
 // return r[a](r[a+1], ... ,r[a+b-1])
-func (self *funcInfo) emitTailCall(a, nArgs int) {
-	self.emitABC(OP_TAILCALL, a, nArgs+1, 0)
+func (self *funcInfo) emitTailCall(line, a, nArgs int) {
+	self.emitABC(line, OP_TAILCALL, a, nArgs+1, 0)
 }
 
 // return r[a], ... ,r[a+b-2]
-func (self *funcInfo) emitReturn(a, n int) {
-	self.emitABC(OP_RETURN, a, n+1, 0)
+func (self *funcInfo) emitReturn(line, a, n int) {
+	self.emitABC(line, OP_RETURN, a, n+1, 0)
 }
 
 // r[a+1] := r[b]; r[a] := r[b][rk(c)]
-func (self *funcInfo) emitSelf(a, b, c int) {
-	self.emitABC(OP_SELF, a, b, c)
+func (self *funcInfo) emitSelf(line, a, b, c int) {
+	self.emitABC(line, OP_SELF, a, b, c)
+}
+
+// mark r[a] as to-be-closed
+func (self *funcInfo) emitTbc(line, a int) {
+	self.emitABC(line, OP_TBC, a, 0, 0)
 }
 
 // pc+=sBx; if (a) close all upvalues >= r[a - 1]
-func (self *funcInfo) emitJmp(a, sBx int) int {
-	self.emitAsBx(OP_JMP, a, sBx)
+func (self *funcInfo) emitJmp(line, a, sBx int) int {
+	self.emitAsBx(line, OP_JMP, a, sBx)
 	return len(self.insts) - 1
 }
 
 // if not (r[a] <=> c) then pc++
-func (self *funcInfo) emitTest(a, c int) {
-	self.emitABC(OP_TEST, a, 0, c)
+func (self *funcInfo) emitTest(line, a, c int) {
+	self.emitABC(line, OP_TEST, a, 0, c)
 }
 
 // if (r[b] <=> c) then r[a] := r[b] else pc++
-func (self *funcInfo) emitTestSet(a, b, c int) {
-	self.emitABC(OP_TESTSET, a, b, c)
+func (self *funcInfo) emitTestSet(line, a, b, c int) {
+	self.emitABC(line, OP_TESTSET, a, b, c)
 }
 
-func (self *funcInfo) emitForPrep(a, sBx int) int {
-	self.emitAsBx(OP_FORPREP, a, sBx)
+func (self *funcInfo) emitForPrep(line, a, sBx int) int {
+	self.emitAsBx(line, OP_FORPREP, a, sBx)
 	return len(self.insts) - 1
 }
 
-func (self *funcInfo) emitForLoop(a, sBx int) int {
-	self.emitAsBx(OP_FORLOOP, a, sBx)
+func (self *funcInfo) emitForLoop(line, a, sBx int) int {
+	self.emitAsBx(line, OP_FORLOOP, a, sBx)
 	return len(self.insts) - 1
 }
 
-func (self *funcInfo) emitTForCall(a, c int) {
-	self.emitABC(OP_TFORCALL, a, 0, c)
+func (self *funcInfo) emitTForCall(line, a, c int) {
+	self.emitABC(line, OP_TFORCALL, a, 0, c)
 }
 
-func (self *funcInfo) emitTForLoop(a, sBx int) {
-	self.emitAsBx(OP_TFORLOOP, a, sBx)
+func (self *funcInfo) emitTForLoop(line, a, sBx int) {
+	self.emitAsBx(line, OP_TFORLOOP, a, sBx)
 }
 
 // r[a] = op r[b]
-func (self *funcInfo) emitUnaryOp(op, a, b int) {
+func (self *funcInfo) emitUnaryOp(line, op, a, b int) {
 	switch op {
 	case TOKEN_OP_NOT:
-		self.emitABC(OP_NOT, a, b, 0)
+		self.emitABC(line, OP_NOT, a, b, 0)
 	case TOKEN_OP_BNOT:
-		self.emitABC(OP_BNOT, a, b, 0)
+		self.emitABC(line, OP_BNOT, a, b, 0)
 	case TOKEN_OP_LEN:
-		self.emitABC(OP_LEN, a, b, 0)
+		self.emitABC(line, OP_LEN, a, b, 0)
 	case TOKEN_OP_UNM:
-		self.emitABC(OP_UNM, a, b, 0)
+		self.emitABC(line, OP_UNM, a, b, 0)
 	}
 }
 
 // r[a] = rk[b] op rk[c]
 // arith & bitwise & relational
-func (self *funcInfo) emitBinaryOp(op, a, b, c int) {
+func (self *funcInfo) emitBinaryOp(line, op, a, b, c int) {
 	if opcode, found := arithAndBitwiseBinops[op]; found {
-		self.emitABC(opcode, a, b, c)
+		self.emitABC(line, opcode, a, b, c)
 	} else {
 		switch op {
 		case TOKEN_OP_EQ:
-			self.emitABC(OP_EQ, 1, b, c)
+			self.emitABC(line, OP_EQ, 1, b, c)
 		case TOKEN_OP_NE:
-			self.emitABC(OP_EQ, 0, b, c)
+			self.emitABC(line, OP_EQ, 0, b, c)
 		case TOKEN_OP_LT:
-			self.emitABC(OP_LT, 1, b, c)
+			self.emitABC(line, OP_LT, 1, b, c)
 		case TOKEN_OP_GT:
-			self.emitABC(OP_LT, 1, c, b)
+			self.emitABC(line, OP_LT, 1, c, b)
 		case TOKEN_OP_LE:
-			self.emitABC(OP_LE, 1, b, c)
+			self.emitABC(line, OP_LE, 1, b, c)
 		case TOKEN_OP_GE:
-			self.emitABC(OP_LE, 1, c, b)
+			self.emitABC(line, OP_LE, 1, c, b)
 		}
-		self.emitJmp(0, 1)
-		self.emitLoadBool(a, 0, 1)
-		self.emitLoadBool(a, 1, 0)
+		self.emitJmp(line, 0, 1)
+		self.emitLoadBool(line, a, 0, 1)
+		self.emitLoadBool(line, a, 1, 0)
 	}
 }
 
@@ -3,10 +3,61 @@ package compiler
 import (
 	"luago/binchunk"
 	"luago/compiler/codegen"
+	"luago/compiler/lexer"
 	"luago/compiler/parser"
 )
 
-func Compile(chunk, chunkName string) *binchunk.Prototype {
-	ast := parser.Parse(chunk, chunkName)
-	return codegen.GenProto(ast)
+// Diagnostic: 编译错误，Go的调用者可以从中取得chunk名、行号、列号、错误信息和出错的token
+type Diagnostic = lexer.Diagnostic
+
+// Options: 编译选项，零值按Lua 5.3的规则编译
+type Options struct {
+	// vararg函数（主函数除外）按Lua 5.1的规则带有局部变量arg，
+	// 函数体中没有使用...时，调用时把变长参数打包成表{n = 个数, ...}放入arg
+	CompatArg bool
+	// 按Lua 5.4的规则分析源代码：\u{XXX}转义最大可以是0x7FFFFFFF
+	Lua54 bool
+}
+
+// Compile: 编译源代码，有编译错误时返回*Diagnostic
+func Compile(chunk, chunkName string) (*binchunk.Prototype, error) {
+	return CompileWithOptions(chunk, chunkName, Options{})
+}
+
+// CompileCompat51: 和Compile相同，但vararg函数带有Lua 5.1的局部变量arg，见Options.CompatArg
+func CompileCompat51(chunk, chunkName string) (*binchunk.Prototype, error) {
+	return CompileWithOptions(chunk, chunkName, Options{CompatArg: true})
+}
+
+// CompileWithOptions: 按opts编译源代码，有编译错误时返回*Diagnostic
+// 词法、语法分析和代码生成以panic(*Diagnostic)报告错误，在这里转换成error；
+// 代码生成阶段的错误没有chunk名，在这里补上
+func CompileWithOptions(chunk, chunkName string, opts Options) (proto *binchunk.Prototype, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			d, ok := r.(*Diagnostic)
+			if !ok {
+				panic(r)
+			}
+			d.ChunkName = chunkName
+			proto, err = nil, d
+		}
+	}()
+
+	lexer := lexer.NewLexer(chunk, chunkName)
+	if opts.Lua54 {
+		lexer.SetLua54()
+	}
+	ast := parser.ParseLexer(lexer)
+	proto = codegen.GenProto(ast, opts.CompatArg)
+	setSource(proto, chunkName)
+	return proto, nil
+}
+
+// setSource: 把源文件名写入全部函数原型，运行时报错时用于定位
+func setSource(proto *binchunk.Prototype, chunkName string) {
+	proto.Source = chunkName
+	for _, f := range proto.Protos {
+		setSource(f, chunkName)
+	}
 }
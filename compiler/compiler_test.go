@@ -0,0 +1,138 @@
+package compiler_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	. "luago/api"
+	"luago/binchunk"
+	"luago/compiler"
+	"luago/state"
+)
+
+func seq(n int, f func(i int) string, sep string) string {
+	parts := make([]string, n)
+	for i := range parts {
+		parts[i] = f(i + 1)
+	}
+	return strings.Join(parts, sep)
+}
+
+func num(i int) string   { return fmt.Sprint(i) }
+func local(i int) string { return fmt.Sprintf("a%d", i) }
+
+// 超过指令操作数范围的常量、表构造器和寄存器：生成的代码要通过Verify，Dump后加载执行的结果正确
+func TestLimits(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+	}{
+		/* SETLIST的C超过MAXARG_C时用EXTRAARG */
+		{"list", "local t = {" + seq(30000, num, ",") + "}\n" +
+			"assert(#t == 30000 and t[25550] == 25550 and t[25551] == 25551 and t[30000] == 30000)"},
+		{"list with varargs", "local function g(...) return {" + seq(29990, num, ",") + ", ...} end\n" +
+			"local t = g(29991, 29992, 29993)\nassert(#t == 29993 and t[29993] == 29993 and t[25600] == 25600)"},
+		/* 常量索引超过MAXINDEXRK时先加载到寄存器 */
+		{"globals", seq(300, func(i int) string { return fmt.Sprintf("g%d = %d", i, i) }, "\n") +
+			"\nassert(g300 == 300 and g256 == 256)"},
+		{"methods", "local o = {}\n" +
+			seq(300, func(i int) string { return fmt.Sprintf("function o:m%d() return %d end", i, i) }, "\n") +
+			"\nassert(o:m300() == 300 and o:m1() == 1 and o:m257(9) == 257)"},
+		/* 常量索引超过MAXARG_Bx时用LOADKX */
+		{"constants", "local t = {" + seq(270000, func(i int) string { return fmt.Sprintf("%d.5", i) }, ",") + "}\n" +
+			"local x = 269999.5\nassert(#t == 270000 and t[270000] == 270000.5 and x == t[269999])"},
+		{"200 locals", "local " + seq(200, local, ",") + " = 1\nassert(a1 == 1)"},
+		{"250 arguments", "local function f(...) return select('#', ...) end\nassert(f(" + seq(250, num, ",") + ") == 250)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proto, err := compiler.Compile(tt.src, "="+tt.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := binchunk.Verify(proto); err != nil {
+				t.Fatal(err)
+			}
+			ls := state.NewState()
+			if ls.Load(binchunk.Dump(proto, false), tt.name, "b") != LUA_OK {
+				t.Fatal(ls.ToString(-1))
+			}
+			if ls.PCall(0, 0, 0) != LUA_OK {
+				t.Fatal(ls.ToString(-1))
+			}
+		})
+	}
+}
+
+func TestLimitErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"locals", "local " + seq(201, local, ","),
+			"=t:1: too many local variables (limit is 200) in main function"},
+		{"locals in function", "\nlocal function f()\nlocal " + seq(201, local, ",") + "\nend",
+			"=t:3: too many local variables (limit is 200) in function at line 2"},
+		{"arguments", "\n\nprint(" + seq(300, num, ",") + ")",
+			"=t:3: function or expression needs too many registers"},
+		{"nesting", "local a = 1 local x = " + strings.Repeat("a + (", 300) + "a" + strings.Repeat(")", 300),
+			"=t:1: function or expression needs too many registers"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := compiler.Compile(tt.src, "=t")
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("got %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// 编译错误的位置和near部分，以及Load返回的Lua格式的错误信息
+func TestDiagnostics(t *testing.T) {
+	tests := []struct {
+		src, chunkName string
+		load           string /* Load的错误信息 */
+		line, column   int
+		message, token string
+	}{
+		{"x = = 1", "=foo", "foo:1: syntax error near '='", 1, 5, "syntax error", "="},
+		{"local a = 1\n  local b = 'abc' 'def' x", "@f.lua", "f.lua:2: syntax error near ''def''", 2, 19, "syntax error", "'def'"},
+		{"local t = {\n1,\n", "=t", "t:3: syntax error near <eof>", 3, 1, "syntax error", "<eof>"},
+		{"x = 1 @", "x = 1 @", `[string "x = 1 @"]:1: unexpected symbol near '@'`, 1, 7, "unexpected symbol", "@"},
+		{"x = 3e", "=n", "n:1: malformed number near '3e'", 1, 5, "malformed number", "3e"},
+		{"x = 'abc\ny'", "=s", "s:1: unfinished string near ''abc'", 1, 5, "unfinished string", "'abc"},
+		{"x = [[abc", "=s", "s:1: unfinished long string or comment near <eof>", 1, 5, "unfinished long string or comment", "<eof>"},
+		{"x = 1\n  --[[ abc", "=s", "s:2: unfinished long string or comment near <eof>", 2, 3, "unfinished long string or comment", "<eof>"},
+		{"x = 'a\\qb'", "=s", `s:1: invalid escape sequence near '\q'`, 1, 5, "invalid escape sequence", `\q`},
+		{"x = \"\x01\"\ny = \x01", "=c", `c:2: unexpected symbol near '<\1>'`, 2, 5, "unexpected symbol", `<\1>`},
+		{"local x <foo> = 1", "=a", "a:1: unknown attribute 'foo'", 1, 13, "unknown attribute 'foo'", ""},
+		{"x = y z", "=k", "k:1: syntax error near <eof>", 1, 8, "syntax error", "<eof>"},
+		{"f(\"abc\" 1)", "=q", `q:1: syntax error near '1'`, 1, 9, "syntax error", "1"},
+		{"return return", "=r", "r:1: syntax error near 'return'", 1, 8, "syntax error", "return"},
+		{"x = [==[\nabc\n]==] )", "=l", "l:3: syntax error near ')'", 3, 6, "syntax error", ")"},
+		/* 代码生成阶段的错误，AST只记录了行号 */
+		{"local x <const> = 1\n\nx = 2", "=a", "a:3: attempt to assign to const variable 'x'", 3, 0, "attempt to assign to const variable 'x'", ""},
+		{"if x then\n  break\nend", "=b", "b:2: <break> at line 2 not inside a loop", 2, 0, "<break> at line 2 not inside a loop", ""},
+		{"function f()\n  return ...\nend", "=v", "v:2: cannot use '...' outside a vararg function", 2, 0, "cannot use '...' outside a vararg function", ""},
+		{"\n\n  goto done", "=g", "g:3: label and goto statements are not supported! near 'goto'", 3, 3, "label and goto statements are not supported!", "goto"},
+	}
+	for _, tt := range tests {
+		ls := state.NewState()
+		if status := ls.Load([]byte(tt.src), tt.chunkName, "t"); status != LUA_ERRSYNTAX || ls.ToString(-1) != tt.load {
+			t.Errorf("Load(%q): status %d, got %q, want %q", tt.src, status, ls.ToString(-1), tt.load)
+		}
+		_, err := compiler.Compile(tt.src, tt.chunkName)
+		d, ok := err.(*compiler.Diagnostic)
+		if !ok {
+			t.Errorf("Compile(%q): got %v, want a *Diagnostic", tt.src, err)
+			continue
+		}
+		want := compiler.Diagnostic{ChunkName: tt.chunkName, Line: tt.line, Column: tt.column, Message: tt.message, Token: tt.token}
+		if *d != want {
+			t.Errorf("Compile(%q): got %+v, want %+v", tt.src, *d, want)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package lexer
+
+import "fmt"
+
+// Diagnostic: 词法、语法分析和代码生成阶段的编译错误
+// 编译器内部以panic(*Diagnostic)报告错误，compiler.Compile把它作为error返回
+type Diagnostic struct {
+	ChunkName string // 源文件名（chunk名），原样保存，没有按luaO_chunkid转换
+	Line      int    // 行号，和Lua的报错信息一致，是读到出错token时的行号
+	Column    int    // 出错token开始的列号（按字节从1开始），0表示不知道列号（AST不记录列号，代码生成阶段的错误大多没有列号）
+	Message   string // 错误信息，不包括位置和near部分
+	Token     string // 出错的token在源代码中的原文，文件结束时为<eof>，为空时没有near部分
+}
+
+// Msg: 错误信息加上出错的token，如syntax error near 'x'
+// lua-5.3.4/src/llex.c#lexerror()
+func (self *Diagnostic) Msg() string {
+	switch self.Token {
+	case "":
+		return self.Message
+	case "<eof>":
+		return self.Message + " near <eof>"
+	default:
+		return fmt.Sprintf("%s near '%s'", self.Message, self.Token)
+	}
+}
+
+// Error: chunk名:行号:列号: 错误信息，不知道列号时省略
+// Load使用的Lua标准格式（chunk名经过转换，没有列号）由调用者用Line和Msg拼接
+func (self *Diagnostic) Error() string {
+	if self.Column > 0 {
+		return fmt.Sprintf("%s:%d:%d: %s", self.ChunkName, self.Line, self.Column, self.Msg())
+	}
+	return fmt.Sprintf("%s:%d: %s", self.ChunkName, self.Line, self.Msg())
+}
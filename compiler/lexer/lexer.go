@@ -3,20 +3,29 @@ package lexer
 import (
 	"bytes"
 	"fmt"
+	"luago/number"
 	"regexp"
 	"strconv"
 	"strings"
 )
 
 type Lexer struct {
-	chunk     string // 源代码
+	src       string // 完整的源代码，用于计算列号和取出token的原文
+	chunk     string // 还没有分析的源代码
 	chunkName string // 源文件名
 	line      int    // 当前行号
+	column    int    // 当前token开始的列号
+	text      string // 当前token在源代码中的原文
+	lineStart int    // 最近找到的行首位置，和已经查找过换行符的位置，用于计算列号
+	scanned   int
+	maxUTF8   int64 // \u{XXX}转义的最大值，5.3是0x10FFFF，5.4是0x7FFFFFFF
 
 	// 用于辈份词法分析器的状态
-	nextToken     string
-	nextTokenKind int
-	nextTokenLine int
+	nextToken       string
+	nextTokenKind   int
+	nextTokenLine   int
+	nextTokenColumn int
+	nextTokenText   string
 }
 
 var (
@@ -24,7 +33,6 @@ var (
 	reOpeningLongBracket = regexp.MustCompile(`^\[=*\[`)
 	reShortStr           = regexp.MustCompile(`(?s)(^'(\\\\|\\'|\\\n|\\z\s*|[^'\n])*')|(^"(\\\\|\\"|\\\n|\\z\s*|[^"\n])*")`)
 	reIdentifier         = regexp.MustCompile(`^[_\d\w]+`)
-	reNumber             = regexp.MustCompile(`^0[xX][0-9a-fA-F]*(\.[0-9a-fA-F]*)?([pP][+\-]?[0-9]+)?|^[0-9]*(\.[0-9]*)?([eE][+\-]?[0-9]+)?`)
 
 	reDecEscapeSeq     = regexp.MustCompile(`^\\[0-9]{1,3}`)
 	reHexEscapeSeq     = regexp.MustCompile(`^\\x[0-9a-fA-F]{2}`)
@@ -33,12 +41,20 @@ var (
 
 func NewLexer(chunk, chunkName string) *Lexer {
 	return &Lexer{
+		src:       chunk,
 		chunk:     chunk,
 		chunkName: chunkName,
 		line:      1,
+		maxUTF8:   0x10FFFF,
 	}
 }
 
+// SetLua54: 按Lua 5.4的规则分析源代码，\u{XXX}转义最大可以是0x7FFFFFFF
+// lua-5.4.6/src/llex.c#readutf8esc()
+func (self *Lexer) SetLua54() {
+	self.maxUTF8 = 0x7FFFFFFF
+}
+
 // NextToken:符号和关键字判断
 func (self *Lexer) NextToken() (line, kind int, token string) {
 	// 之前如果已经读取过了直接取缓存内容
@@ -47,14 +63,20 @@ func (self *Lexer) NextToken() (line, kind int, token string) {
 		kind = self.nextTokenKind
 		token = self.nextToken
 		self.line = self.nextTokenLine
+		self.column = self.nextTokenColumn
+		self.text = self.nextTokenText
 		self.nextTokenLine = 0
 		return
 	}
 
 	self.skipWhiteSpaces()
+	start := self.offset()
+	self.column = self.columnAt(start)
+	self.text = ""
 	if len(self.chunk) == 0 {
 		return self.line, TOKEN_EOF, "EOF"
 	}
+	defer func() { self.text = self.src[start:self.offset()] }()
 
 	// 符号处理
 	switch self.chunk[0] {
@@ -196,14 +218,24 @@ func (self *Lexer) NextToken() (line, kind int, token string) {
 		}
 	}
 
-	self.error("unexpected symbol near %q", c)
+	self.errorNear("unexpected symbol", token2str(c))
 	return
 }
 
+// token2str: 不可打印的字符显示为<\ddd>
+// lua-5.3.4/src/llex.c#luaX_token2str()
+func token2str(c byte) string {
+	if c < ' ' || c >= 0x7F {
+		return fmt.Sprintf("<\\%d>", c)
+	}
+	return string(c)
+}
+
 // skipWhiteSpaces:跳过空白字符，一并跳过注释
 func (self *Lexer) skipWhiteSpaces() {
 	for len(self.chunk) > 0 {
 		if self.test("--") {
+			self.column = self.columnAt(self.offset()) /* 未结束的长注释在注释开始的地方报错 */
 			self.skipComment()
 		} else if self.test("\r\n") || self.test("\n\r") {
 			self.next(2)
@@ -248,9 +280,41 @@ func isDigit(c byte) bool {
 	return c >= '0' && c <= '9'
 }
 
-// scanNumber:数字扫描，调用scan
+// scanNumber:数字扫描，规则同Lua的read_numeral，再检查是否为合法数字
+// lua-5.3.4/src/llex.c#read_numeral()
 func (self *Lexer) scanNumber() string {
-	return self.scan(reNumber)
+	expo := "Ee"
+	i := 1
+	if self.test("0x") || self.test("0X") { /* hexadecimal? */
+		expo = "Pp"
+		i = 2
+	}
+	for i < len(self.chunk) {
+		c := self.chunk[i]
+		if strings.IndexByte(expo, c) >= 0 { /* exponent part? */
+			i++
+			if i < len(self.chunk) && (self.chunk[i] == '-' || self.chunk[i] == '+') {
+				i++ /* optional exponent sign */
+			}
+		} else if isHexDigit(c) || c == '.' {
+			i++
+		} else {
+			break
+		}
+	}
+	token := self.chunk[:i]
+	if _, ok := number.ParseInteger(token); !ok {
+		if _, ok := number.ParseFloat(token); !ok { /* format error? */
+			self.errorNear("malformed number", token)
+		}
+	}
+	self.next(i)
+	return token
+}
+
+// isHexDigit:判断字符是否为十六进制数字
+func isHexDigit(c byte) bool {
+	return isDigit(c) || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
 }
 
 // isLetter:判断字符是否为字母
@@ -282,13 +346,13 @@ func (self *Lexer) scanLongString() string {
 	// 1.寻找左右长方括号
 	openingLongBracket := reOpeningLongBracket.FindString(self.chunk)
 	if openingLongBracket == "" {
-		self.error("invalid long string delimiter near '%s'", self.chunk[0:2])
+		self.errorNear("invalid long string delimiter", self.chunk[0:2])
 	}
 
 	closingLongBracket := strings.Replace(openingLongBracket, "[", "]", -1)
 	closingLongBracketIdx := strings.Index(self.chunk, closingLongBracket)
 	if closingLongBracketIdx < 0 {
-		self.error("unfinished long string or comment")
+		self.errorNear("unfinished long string or comment", "<eof>")
 	}
 
 	// 2. 提取左右长方括号内的内容
@@ -317,7 +381,10 @@ func (self *Lexer) scanShortString() string {
 		}
 		return str
 	}
-	self.error("unfinished string")
+	if i := strings.IndexAny(self.chunk, "\r\n"); i >= 0 {
+		self.errorNear("unfinished string", self.chunk[:i])
+	}
+	self.errorNear("unfinished string", "<eof>")
 	return ""
 }
 
@@ -333,7 +400,7 @@ func (self *Lexer) escape(str string) string {
 		}
 
 		if len(str) == 1 {
-			self.error("unfinished string")
+			self.errorNear("unfinished string", "")
 		}
 
 		switch str[1] {
@@ -385,7 +452,7 @@ func (self *Lexer) escape(str string) string {
 					str = str[len(found):]
 					continue
 				}
-				self.error("decimal escape too large near '%s'", found)
+				self.errorNear("decimal escape too large", found)
 			}
 		case 'x': // \xXX
 			if found := reHexEscapeSeq.FindString(str); found != "" {
@@ -397,12 +464,12 @@ func (self *Lexer) escape(str string) string {
 		case 'u': // \u{XXX}
 			if found := reUnicodeEscapeSeq.FindString(str); found != "" {
 				d, err := strconv.ParseInt(found[3:len(found)-1], 16, 32)
-				if err == nil && d <= 0x10FFFF {
-					buf.WriteRune(rune(d))
+				if err == nil && d <= self.maxUTF8 {
+					buf.WriteString(number.UTF8Esc(uint32(d)))
 					str = str[len(found):]
 					continue
 				}
-				self.error("UTF-8 value too large near '%s'", found)
+				self.errorNear("UTF-8 value too large", found)
 			}
 		case 'z':
 			str = str[2:]
@@ -411,17 +478,38 @@ func (self *Lexer) escape(str string) string {
 			}
 			continue
 		}
-		self.error("invalid escape sequence near '\\%c'", str[1])
+		self.errorNear("invalid escape sequence", "\\"+string(str[1]))
 	}
 
 	return buf.String()
 }
 
-// error:词法错误处理
-func (self *Lexer) error(f string, a ...interface{}) {
-	err := fmt.Sprintf(f, a)
-	err = fmt.Sprintf("%s:%d: %s", self.chunkName, self.line, err)
-	panic(err)
+// errorNear:词法和语法错误处理，token是出错的token，为空时没有near部分
+// 位置是当前token开始的地方
+// lua-5.3.4/src/llex.c#lexerror()
+func (self *Lexer) errorNear(msg, token string) {
+	panic(&Diagnostic{
+		ChunkName: self.chunkName,
+		Line:      self.line,
+		Column:    self.column,
+		Message:   msg,
+		Token:     token,
+	})
+}
+
+// offset:已经分析过的源代码长度
+func (self *Lexer) offset() int {
+	return len(self.src) - len(self.chunk)
+}
+
+// columnAt:源代码中第offset个字节所在的列号，从1开始
+// offset只会增大，每次只在上次查找过的位置之后找换行符
+func (self *Lexer) columnAt(offset int) int {
+	if i := strings.LastIndexAny(self.src[self.scanned:offset], "\r\n"); i >= 0 {
+		self.lineStart = self.scanned + i + 1
+	}
+	self.scanned = offset
+	return offset - self.lineStart + 1
 }
 
 // scan:针对指定正则进行扫描
@@ -438,12 +526,14 @@ func (self *Lexer) LookAhead() int {
 	if self.nextTokenLine > 0 {
 		return self.nextTokenKind
 	}
-	currentLine := self.line
+	currentLine, currentColumn, currentText := self.line, self.column, self.text
 	line, kind, token := self.NextToken()
-	self.line = currentLine
 	self.nextTokenLine = line
 	self.nextTokenKind = kind
 	self.nextToken = token
+	self.nextTokenColumn = self.column
+	self.nextTokenText = self.text
+	self.line, self.column, self.text = currentLine, currentColumn, currentText
 	return kind
 }
 
@@ -454,7 +544,10 @@ func (self *Lexer) NextIdentifier() (line int, token string) {
 func (self *Lexer) NextTokenOfKind(kind int) (line int, token string) {
 	line, _kind, token := self.NextToken()
 	if kind != _kind {
-		self.error("syntax error near '%s'", token)
+		if _kind == TOKEN_EOF {
+			self.errorNear("syntax error", "<eof>")
+		}
+		self.errorNear("syntax error", self.text)
 	}
 	return line, token
 }
@@ -462,3 +555,14 @@ func (self *Lexer) NextTokenOfKind(kind int) (line int, token string) {
 func (self *Lexer) Line() int {
 	return self.line
 }
+
+// Column:当前token开始的列号
+func (self *Lexer) Column() int {
+	return self.column
+}
+
+// Error:语法分析中的语义错误，和词法错误一样附带chunk名和当前位置，没有near部分
+// lua-5.3.4/src/lparser.c#semerror()
+func (self *Lexer) Error(f string, a ...interface{}) {
+	self.errorNear(fmt.Sprintf(f, a...), "")
+}
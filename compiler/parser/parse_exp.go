@@ -300,7 +300,7 @@ func parseTableConstructorExp(lexer *Lexer) *TableConstructorExp {
 
 // fieldlist ::= field {fieldsep field} [fieldsep]
 func _parseFieldList(lexer *Lexer) (ks, vs []Exp) {
-	if lexer.LookAhead() != TOKEN_SEP_LCURLY {
+	if lexer.LookAhead() != TOKEN_SEP_RCURLY {
 		k, v := _parseField(lexer)
 		ks = append(ks, k)
 		vs = append(vs, v)
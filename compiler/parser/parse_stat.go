@@ -63,16 +63,18 @@ func parseBreakStat(lexer *Lexer) *BreakStat {
 
 func parseLabelStat(lexer *Lexer) *LabelStat {
 	// 跳过分隔符记录签名
-	lexer.NextTokenOfKind(TOKEN_SEP_LABEL)
+	line, _ := lexer.NextTokenOfKind(TOKEN_SEP_LABEL)
+	column := lexer.Column()
 	_, name := lexer.NextIdentifier()
 	lexer.NextTokenOfKind(TOKEN_SEP_LABEL)
-	return &LabelStat{Name: name}
+	return &LabelStat{Line: line, Column: column, Name: name}
 }
 
 func parseGotoStat(lexer *Lexer) *GotoStat {
-	lexer.NextTokenOfKind(TOKEN_KW_GOTO)
+	line, _ := lexer.NextTokenOfKind(TOKEN_KW_GOTO)
+	column := lexer.Column()
 	_, name := lexer.NextIdentifier()
-	return &GotoStat{Name: name}
+	return &GotoStat{Line: line, Column: column, Name: name}
 }
 
 func parseDoStat(lexer *Lexer) *DoStat {
@@ -289,17 +291,52 @@ func _finishLocalFuncDefStat(lexer *Lexer) *LocalFuncDefStat {
 	return &LocalFuncDefStat{name, fdExp}
 }
 
-// local namelist [‘=’ explist] 局部变量
+// local attnamelist [‘=’ explist] 局部变量
 func _finishLocalVarDeclStat(lexer *Lexer) *LocalVarDeclStat {
-	_, name0 := lexer.NextIdentifier()        // local Name
-	nameList := _finishNameList(lexer, name0) // { , Name }
+	nameList, attribList := _parseAttribNameList(lexer) // Name attrib { , Name attrib }
 	var expList []Exp = nil
 	if lexer.LookAhead() == TOKEN_OP_ASSIGN {
 		lexer.NextToken()             // ==
 		expList = parseExpList(lexer) // explist
 	}
 	lastLine := lexer.Line()
-	return &LocalVarDeclStat{lastLine, nameList, expList}
+	return &LocalVarDeclStat{lastLine, nameList, expList, attribList}
+}
+
+// attnamelist ::= Name attrib {‘,’ Name attrib}
+// 一个列表中最多只能有一个<close>变量
+func _parseAttribNameList(lexer *Lexer) (names, attribs []string) {
+	hasClose := false
+	for {
+		_, name := lexer.NextIdentifier()
+		attrib := _parseAttrib(lexer)
+		if attrib == "close" {
+			if hasClose {
+				lexer.Error("multiple to-be-closed variables in local list")
+			}
+			hasClose = true
+		}
+		names = append(names, name)
+		attribs = append(attribs, attrib)
+		if lexer.LookAhead() != TOKEN_SEP_COMMA {
+			return
+		}
+		lexer.NextToken()
+	}
+}
+
+// attrib ::= [‘<’ Name ‘>’]
+func _parseAttrib(lexer *Lexer) string {
+	if lexer.LookAhead() != TOKEN_OP_LT {
+		return ""
+	}
+	lexer.NextToken()
+	_, attrib := lexer.NextIdentifier()
+	lexer.NextTokenOfKind(TOKEN_OP_GT)
+	if attrib != "const" && attrib != "close" {
+		lexer.Error("unknown attribute '%s'", attrib)
+	}
+	return attrib
 }
 
 // funcname ::= Name {‘.’ Name} [‘:’ Name]
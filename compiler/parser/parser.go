@@ -6,7 +6,11 @@ import (
 )
 
 func Parse(chunk, chunkName string) *Block {
-	lexer := NewLexer(chunk, chunkName)
+	return ParseLexer(NewLexer(chunk, chunkName))
+}
+
+// ParseLexer: 分析lexer中的源代码，调用者可以先设置lexer的选项（如SetLua54）
+func ParseLexer(lexer *Lexer) *Block {
 	block := parseBlock(lexer)
 	lexer.NextTokenOfKind(TOKEN_EOF)
 	return block
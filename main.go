@@ -3,20 +3,280 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	. "luago/api"
 	. "luago/compiler/lexer"
 	"luago/compiler/parser"
+	"luago/repl"
 	"luago/state"
 	"os"
+	"strings"
 )
 
+/* bits of various argument indicators in 'args' */
+const (
+	has_error = 1  /* bad option */
+	has_i     = 2  /* -i */
+	has_v     = 4  /* -v */
+	has_e     = 8  /* -e */
+	has_E     = 16 /* -E */
+)
+
+// 命令行用法同标准的lua程序：lua [options] [script [args]]
+// lua-5.3.4/src/lua.c#main()
 func main() {
-	if len(os.Args) > 1 {
-		ls := state.New()
-		ls.OpenLibs()           // 开启标准库
-		ls.LoadFile(os.Args[1]) // 加载文件
-		ls.Call(0, -1)
+	ls := state.New()
+	ls.PushGoFunction(func(ls LuaState) int { /* to call 'pmain' in protected mode */
+		ls.PushBoolean(pmain(ls, os.Args)) /* result */
+		return 1
+	})
+	status := ls.PCall(0, 1, 0) /* do the call */
+	result := ls.ToBoolean(-1)  /* get result */
+	repl.Report(ls, status)
+	ls.Close()
+	if !result || status != LUA_OK {
+		os.Exit(1) /* EXIT_FAILURE */
+	}
+}
+
+// lua-5.3.4/src/lua.c#pmain()
+func pmain(ls LuaState, argv []string) bool {
+	args, script := collectArgs(argv)
+	if len(argv) > 0 && argv[0] != "" {
+		repl.ProgName = argv[0]
+	}
+	if args == has_error { /* bad arg? */
+		printUsage(argv[script]) /* 'script' has index of bad arg. */
+		return false
+	}
+	if args&has_v != 0 { /* option '-v'? */
+		printVersion()
+	}
+	if args&has_E != 0 { /* option '-E'? */
+		ls.PushBoolean(true) /* signal for libraries to ignore env. vars. */
+		ls.SetField(LUA_REGISTRYINDEX, "LUA_NOENV")
+	}
+	ls.OpenLibs()                    /* open standard libraries */
+	createArgTable(ls, argv, script) /* create table 'arg' */
+	if args&has_E == 0 {             /* no option '-E'? */
+		if handleLuaInit(ls) != LUA_OK { /* run LUA_INIT */
+			return false /* error running LUA_INIT */
+		}
+	}
+	if !runArgs(ls, argv, script) { /* execute arguments -e and -l */
+		return false /* something failed */
+	}
+	if script < len(argv) && /* execute main script (if there is one) */
+		handleScript(ls, argv, script) != LUA_OK {
+		return false
+	}
+	if args&has_i != 0 { /* -i option? */
+		repl.Run(ls) /* do read-eval-print loop */
+	} else if script == len(argv) && args&(has_e|has_v) == 0 { /* no arguments? */
+		if stdinIsTTY() { /* running in interactive mode? */
+			printVersion()
+			repl.Run(ls) /* do read-eval-print loop */
+		} else {
+			doFile(ls, "") /* executes stdin as a file */
+		}
+	}
+	return true
+}
+
+// 检查选项，返回选项标志和脚本名（或出错的选项）的下标
+// lua-5.3.4/src/lua.c#collectargs()
+func collectArgs(argv []string) (args, first int) {
+	i := 1
+	for ; i < len(argv); i++ {
+		first = i
+		arg := argv[i]
+		if arg == "" || arg[0] != '-' { /* not an option? */
+			return args, first /* stop handling options */
+		}
+		if arg == "-" {
+			return args, first /* script "name" is '-' */
+		}
+		switch arg[1] { /* else check option */
+		case '-': /* '--' */
+			if len(arg) > 2 { /* extra characters after '--'? */
+				return has_error, first /* invalid option */
+			}
+			return args, i + 1
+		case 'E':
+			if len(arg) > 2 { /* extra characters after 1st? */
+				return has_error, first /* invalid option */
+			}
+			args |= has_E
+		case 'i', 'v':
+			if arg[1] == 'i' {
+				args |= has_i /* (-i implies -v) */
+			}
+			if len(arg) > 2 { /* extra characters after 1st? */
+				return has_error, first /* invalid option */
+			}
+			args |= has_v
+		case 'e', 'l': /* both options need an argument */
+			if arg[1] == 'e' {
+				args |= has_e
+			}
+			if len(arg) == 2 { /* no concatenated argument? */
+				i++ /* try next 'argv' */
+				if i >= len(argv) || strings.HasPrefix(argv[i], "-") {
+					return has_error, first /* no next argument or it is another option */
+				}
+			}
+		default: /* invalid option */
+			return has_error, first
+		}
+	}
+	return args, i /* no script name */
+}
+
+// lua-5.3.4/src/lua.c#print_usage()
+func printUsage(badOption string) {
+	fmt.Fprintf(os.Stderr, "%s: ", repl.ProgName)
+	if badOption[1] == 'e' || badOption[1] == 'l' {
+		fmt.Fprintf(os.Stderr, "'%s' needs argument\n", badOption)
+	} else {
+		fmt.Fprintf(os.Stderr, "unrecognized option '%s'\n", badOption)
+	}
+	fmt.Fprintf(os.Stderr, "usage: %s [options] [script [args]]\n"+
+		"Available options are:\n"+
+		"  -e stat  execute string 'stat'\n"+
+		"  -i       enter interactive mode after executing 'script'\n"+
+		"  -l name  require library 'name'\n"+
+		"  -v       show version information\n"+
+		"  -E       ignore environment variables\n"+
+		"  --       stop handling options\n"+
+		"  -        stop handling options and execute stdin\n",
+		repl.ProgName)
+}
+
+// lua-5.3.4/src/lua.c#print_version()
+func printVersion() {
+	fmt.Println(LUA_COPYRIGHT)
+}
+
+// 创建全局表arg：脚本名在arg[0]，之前的参数为负下标，之后的参数为正下标
+// lua-5.3.4/src/lua.c#createargtable()
+func createArgTable(ls LuaState, argv []string, script int) {
+	if script == len(argv) {
+		script = 0 /* no script name? */
 	}
+	narg := len(argv) - (script + 1) /* number of positive indices */
+	ls.CreateTable(narg, script+1)
+	for i, arg := range argv {
+		ls.PushString(arg)
+		ls.RawSetI(-2, int64(i-script))
+	}
+	ls.SetGlobal("arg")
+}
+
+// lua-5.3.4/src/lua.c#dochunk()
+func doChunk(ls LuaState, status int) int {
+	if status == LUA_OK {
+		status = repl.DoCall(ls, 0, 0)
+	}
+	return repl.Report(ls, status)
+}
+
+// lua-5.3.4/src/lua.c#dofile()
+func doFile(ls LuaState, name string) int {
+	return doChunk(ls, ls.LoadFile(name))
+}
+
+// lua-5.3.4/src/lua.c#dostring()
+func doString(ls LuaState, s, name string) int {
+	return doChunk(ls, ls.Load([]byte(s), name, "bt"))
+}
+
+// 执行require(name)，并把结果赋给同名全局变量
+// lua-5.3.4/src/lua.c#dolibrary()
+func doLibrary(ls LuaState, name string) int {
+	ls.GetGlobal("require")
+	ls.PushString(name)
+	status := repl.DoCall(ls, 1, 1) /* call 'require(name)' */
+	if status == LUA_OK {
+		ls.SetGlobal(name) /* global[name] = require return */
+	}
+	return repl.Report(ls, status)
+}
+
+// 执行-e和-l选项
+// lua-5.3.4/src/lua.c#runargs()
+func runArgs(ls LuaState, argv []string, n int) bool {
+	for i := 1; i < n; i++ {
+		option := argv[i][1]
+		if option == 'e' || option == 'l' {
+			extra := argv[i][2:] /* both options need an argument */
+			if extra == "" {
+				i++
+				extra = argv[i]
+			}
+			var status int
+			if option == 'e' {
+				status = doString(ls, extra, "=(command line)")
+			} else {
+				status = doLibrary(ls, extra)
+			}
+			if status != LUA_OK {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// 执行脚本，arg中的正下标参数作为脚本的可变参数
+// lua-5.3.4/src/lua.c#handle_script()
+func handleScript(ls LuaState, argv []string, script int) int {
+	fname := argv[script]
+	if fname == "-" && argv[script-1] != "--" {
+		fname = "" /* stdin */
+	}
+	status := ls.LoadFile(fname)
+	if status == LUA_OK {
+		n := pushArgs(ls) /* push arguments to script */
+		status = repl.DoCall(ls, n, LUA_MULTRET)
+	}
+	return repl.Report(ls, status)
+}
+
+// lua-5.3.4/src/lua.c#pushargs()
+func pushArgs(ls LuaState) int {
+	if ls.GetGlobal("arg") != LUA_TTABLE {
+		ls.Error2("'arg' is not a table")
+	}
+	n := int(ls.Len2(-1))
+	ls.CheckStack2(n+3, "too many arguments to script")
+	i := 1
+	for ; i <= n; i++ {
+		ls.RawGetI(-i, int64(i))
+	}
+	ls.Remove(-i) /* remove table from the stack */
+	return n
+}
+
+// 执行环境变量LUA_INIT_5_3（或LUA_INIT）中的代码，以'@'开头时作为文件名
+// lua-5.3.4/src/lua.c#handle_luainit()
+func handleLuaInit(ls LuaState) int {
+	name := "=LUA_INIT_5_3"
+	init, ok := os.LookupEnv(name[1:])
+	if !ok {
+		name = "=LUA_INIT"
+		init, ok = os.LookupEnv(name[1:]) /* try alternative name */
+	}
+	if !ok {
+		return LUA_OK
+	} else if strings.HasPrefix(init, "@") {
+		return doFile(ls, init[1:])
+	} else {
+		return doString(ls, init, name)
+	}
+}
 
+func stdinIsTTY() bool {
+	fi, err := os.Stdin.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
 }
 
 // 测试模块使用
@@ -0,0 +1,57 @@
+package number
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// IntegerToString: 整数转字符串
+func IntegerToString(i int64) string {
+	return strconv.FormatInt(i, 10)
+}
+
+// FloatToString: 浮点数转字符串，格式同C的"%.14g"
+// 看起来像整数的结果补上".0"，inf和nan的写法与C一致
+// lua-5.3.4/src/lobject.c#tostringbuff()
+func FloatToString(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	case math.IsNaN(f):
+		if math.Signbit(f) {
+			return "-nan"
+		}
+		return "nan"
+	}
+	s := strconv.FormatFloat(f, 'g', 14, 64)
+	if strings.Trim(s, "-0123456789") == "" { /* looks like an int? */
+		s += ".0" /* adds '.0' to result */
+	}
+	return s
+}
+
+// UTF8Esc: 把码点编码成UTF-8，最大0x7FFFFFFF（最长6字节），代理项也照常编码
+// lua-5.4.6/src/lobject.c#luaO_utf8esc()
+func UTF8Esc(x uint32) string {
+	if x < 0x80 { /* ascii? */
+		return string([]byte{byte(x)})
+	}
+	var buf [6]byte
+	n := len(buf)
+	mfb := uint32(0x3f) /* maximum that fits in first byte */
+	for {
+		n-- /* add continuation bytes */
+		buf[n] = byte(0x80 | x&0x3f)
+		x >>= 6   /* remove added bits */
+		mfb >>= 1 /* now there is one less bit available in first byte */
+		if x <= mfb {
+			break
+		}
+	}
+	n--
+	buf[n] = byte(^mfb<<1 | x) /* add first byte */
+	return string(buf[n:])
+}
@@ -5,10 +5,13 @@ import (
 )
 
 // FloatToInteger:浮点数转整数
-// todo:思考什么情况下会出现错误
+// 只有f没有小数部分且在int64范围内时才能转换，否则int64(f)的结果是未定义的
 func FloatToInteger(f float64) (int64, bool) {
-	i := int64(f)
-	return i, float64(i) == f
+	if f >= -(1<<63) && f < 1<<63 {
+		i := int64(f)
+		return i, float64(i) == f
+	}
+	return 0, false
 }
 
 // IFloorDiv:整数类型除法
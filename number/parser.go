@@ -1,15 +1,194 @@
 package number
 
-import "strconv"
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// maximum number of significant digits to read (to avoid overflows
+// even with single floats)
+const maxSigDig = 30
 
 // ParseInteger: 字符串解析成整数
+// 允许前后空白和十六进制，十六进制溢出时回绕，十进制溢出时失败（交给ParseFloat）
+// lua-5.3.4/src/lobject.c#l_str2int()
 func ParseInteger(str string) (int64, bool) {
-	i, err := strconv.ParseInt(str, 10, 64)
-	return i, err == nil
+	str = trimSpace(str)
+	neg := false
+	if strings.HasPrefix(str, "-") {
+		str = str[1:]
+		neg = true
+	} else if strings.HasPrefix(str, "+") {
+		str = str[1:]
+	}
+	if str == "" {
+		return 0, false
+	}
+
+	var a uint64
+	if isHexPrefix(str) { /* hex? */
+		str = str[2:]
+		if str == "" {
+			return 0, false
+		}
+		for i := 0; i < len(str); i++ {
+			d, ok := hexDigit(str[i])
+			if !ok {
+				return 0, false
+			}
+			a = a*16 + uint64(d) /* wrap around */
+		}
+	} else { /* decimal */
+		const maxBy10 = math.MaxInt64 / 10
+		const maxLastD = math.MaxInt64 % 10
+		for i := 0; i < len(str); i++ {
+			c := str[i]
+			if c < '0' || c > '9' {
+				return 0, false
+			}
+			d := uint64(c - '0')
+			if a >= maxBy10 && (a > maxBy10 || d > maxLastD+b2u(neg)) {
+				return 0, false /* overflow: do not accept it (as integer) */
+			}
+			a = a*10 + d
+		}
+	}
+	if neg {
+		a = 0 - a
+	}
+	return int64(a), true
 }
 
 // ParseFloat: 字符串解析成浮点数
+// 允许前后空白和十六进制浮点数（指数部分可选），不接受inf和nan
+// lua-5.3.4/src/lobject.c#l_str2d()
 func ParseFloat(str string) (float64, bool) {
+	str = trimSpace(str)
+	if strings.ContainsAny(str, "nN") { /* reject 'inf' and 'nan' */
+		return 0, false
+	}
+	if body := str; body != "" {
+		if body[0] == '-' || body[0] == '+' {
+			body = body[1:]
+		}
+		if isHexPrefix(body) {
+			return parseHexFloat(str)
+		}
+	}
+	for i := 0; i < len(str); i++ { /* strtod语法之外的字符，如'_' */
+		if strings.IndexByte("0123456789+-.eE", str[i]) < 0 {
+			return 0, false
+		}
+	}
 	f, err := strconv.ParseFloat(str, 64)
-	return f, err == nil
+	if err != nil {
+		if ne, ok := err.(*strconv.NumError); !ok || ne.Err != strconv.ErrRange {
+			return 0, false
+		} /* 溢出时与strtod一样得到±HUGE_VAL */
+	}
+	return f, true
+}
+
+// lua-5.3.4/src/lobject.c#lua_strx2number()
+func parseHexFloat(str string) (float64, bool) {
+	neg := false
+	if strings.HasPrefix(str, "-") {
+		str = str[1:]
+		neg = true
+	} else if strings.HasPrefix(str, "+") {
+		str = str[1:]
+	}
+	str = str[2:] /* skip '0x' */
+
+	r := 0.0      /* result (accumulator) */
+	sigDig := 0   /* number of significant digits */
+	noSigDig := 0 /* number of non-significant digits */
+	e := 0        /* exponent correction */
+	hasDot := false
+	i := 0
+	for ; i < len(str); i++ {
+		if str[i] == '.' {
+			if hasDot {
+				break /* second dot? stop loop */
+			}
+			hasDot = true
+		} else if d, ok := hexDigit(str[i]); ok {
+			if sigDig == 0 && d == 0 { /* non-significant digit (zero)? */
+				noSigDig++
+			} else if sigDig++; sigDig <= maxSigDig { /* can read it without overflow? */
+				r = r*16 + float64(d)
+			} else {
+				e++ /* too many digits; ignore, but still count for exponent */
+			}
+			if hasDot {
+				e-- /* decimal digit? correct exponent */
+			}
+		} else {
+			break /* neither a dot nor a digit */
+		}
+	}
+	if noSigDig+sigDig == 0 { /* no digits? */
+		return 0, false
+	}
+	e *= 4 /* each digit multiplies/divides value by 2^4 */
+	str = str[i:]
+	if str != "" && (str[0] == 'p' || str[0] == 'P') { /* exponent part? */
+		str = str[1:]
+		expNeg := false
+		if str != "" && (str[0] == '-' || str[0] == '+') {
+			expNeg = str[0] == '-'
+			str = str[1:]
+		}
+		if str == "" {
+			return 0, false /* invalid; must have at least one digit */
+		}
+		exp1 := 0
+		for j := 0; j < len(str); j++ {
+			if str[j] < '0' || str[j] > '9' {
+				return 0, false
+			}
+			if exp1 < 1<<20 { /* 足以溢出或下溢 */
+				exp1 = exp1*10 + int(str[j]-'0')
+			}
+		}
+		if expNeg {
+			exp1 = -exp1
+		}
+		e += exp1
+	} else if str != "" {
+		return 0, false
+	}
+	if neg {
+		r = -r
+	}
+	return math.Ldexp(r, e), true
+}
+
+// 跳过lisspace定义的空白字符
+func trimSpace(s string) string {
+	return strings.Trim(s, " \f\n\r\t\v")
+}
+
+func isHexPrefix(s string) bool {
+	return len(s) >= 2 && s[0] == '0' && (s[1] == 'x' || s[1] == 'X')
+}
+
+func hexDigit(c byte) (int, bool) {
+	switch {
+	case c >= '0' && c <= '9':
+		return int(c - '0'), true
+	case c >= 'a' && c <= 'f':
+		return int(c-'a') + 10, true
+	case c >= 'A' && c <= 'F':
+		return int(c-'A') + 10, true
+	}
+	return 0, false
+}
+
+func b2u(b bool) uint64 {
+	if b {
+		return 1
+	}
+	return 0
 }
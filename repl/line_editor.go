@@ -0,0 +1,264 @@
+package repl
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+/* 按下Ctrl-C放弃当前行 */
+var errInterrupted = errors.New("interrupted")
+
+const maxHistory = 1000
+
+// 简单的单行编辑器：终端支持时进入raw模式，提供光标移动、删除和历史记录，
+// 否则（比如输入被重定向）退化为按行读取
+type lineEditor struct {
+	in      io.Reader
+	out     io.Writer
+	reader  *bufio.Reader
+	history []string
+
+	// 当前行的编辑状态
+	buf     []rune
+	pos     int // 光标在buf中的位置
+	histIdx int // 正在浏览的历史记录，len(history)表示当前输入
+	saved   []rune
+}
+
+func newLineEditor(in io.Reader, out io.Writer) *lineEditor {
+	return &lineEditor{
+		in:     in,
+		out:    out,
+		reader: bufio.NewReader(in),
+	}
+}
+
+// addHistory: 记录一行输入，忽略空行和与上一条相同的行
+func (self *lineEditor) addHistory(line string) {
+	if strings.TrimSpace(line) == "" {
+		return
+	}
+	if n := len(self.history); n > 0 && self.history[n-1] == line {
+		return
+	}
+	self.history = append(self.history, line)
+	if len(self.history) > maxHistory {
+		self.history = self.history[1:]
+	}
+}
+
+// readLine: 显示提示符并读取一行（不含换行符）
+// 输入结束时返回io.EOF，按下Ctrl-C时返回errInterrupted
+func (self *lineEditor) readLine(prompt string) (string, error) {
+	f, ok := self.in.(*os.File)
+	if !ok {
+		return self.readCooked(prompt)
+	}
+	state, err := makeRaw(f)
+	if err != nil { /* not a terminal */
+		return self.readCooked(prompt)
+	}
+	defer restoreTerminal(f, state)
+	return self.readRaw(prompt)
+}
+
+func (self *lineEditor) readCooked(prompt string) (string, error) {
+	fmt.Fprint(self.out, prompt)
+	line, err := self.reader.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+const (
+	keyCtrlA     = 1
+	keyCtrlB     = 2
+	keyCtrlC     = 3
+	keyCtrlD     = 4
+	keyCtrlE     = 5
+	keyCtrlF     = 6
+	keyCtrlH     = 8
+	keyTab       = 9
+	keyLF        = 10
+	keyCtrlK     = 11
+	keyCtrlL     = 12
+	keyCR        = 13
+	keyCtrlN     = 14
+	keyCtrlP     = 16
+	keyCtrlU     = 21
+	keyCtrlW     = 23
+	keyEsc       = 27
+	keyBackspace = 127
+)
+
+func (self *lineEditor) readRaw(prompt string) (string, error) {
+	self.buf, self.pos = self.buf[:0], 0
+	self.histIdx, self.saved = len(self.history), nil
+	fmt.Fprint(self.out, prompt)
+
+	for {
+		r, _, err := self.reader.ReadRune()
+		if err != nil {
+			fmt.Fprint(self.out, "\r\n")
+			return "", err
+		}
+
+		switch r {
+		case keyCR, keyLF:
+			fmt.Fprint(self.out, "\r\n")
+			return string(self.buf), nil
+		case keyCtrlC:
+			fmt.Fprint(self.out, "^C\r\n")
+			return "", errInterrupted
+		case keyCtrlD:
+			if len(self.buf) == 0 {
+				fmt.Fprint(self.out, "\r\n")
+				return "", io.EOF
+			}
+			self.deleteRune()
+		case keyCtrlA:
+			self.pos = 0
+		case keyCtrlE:
+			self.pos = len(self.buf)
+		case keyCtrlB:
+			self.moveLeft()
+		case keyCtrlF:
+			self.moveRight()
+		case keyBackspace, keyCtrlH:
+			if self.pos > 0 {
+				self.pos--
+				self.deleteRune()
+			}
+		case keyCtrlK:
+			self.buf = self.buf[:self.pos]
+		case keyCtrlU:
+			self.buf = append(self.buf[:0], self.buf[self.pos:]...)
+			self.pos = 0
+		case keyCtrlW:
+			self.deleteWord()
+		case keyCtrlL:
+			fmt.Fprint(self.out, "\x1b[H\x1b[2J")
+		case keyCtrlP:
+			self.historyMove(-1)
+		case keyCtrlN:
+			self.historyMove(1)
+		case keyEsc:
+			self.readEscape()
+		case keyTab:
+			self.insert(' ')
+			self.insert(' ')
+		default:
+			if r >= 32 && r != utf8.RuneError {
+				self.insert(r)
+			}
+		}
+		self.refresh(prompt)
+	}
+}
+
+/* 处理方向键等ESC序列 */
+func (self *lineEditor) readEscape() {
+	b, err := self.reader.ReadByte()
+	if err != nil || (b != '[' && b != 'O') {
+		return
+	}
+	seq := ""
+	for {
+		c, err := self.reader.ReadByte()
+		if err != nil {
+			return
+		}
+		seq += string(c)
+		if c >= '@' && c <= '~' && !(c >= '0' && c <= '9') && c != ';' {
+			break
+		}
+	}
+	switch seq {
+	case "A":
+		self.historyMove(-1)
+	case "B":
+		self.historyMove(1)
+	case "C":
+		self.moveRight()
+	case "D":
+		self.moveLeft()
+	case "H", "1~", "7~":
+		self.pos = 0
+	case "F", "4~", "8~":
+		self.pos = len(self.buf)
+	case "3~":
+		self.deleteRune()
+	}
+}
+
+func (self *lineEditor) insert(r rune) {
+	self.buf = append(self.buf, 0)
+	copy(self.buf[self.pos+1:], self.buf[self.pos:])
+	self.buf[self.pos] = r
+	self.pos++
+}
+
+/* 删除光标处的字符 */
+func (self *lineEditor) deleteRune() {
+	if self.pos < len(self.buf) {
+		self.buf = append(self.buf[:self.pos], self.buf[self.pos+1:]...)
+	}
+}
+
+/* 删除光标前的一个单词 */
+func (self *lineEditor) deleteWord() {
+	i := self.pos
+	for i > 0 && self.buf[i-1] == ' ' {
+		i--
+	}
+	for i > 0 && self.buf[i-1] != ' ' {
+		i--
+	}
+	self.buf = append(self.buf[:i], self.buf[self.pos:]...)
+	self.pos = i
+}
+
+func (self *lineEditor) moveLeft() {
+	if self.pos > 0 {
+		self.pos--
+	}
+}
+
+func (self *lineEditor) moveRight() {
+	if self.pos < len(self.buf) {
+		self.pos++
+	}
+}
+
+/* 在历史记录中上下移动，离开当前输入前先保存它 */
+func (self *lineEditor) historyMove(delta int) {
+	idx := self.histIdx + delta
+	if idx < 0 || idx > len(self.history) {
+		return
+	}
+	if self.histIdx == len(self.history) {
+		self.saved = append(self.saved[:0], self.buf...)
+	}
+	self.histIdx = idx
+	if idx == len(self.history) {
+		self.buf = append(self.buf[:0], self.saved...)
+	} else {
+		self.buf = append(self.buf[:0], []rune(self.history[idx])...)
+	}
+	self.pos = len(self.buf)
+}
+
+/* 重画当前行并把光标放到正确位置 */
+func (self *lineEditor) refresh(prompt string) {
+	col := utf8.RuneCountInString(prompt) + self.pos
+	fmt.Fprintf(self.out, "\r%s%s\x1b[K\r", prompt, string(self.buf))
+	if col > 0 {
+		fmt.Fprintf(self.out, "\x1b[%dC", col)
+	}
+}
@@ -0,0 +1,201 @@
+package repl
+
+import (
+	"fmt"
+	. "luago/api"
+	"os"
+	"os/signal"
+	"strings"
+)
+
+const (
+	LUA_PROGNAME = "lua"
+	LUA_PROMPT   = "> "
+	LUA_PROMPT2  = ">> "
+	EOFMARK      = "<eof>" /* mark in error messages for incomplete statements */
+)
+
+// ProgName: 错误信息前显示的程序名
+var ProgName = LUA_PROGNAME
+
+// Run: 交互式解释器，逐条读取语句并执行，打印表达式的值
+// 输入不完整时（错误信息以<eof>结尾）继续读取下一行
+// lua-5.3.4/src/lua.c#doREPL()
+func Run(ls LuaState) {
+	editor := newLineEditor(ls.Stdin(), ls.Stdout())
+	for {
+		status, ok := loadLine(ls, editor)
+		if !ok { /* no more input */
+			break
+		}
+		if status == LUA_OK {
+			status = DoCall(ls, 0, LUA_MULTRET)
+		}
+		if status == LUA_OK {
+			printResults(ls)
+		} else {
+			Report(ls, status)
+		}
+	}
+	ls.SetTop(0) /* clear stack */
+	fmt.Fprintln(ls.Stdout())
+}
+
+// 读取一条完整的语句并编译，返回编译状态
+// lua-5.3.4/src/lua.c#loadline()
+func loadLine(ls LuaState, editor *lineEditor) (int, bool) {
+	ls.SetTop(0)
+	line, ok := pushLine(ls, editor, true)
+	if !ok {
+		return 0, false /* no input */
+	}
+	status := addReturn(ls, editor, line)
+	if status != LUA_OK { /* 'return ...' did not work? */
+		status = multiLine(ls, editor, line) /* try as command, maybe with continuation lines */
+	}
+	return status, true
+}
+
+// 读取一行，以'='开头的行改写为'return'语句
+// lua-5.3.4/src/lua.c#pushline()
+func pushLine(ls LuaState, editor *lineEditor, firstLine bool) (string, bool) {
+	for {
+		line, err := editor.readLine(getPrompt(ls, firstLine))
+		if err == errInterrupted {
+			if !firstLine {
+				return "", false
+			}
+			continue /* discard the line and start again */
+		}
+		if err != nil {
+			return "", false
+		}
+		if firstLine && strings.HasPrefix(line, "=") { /* for compatibility with 5.2 */
+			line = "return " + line[1:]
+		}
+		return line, true
+	}
+}
+
+// lua-5.3.4/src/lua.c#get_prompt()
+func getPrompt(ls LuaState, firstLine bool) string {
+	name, dft := "_PROMPT", LUA_PROMPT
+	if !firstLine {
+		name, dft = "_PROMPT2", LUA_PROMPT2
+	}
+	ls.GetGlobal(name)
+	defer ls.Pop(1)
+	if s, ok := ls.ToStringX(-1); ok {
+		return s
+	}
+	return dft
+}
+
+// 先尝试把输入当作表达式，编译为'return <line>'
+// lua-5.3.4/src/lua.c#addreturn()
+func addReturn(ls LuaState, editor *lineEditor, line string) int {
+	status := ls.Load([]byte("return "+line), "=stdin", "t")
+	if status == LUA_OK {
+		if line != "" {
+			editor.addHistory(line) /* keep history */
+		}
+	} else {
+		ls.Pop(1) /* remove result from 'luaL_loadbuffer' */
+	}
+	return status
+}
+
+// 作为语句编译，输入不完整时继续读取下一行
+// lua-5.3.4/src/lua.c#multiline()
+func multiLine(ls LuaState, editor *lineEditor, line string) int {
+	lines := []string{line}
+	for { /* repeat until gets a complete statement */
+		status := ls.Load([]byte(strings.Join(lines, "\n")), "=stdin", "t")
+		if !incomplete(ls, status) {
+			for _, l := range lines {
+				editor.addHistory(l) /* keep history */
+			}
+			return status /* cannot or should not try to add continuation line */
+		}
+		ls.Pop(1) /* remove error message */
+		next, ok := pushLine(ls, editor, false)
+		if !ok { /* no more input or interrupted? */
+			ls.PushString("incomplete statement discarded")
+			return LUA_ERRSYNTAX
+		}
+		lines = append(lines, next)
+	}
+}
+
+// lua-5.3.4/src/lua.c#incomplete()
+func incomplete(ls LuaState, status int) bool {
+	if status == LUA_ERRSYNTAX {
+		msg := ls.ToString(-1)
+		return strings.HasSuffix(msg, EOFMARK)
+	}
+	return false
+}
+
+// DoCall: 执行栈上的函数，执行期间Ctrl-C会中断执行，中断只对这次调用有效
+// lua-5.3.4/src/lua.c#docall()
+func DoCall(ls LuaState, nArgs, nResults int) int {
+	sigs := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	signal.Notify(sigs, os.Interrupt)
+	go func() {
+		defer close(exited)
+		select {
+		case <-sigs:
+			ls.Interrupt()
+		case <-done:
+		}
+	}()
+	status := ls.PCall(nArgs, nResults, 0)
+	signal.Stop(sigs)
+	close(done)
+	<-exited
+	ls.ClearInterrupt() /* a Ctrl-C after the call has finished must not abort the next one */
+	return status
+}
+
+// 调用print打印栈上的全部结果
+// lua-5.3.4/src/lua.c#l_print()
+func printResults(ls LuaState) {
+	n := ls.GetTop()
+	if n > 0 { /* any result to be printed? */
+		ls.CheckStack2(LUA_MINSTACK, "too many results to print")
+		ls.GetGlobal("print")
+		ls.Insert(1)
+		if ls.PCall(n, 0, 0) != LUA_OK {
+			msg := fmt.Sprintf("error calling 'print' (%s)", ls.ToString(-1))
+			PrintMessage(ls, msg)
+		}
+	}
+}
+
+// Report: 出错时打印栈顶的错误信息并将其弹出，返回status
+// 非字符串的错误对象尽量转换为字符串
+// lua-5.3.4/src/lua.c#report()
+func Report(ls LuaState, status int) int {
+	if status != LUA_OK {
+		var msg string
+		if s, ok := ls.ToStringX(-1); ok {
+			msg = s
+		} else if ls.CallMeta(-1, "__tostring") && ls.IsString(-1) {
+			msg = ls.ToString(-1)
+			ls.Pop(1)
+		} else {
+			msg = fmt.Sprintf("(error object is a %s value)", ls.TypeName2(-1))
+		}
+		PrintMessage(ls, msg)
+		ls.Pop(1) /* remove message */
+	}
+	return status
+}
+
+// PrintMessage: 向state的错误输出打印带程序名的信息
+// lua-5.3.4/src/lua.c#l_message()
+func PrintMessage(ls LuaState, msg string) {
+	fmt.Fprintf(ls.Stderr(), "%s: %s\n", ProgName, msg)
+}
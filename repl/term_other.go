@@ -0,0 +1,17 @@
+//go:build !linux
+
+package repl
+
+import (
+	"errors"
+	"os"
+)
+
+type termState struct{}
+
+// 其他平台不支持raw模式，行编辑器退化为按行读取
+func makeRaw(f *os.File) (*termState, error) {
+	return nil, errors.New("raw mode not supported")
+}
+
+func restoreTerminal(f *os.File, state *termState) {}
@@ -1,8 +1,8 @@
 package state
 
 import (
-	"fmt"
 	. "luago/api"
+	"luago/number"
 )
 
 func (self *luaState) TypeName(tp LuaType) string {
@@ -54,7 +54,9 @@ func (self *luaState) IsBoolean(idx int) bool {
 }
 
 func (self *luaState) IsInteger(idx int) bool {
-	return self.Type(idx) == LUA_TTABLE
+	val := self.stack.get(idx)
+	_, ok := val.(int64)
+	return ok
 }
 
 func (self *luaState) IsNumber(idx int) bool {
@@ -116,8 +118,12 @@ func (self *luaState) ToStringX(idx int) (string, bool) {
 	switch x := val.(type) {
 	case string:
 		return x, true
-	case int64, float64:
-		s := fmt.Sprintf("%v", x) // todo
+	case int64:
+		s := number.IntegerToString(x)
+		self.stack.set(idx, s)
+		return s, true
+	case float64:
+		s := number.FloatToString(x)
 		self.stack.set(idx, s)
 		return s, true
 	default:
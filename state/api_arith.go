@@ -66,7 +66,9 @@ func (self *luaState) Arith(op ArithOp) {
 	// 更正 并非作者笔误，起初在写abc模式提取操作数时，误认为排列时cba，
 	// 	实际上的排列是 B(9位) C(9位) A(8位) OPCODE(6位)
 	operator := operators[op]
-	if result := _arith(a, b, operator); result != nil {
+	// 5.4中字符串的算术运算由字符串元表中的元方法完成
+	coerceStrings := self.version < LUA_VERSION_NUM_54
+	if result := _arith(a, b, operator, coerceStrings); result != nil {
 		self.stack.push(result)
 		return
 	}
@@ -75,11 +77,25 @@ func (self *luaState) Arith(op ArithOp) {
 		self.stack.push(result)
 		return
 	}
-	panic("arithmetic error")
+	if operator.floatFunc == nil { /* bitwise operation? */
+		if _, ok := convertToFloat(_stringToNumber(a)); ok {
+			if _, ok := convertToFloat(_stringToNumber(b)); ok {
+				self.toIntError(a, b) /* both are numbers */
+			}
+		}
+		self.opInterror(a, b, "perform bitwise operation on")
+	}
+	self.opInterror(a, b, "perform arithmetic on")
+}
+
+func _isString(val luaValue) bool {
+	_, ok := val.(string)
+	return ok
 }
 
 // _arith: 区分类型的辅助函数
-func _arith(a, b luaValue, op operator) luaValue {
+// coerceStrings为false时算术运算不把字符串转换为数字（位运算仍然转换）
+func _arith(a, b luaValue, op operator, coerceStrings bool) luaValue {
 	if op.floatFunc == nil {
 		// 没有浮点型运算函数一般为位运算，先将其转换为整数
 		if x, ok := convertToInteger(a); ok {
@@ -88,7 +104,12 @@ func _arith(a, b luaValue, op operator) luaValue {
 			}
 		}
 	} else {
-		// 常规算术符运算
+		// 常规算术符运算，字符串按Lua的规则先转换为整数或浮点数
+		if coerceStrings {
+			a, b = _stringToNumber(a), _stringToNumber(b)
+		} else if _isString(a) || _isString(b) {
+			return nil
+		}
 		if op.integerFunc != nil {
 			// add,sub,mul,mod,idiv,unm
 			if x, ok := a.(int64); ok {
@@ -1,30 +1,83 @@
 package state
 
 import (
+	"fmt"
 	"luago/api"
 	"luago/binchunk"
 	"luago/compiler"
+	"runtime"
+	"strings"
 )
 import "luago/vm"
+import "sync/atomic"
 
 /*
 	Load: 加载chunk，可以是lua也可以是编译后的二进制chunk，根据mode来决定
-		返回值为状态码：0表示成功
+		返回值为状态码：0表示成功，编译出错时返回LUA_ERRSYNTAX并把错误信息压栈
 */
-func (self *luaState) Load(chunk []byte, chunkName, mode string) int {
+func (self *luaState) Load(chunk []byte, chunkName, mode string) (status int) {
+	defer func() {
+		if err := recover(); err != nil {
+			self.stack.push(fmt.Sprint(err))
+			status = api.LUA_ERRSYNTAX
+		}
+	}()
+
 	var proto *binchunk.Prototype
 	if binchunk.IsBinaryChunk(chunk) {
-		proto = binchunk.Undump(chunk)
+		self.checkMode("binary", mode)
+		proto = undump(chunk, chunkName)
 	} else {
-		proto = compiler.Compile(string(chunk), chunkName)
+		self.checkMode("text", mode)
+		proto = self.compile(string(chunk), chunkName)
 	}
-	c := newLuaClosure(proto)
+	c := self.trackClosure(newLuaClosure(proto))
 	self.stack.push(c)
-	if len(proto.Upvalues) > 0 {
-		env := self.registry.get(api.LUA_RIDX_GLOBALS)
-		c.upvals[0] = &upvalue{&env}
+	for i := range c.upvals { /* lua-5.3.4/src/lfunc.c#luaF_initupvals() */
+		c.upvals[i] = &upvalue{new(luaValue)}
+	}
+	if len(proto.Upvalues) > 0 { /* the first upvalue is the global environment */
+		*c.upvals[0].val = self.registry.get(api.LUA_RIDX_GLOBALS)
+	}
+	return api.LUA_OK
+}
+
+// checkMode: mode中没有这种chunk（"binary"或"text"）的首字母时报错，空串表示"bt"
+// WithBinaryChunks(false)时总是拒绝二进制chunk
+// lua-5.3.4/src/ldo.c#checkmode()
+func (self *luaState) checkMode(x, mode string) {
+	if x == "binary" && self.noBinary {
+		panic("attempt to load a binary chunk (binary chunks are disabled)")
+	}
+	if mode != "" && !strings.Contains(mode, x[:1]) {
+		panic(fmt.Sprintf("attempt to load a %s chunk (mode is '%s')", x, mode))
+	}
+}
+
+// undump: 解析二进制chunk并检查字节码，出错时的信息以chunk名开头
+func undump(chunk []byte, chunkName string) *binchunk.Prototype {
+	proto, err := binchunk.Undump(chunk)
+	if err == nil {
+		err = binchunk.Verify(proto)
+	}
+	if err != nil {
+		panic(chunkID(chunkName) + ": " + err.Error())
 	}
-	return 0
+	return proto
+}
+
+// compile: 编译源代码，编译错误按Lua的标准格式chunk:line: msg near 'tok'报告
+// 需要列号等结构化信息的Go代码可以直接调用compiler.Compile
+func (self *luaState) compile(chunk, chunkName string) *binchunk.Prototype {
+	proto, err := compiler.CompileWithOptions(chunk, chunkName, compiler.Options{
+		CompatArg: self.registry.get(api.LUA_COMPAT51) == true,
+		Lua54:     self.version >= api.LUA_VERSION_NUM_54,
+	})
+	if err != nil {
+		d := err.(*compiler.Diagnostic)
+		panic(fmt.Sprintf("%s:%d: %s", chunkID(d.ChunkName), d.Line, d.Msg()))
+	}
+	return proto
 }
 
 // callLuaClosure:具体逻辑，
@@ -33,7 +86,7 @@ func (self *luaState) callLuaClosure(nArgs, nResults int, c *closure) {
 	//	以及是否是vararg函数（会是当扩大）
 	nRegs := int(c.proto.MaxStackSize)
 	nParams := int(c.proto.NumParams)
-	isVararg := c.proto.IsVararg == 1
+	isVararg := c.proto.IsVararg&binchunk.VARARG_ISVARARG != 0
 
 	// 2. 创建一个新的调用帧，把闭包（函数原型）和调用帧联系起来
 	newStack := newLuaStack(nRegs+api.LUA_MINSTACK, self)
@@ -47,6 +100,9 @@ func (self *luaState) callLuaClosure(nArgs, nResults int, c *closure) {
 	if nArgs > nParams && isVararg {
 		newStack.varargs = funcAndArgs[nParams+1:]
 	}
+	if c.proto.IsVararg&binchunk.VARARG_NEEDSARG != 0 {
+		newStack.slots[nParams] = self.newArgTable(newStack.varargs)
+	}
 
 	// 4. 将新帧push进调用栈栈顶，让他成为当前帧，最后调用runLuaClosure
 	self.pushLuaStack(newStack)
@@ -76,6 +132,7 @@ func (self *luaState) callGoClosure(nArgs, nResults int, c *closure) {
 
 	// run closure
 	self.pushLuaStack(newStack)
+	self.checkFinalizers()
 	r := c.goFunc(self)
 	self.popLuaStack()
 
@@ -90,6 +147,12 @@ func (self *luaState) callGoClosure(nArgs, nResults int, c *closure) {
 // runLuaClosure:调用栈顶函数
 func (self *luaState) runLuaClosure() {
 	for {
+		self.checkInterrupt()
+		if self.instLimit > 0 {
+			if self.instCount++; self.instCount > self.instLimit {
+				panic("instruction limit exceeded")
+			}
+		}
 		inst := vm.Instruction(self.Fetch())
 		inst.Execute(self)
 		if inst.Opcode() == vm.OP_RETURN {
@@ -102,6 +165,10 @@ func (self *luaState) runLuaClosure() {
 // 	参数说明：nArgs 参数在寄存器中的索引  nResult：结果值的初始索引（因为会有多个返回值）
 //	也可以理解成被调函数的在寄存器中的索引
 func (self *luaState) Call(nArgs, nResults int) {
+	if self.stack.prev == nil && self == self.mainThread { /* called from the host */
+		self.instCount = 0 /* restart the instruction count */
+		self.checkFinalizers()
+	}
 	val := self.stack.get(-(nArgs + 1))
 
 	c, ok := val.(*closure)
@@ -122,22 +189,136 @@ func (self *luaState) Call(nArgs, nResults int) {
 			self.callGoClosure(nArgs, nResults, c)
 		}
 	} else {
-		panic("not function!")
+		self.valueTypeError(val, "call")
 	}
 }
 
+// Interrupt: 请求中断正在执行的Lua代码，可以在其他goroutine中调用
+// 下一条指令执行前会抛出"interrupted!"错误
+func (self *luaState) Interrupt() {
+	atomic.StoreInt32(&self.interrupted, 1)
+}
+
+// ClearInterrupt: 取消还没有生效的Interrupt请求
+// 在一次调用结束之后才到达的请求会中断下一次调用，宿主可以在调用结束后用它把请求限制在这次调用之内
+func (self *luaState) ClearInterrupt() {
+	atomic.StoreInt32(&self.interrupted, 0)
+}
+
+// checkInterrupt: 有中断请求时抛出"interrupted!"错误
+// Interrupt的请求只生效一次；PCallContext的ctx结束后一直生效，直到这次调用返回
+func (self *luaState) checkInterrupt() {
+	if atomic.LoadInt32(&self.cancelled) != 0 || atomic.SwapInt32(&self.interrupted, 0) != 0 {
+		panic("interrupted!")
+	}
+}
+
+// luaError: Error()抛出的错误对象，和Go代码中的其他panic区分开
+type luaError struct {
+	value luaValue
+}
+
+// PCall: 以保护模式调用函数，出错时弹出函数和参数，把错误对象压栈并返回错误码
+// msgh不为0时，出错后先在出错的位置调用栈上该索引处的消息处理函数，再用它的返回值作为错误对象
+// [-(nargs + 1), +(nresults|1), –]
+// http://www.lua.org/manual/5.3/manual.html#lua_pcall
 func (self *luaState) PCall(nArgs, nResults, msgh int) (status int) {
 	caller := self.stack
+	funcIdx := caller.absIndex(-(nArgs + 1))
+	var handler luaValue
+	if msgh != 0 {
+		handler = caller.get(msgh)
+	}
 	status = api.LUA_ERRRUN
 	defer func() {
-		if err := recover(); err != nil {
+		if r := recover(); r != nil {
+			if _, ok := r.(threadClose); ok {
+				panic(r) /* 关闭挂起的协程，见api_coroutine.go */
+			}
+			if (caller.prev != nil || self != self.mainThread) && atomic.LoadInt32(&self.cancelled) != 0 {
+				panic(r) /* Lua代码和协程中的pcall不能拦截PCallContext的中断 */
+			}
+			if re, ok := r.(runtime.Error); ok {
+				if self.goPanics {
+					panic(re)
+				}
+				r = _goPanicMessage(re)
+			}
+			err := _errorValue(r)
+			if _, ok := r.(memoryError); ok {
+				status = api.LUA_ERRMEM
+			} else if handler != nil {
+				err, status = self.callMsgHandler(handler, err)
+			}
 			for self.stack != caller {
+				status, err = self.closeTbcProtected(status, err)
 				self.popLuaStack()
 			}
-			self.stack.push(err)
+			for caller.top >= funcIdx { /* remove function and arguments */
+				caller.pop()
+			}
+			caller.push(err)
 		}
 	}()
 	self.Call(nArgs, nResults)
 	status = api.LUA_OK
 	return
 }
+
+// callMsgHandler: 在出错的调用帧上调用消息处理函数
+// 消息处理函数本身出错时返回LUA_ERRERR
+func (self *luaState) callMsgHandler(handler, err luaValue) (result luaValue, status int) {
+	defer func() {
+		if r := recover(); r != nil {
+			result, status = "error in error handling", api.LUA_ERRERR
+		}
+	}()
+	self.stack.check(2)
+	self.stack.push(handler)
+	self.stack.push(err)
+	self.Call(1, 1)
+	return self.stack.pop(), api.LUA_ERRRUN
+}
+
+// _goPanicMessage: Go运行时错误转换为错误信息，附带出错位置的Go调用栈摘要
+// 只能在recover所在的defer函数里调用，此时panic处的调用栈还在
+func _goPanicMessage(err runtime.Error) string {
+	const maxFrames = 5
+
+	pcs := make([]uintptr, 64)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(2, pcs)])
+	var sb strings.Builder
+	sb.WriteString(err.Error())
+	sb.WriteString("\ngo stack traceback:")
+	inPanic, n := false, 0
+	for n < maxFrames {
+		frame, more := frames.Next()
+		if !inPanic { /* skip frames of the recover itself */
+			inPanic = frame.Function == "runtime.gopanic"
+		} else if n > 0 && strings.HasPrefix(frame.Function, "luago/state.") { /* back to the VM */
+			break
+		} else if !strings.HasPrefix(frame.Function, "runtime.") {
+			fmt.Fprintf(&sb, "\n\t%s\n\t\t%s:%d", frame.Function, frame.File, frame.Line)
+			n++
+		}
+		if !more {
+			break
+		}
+	}
+	return sb.String()
+}
+
+// _errorValue: 把recover()得到的值转换为Lua值
+// Error()抛出的错误对象原样返回，其他Go值转换为字符串
+func _errorValue(r interface{}) luaValue {
+	switch x := r.(type) {
+	case luaError:
+		return x.value
+	case string:
+		return x
+	case error:
+		return x.Error()
+	default:
+		return fmt.Sprint(x)
+	}
+}
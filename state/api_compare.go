@@ -83,7 +83,8 @@ func _lt(a, b luaValue, ls *luaState) bool {
 	if result, ok := callMetamethod(a, b, "__lt", ls); ok {
 		return convertToBoolean(result)
 	} else {
-		panic("comparison error!")
+		ls.orderError(a, b)
+		return false
 	}
 
 }
@@ -114,7 +115,8 @@ func _le(a, b luaValue, ls *luaState) bool {
 	} else if result, ok := callMetamethod(b, a, "__lt", ls); ok {
 		return !convertToBoolean(result)
 	} else {
-		panic("comparison error!")
+		ls.orderError(a, b)
+		return false
 	}
 }
 
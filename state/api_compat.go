@@ -0,0 +1,48 @@
+package state
+
+import "io"
+
+// Version: 语言版本号，LUA_VERSION_NUM或LUA_VERSION_NUM_54
+// http://www.lua.org/manual/5.4/manual.html#lua_version
+func (self *luaState) Version() int {
+	return self.version
+}
+
+// Warning: 发出警告，toCont为true时消息还没有结束，和下一次调用的消息连在一起
+// 不分段的、以'@'开头的消息是控制消息："@on"打开警告，"@off"关闭警告（默认）
+// 警告以"Lua warning: "开头输出到Stderr
+// http://www.lua.org/manual/5.4/manual.html#lua_warning
+// lua-5.4.6/src/lauxlib.c#warnfon()
+func (self *luaState) Warning(msg string, toCont bool) {
+	switch {
+	case self.warnCont: /* continuation of a previous message */
+		io.WriteString(self.stderr, msg)
+	case !toCont && len(msg) > 0 && msg[0] == '@': /* control message? */
+		if msg == "@off" {
+			self.warnOn = false
+		} else if msg == "@on" {
+			self.warnOn = true
+		}
+		return
+	case !self.warnOn:
+		return
+	default:
+		io.WriteString(self.stderr, "Lua warning: ")
+		io.WriteString(self.stderr, msg)
+	}
+	if self.warnCont = toCont; !toCont { /* last part? */
+		io.WriteString(self.stderr, "\n") /* finish message with end-of-line */
+	}
+}
+
+// newArgTable: Lua 5.1兼容，把变长参数打包成vararg函数的局部变量arg，字段n是参数个数
+// lua-5.1.5/src/ldo.c#adjust_varargs()
+func (self *luaState) newArgTable(varargs []luaValue) *luaTable {
+	nExtra := len(varargs)
+	t := self.newTable(nExtra, 1)
+	for i, v := range varargs { /* put extra arguments into 'arg' table */
+		t.put(int64(i+1), v)
+	}
+	t.put("n", int64(nExtra)) /* store counter in field 'n' */
+	return t
+}
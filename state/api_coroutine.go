@@ -0,0 +1,328 @@
+package state
+
+import "runtime"
+import "sync"
+import "sync/atomic"
+import "weak"
+import . "luago/api"
+
+// 协程
+// 每个协程在自己的goroutine中执行，resume和yield通过channel交接控制权，同一时刻同一个state中
+// 只有一个goroutine在执行。因此Lua代码和Go函数中的任何位置（包括pcall、元方法和迭代器中）都可以yield。
+// 挂起的协程阻塞在Yield中，CloseThread（coroutine.close）和state的Close让它展开调用栈、
+// 关闭待关闭变量后退出。Lua中不再引用的挂起的协程被回收时，state在安全的位置让它的goroutine
+// 直接退出，和Lua一样不关闭它的待关闭变量；从协程自己的栈上能到达的协程（比如协程的函数
+// 把协程保存在upvalue中）不会被回收，它会一直占用它的goroutine，直到被关闭。
+
+const LUAI_MAXCCALLS = 200 /* resume的最大嵌套层数 */
+
+// coMsg: resume发给挂起的协程的消息
+type coMsg struct {
+	nArgs   int  /* resume的参数个数 */
+	close   bool /* 为true时展开调用栈，结束协程 */
+	abandon bool /* 和close一起使用，协程已经被回收，不关闭待关闭变量 */
+}
+
+// coDone: 协程挂起或结束时发给resume的消息
+type coDone struct {
+	status int
+	panic  interface{} /* 协程中没有被拦截的panic，由resume在自己的goroutine中重新抛出 */
+}
+
+// threadClose: 关闭挂起的协程时从Yield抛出，PCall不拦截它
+type threadClose struct {
+	abandon bool
+}
+
+// threadValue: Lua中代表线程的值
+// 挂起的协程的goroutine一直引用着它的luaState，Lua中的值因此不能是luaState本身：
+// luaState只持有threadValue的弱引用，Lua中不再引用协程时threadValue被Go回收，
+// 清理函数把协程放入threadQueue，由collectThreads让它的goroutine退出
+type threadValue struct {
+	ls *luaState
+}
+
+// thread: self在Lua中的值，原来的值已经被回收时新建一个
+func (self *luaState) thread() *threadValue {
+	if v := self.value.Value(); v != nil {
+		return v
+	}
+	v := &threadValue{self}
+	self.value = weak.Make(v)
+	if self != self.mainThread {
+		q := self.coq
+		runtime.AddCleanup(v, q.push, self)
+	}
+	return v
+}
+
+// threadQueue: Lua中已经不再引用的协程，等待在state的goroutine上处理
+// 清理函数在其他goroutine中调用push，因此需要加锁
+type threadQueue struct {
+	mu      sync.Mutex
+	pending []*luaState
+	n       int32 // len(pending)，用于不加锁的快速检查
+}
+
+func (self *threadQueue) push(t *luaState) {
+	self.mu.Lock()
+	self.pending = append(self.pending, t)
+	atomic.StoreInt32(&self.n, int32(len(self.pending)))
+	self.mu.Unlock()
+}
+
+func (self *threadQueue) take() []*luaState {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	pending := self.pending
+	self.pending = nil
+	atomic.StoreInt32(&self.n, 0)
+	return pending
+}
+
+// collectThreads: 让Lua中已经不再引用的挂起的协程的goroutine退出，不关闭它的待关闭变量
+// 正在执行的协程留到它挂起或者结束之后再处理
+func (self *luaState) collectThreads() {
+	if atomic.LoadInt32(&self.coq.n) == 0 {
+		return
+	}
+	for _, t := range self.coq.take() {
+		switch {
+		case t.value.Value() != nil: /* pushed again from Go; the new value has its own cleanup */
+		case !t.started: /* not started or dead */
+		case t.status == LUA_YIELD:
+			t.resume <- coMsg{close: true, abandon: true}
+			<-t.yield
+			t.finish()
+			t.resetStack()
+		default: /* running or normal */
+			self.coq.push(t)
+		}
+	}
+}
+
+// NewThread: 创建新线程并压栈，它和self共享全局状态，有自己独立的调用栈
+// [-0, +1, m]
+// http://www.lua.org/manual/5.3/manual.html#lua_newthread
+// lua-5.3.4/src/lstate.c#lua_newthread()
+func (self *luaState) NewThread() LuaState {
+	t := self.trackThread(&luaState{globalState: self.globalState})
+	t.pushLuaStack(newLuaStack(LUA_MINSTACK, t))
+	self.stack.push(t.thread())
+	return t
+}
+
+// PushThread: 把self压入自己的栈，self是主线程时返回true
+// [-0, +1, –]
+// http://www.lua.org/manual/5.3/manual.html#lua_pushthread
+func (self *luaState) PushThread() bool {
+	self.stack.push(self.thread())
+	return self == self.mainThread
+}
+
+// ToThread: 把idx处的值转换为线程，不是线程时返回nil
+// [-0, +0, –]
+// http://www.lua.org/manual/5.3/manual.html#lua_tothread
+func (self *luaState) ToThread(idx int) LuaState {
+	if t, ok := self.stack.get(idx).(*threadValue); ok {
+		return t.ls
+	}
+	return nil
+}
+
+// XMove: 从self的栈顶弹出n个值，按原来的顺序压入to的栈
+// [-?, +?, –]
+// http://www.lua.org/manual/5.3/manual.html#lua_xmove
+func (self *luaState) XMove(to LuaState, n int) {
+	vals := self.stack.popN(n)
+	dst := to.(*luaState).stack
+	dst.check(n)
+	dst.pushN(vals, n)
+}
+
+// Status: 线程的状态，正常时为LUA_OK，挂起时为LUA_YIELD，出错结束后为错误码
+// [-0, +0, –]
+// http://www.lua.org/manual/5.3/manual.html#lua_status
+func (self *luaState) Status() int {
+	return self.status
+}
+
+// IsYieldable: 线程能否yield，主线程和正在关闭的协程不能yield
+// [-0, +0, –]
+// http://www.lua.org/manual/5.3/manual.html#lua_isyieldable
+func (self *luaState) IsYieldable() bool {
+	return self != self.mainThread && (self.started || self.stack.prev == nil)
+}
+
+// Resume: 在协程self中开始或继续执行，nArgs个参数在self的栈顶
+// 第一次resume时调用参数下面的函数；协程挂起时参数成为yield的返回值
+// 返回LUA_YIELD时self的栈上是传给yield的值，返回LUA_OK时是函数的返回值，出错时错误对象在栈顶
+// [-?, +?, –]
+// http://www.lua.org/manual/5.3/manual.html#lua_resume
+// lua-5.3.4/src/ldo.c#lua_resume()
+func (self *luaState) Resume(from LuaState, nArgs int) int {
+	if self.status == LUA_OK { /* may be starting a coroutine */
+		if self.started || self.stack.prev != nil { /* not in base level? */
+			return self.resumeError("cannot resume non-suspended coroutine", nArgs)
+		}
+	} else if self.status != LUA_YIELD {
+		return self.resumeError("cannot resume dead coroutine", nArgs)
+	}
+	depth := 0
+	if from != nil {
+		depth = from.(*luaState).depth + 1
+	}
+	if depth >= LUAI_MAXCCALLS {
+		return self.resumeError("C stack overflow", nArgs)
+	}
+	self.depth = depth
+
+	self.status = LUA_OK
+	if !self.started {
+		self.started = true
+		self.resume = make(chan coMsg)
+		self.yield = make(chan coDone)
+		self.threads[self] = struct{}{}
+		go self.run(nArgs)
+	} else {
+		self.resume <- coMsg{nArgs: nArgs}
+	}
+	done := <-self.yield
+	self.status = done.status
+	if done.status == LUA_YIELD {
+		return LUA_YIELD
+	}
+	self.finish()
+	if done.panic != nil { /* the coroutine is dead; raise the error in the resumer */
+		self.status = LUA_ERRRUN
+		self.resetStack()
+		panic(done.panic)
+	}
+	if done.status != LUA_OK { /* keep a copy of the error object for CloseThread */
+		self.stack.push(self.stack.get(-1))
+	}
+	return done.status
+}
+
+// resumeError: resume失败，弹出参数，压入错误信息并返回LUA_ERRRUN
+// lua-5.3.4/src/ldo.c#resume_error()
+func (self *luaState) resumeError(msg string, nArgs int) int {
+	self.stack.popN(nArgs)
+	self.stack.push(msg)
+	return LUA_ERRRUN
+}
+
+// run: 协程的goroutine，以保护模式调用函数，结束时把状态交给resume
+func (self *luaState) run(nArgs int) {
+	var done coDone
+	done.panic = catch(func() { done.status = self.PCall(nArgs, LUA_MULTRET, 0) })
+	if tc, ok := done.panic.(threadClose); ok { /* closed while suspended */
+		done.panic = nil
+		if !tc.abandon {
+			done.panic = catch(func() { done.status = self.closeFrames() })
+		}
+	}
+	self.yield <- done
+}
+
+// catch: 调用f，返回f中没有被拦截的panic
+func catch(f func()) (r interface{}) {
+	defer func() {
+		r = recover()
+	}()
+	f()
+	return nil
+}
+
+// Yield: 挂起正在执行的协程，把栈顶的nResults个值交给resume
+// Go函数用return ls.Yield(n)挂起协程，再次resume时传入的参数成为这个Go函数的返回值
+// http://www.lua.org/manual/5.3/manual.html#lua_yield
+// lua-5.3.4/src/ldo.c#lua_yieldk()
+func (self *luaState) Yield(nResults int) int {
+	if !self.started {
+		if self == self.mainThread {
+			self.runError("attempt to yield from outside a coroutine")
+		}
+		self.runError("attempt to yield across a C-call boundary")
+	}
+	/* 挂起期间resume看到的栈只有yield的值 */
+	vals := self.stack.popN(nResults)
+	frame := newLuaStack(nResults+LUA_MINSTACK, self)
+	frame.pushN(vals, nResults)
+	self.pushLuaStack(frame)
+	self.yield <- coDone{status: LUA_YIELD}
+	msg := <-self.resume
+	self.popLuaStack()
+	if msg.close {
+		panic(threadClose{abandon: msg.abandon})
+	}
+	args := frame.popN(msg.nArgs) /* values passed to resume */
+	self.stack.check(msg.nArgs)
+	self.stack.pushN(args, msg.nArgs)
+	return msg.nArgs
+}
+
+// CloseThread: 关闭挂起或者已经结束的协程，按声明的相反顺序关闭它的全部待关闭变量，
+// 清空它的栈，之后可以再用来执行函数
+// 返回LUA_OK，或者协程出错结束时的错误码、关闭变量时出错的LUA_ERRRUN，此时错误对象在栈顶
+// [-0, +?, –]
+// http://www.lua.org/manual/5.4/manual.html#lua_closethread
+// lua-5.4.6/src/lstate.c#luaE_resetthread()
+func (self *luaState) CloseThread(from LuaState) int {
+	status := self.status
+	var err luaValue
+	if status != LUA_OK && status != LUA_YIELD {
+		err = self.stack.get(-1)
+	}
+	if status == LUA_YIELD {
+		status = LUA_OK
+		self.started = false /* __close can't yield */
+		self.resume <- coMsg{close: true}
+		done := <-self.yield
+		self.finish()
+		if done.panic != nil {
+			self.status = LUA_ERRRUN
+			self.resetStack()
+			panic(done.panic)
+		}
+		if done.status != LUA_OK {
+			status, err = done.status, self.stack.get(-1)
+		}
+	}
+	self.status = LUA_OK
+	self.resetStack()
+	if status != LUA_OK {
+		self.stack.push(err)
+	}
+	return status
+}
+
+// closeFrames: 从最内层的调用帧开始关闭全部待关闭变量，返回状态码，出错时错误对象在栈顶
+// lua-5.4.6/src/ldo.c#luaD_closeprotected()
+func (self *luaState) closeFrames() int {
+	status := LUA_OK
+	var err luaValue
+	for self.stack.prev != nil {
+		status, err = self.closeTbcProtected(status, err)
+		self.popLuaStack()
+	}
+	if status != LUA_OK {
+		self.stack.push(err)
+	}
+	return status
+}
+
+// finish: 协程的goroutine已经退出
+func (self *luaState) finish() {
+	self.started = false
+	delete(self.threads, self)
+}
+
+// resetStack: 丢弃全部调用帧和栈上的值
+func (self *luaState) resetStack() {
+	for self.stack.prev != nil {
+		self.popLuaStack()
+	}
+	self.stack.popN(self.stack.top)
+	self.stack.tbc = nil
+}
@@ -0,0 +1,79 @@
+package state
+
+// GetStackFunc: 把第level层调用帧正在执行的函数推入栈顶，0表示当前正在运行的函数
+// 没有这一层时返回false，不推入任何值
+// lua-5.3.4/src/ldebug.c#lua_getstack() + lua_getinfo(L, "f", ar)
+func (self *luaState) GetStackFunc(level int) bool {
+	stack := self.getStack(level)
+	if stack == nil { /* level not found? */
+		return false
+	}
+	self.stack.push(stack.closure)
+	return true
+}
+
+// GetUpvalue: 把idx处闭包的第n个upvalue推入栈顶，返回它的名字
+// Go闭包的upvalue名字为空串，n超出范围时返回false，不推入任何值
+// http://www.lua.org/manual/5.3/manual.html#lua_getupvalue
+func (self *luaState) GetUpvalue(funcIdx, n int) (string, bool) {
+	c, name, ok := self.auxUpvalue(funcIdx, n)
+	if !ok {
+		return "", false
+	}
+	var val luaValue
+	if uv := c.upvals[n-1]; uv != nil {
+		val = *uv.val
+	}
+	self.stack.push(val)
+	return name, true
+}
+
+// SetUpvalue: 弹出栈顶的值赋给idx处闭包的第n个upvalue，返回它的名字
+// n超出范围时返回false，不弹出任何值
+// http://www.lua.org/manual/5.3/manual.html#lua_setupvalue
+func (self *luaState) SetUpvalue(funcIdx, n int) (string, bool) {
+	c, name, ok := self.auxUpvalue(funcIdx, n)
+	if !ok {
+		return "", false
+	}
+	val := self.stack.pop()
+	if uv := c.upvals[n-1]; uv != nil {
+		*uv.val = val
+	} else {
+		c.upvals[n-1] = &upvalue{&val}
+	}
+	return name, true
+}
+
+// UpvalueJoin: 让f1处闭包的第n1个upvalue引用f2处闭包的第n2个upvalue
+// 和C API不同，Go闭包的upvalue也可以参与
+// http://www.lua.org/manual/5.3/manual.html#lua_upvaluejoin
+func (self *luaState) UpvalueJoin(f1, n1, f2, n2 int) {
+	c1, _, ok1 := self.auxUpvalue(f1, n1)
+	c2, _, ok2 := self.auxUpvalue(f2, n2)
+	if !ok1 || !ok2 {
+		panic("invalid upvalue index")
+	}
+	if c2.upvals[n2-1] == nil {
+		var val luaValue
+		c2.upvals[n2-1] = &upvalue{&val}
+	}
+	c1.upvals[n1-1] = c2.upvals[n2-1]
+}
+
+// auxUpvalue: 取出idx处的闭包和第n个upvalue的名字
+// lua-5.3.4/src/lapi.c#aux_upvalue()
+func (self *luaState) auxUpvalue(funcIdx, n int) (*closure, string, bool) {
+	c, ok := self.stack.get(funcIdx).(*closure)
+	if !ok || n < 1 || n > len(c.upvals) {
+		return nil, "", false
+	}
+	if c.proto == nil { /* Go closure */
+		return c, "", true
+	}
+	names := c.proto.UpvalueNames
+	if n > len(names) || names[n-1] == "" {
+		return c, "(*no name)", true
+	}
+	return c, names[n-1], true
+}
@@ -0,0 +1,75 @@
+package state
+
+import "runtime"
+import "sync/atomic"
+import "time"
+import . "luago/api"
+
+const (
+	LUAI_GCPAUSE = 200 /* 200% */
+	LUAI_GCMUL   = 200 /* GC runs 'twice the speed' of memory allocation */
+)
+
+// GC: 控制垃圾回收
+// 内存由Go管理，Go的垃圾回收是整个进程共享的，不能为一个state停止，这里在它之上实现：
+// LUA_GCCOLLECT做一次完整的回收，执行被回收对象的终结器，之后弱表中被回收的项不再可见
+// LUA_GCSTOP/LUA_GCRESTART暂停和恢复在安全点自动执行终结器，显式的回收不受影响
+// LUA_GCSTEP把data KB计入分配量，累计超过暂停参数允许的增长量时（data为0时总是）做一次完整的回收
+// LUA_GCCOUNT/LUA_GCCOUNTB返回统计的Lua对象内存，见lua_mem.go
+// [-0, +0, e]
+// http://www.lua.org/manual/5.3/manual.html#lua_gc
+// lua-5.3.4/src/lapi.c#lua_gc()
+func (self *luaState) GC(what, data int) int {
+	res := 0
+	switch what {
+	case LUA_GCSTOP:
+		self.gcStopped = true
+	case LUA_GCRESTART:
+		self.gcStopped = false
+	case LUA_GCCOLLECT:
+		self.fullGC()
+	case LUA_GCCOUNT: /* GC values are expressed in Kbytes: #bytes/2^10 */
+		res = int(atomic.LoadInt64(&self.mem.used) >> 10)
+	case LUA_GCCOUNTB:
+		res = int(atomic.LoadInt64(&self.mem.used) & 0x3ff)
+	case LUA_GCSTEP:
+		self.gcDebt += int64(data) * 1024 * int64(self.gcStepMul) / 100
+		growth := atomic.LoadInt64(&self.mem.used) * int64(self.gcPause-100) / 100
+		if data == 0 || self.gcDebt >= growth {
+			self.fullGC()
+			res = 1 /* signal it */
+		}
+	case LUA_GCSETPAUSE:
+		res = self.gcPause
+		self.gcPause = data
+	case LUA_GCSETSTEPMUL:
+		res = self.gcStepMul
+		self.gcStepMul = data
+	case LUA_GCISRUNNING:
+		if !self.gcStopped {
+			res = 1
+		}
+	default:
+		res = -1 /* invalid option */
+	}
+	return res
+}
+
+// fullGC: 做一次完整的Go垃圾回收并执行终结器
+// 内存统计在清理函数中扣除，这里尽量等它们执行完，使随后的LUA_GCCOUNT反映回收的结果
+// lua-5.3.4/src/lgc.c#luaC_fullgc()
+func (self *luaState) fullGC() {
+	self.gcDebt = 0
+	done := make(chan struct{})
+	/* not a tiny allocation, whose cleanup might never run */
+	runtime.AddCleanup(new([32]byte), func(done chan struct{}) { close(done) }, done)
+	runtime.GC()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Millisecond):
+	}
+	self.awaitFinalizers()
+	self.purgeEphemerons()
+	self.collectThreads()
+	self.runFinalizers(true)
+}
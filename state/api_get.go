@@ -6,13 +6,13 @@ import (
 
 // CreateTable: 建表，带长度的
 func (self *luaState) CreateTable(nArr, nRec int) {
-	t := newLuaTable(nArr, nRec)
+	t := self.newTable(nArr, nRec)
 	self.stack.push(t)
 }
 
 // NewTable: 新建表，数组和哈希长度都为0
 func (self *luaState) NewTable() {
-	t := newLuaTable(0, 0)
+	t := self.newTable(0, 0)
 	self.stack.push(t)
 }
 
@@ -46,7 +46,8 @@ func (self *luaState) getTable(t, k luaValue, raw bool) LuaType {
 			}
 		}
 	}
-	panic("index error")
+	self.valueTypeError(t, "index")
+	return LUA_TNIL
 }
 
 func (self *luaState) GetField(idx int, k string) LuaType {
@@ -0,0 +1,105 @@
+package state
+
+import "context"
+import "sync/atomic"
+import . "luago/api"
+
+// PCallContext: 以保护模式调用函数，ctx结束时中断正在执行的Lua代码
+// 成功时和PCall一样留下返回值；出错时弹出函数、参数和错误对象，把错误对象包装成*LuaError返回
+// [-(nargs + 1), +(nresults|0), –]
+func (self *luaState) PCallContext(ctx context.Context, nArgs, nResults int) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if err := ctx.Err(); err != nil {
+		self.Pop(nArgs + 1)
+		return &LuaError{Status: LUA_ERRRUN, Message: "interrupted!", Cause: err}
+	}
+
+	stop := self.watchContext(ctx)
+	status := self.PCall(nArgs, nResults, 0)
+	interrupted := stop()
+	if status == LUA_OK {
+		return nil
+	}
+	err := NewLuaError(self, status)
+	if interrupted {
+		err.Cause = ctx.Err()
+	}
+	self.Pop(1)
+	return err
+}
+
+// watchContext: ctx结束时开始中断正在执行的Lua代码，返回的函数停止监视并报告是否发生过中断
+// 中断一直生效到停止监视，其间每条指令前和Lua代码中的每个pcall都会再次抛出"interrupted!"
+func (self *luaState) watchContext(ctx context.Context) func() bool {
+	done := ctx.Done()
+	if done == nil {
+		return func() bool { return false }
+	}
+	quit := make(chan struct{})
+	fired := make(chan bool, 1)
+	go func() {
+		select {
+		case <-done:
+			atomic.AddInt32(&self.cancelled, 1)
+			fired <- true
+		case <-quit:
+			fired <- false
+		}
+	}()
+	return func() bool {
+		close(quit)
+		if <-fired {
+			atomic.AddInt32(&self.cancelled, -1)
+			return true
+		}
+		return false
+	}
+}
+
+// CallGlobal: 调用全局函数name，参数按PushGoValue转换，返回值按ToGoValue转换
+// 取全局变量、压入参数和调用都在保护模式下进行，出错时返回error，调用前后栈保持不变
+func (self *luaState) CallGlobal(ctx context.Context, name string, args ...interface{}) ([]interface{}, error) {
+	return self.callWithArgs(ctx, 0, args, func(ls LuaState) {
+		ls.GetGlobal(name)
+	})
+}
+
+// CallMethod: 以idx处的值为self调用它的方法name，即idx:name(args...)
+// 取方法、压入参数和调用都在保护模式下进行，出错时返回error，调用前后栈保持不变
+func (self *luaState) CallMethod(ctx context.Context, idx int, name string, args ...interface{}) ([]interface{}, error) {
+	self.CheckStack(1)
+	self.PushValue(idx)
+	return self.callWithArgs(ctx, 1, args, func(ls LuaState) {
+		ls.GetField(1, name)
+		ls.Insert(1)
+	})
+}
+
+// callWithArgs: 栈顶的nSelf个值是调用的前几个参数，getFunc在保护模式下把函数放到它们前面，
+// 接着压入args并调用，最后恢复栈顶
+func (self *luaState) callWithArgs(ctx context.Context, nSelf int, args []interface{},
+	getFunc func(ls LuaState)) ([]interface{}, error) {
+	defer self.SetTop(self.GetTop() - nSelf)
+	var results []interface{}
+	err := PCallFunc(ctx, self, nSelf, func(ls LuaState) error {
+		getFunc(ls)
+		ls.CheckStack(len(args))
+		for _, arg := range args {
+			if err := PushGoValue(ls, arg); err != nil {
+				return err
+			}
+		}
+		ls.Call(nSelf+len(args), LUA_MULTRET)
+		results = make([]interface{}, ls.GetTop())
+		for i := range results {
+			results[i] = ToGoValue(ls, i+1)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
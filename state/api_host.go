@@ -0,0 +1,70 @@
+package state
+
+import "io"
+import "io/fs"
+import "math/rand"
+import "time"
+
+// Stdout: print等函数的输出目标
+func (self *luaState) Stdout() io.Writer {
+	return self.stdout
+}
+
+// Stderr: 错误输出目标
+func (self *luaState) Stderr() io.Writer {
+	return self.stderr
+}
+
+// Stdin: 标准输入
+func (self *luaState) Stdin() io.Reader {
+	return self.stdin
+}
+
+// SetStdout: 修改print、io.write和交互式解释器的输出目标，每个state可以有自己的输出
+func (self *luaState) SetStdout(w io.Writer) {
+	self.stdout = w
+}
+
+// SetStderr: 修改错误输出目标
+func (self *luaState) SetStderr(w io.Writer) {
+	self.stderr = w
+}
+
+// SetStdin: 修改标准输入
+func (self *luaState) SetStdin(r io.Reader) {
+	self.stdin = r
+}
+
+// FS: 加载文件使用的文件系统
+func (self *luaState) FS() fs.FS {
+	return self.fsys
+}
+
+// Now: 当前时间
+func (self *luaState) Now() time.Time {
+	return self.now()
+}
+
+// Rand: math.random使用的随机数生成器
+func (self *luaState) Rand() *rand.Rand {
+	return self.rand
+}
+
+// Close: 关闭state，关闭挂起的协程，从最内层的调用帧开始关闭主线程中的全部待关闭变量，
+// 清空调用栈并执行全部剩余的__gc终结器，之后不能再使用这个state
+// 重复调用没有影响
+// http://www.lua.org/manual/5.3/manual.html#lua_close
+// lua-5.4.6/src/lstate.c#close_state()
+func (self *luaState) Close() {
+	if self.closed {
+		return
+	}
+	self.closed = true
+	self.collectThreads()
+	for t := range self.threads {
+		t.CloseThread(self)
+	}
+	self.closeFrames()
+	self.SetTop(0)
+	self.closeFinalizers()
+}
@@ -11,7 +11,7 @@ func (self *luaState) Len(idx int) {
 	} else if t, ok := val.(*luaTable); ok {
 		self.stack.push(int64(t.len()))
 	} else {
-		panic("length error!")
+		self.valueTypeError(val, "get length of")
 	}
 }
 
@@ -25,7 +25,9 @@ func (self *luaState) Concat(n int) {
 				s1 := self.ToString(-2)
 				self.stack.pop()
 				self.stack.pop()
-				self.stack.push(s1 + s2)
+				s := s1 + s2
+				self.mem.trackString(s)
+				self.stack.push(s)
 				continue
 			}
 
@@ -36,7 +38,7 @@ func (self *luaState) Concat(n int) {
 				continue
 			}
 
-			panic("concatenation error")
+			self.concatError(a, b)
 		}
 	}
 
@@ -57,9 +59,10 @@ func (self *luaState) Next(idx int) bool {
 	panic("table expected")
 }
 
+// Error: 以栈顶的值作为错误对象抛出，错误对象可以是任意Lua值
 func (self *luaState) Error() int {
 	err := self.stack.pop()
-	panic(err)
+	panic(luaError{err})
 }
 
 // [-0, +1, –]
@@ -22,6 +22,7 @@ func (self *luaState) PushNumber(n float64) {
 }
 
 func (self *luaState) PushString(s string) {
+	self.mem.trackString(s)
 	self.stack.push(s)
 }
 
@@ -29,6 +30,7 @@ func (self *luaState) PushString(s string) {
 // http://www.lua.org/manual/5.3/manual.html#lua_pushfstring
 func (self *luaState) PushFString(fmtStr string, a ...interface{}) {
 	str := fmt.Sprintf(fmtStr, a...)
+	self.mem.trackString(str)
 	self.stack.push(str)
 }
 
@@ -38,7 +40,7 @@ func (self *luaState) PrintStack() {
 }
 
 func (self *luaState) PushGoFunction(f GoFunction) {
-	self.stack.push(newGoClosure(f, 0))
+	self.stack.push(self.trackClosure(newGoClosure(f, 0)))
 }
 
 // PushGlobalTable:将全局表push进栈
@@ -53,7 +55,7 @@ func (self *luaState) PushGlobalTable() {
 
 // PushGoClosure:将Go函数打包成闭包入栈中，第二个参数是Upval的数量
 func (self *luaState) PushGoClosure(f GoFunction, nUpVals int) {
-	closure := newGoClosure(f, nUpVals)
+	closure := self.trackClosure(newGoClosure(f, nUpVals))
 	for i := nUpVals; i > 0; i-- {
 		val := self.stack.pop()
 		closure.upvals[nUpVals-1] = &upvalue{&val}
@@ -3,9 +3,9 @@ package state
 import "luago/api"
 
 func (self *luaState) SetTable(idx int) {
+	t := self.stack.get(idx) /* index refers to the stack before popping */
 	v := self.stack.pop()
 	k := self.stack.pop()
-	t := self.stack.get(idx)
 	self.setTable(t, k, v, false)
 }
 
@@ -30,7 +30,7 @@ func (self *luaState) setTable(t, k, v luaValue, raw bool) {
 			}
 		}
 	}
-	panic("not a table")
+	self.valueTypeError(t, "index")
 }
 
 func (self *luaState) SetField(idx int, k string) {
@@ -57,7 +57,7 @@ func (self *luaState) LoadVararg(n int) {
 func (self *luaState) LoadProto(idx int) {
 	stack := self.stack
 	subProto := stack.closure.proto.Protos[idx] // 栈内的外部原型
-	closure := newLuaClosure(subProto)
+	closure := self.trackClosure(newLuaClosure(subProto))
 	self.stack.push(closure)
 	//加载UpValue
 	for i, uvInfo := range subProto.Upvalues {
@@ -82,7 +82,7 @@ func (self *luaState) LoadProto(idx int) {
 
 }
 
-// CloseUpvalues:关闭openuv的通道
+// CloseUpvalues:关闭openuv的通道，同时关闭寄存器a-1及以上的待关闭变量
 //	如果某个块内部定义的局部变量已经被嵌套函数捕获，那么当这些局部变量退出作用域时（块结束）
 //	编译器会产生一条jmp指令，指示虚拟机闭合相应的Upvalue
 func (self *luaState) CloseUpvalues(a int) {
@@ -93,4 +93,5 @@ func (self *luaState) CloseUpvalues(a int) {
 			delete(self.stack.openuvs, i)
 		}
 	}
+	self.closeTbc(a)
 }
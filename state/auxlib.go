@@ -1,23 +1,47 @@
 package state
 
+import "bytes"
 import "fmt"
-import "io/ioutil"
+import "io"
+import "io/fs"
+import "os"
+import "sort"
 import . "luago/api"
+import "luago/number"
 
 import "luago/stdlib"
 
 // [-0, +0, v]
 // http://www.lua.org/manual/5.3/manual.html#luaL_error
 func (self *luaState) Error2(fmt string, a ...interface{}) int {
-	self.PushFString(fmt, a...) // todo
+	self.Where(1)
+	self.PushFString(fmt, a...)
+	self.Concat(2)
 	return self.Error()
 }
 
+// 压入第level层函数当前执行到的位置"chunkname:currentline: "，不是Lua函数时压入空串
+// [-0, +1, m]
+// http://www.lua.org/manual/5.3/manual.html#luaL_where
+func (self *luaState) Where(level int) {
+	if stack := self.getStack(level); stack != nil { /* check function at level */
+		if line := stack.currentLine(); line > 0 { /* is there info? */
+			self.PushFString("%s:%d: ", chunkID(stack.closure.proto.Source), line)
+			return
+		}
+	}
+	self.PushString("") /* else, no information available... */
+}
+
 // [-0, +0, v]
 // http://www.lua.org/manual/5.3/manual.html#luaL_argerror
 func (self *luaState) ArgError(arg int, extraMsg string) int {
 	// bad argument #arg to 'funcname' (extramsg)
-	return self.Error2("bad argument #%d (%s)", arg, extraMsg) // todo
+	name, ok := self.globalFuncName()
+	if !ok {
+		name = "?"
+	}
+	return self.Error2("bad argument #%d to '%s' (%s)", arg, name, extraMsg)
 }
 
 // [-0, +0, v]
@@ -136,10 +160,44 @@ func (self *luaState) LoadFile(filename string) int {
 
 // [-0, +1, m]
 // http://www.lua.org/manual/5.3/manual.html#luaL_loadfilex
+// 文件名为空时从标准输入读取；跳过第一行的'#'注释（如shebang）
 func (self *luaState) LoadFileX(filename, mode string) int {
-	if data, err := ioutil.ReadFile(filename); err == nil {
-		return self.Load(data, "@"+filename, mode)
+	var data []byte
+	var err error
+	chunkName := "=stdin"
+	if filename == "" {
+		data, err = io.ReadAll(self.stdin)
+	} else {
+		chunkName = "@" + filename
+		data, err = fs.ReadFile(self.fsys, filename)
+	}
+	if err != nil {
+		return self.errFile("read", chunkName, err)
 	}
+	return self.Load(skipComment(data), chunkName, mode)
+}
+
+// lua-5.3.4/src/lauxlib.c#skipcomment()
+func skipComment(data []byte) []byte {
+	data = bytes.TrimPrefix(data, []byte("\xEF\xBB\xBF")) /* skip optional BOM */
+	if len(data) > 0 && data[0] == '#' {                  /* first line is a comment (Unix exec. file)? */
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			return data[i:] /* keep the newline to correct line numbers */
+		}
+		return nil
+	}
+	return data
+}
+
+// lua-5.3.4/src/lauxlib.c#errfile()
+func (self *luaState) errFile(what, chunkName string, err error) int {
+	if pe, ok := err.(*os.PathError); ok {
+		if pe.Op == "open" {
+			what = "open"
+		}
+		err = pe.Err
+	}
+	self.PushString(fmt.Sprintf("cannot %s %s: %v", what, chunkName[1:], err))
 	return LUA_ERRFILE
 }
 
@@ -178,9 +236,9 @@ func (self *luaState) ToString2(idx int) string {
 		switch self.Type(idx) {
 		case LUA_TNUMBER:
 			if self.IsInteger(idx) {
-				self.PushString(fmt.Sprintf("%d", self.ToInteger(idx))) // todo
+				self.PushString(number.IntegerToString(self.ToInteger(idx)))
 			} else {
-				self.PushString(fmt.Sprintf("%g", self.ToNumber(idx))) // todo
+				self.PushString(number.FloatToString(self.ToNumber(idx)))
 			}
 		case LUA_TSTRING:
 			self.PushValue(idx)
@@ -257,21 +315,63 @@ func (self *luaState) CallMeta(obj int, event string) bool {
 // [-0, +0, e]
 // http://www.lua.org/manual/5.3/manual.html#luaL_openlibs
 func (self *luaState) OpenLibs() {
-	libs := map[string]GoFunction{
-		"_G":     stdlib.OpenBaseLib,
-		"math":   stdlib.OpenMathLib,
-		"table":  stdlib.OpenTableLib,
-		"string": stdlib.OpenStringLib,
-		"utf8":   stdlib.OpenUTF8Lib,
-		"os":     stdlib.OpenOSLib,
+	for _, lib := range loadedLibs {
+		self.RequireF(lib.name, lib.openf, true)
+		self.Pop(1)
 	}
+}
 
-	for name, fun := range libs {
-		self.RequireF(name, fun, true)
-		self.Pop(1)
+// openLibs: 只打开names中列出的标准库，未知的名字忽略
+func (self *luaState) openLibs(names []string) {
+	for _, lib := range loadedLibs {
+		for _, name := range names {
+			if name == lib.name {
+				self.RequireF(lib.name, lib.openf, true)
+				self.Pop(1)
+				break
+			}
+		}
+	}
+}
+
+// openOptionalLibs: 打开names中列出的可选库，需要在标准库之后打开
+func (self *luaState) openOptionalLibs(names []string) {
+	for _, lib := range optionalLibs {
+		for _, name := range names {
+			if name == lib.name {
+				self.RequireF(lib.name, lib.openf, false)
+				self.Pop(1)
+				break
+			}
+		}
 	}
 }
 
+/* standard libraries, in the order they are opened */
+var loadedLibs = []struct {
+	name  string
+	openf GoFunction
+}{
+	{"_G", stdlib.OpenBaseLib},
+	{"package", stdlib.OpenPackageLib},
+	{"coroutine", stdlib.OpenCoroutineLib},
+	{"table", stdlib.OpenTableLib},
+	{"io", stdlib.OpenIOLib},
+	{"os", stdlib.OpenOSLib},
+	{"string", stdlib.OpenStringLib},
+	{"math", stdlib.OpenMathLib},
+	{"utf8", stdlib.OpenUTF8Lib},
+	{"json", stdlib.OpenJSONLib},
+}
+
+/* optional libraries, not opened by OpenLibs */
+var optionalLibs = []struct {
+	name  string
+	openf GoFunction
+}{
+	{"compat51", stdlib.OpenCompat51Lib},
+}
+
 // [-0, +1, e]
 // http://www.lua.org/manual/5.3/manual.html#luaL_requiref
 func (self *luaState) RequireF(modname string, openf GoFunction, glb bool) {
@@ -314,12 +414,53 @@ func (self *luaState) SetFuncs(l FuncReg, nup int) {
 			self.PushValue(-nup)
 		}
 		// r[-(nup+2)][name]=fun
-		self.PushGoClosure(fun, nup) /* closure with those upvalues */
+		if fun == nil { /* place holder? */
+			self.PushBoolean(false)
+		} else {
+			self.PushGoClosure(fun, nup) /* closure with those upvalues */
+		}
 		self.SetField(-(nup + 2), name)
 	}
 	self.Pop(nup) /* remove upvalues */
 }
 
+// globalFuncName: 在package.loaded中查找当前函数，返回它在模块中的字段名
+// lua-5.3.4/src/lauxlib.c#pushglobalfuncname()
+func (self *luaState) globalFuncName() (string, bool) {
+	c := self.stack.closure
+	if c == nil {
+		return "", false
+	}
+	if loaded, ok := self.registry.get("_LOADED").(*luaTable); ok {
+		return _findField(loaded, c, 2)
+	}
+	return "", false
+}
+
+// 按键名的顺序查找，同一个函数有多个名字时结果是确定的
+// lua-5.3.4/src/lauxlib.c#findfield()
+func _findField(t *luaTable, c *closure, level int) (string, bool) {
+	names := make([]string, 0, len(t._map))
+	for k := range t._map {
+		if name, ok := k.(string); ok { /* ignore non-string keys */
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		v := t._map[name]
+		if v == luaValue(c) {
+			return name, true
+		}
+		if sub, ok := v.(*luaTable); ok && level > 1 {
+			if name, ok := _findField(sub, c, level-1); ok {
+				return name, true
+			}
+		}
+	}
+	return "", false
+}
+
 func (self *luaState) intError(arg int) {
 	if self.IsNumber(arg) {
 		self.ArgError(arg, "number has no integer representation")
@@ -345,3 +486,44 @@ func (self *luaState) typeError(arg int, tname string) int {
 	self.PushString(msg)
 	return self.ArgError(arg, msg)
 }
+
+/* index of free-list header */
+const freelist = 0
+
+// Ref: 弹出栈顶的值，存入t处的表中并返回一个整数键作为引用
+// 释放的引用记录在t[0]开始的空闲链表中，以便重复使用
+// [-1, +0, m]
+// http://www.lua.org/manual/5.3/manual.html#luaL_ref
+// lua-5.3.4/src/lauxlib.c#luaL_ref()
+func (self *luaState) Ref(t int) int {
+	if self.IsNil(-1) {
+		self.Pop(1)       /* remove it from stack */
+		return LUA_REFNIL /* 'nil' has a unique fixed reference */
+	}
+	t = self.AbsIndex(t)
+	self.RawGetI(t, freelist)      /* get first free element */
+	ref := int(self.ToInteger(-1)) /* ref = t[freelist] */
+	self.Pop(1)                    /* remove it from stack */
+	if ref != 0 {                  /* any free element? */
+		self.RawGetI(t, int64(ref)) /* remove it from list */
+		self.RawSetI(t, freelist)   /* (t[freelist] = t[ref]) */
+	} else { /* no free elements */
+		ref = int(self.RawLen(t)) + 1 /* get a new reference */
+	}
+	self.RawSetI(t, int64(ref))
+	return ref
+}
+
+// Unref: 释放引用ref，对应的值可以被回收，ref可以被再次使用
+// [-0, +0, –]
+// http://www.lua.org/manual/5.3/manual.html#luaL_unref
+// lua-5.3.4/src/lauxlib.c#luaL_unref()
+func (self *luaState) Unref(t, ref int) {
+	if ref >= 0 {
+		t = self.AbsIndex(t)
+		self.RawGetI(t, freelist)
+		self.RawSetI(t, int64(ref)) /* t[ref] = t[freelist] */
+		self.PushInteger(int64(ref))
+		self.RawSetI(t, freelist) /* t[freelist] = ref */
+	}
+}
@@ -3,6 +3,7 @@ package state
 import (
 	. "luago/api"
 	"luago/binchunk"
+	"weak"
 )
 
 type closure struct {
@@ -10,6 +11,8 @@ type closure struct {
 	proto  *binchunk.Prototype
 	goFunc GoFunction
 	upvals []*upvalue
+	// 以这个闭包为键的弱键表中的值（ephemeron），见lua_weak.go
+	ephemerons map[weak.Pointer[luaTable]]luaValue
 }
 
 type upvalue struct {
@@ -0,0 +1,334 @@
+package state
+
+import (
+	"fmt"
+	"luago/binchunk"
+	"luago/vm"
+	"strings"
+)
+
+const LUA_IDSIZE = 60 /* size of the "source" part of debug messages */
+
+const LUA_ENV = "_ENV"
+
+// runError: 抛出运行时错误，当前函数是Lua函数时在信息前加上"源文件:行号:"
+// lua-5.3.4/src/ldebug.c#luaG_runerror()
+func (self *luaState) runError(format string, a ...interface{}) {
+	msg := fmt.Sprintf(format, a...)
+	if proto := self.stack.luaProto(); proto != nil { /* if Lua function, add source:line information */
+		msg = fmt.Sprintf("%s:%d: %s", chunkID(proto.Source), self.stack.currentLine(), msg)
+	}
+	panic(msg)
+}
+
+// valueTypeError: 对错误类型的值执行操作，比如"attempt to index a nil value (global 'x')"
+// lua-5.3.4/src/ldebug.c#luaG_typeerror()
+func (self *luaState) valueTypeError(val luaValue, op string) {
+	t := self.objTypeName(val)
+	self.runError("attempt to %s a %s value%s", op, t, self.varInfo(val))
+}
+
+// 算术运算出错时，报告第一个不是数字的操作数
+// lua-5.3.4/src/ldebug.c#luaG_opinterror()
+func (self *luaState) opInterror(p1, p2 luaValue, msg string) {
+	if _, ok := convertToFloat(_stringToNumber(p1)); !ok { /* first operand is wrong? */
+		p2 = p1 /* now second is wrong too */
+	}
+	self.valueTypeError(p2, msg)
+}
+
+// 位运算的操作数都是数字，但有一个不能转换成整数
+// lua-5.3.4/src/ldebug.c#luaG_tointerror()
+func (self *luaState) toIntError(p1, p2 luaValue) {
+	if _, ok := convertToInteger(p1); !ok {
+		p2 = p1
+	}
+	self.runError("number%s has no integer representation", self.varInfo(p2))
+}
+
+// lua-5.3.4/src/ldebug.c#luaG_concaterror()
+func (self *luaState) concatError(p1, p2 luaValue) {
+	switch p1.(type) {
+	case string, int64, float64:
+		p1 = p2
+	}
+	self.valueTypeError(p1, "concatenate")
+}
+
+// lua-5.3.4/src/ldebug.c#luaG_ordererror()
+func (self *luaState) orderError(p1, p2 luaValue) {
+	t1 := self.objTypeName(p1)
+	t2 := self.objTypeName(p2)
+	if t1 == t2 {
+		self.runError("attempt to compare two %s values", t1)
+	} else {
+		self.runError("attempt to compare %s with %s", t1, t2)
+	}
+}
+
+// 类型名，元表中有字符串类型的__name字段时使用它
+// lua-5.3.4/src/ltm.c#luaT_objtypename()
+func (self *luaState) objTypeName(val luaValue) string {
+	if name, ok := getMetafield(val, "__name", self).(string); ok {
+		return name
+	}
+	return self.TypeName(typeOf(val))
+}
+
+// varInfo: 根据当前指令找出出错的值来自哪个变量，返回" (kind 'name')"
+// 出错的值不是当前指令的操作数（比如来自元方法）时返回空串
+// lua-5.3.4/src/ldebug.c#varinfo()
+func (self *luaState) varInfo(val luaValue) string {
+	stack := self.stack
+	proto := stack.luaProto()
+	if proto == nil {
+		return ""
+	}
+	pc := stack.pc - 1 /* current instruction */
+	if pc < 0 || pc >= len(proto.Code) {
+		return ""
+	}
+	i := vm.Instruction(proto.Code[pc])
+	a, b, c := i.ABC()
+
+	var regs, upvals []int /* operands that may hold the wrong value */
+	switch i.Opcode() {
+	case vm.OP_GETTABUP:
+		upvals = []int{b}
+	case vm.OP_SETTABUP:
+		upvals = []int{a}
+	case vm.OP_GETTABLE, vm.OP_SELF, vm.OP_UNM, vm.OP_BNOT, vm.OP_LEN:
+		regs = []int{b}
+	case vm.OP_SETTABLE, vm.OP_CALL, vm.OP_TAILCALL, vm.OP_TFORCALL:
+		regs = []int{a}
+	case vm.OP_CONCAT:
+		for r := b; r <= c; r++ {
+			regs = append(regs, r)
+		}
+	case vm.OP_ADD, vm.OP_SUB, vm.OP_MUL, vm.OP_MOD, vm.OP_POW, vm.OP_DIV,
+		vm.OP_IDIV, vm.OP_BAND, vm.OP_BOR, vm.OP_BXOR, vm.OP_SHL, vm.OP_SHR:
+		for _, rk := range []int{b, c} {
+			if rk <= 0xFF { /* constants have no name */
+				regs = append(regs, rk)
+			}
+		}
+	}
+
+	for _, uv := range upvals { /* check whether 'val' is an upvalue */
+		if uv < len(stack.closure.upvals) && *stack.closure.upvals[uv].val == val {
+			return fmt.Sprintf(" (upvalue '%s')", upvalName(proto, uv))
+		}
+	}
+	for _, reg := range regs { /* no? try a register */
+		if reg < len(stack.slots) && stack.slots[reg] == val {
+			if kind, name := getObjName(proto, pc, reg); kind != "" {
+				return fmt.Sprintf(" (%s '%s')", kind, name)
+			}
+			return ""
+		}
+	}
+	return ""
+}
+
+// getObjName: 通过局部变量表或者符号执行推测寄存器中的值的名字
+// lua-5.3.4/src/ldebug.c#getobjname()
+func getObjName(proto *binchunk.Prototype, lastPC, reg int) (kind, name string) {
+	if name = getLocalName(proto, reg+1, lastPC); name != "" { /* is a local? */
+		return "local", name
+	}
+	/* else try symbolic execution */
+	pc := findSetReg(proto, lastPC, reg)
+	if pc == -1 { /* could not find instruction? */
+		return "", ""
+	}
+	i := vm.Instruction(proto.Code[pc])
+	switch op := i.Opcode(); op {
+	case vm.OP_MOVE:
+		a, b, _ := i.ABC() /* move from 'b' to 'a' */
+		if b < a {
+			return getObjName(proto, pc, b) /* get name for 'b' */
+		}
+	case vm.OP_GETTABUP, vm.OP_GETTABLE:
+		_, t, k := i.ABC() /* table index and key index */
+		var vn string      /* name of indexed variable */
+		if op == vm.OP_GETTABLE {
+			if vn = getLocalName(proto, t+1, pc); vn == "" {
+				if kind, n := getObjName(proto, pc, t); kind == "upvalue" {
+					vn = n /* _ENV loaded by GETUPVAL */
+				}
+			}
+		} else {
+			vn = upvalName(proto, t)
+		}
+		name = kName(proto, pc, k)
+		if vn == LUA_ENV {
+			return "global", name
+		}
+		return "field", name
+	case vm.OP_GETUPVAL:
+		_, b, _ := i.ABC()
+		return "upvalue", upvalName(proto, b)
+	case vm.OP_LOADK, vm.OP_LOADKX:
+		_, b := i.ABx()
+		if op == vm.OP_LOADKX {
+			b = vm.Instruction(proto.Code[pc+1]).Ax()
+		}
+		if s, ok := proto.Constants[b].(string); ok {
+			return "constant", s
+		}
+	case vm.OP_SELF:
+		_, _, k := i.ABC() /* key index */
+		return "method", kName(proto, pc, k)
+	}
+	return "", "" /* could not find reasonable name */
+}
+
+// kName: 键的名字，只有字符串常量才有意义
+// lua-5.3.4/src/ldebug.c#kname()
+func kName(proto *binchunk.Prototype, pc, c int) string {
+	if c > 0xFF { /* is 'c' a constant? */
+		if s, ok := proto.Constants[c&0xFF].(string); ok { /* literal constant? */
+			return s /* it is its own name */
+		}
+	} else { /* 'c' is a register */
+		if kind, name := getObjName(proto, pc, c); kind == "constant" { /* found a constant name? */
+			return name
+		}
+	}
+	return "?" /* no reasonable name found */
+}
+
+// findSetReg: 找到lastPC之前最后一条修改寄存器reg的指令
+// lua-5.3.4/src/ldebug.c#findsetreg()
+func findSetReg(proto *binchunk.Prototype, lastPC, reg int) int {
+	setReg := -1   /* keep last instruction that changed 'reg' */
+	jmpTarget := 0 /* any code before this address is conditional */
+	filterPC := func(pc int) int {
+		if pc < jmpTarget { /* is code conditional (inside a jump)? */
+			return -1 /* cannot know who sets that register */
+		}
+		return pc /* current position sets that register */
+	}
+	for pc := 0; pc < lastPC; pc++ {
+		i := vm.Instruction(proto.Code[pc])
+		a, b, _ := i.ABC()
+		switch i.Opcode() {
+		case vm.OP_LOADNIL:
+			if a <= reg && reg <= a+b { /* set registers from 'a' to 'a+b' */
+				setReg = filterPC(pc)
+			}
+		case vm.OP_TFORCALL:
+			if reg >= a+2 { /* affect all regs above its base */
+				setReg = filterPC(pc)
+			}
+		case vm.OP_CALL, vm.OP_TAILCALL:
+			if reg >= a { /* affect all registers above base */
+				setReg = filterPC(pc)
+			}
+		case vm.OP_JMP:
+			_, sBx := i.AsBx()
+			dest := pc + 1 + sBx
+			/* jump is forward and do not skip 'lastpc'? */
+			if pc < dest && dest <= lastPC && dest > jmpTarget {
+				jmpTarget = dest /* update 'jmptarget' */
+			}
+		default:
+			if i.TestAMode() && reg == a { /* any instruction that set A */
+				setReg = filterPC(pc)
+			}
+		}
+	}
+	return setReg
+}
+
+// getLocalName: 第n个在pc处有效的局部变量的名字
+// lua-5.3.4/src/lfunc.c#luaF_getlocalname()
+func getLocalName(proto *binchunk.Prototype, localNumber, pc int) string {
+	for _, locVar := range proto.LocVars {
+		if int(locVar.StartPC) > pc {
+			break
+		}
+		if pc < int(locVar.EndPC) { /* is variable active? */
+			localNumber--
+			if localNumber == 0 {
+				return locVar.VarName
+			}
+		}
+	}
+	return "" /* not found */
+}
+
+func upvalName(proto *binchunk.Prototype, uv int) string {
+	if uv < len(proto.UpvalueNames) && proto.UpvalueNames[uv] != "" {
+		return proto.UpvalueNames[uv]
+	}
+	return "?"
+}
+
+// chunkID: 把chunk名转换成报错信息中使用的形式
+// "=name"原样输出，"@filename"输出文件名，其他的输出[string "source"]
+// lua-5.3.4/src/lobject.c#luaO_chunkid()
+func chunkID(source string) string {
+	const RETS = "..."
+	const PRE = "[string \""
+	const POS = "\"]"
+
+	l := len(source)
+	switch {
+	case strings.HasPrefix(source, "="): /* 'literal' source */
+		if l <= LUA_IDSIZE { /* small enough? */
+			return source[1:]
+		}
+		return source[1:LUA_IDSIZE] /* truncate it */
+	case strings.HasPrefix(source, "@"): /* file name */
+		if l <= LUA_IDSIZE { /* small enough? */
+			return source[1:]
+		}
+		/* add '...' before rest of name */
+		return RETS + source[l-(LUA_IDSIZE-len(RETS)-1):]
+	default: /* string; format as [string "source"] */
+		bufflen := LUA_IDSIZE - len(PRE+RETS+POS) - 1 /* save space for prefix+suffix+'\0' */
+		nl := strings.IndexByte(source, '\n')         /* find first new line (if any) */
+		if l < bufflen && nl < 0 {                    /* small one-line source? */
+			return PRE + source + POS /* keep it */
+		}
+		if nl >= 0 {
+			l = nl /* stop at first newline */
+		}
+		if l > bufflen {
+			l = bufflen
+		}
+		return PRE + source[:l] + RETS + POS
+	}
+}
+
+// getStack: 第level层调用帧，0表示当前正在运行的函数，没有这一层时返回nil
+// lua-5.3.4/src/ldebug.c#lua_getstack()
+func (self *luaState) getStack(level int) *luaStack {
+	stack := self.stack
+	for ; level > 0 && stack != nil; level-- {
+		stack = stack.prev
+	}
+	if stack == nil || stack.closure == nil { /* base of the call chain */
+		return nil
+	}
+	return stack
+}
+
+// luaProto: 调用帧对应的Lua函数原型，Go函数返回nil
+func (self *luaStack) luaProto() *binchunk.Prototype {
+	if self.closure == nil || self.closure.proto == nil {
+		return nil
+	}
+	return self.closure.proto
+}
+
+// currentLine: 当前执行的指令所在的行号，没有行号信息时返回-1
+// lua-5.3.4/src/ldebug.c#currentline()
+func (self *luaStack) currentLine() int {
+	pc := self.pc - 1
+	if proto := self.luaProto(); proto != nil && pc >= 0 && pc < len(proto.LineInfo) {
+		return int(proto.LineInfo[pc])
+	}
+	return -1
+}
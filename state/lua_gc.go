@@ -0,0 +1,197 @@
+package state
+
+import "fmt"
+import "runtime"
+import "sort"
+import "sync"
+import "sync/atomic"
+import "time"
+import "weak"
+import . "luago/api"
+
+// __gc终结器
+// setmetatable时元表中有__gc字段的表被标记为需要终结（本实现没有userdata，只支持表），
+// 之后再往元表中添加__gc不会标记。被标记的表不可达时，Go的finalizer把它放入待终结队列
+// （对象因此复活），终结器在state自己的goroutine上执行：调用Go函数时、从Go发起调用时
+// （collectgarbage("stop")之后暂停）、collectgarbage完成回收时以及Close时。每个对象的终结器只执行一次，除非再次用带__gc的元表
+// 调用setmetatable。和Go的finalizer一样，能从自身到达的对象（比如t.self = t）不会被Go回收，
+// 它们的终结器在Close时执行。
+
+const (
+	finalizerPoll = 10 * time.Millisecond  /* 等不到入队通知时再做一次回收的间隔 */
+	finalizerWait = 100 * time.Millisecond /* 最多等待Go的finalizer的时间 */
+)
+
+// gcRecord: 被标记对象的记录，只持有对象的弱引用
+type gcRecord struct {
+	ref    weak.Pointer[luaTable]
+	seq    int64 // 标记的顺序，Close时按相反的顺序执行终结器
+	queued int32 // Go的finalizer已经把对象放入队列
+}
+
+// finalizerQueue: 等待在state的goroutine上执行终结器的对象
+// Go的finalizer在其他goroutine中调用push，因此需要加锁
+type finalizerQueue struct {
+	mu      sync.Mutex
+	pending []*luaTable
+	n       int32         // len(pending)，用于不加锁的快速检查
+	notify  chan struct{} // 有对象入队时发出通知
+}
+
+func newFinalizerQueue() *finalizerQueue {
+	return &finalizerQueue{notify: make(chan struct{}, 1)}
+}
+
+func (self *finalizerQueue) push(t *luaTable, rec *gcRecord) {
+	self.mu.Lock()
+	self.pending = append(self.pending, t)
+	atomic.StoreInt32(&self.n, int32(len(self.pending)))
+	atomic.StoreInt32(&rec.queued, 1)
+	self.mu.Unlock()
+	select {
+	case self.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (self *finalizerQueue) take() []*luaTable {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	pending := self.pending
+	self.pending = nil
+	atomic.StoreInt32(&self.n, 0)
+	return pending
+}
+
+// checkFinalizer: setmetatable时调用，元表中有__gc时标记对象
+// lua-5.3.4/src/lgc.c#luaC_checkfinalizer()
+func (self *luaState) checkFinalizer(t *luaTable, mt *luaTable) {
+	if t.gcRec != nil || mt == nil || mt.get("__gc") == nil {
+		return /* or already marked, or has no finalizer */
+	}
+	self.gcSeq++
+	rec := &gcRecord{ref: weak.Make(t), seq: self.gcSeq}
+	t.gcRec = rec
+	self.gcRecords[rec] = struct{}{}
+	q := self.gcq
+	runtime.SetFinalizer(t, func(t *luaTable) { q.push(t, rec) })
+}
+
+// checkFinalizers: 在安全的位置执行已经入队的终结器，出错时向调用者抛出错误
+func (self *luaState) checkFinalizers() {
+	self.purgeEphemerons()
+	self.collectThreads()
+	if atomic.LoadInt32(&self.gcq.n) != 0 && !self.inFinalizer && !self.gcStopped {
+		self.runFinalizers(true)
+	}
+}
+
+// runFinalizers: 执行队列中全部对象的终结器
+// lua-5.3.4/src/lgc.c#callallpendingfinalizers()
+func (self *luaState) runFinalizers(propagateErrors bool) {
+	for {
+		pending := self.gcq.take()
+		if len(pending) == 0 {
+			return
+		}
+		self.callPending(pending, propagateErrors)
+	}
+}
+
+// callPending: 依次执行终结器，某个终结器出错时把还没有执行的对象放回队列
+func (self *luaState) callPending(pending []*luaTable, propagateErrors bool) {
+	i := 0
+	defer func() {
+		for _, t := range pending[min(i+1, len(pending)):] {
+			self.gcq.push(t, t.gcRec)
+		}
+	}()
+	for ; i < len(pending); i++ {
+		self.callGCTM(pending[i], propagateErrors)
+	}
+}
+
+// awaitFinalizers: 等待Go的finalizer把全部已经不可达的被标记对象放入队列
+// Go不保证finalizer及时执行（比如finalizer的goroutine被宿主的其他finalizer阻塞），
+// 每隔finalizerPoll再做一次回收，最多等待finalizerWait，返回时是否还有对象没有入队
+func (self *luaState) awaitFinalizers() (timedOut bool) {
+	deadline := time.After(finalizerWait)
+	for self.finalizersPending() {
+		select {
+		case <-self.gcq.notify:
+		case <-time.After(finalizerPoll):
+			runtime.GC()
+		case <-deadline:
+			return self.finalizersPending()
+		}
+	}
+	return false
+}
+
+// finalizersPending: 是否有已经不可达但Go的finalizer还没有把它放入队列的对象
+func (self *luaState) finalizersPending() bool {
+	for rec := range self.gcRecords {
+		if rec.ref.Value() == nil && atomic.LoadInt32(&rec.queued) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// callGCTM: 调用对象的__gc元方法，元方法在执行时才从元表中取出
+// lua-5.3.4/src/lgc.c#GCTM()
+func (self *luaState) callGCTM(t *luaTable, propagateErrors bool) {
+	delete(self.gcRecords, t.gcRec)
+	t.gcRec = nil
+	tm, ok := getMetafield(t, "__gc", self).(*closure)
+	if !ok { /* is there a finalizer? */
+		return
+	}
+	self.stack.check(2)
+	self.stack.push(tm)
+	self.stack.push(t)
+	inFinalizer := self.inFinalizer
+	self.inFinalizer = true /* avoid running finalizers recursively */
+	status := self.PCall(1, 0, 0)
+	self.inFinalizer = inFinalizer
+	if status != LUA_OK { /* error while running __gc? */
+		msg, ok := self.stack.pop().(string)
+		if !ok {
+			msg = "no message"
+		}
+		if propagateErrors {
+			panic(fmt.Sprintf("error in __gc metamethod (%s)", msg))
+		}
+	}
+}
+
+// closeFinalizers: Close时执行全部剩余的终结器，错误被忽略
+// 仍然可达的对象按标记的相反顺序终结
+// lua-5.3.4/src/lgc.c#luaC_freeallobjects()
+func (self *luaState) closeFinalizers() {
+	for len(self.gcRecords) > 0 || atomic.LoadInt32(&self.gcq.n) != 0 {
+		if self.awaitFinalizers() { /* give up on objects whose finalizer never ran */
+			for rec := range self.gcRecords {
+				if rec.ref.Value() == nil && atomic.LoadInt32(&rec.queued) == 0 {
+					delete(self.gcRecords, rec)
+				}
+			}
+		}
+		self.runFinalizers(false)
+		var live []*luaTable
+		for rec := range self.gcRecords {
+			if t := rec.ref.Value(); t != nil {
+				live = append(live, t)
+			}
+		}
+		sort.Slice(live, func(i, j int) bool {
+			return live[i].gcRec.seq > live[j].gcRec.seq
+		})
+		for _, t := range live {
+			if t.gcRec != nil {
+				runtime.SetFinalizer(t, nil)
+				self.callGCTM(t, false)
+			}
+		}
+	}
+}
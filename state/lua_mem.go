@@ -0,0 +1,154 @@
+package state
+
+import "runtime"
+import "sync"
+import "sync/atomic"
+import "time"
+import "unsafe"
+
+// 内存统计
+// Go负责真正的内存管理，这里只按估算的大小统计Lua对象（表、闭包、字符串和线程）占用的内存：
+// 对象创建和表扩容时计入，对象被Go回收后由runtime.AddCleanup注册的清理函数扣除
+// 超出上限时做一次Go的垃圾回收，之后要再增长一个步长（上限的1/8）才会再做，避免每次分配都阻塞在回收上；
+// 回收并等待清理函数执行后仍然超出上限时抛出memoryError
+
+/* estimated sizes of objects, in bytes */
+const (
+	tableBaseSize   = 64
+	tableSlotSize   = 16 /* one luaValue in the array part */
+	tableNodeSize   = 40 /* one key-value pair in the hash part */
+	closureBaseSize = 48
+	upvalueSize     = 24
+	stringBaseSize  = 16   /* string header */
+	threadSize      = 1024 /* luaState and its base stack frame */
+
+	minTrackedString = 64                    /* 更短的字符串不单独统计，它们的内存主要体现在保存它们的表中 */
+	cleanupWait      = 10 * time.Millisecond /* 回收后最多等待清理函数执行的时间 */
+)
+
+// memoryError: 超出内存限制时抛出，PCall返回LUA_ERRMEM
+type memoryError struct{}
+
+func (memoryError) Error() string {
+	return "not enough memory"
+}
+
+// memStats: 一个luaState的内存统计，清理函数只引用它而不引用state，不影响state的回收
+type memStats struct {
+	used      int64 // 当前估算的内存占用，清理函数在其他goroutine中修改，需要原子操作
+	limit     int64 // 内存上限，0表示不限制
+	gcTrigger int64 // 超出上限后，内存占用达到这个值时才再做一次垃圾回收
+	// 已经计入统计的字符串，以数据的地址为键，避免同一个字符串多次压栈时重复计入
+	strMu sync.Mutex
+	strs  map[uintptr]struct{}
+}
+
+// memBlock: 一个对象的内存记录
+type memBlock struct {
+	stats *memStats
+	size  int64
+}
+
+// newMemBlock: 记录对象obj占用size字节，obj被回收后自动扣除
+func newMemBlock[T any](stats *memStats, obj *T, size int64) *memBlock {
+	b := &memBlock{stats: stats}
+	runtime.AddCleanup(obj, func(b *memBlock) {
+		atomic.AddInt64(&b.stats.used, -atomic.LoadInt64(&b.size))
+	}, b)
+	b.resize(size)
+	return b
+}
+
+// resize: 修改对象占用的内存，增长后超出内存上限时抛出memoryError
+func (self *memBlock) resize(size int64) {
+	delta := size - atomic.LoadInt64(&self.size)
+	if delta == 0 {
+		return
+	}
+	atomic.AddInt64(&self.size, delta)
+	self.stats.add(delta)
+}
+
+// add: 计入delta字节，增长后超出上限时检查
+func (self *memStats) add(delta int64) {
+	used := atomic.AddInt64(&self.used, delta)
+	if delta > 0 && self.limit > 0 && used > self.limit && used >= atomic.LoadInt64(&self.gcTrigger) {
+		self.checkLimit()
+	}
+}
+
+// checkLimit: 先做一次完整的垃圾回收，等已经不可达的对象的清理函数把它们扣除，仍然超出上限则报错
+// 下一次回收推迟到内存再增长一个步长之后
+func (self *memStats) checkLimit() {
+	runtime.GC()
+	deadline := time.Now().Add(cleanupWait)
+	for atomic.LoadInt64(&self.used) > self.limit && time.Now().Before(deadline) {
+		runtime.Gosched() /* give cleanups a chance to run */
+	}
+	used := atomic.LoadInt64(&self.used)
+	atomic.StoreInt64(&self.gcTrigger, min(used, self.limit)+max(self.limit/8, 1))
+	if used > self.limit {
+		panic(memoryError{})
+	}
+}
+
+// trackString: 把新压栈的字符串计入内存统计，字符串的数据被回收后扣除
+func (self *memStats) trackString(s string) {
+	if len(s) < minTrackedString {
+		return
+	}
+	data := unsafe.StringData(s)
+	key := uintptr(unsafe.Pointer(data))
+	self.strMu.Lock()
+	if _, found := self.strs[key]; found {
+		self.strMu.Unlock()
+		return
+	}
+	if self.strs == nil {
+		self.strs = map[uintptr]struct{}{}
+	}
+	self.strs[key] = struct{}{}
+	self.strMu.Unlock()
+
+	size := stringBaseSize + int64(len(s))
+	if addStringCleanup(data, func(key uintptr) {
+		self.strMu.Lock()
+		delete(self.strs, key)
+		self.strMu.Unlock()
+		atomic.AddInt64(&self.used, -size)
+	}, key) {
+		self.add(size)
+	}
+}
+
+// addStringCleanup: 为字符串数据注册清理函数
+// 字符串常量由链接器分配，不在堆上，AddCleanup会panic，这种字符串不会被回收，也不计入统计，
+// 它留在strs中，之后再压栈时不再尝试
+func addStringCleanup(data *byte, cleanup func(uintptr), key uintptr) (ok bool) {
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+	runtime.AddCleanup(data, cleanup, key)
+	return true
+}
+
+// newTable: 新建受内存统计的表
+func (self *luaState) newTable(nArr, nRec int) *luaTable {
+	t := newLuaTable(nArr, nRec)
+	t.mem = newMemBlock(self.mem, t, t.memSize())
+	return t
+}
+
+// trackClosure: 把闭包计入内存统计
+func (self *luaState) trackClosure(c *closure) *closure {
+	newMemBlock(self.mem, c, closureBaseSize+upvalueSize*int64(len(c.upvals)))
+	return c
+}
+
+// trackThread: 把线程计入内存统计
+func (self *luaState) trackThread(t *luaState) *luaState {
+	newMemBlock(self.mem, t, threadSize)
+	return t
+}
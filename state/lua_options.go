@@ -0,0 +1,146 @@
+package state
+
+import "io"
+import "io/fs"
+import "math/rand"
+import "os"
+import "time"
+import . "luago/api"
+
+// Option: NewState的配置选项
+type Option func(*options)
+
+type options struct {
+	stdout     io.Writer
+	stderr     io.Writer
+	stdin      io.Reader
+	libs       []string // nil表示打开全部标准库
+	optLibs    []string // 要打开的可选库
+	stackSize  int
+	memLimit   int64
+	instLimit  int64
+	fsys       fs.FS
+	now        func() time.Time
+	randSource rand.Source
+	version    int
+	noBinary   bool
+	goPanics   bool
+}
+
+func defaultOptions() *options {
+	return &options{
+		stdout:     os.Stdout,
+		stderr:     os.Stderr,
+		stdin:      os.Stdin,
+		stackSize:  LUA_MINSTACK,
+		fsys:       osFS{},
+		now:        time.Now,
+		randSource: rand.NewSource(time.Now().UnixNano()),
+		version:    LUA_VERSION_NUM,
+	}
+}
+
+// NewState: 按选项创建luaState，默认打开全部标准库
+func NewState(opts ...Option) LuaState {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(o)
+	}
+	ls := newState(o)
+	if o.libs == nil {
+		ls.OpenLibs()
+	} else {
+		ls.openLibs(o.libs)
+	}
+	ls.openOptionalLibs(o.optLibs)
+	return ls
+}
+
+// WithStdout: print、io.write等函数的输出目标，默认os.Stdout
+func WithStdout(w io.Writer) Option {
+	return func(o *options) { o.stdout = w }
+}
+
+// WithStderr: 错误输出目标，默认os.Stderr
+func WithStderr(w io.Writer) Option {
+	return func(o *options) { o.stderr = w }
+}
+
+// WithStdin: 标准输入，默认os.Stdin
+func WithStdin(r io.Reader) Option {
+	return func(o *options) { o.stdin = r }
+}
+
+// WithLibs: 只打开指定的标准库，名字和全局变量名相同，基础库为"_G"
+// 不带参数时不打开任何标准库
+func WithLibs(names ...string) Option {
+	return func(o *options) { o.libs = append([]string{}, names...) }
+}
+
+// WithOptionalLibs: 在标准库之后打开指定的可选库，OpenLibs不会打开它们
+// "compat51"：Lua 5.1兼容库（setfenv、getfenv、unpack、loadstring、module、table.getn等），
+// 打开之后vararg函数带有5.1的局部变量arg
+func WithOptionalLibs(names ...string) Option {
+	return func(o *options) { o.optLibs = append(o.optLibs, names...) }
+}
+
+// WithStackSize: 初始栈大小，栈空间不足时仍会自动扩容
+func WithStackSize(n int) Option {
+	return func(o *options) {
+		if n > 0 {
+			o.stackSize = n
+		}
+	}
+}
+
+// WithMemoryLimit: 内存上限（字节），按估算的Lua对象大小计算，超出时报错"not enough memory"
+// 0表示不限制
+func WithMemoryLimit(bytes int64) Option {
+	return func(o *options) { o.memLimit = bytes }
+}
+
+// WithInstructionLimit: 每次从Go发起的调用最多执行的虚拟机指令数，超出时报错
+// 0表示不限制
+func WithInstructionLimit(n int64) Option {
+	return func(o *options) { o.instLimit = n }
+}
+
+// WithFS: 加载文件（loadfile、dofile、require）使用的文件系统，默认使用操作系统的文件系统
+func WithFS(fsys fs.FS) Option {
+	return func(o *options) { o.fsys = fsys }
+}
+
+// WithClock: os.time和os.date取当前时间使用的时钟，默认time.Now
+func WithClock(now func() time.Time) Option {
+	return func(o *options) { o.now = now }
+}
+
+// WithRandSource: math.random使用的随机数源，默认用当前时间作种子
+func WithRandSource(src rand.Source) Option {
+	return func(o *options) { o.randSource = src }
+}
+
+// WithVersion: 语言版本，LUA_VERSION_NUM（5.3，默认）或LUA_VERSION_NUM_54（5.4）
+// 5.4的语义包括：整数for循环不会溢出，字符串的算术运算由字符串元方法完成，
+// 5.4的math.random和utf8库，coroutine.close，warn函数以及_VERSION = "Lua 5.4"
+func WithVersion(v int) Option {
+	return func(o *options) {
+		if v == LUA_VERSION_NUM_54 {
+			o.version = v
+		} else {
+			o.version = LUA_VERSION_NUM
+		}
+	}
+}
+
+// WithBinaryChunks: 是否允许Load加载二进制chunk，默认允许
+// 二进制chunk在加载时会先检查字节码，但仍然可以绕过编译器的限制，运行不受信任的代码时应该关闭
+func WithBinaryChunks(allow bool) Option {
+	return func(o *options) { o.noBinary = !allow }
+}
+
+// WithGoPanics: PCall遇到Go运行时错误（空指针、数组越界等）时是否重新panic，默认转换为Lua错误
+// 调试Go函数时可以打开以得到完整的Go调用栈，创建之后可以用SetGoPanics修改
+func WithGoPanics(enable bool) Option {
+	return func(o *options) { o.goPanics = enable }
+}
@@ -12,6 +12,7 @@ type luaStack struct {
 	pc      int              // pc:指令计数器
 	state   *luaState        // state:用于间接访问注册表
 	openuvs map[int]*upvalue // openuvs:当前栈内的upvalue
+	tbc     []int            // tbc:待关闭变量的索引，按声明的顺序排列
 }
 
 // newLuaStack:工厂创建lua栈
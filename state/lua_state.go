@@ -1,23 +1,111 @@
 package state
 
+import "io"
+import "io/fs"
+import "math/rand"
+import "os"
+import "time"
+import "weak"
 import . "luago/api"
 
+// luaState: Lua线程，主线程和协程
+// 每个线程有自己的调用栈，其余的状态由同一个state中的全部线程共享
+// lua-5.3.4/src/lstate.h#lua_State
 type luaState struct {
-	registry *luaTable
-	stack    *luaStack
+	*globalState
+	stack *luaStack
+	// 协程，见api_coroutine.go
+	status  int                       // LUA_OK、LUA_YIELD或者结束协程的错误码
+	started bool                      // 协程的goroutine已经启动
+	depth   int                       // resume的嵌套层数
+	resume  chan coMsg                // resume和close发给协程的消息
+	yield   chan coDone               // 协程挂起或结束时发给resume的消息
+	value   weak.Pointer[threadValue] // Lua中代表这个线程的值，见thread
+}
+
+// globalState: 同一个state中全部线程共享的状态
+// lua-5.3.4/src/lstate.h#global_State
+type globalState struct {
+	registry    *luaTable
+	interrupted int32 // 非0时在执行下一条指令前抛出"interrupted!"错误，抛出后清除
+	cancelled   int32 // 已经结束但调用还没有返回的PCallContext的ctx个数，非0时每条指令前都抛出"interrupted!"
+	goPanics    bool  // 为true时Go代码中的运行时错误不转换为Lua错误，直接panic
+	closed      bool  // Close之后为true
+	version     int   // 语言版本，见WithVersion
+	noBinary    bool  // 为true时Load拒绝二进制chunk，见WithBinaryChunks
+	// 线程
+	mainThread *luaState
+	threads    map[*luaState]struct{} // 已经启动、还没有结束的协程，Close时关闭
+	coq        *threadQueue           // Lua中已经不再引用的协程
+	// warn的状态
+	warnOn   bool // 是否输出警告，默认关闭
+	warnCont bool // 上一条警告还没有结束
+	// 终结器
+	gcq         *finalizerQueue
+	gcRecords   map[*gcRecord]struct{} // 被标记为需要终结的对象
+	gcSeq       int64
+	inFinalizer bool // 正在执行终结器
+	// 弱表
+	weakq *weakQueue // 被回收的ephemeron表，见lua_weak.go
+	// collectgarbage的参数
+	gcStopped bool  // 为true时不在安全点自动执行终结器
+	gcPause   int   // 百分比，step累计的分配量超过当前内存的(gcPause-100)%时完成一次回收
+	gcStepMul int   // 百分比，step的分配量按这个倍数计入
+	gcDebt    int64 // step累计的分配量
+	// 宿主环境
+	stdout io.Writer
+	stderr io.Writer
+	stdin  io.Reader
+	fsys   fs.FS
+	now    func() time.Time
+	rand   *rand.Rand
+	// 资源限制
+	mem       *memStats
+	instLimit int64 // 每次从Go发起的调用最多执行的指令数，0表示不限制
+	instCount int64 // 本次调用已经执行的指令数
 }
 
 // New:创建luaState实例
 func New() *luaState {
-	registry := newLuaTable(0, 0)
-	registry.put(LUA_RIDX_GLOBALS, newLuaTable(0, 0)) // 全局环境
-	ls := &luaState{
-		registry: registry,
+	return newState(defaultOptions())
+}
+
+func newState(opts *options) *luaState {
+	g := &globalState{
+		threads:   map[*luaState]struct{}{},
+		coq:       &threadQueue{},
+		stdout:    opts.stdout,
+		stderr:    opts.stderr,
+		stdin:     opts.stdin,
+		fsys:      opts.fsys,
+		now:       opts.now,
+		rand:      rand.New(opts.randSource),
+		mem:       &memStats{limit: opts.memLimit},
+		gcq:       newFinalizerQueue(),
+		gcRecords: map[*gcRecord]struct{}{},
+		weakq:     &weakQueue{},
+		gcPause:   LUAI_GCPAUSE,
+		gcStepMul: LUAI_GCMUL,
+		instLimit: opts.instLimit,
+		version:   opts.version,
+		noBinary:  opts.noBinary,
+		goPanics:  opts.goPanics,
 	}
-	ls.pushLuaStack(newLuaStack(LUA_MINSTACK, ls)) // 代替了原来用传参或者写死的栈大小
+	ls := &luaState{globalState: g}
+	g.mainThread = ls
+	registry := ls.newTable(0, 0)
+	registry.put(LUA_RIDX_GLOBALS, ls.newTable(0, 0)) // 全局环境
+	ls.registry = registry
+	ls.pushLuaStack(newLuaStack(opts.stackSize, ls)) // 代替了原来用传参或者写死的栈大小
 	return ls
 }
 
+// SetGoPanics: 设置PCall遇到Go运行时错误（空指针、数组越界等）时是否重新panic
+// 默认会把它们转换为带Go调用栈摘要的Lua错误信息，调试时可以打开以得到完整的Go调用栈
+func (self *luaState) SetGoPanics(enable bool) {
+	self.goPanics = enable
+}
+
 // 链式调用栈部分
 
 func (self *luaState) pushLuaStack(stack *luaStack) {
@@ -30,3 +118,10 @@ func (self *luaState) popLuaStack() {
 	self.stack = stack.prev
 	stack.prev = nil
 }
+
+// osFS: 直接使用操作系统的文件系统，路径按操作系统的规则解释（可以是相对路径或绝对路径）
+type osFS struct{}
+
+func (osFS) Open(name string) (fs.File, error) {
+	return os.Open(name)
+}
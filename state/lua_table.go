@@ -3,6 +3,7 @@ package state
 import (
 	"luago/number"
 	"math"
+	"weak"
 )
 
 type luaTable struct {
@@ -11,6 +12,11 @@ type luaTable struct {
 	metatable *luaTable             // 元表支持
 	keys      map[luaValue]luaValue // 键值表
 	changed   bool                  //
+	mem       *memBlock             // 内存统计，由luaState.newTable设置
+	weak      *weakState            // 弱表状态，普通表为nil
+	gcRec     *gcRecord             // 被标记为需要终结时不为nil，见lua_gc.go
+	// 以这个表为键的弱键表中的值（ephemeron），见lua_weak.go
+	ephemerons map[weak.Pointer[luaTable]]luaValue
 }
 
 // newLuaTable:新建Lua表
@@ -30,10 +36,10 @@ func (self *luaTable) get(key luaValue) luaValue {
 	key = _floatToInteger(key)
 	if idx, ok := key.(int64); ok {
 		if idx >= 1 && idx <= int64(len(self.arr)) {
-			return self.arr[idx-1]
+			return self.load(key, self.arr[idx-1])
 		}
 	}
-	return self._map[key]
+	return self.load(key, self._map[self.mapKey(key)])
 }
 
 func _floatToInteger(key luaValue) luaValue {
@@ -52,6 +58,10 @@ func (self *luaTable) put(key, val luaValue) {
 	if f, ok := key.(float64); ok && math.IsNaN(f) {
 		panic("table index is nil")
 	}
+	if self.weak != nil {
+		self.sweep()
+		key, val = self.weak.store(key, val)
+	}
 	if idx, ok := key.(int64); ok && idx >= 1 {
 		arrLen := int64(len(self.arr))
 		if idx <= arrLen {
@@ -68,6 +78,7 @@ func (self *luaTable) put(key, val luaValue) {
 				// 在末尾后一位则扩展数组部分
 				self.arr = append(self.arr, val)
 				self._expandArray()
+				self.updateMem()
 				/*
 					这里举个例子：
 						如果数组长度一开始是2 并且定义了key为1和2的值
@@ -85,17 +96,32 @@ func (self *luaTable) put(key, val luaValue) {
 			self._map = make(map[luaValue]luaValue, 8)
 		}
 		self._map[key] = val
+		self.updateMem()
 	} else {
 		delete(self._map, key)
 	}
 }
 
+// memSize: 估算表占用的内存
+func (self *luaTable) memSize() int64 {
+	return tableBaseSize + tableSlotSize*int64(cap(self.arr)) +
+		tableNodeSize*int64(len(self._map))
+}
+
+// updateMem: 表增长后更新内存统计
+func (self *luaTable) updateMem() {
+	if self.mem != nil {
+		self.mem.resize(self.memSize())
+	}
+}
+
 // _shrinkArray: 删除数组中多余的hole（值为nil的key）
 func (self *luaTable) _shrinkArray() {
 	for i := len(self.arr) - 1; i >= 0; i-- {
-		if self.arr[i] == nil {
-			self.arr = self.arr[0:i]
+		if self.arr[i] != nil {
+			break
 		}
+		self.arr = self.arr[0:i]
 	}
 }
 
@@ -114,6 +140,10 @@ func (self *luaTable) _expandArray() {
 // len:这个方法和项目中的table_count 不是一个方法，理解成
 //		table.getn方法，只计算数组部分长度
 func (self *luaTable) len() int {
+	if self.weak != nil {
+		self.sweep()
+		self.trimDead()
+	}
 	return len(self.arr)
 }
 
@@ -124,11 +154,25 @@ func (self *luaTable) hasMetafield(fieldName string) bool {
 
 // nextKey:
 func (self *luaTable) nextKey(key luaValue) luaValue {
+	if self.weak != nil && key == nil {
+		self.sweep()
+	}
 	if self.keys == nil || key == nil {
 		self.initKeys()
 		self.changed = false
 	}
-	return self.keys[key]
+	if self.weak == nil {
+		return self.keys[key]
+	}
+	/* skip entries whose key or value has been collected */
+	for k := self.mapKey(key); ; {
+		if k = self.keys[k]; k == nil {
+			return nil
+		}
+		if sk := strongValue(k); sk != nil && self.get(sk) != nil {
+			return sk
+		}
+	}
 }
 
 // initKeys:
@@ -0,0 +1,67 @@
+package state
+
+import . "luago/api"
+
+// 待关闭变量
+// local x <close> = v 声明时TBC指令把x的寄存器记录在调用帧中，x离开作用域时（块结束、break、return）
+// 按声明的相反顺序调用v的__close元方法，参数为(v, nil)。出错时PCall在展开调用帧之前
+// 关闭这些帧中的全部待关闭变量，参数为(v, 错误对象)；__close本身出错时新的错误替换原来的错误，
+// 其余的变量照常关闭。关闭挂起的协程时关闭它全部调用帧中的待关闭变量，参数为(v, nil)。
+
+// ToClose: 把idx处的值标记为待关闭变量，nil和false不需要关闭
+// lua-5.4.6/src/lfunc.c#luaF_newtbcupval()
+func (self *luaState) ToClose(idx int) {
+	idx = self.stack.absIndex(idx)
+	val := self.stack.get(idx)
+	if val == nil || val == false {
+		return /* false doesn't need to be closed */
+	}
+	if getMetafield(val, "__close", self) == nil { /* no metamethod? */
+		name := ""
+		if proto := self.stack.luaProto(); proto != nil {
+			name = getLocalName(proto, idx, self.stack.pc-1)
+		}
+		if name == "" {
+			name = "?"
+		}
+		self.runError("variable '%s' got a non-closable value", name)
+	}
+	self.stack.tbc = append(self.stack.tbc, idx)
+}
+
+// closeTbc: 按声明的相反顺序关闭当前调用帧中索引不小于level的待关闭变量
+// lua-5.4.6/src/lfunc.c#luaF_close()
+func (self *luaState) closeTbc(level int) {
+	stack := self.stack
+	for n := len(stack.tbc); n > 0 && stack.tbc[n-1] >= level; n = len(stack.tbc) {
+		idx := stack.tbc[n-1]
+		stack.tbc = stack.tbc[:n-1] /* remove it before the call */
+		self.prepCloseMethod(stack.get(idx), nil)
+		self.Call(2, 0)
+	}
+}
+
+// closeTbcProtected: 关闭当前调用帧中的全部待关闭变量，返回最终的状态码和错误对象
+// status不是LUA_OK时把错误对象err传给__close；__close出错时新的错误替换原来的错误
+// lua-5.4.6/src/ldo.c#luaD_closeprotected()
+func (self *luaState) closeTbcProtected(status int, err luaValue) (int, luaValue) {
+	stack := self.stack
+	for n := len(stack.tbc); n > 0; n = len(stack.tbc) {
+		idx := stack.tbc[n-1]
+		stack.tbc = stack.tbc[:n-1]
+		self.prepCloseMethod(stack.get(idx), err)
+		if s := self.PCall(2, 0, 0); s != LUA_OK { /* error while closing? */
+			status, err = s, stack.pop() /* the new error replaces the original one */
+		}
+	}
+	return status, err
+}
+
+// prepCloseMethod: 压入val的__close元方法和它的两个参数
+// lua-5.4.6/src/lfunc.c#prepcallclosemth()
+func (self *luaState) prepCloseMethod(val, err luaValue) {
+	self.stack.check(3)
+	self.stack.push(getMetafield(val, "__close", self))
+	self.stack.push(val)
+	self.stack.push(err)
+}
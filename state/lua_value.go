@@ -24,8 +24,10 @@ func typeOf(val luaValue) LuaType {
 		return LUA_TTABLE
 	case *closure:
 		return LUA_TFUNCTION
-	default:
-		panic("todo!")
+	case *threadValue:
+		return LUA_TTHREAD
+	default: /* other Go values are opaque to Lua */
+		return LUA_TLIGHTUSERDATA
 	}
 }
 
@@ -81,11 +83,30 @@ func _stringToInteger(s string) (int64, bool) {
 	return 0, false
 }
 
+// _stringToNumber: 字符串按Lua数字的语法转换为整数或浮点数，其他值原样返回
+func _stringToNumber(val luaValue) luaValue {
+	if s, ok := val.(string); ok {
+		if i, ok := number.ParseInteger(s); ok {
+			return i
+		}
+		if f, ok := number.ParseFloat(s); ok {
+			return f
+		}
+	}
+	return val
+}
+
 // setMetatable: 先判断值是否是表，如果是，直接修改其元表字段即可。
 //			否则根据变量类型把元表存储到注册表里
 func setMetatable(val luaValue, mt *luaTable, ls *luaState) {
 	if t, ok := val.(*luaTable); ok {
 		t.metatable = mt
+		mode := ""
+		if mt != nil {
+			mode, _ = mt.get("__mode").(string)
+		}
+		t.setMode(mode, ls.weakq)
+		ls.checkFinalizer(t, mt)
 		return
 	}
 	key := fmt.Sprintf("_MT%d", typeOf(val))
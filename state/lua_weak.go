@@ -0,0 +1,269 @@
+package state
+
+import "runtime"
+import "strings"
+import "sync"
+import "sync/atomic"
+import "weak"
+
+// 弱表
+// 元表的__mode包含'k'或'v'时，表的键或值对可回收对象（表和闭包）只保持弱引用：
+// 键或值以weakRef的形式存放，对象被Go回收后对应的项在get、next和#中都不再可见。
+// 只有键是弱引用时实现ephemeron语义：值不存放在表中，而是挂在键对象上，
+// 这样值只在键可达时可达，值引用键也不会阻止键被回收。
+// 弱表被回收后，它挂在仍然可达的键对象上的值由state在安全的位置清除，见purgeEphemerons。
+// __mode在setmetatable时读取，之后再修改元表的__mode不会生效。
+
+// weakRef: 可回收对象的弱引用，同一个对象得到的weakRef相等，可以作为map的键
+type weakRef struct {
+	t weak.Pointer[luaTable]
+	c weak.Pointer[closure]
+}
+
+// ephemeronMark: 弱键表中占位的值，真正的值存放在键对象的ephemerons中
+type ephemeronMark struct{}
+
+// weakState: 弱表的状态
+type weakState struct {
+	weakK bool
+	weakV bool
+	self  weak.Pointer[luaTable] // 表自身，在键对象中标识ephemeron
+	dirty int32                  // 有对象被回收后由清理函数置1，下次修改表时清除失效的项
+	// 已经注册了清理函数的对象，每个对象只注册一次
+	watched map[weakRef]struct{}
+	// ephemeron表被回收时把自己交给state，由state从键对象上清除挂着的值
+	cleanup runtime.Cleanup
+}
+
+// weakQueue: 已经被回收的ephemeron表，等待在state的goroutine上清除键对象上的值
+// 清理函数在其他goroutine中调用push，因此需要加锁
+type weakQueue struct {
+	mu      sync.Mutex
+	pending []*weakState
+	n       int32 // len(pending)，用于不加锁的快速检查
+}
+
+func (self *weakQueue) push(w *weakState) {
+	self.mu.Lock()
+	self.pending = append(self.pending, w)
+	atomic.StoreInt32(&self.n, int32(len(self.pending)))
+	self.mu.Unlock()
+}
+
+func (self *weakQueue) take() []*weakState {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	pending := self.pending
+	self.pending = nil
+	atomic.StoreInt32(&self.n, 0)
+	return pending
+}
+
+// purgeEphemerons: 从仍然可达的键对象上清除已经被回收的弱表的值
+func (self *luaState) purgeEphemerons() {
+	if atomic.LoadInt32(&self.weakq.n) == 0 {
+		return
+	}
+	for _, w := range self.weakq.take() {
+		for ref := range w.watched {
+			if m := ephemeronsOf(ref.value()); m != nil {
+				delete(*m, w.self)
+			}
+		}
+		w.watched = nil
+	}
+}
+
+func isCollectable(v luaValue) bool {
+	switch v.(type) {
+	case *luaTable, *closure:
+		return true
+	}
+	return false
+}
+
+// makeWeak: 把可回收对象转换为弱引用，其他值不变
+func makeWeak(v luaValue) luaValue {
+	switch x := v.(type) {
+	case *luaTable:
+		return weakRef{t: weak.Make(x)}
+	case *closure:
+		return weakRef{c: weak.Make(x)}
+	}
+	return v
+}
+
+// value: 弱引用的对象，已被回收时返回nil
+func (self weakRef) value() luaValue {
+	if t := self.t.Value(); t != nil {
+		return t
+	}
+	if c := self.c.Value(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// strongValue: 把存放形式转换回Lua值，对象已被回收时返回nil
+func strongValue(v luaValue) luaValue {
+	if w, ok := v.(weakRef); ok {
+		return w.value()
+	}
+	return v
+}
+
+// ephemeronsOf: 键对象上存放ephemeron值的map
+func ephemeronsOf(key luaValue) *map[weak.Pointer[luaTable]]luaValue {
+	switch x := key.(type) {
+	case *luaTable:
+		return &x.ephemerons
+	case *closure:
+		return &x.ephemerons
+	}
+	return nil
+}
+
+// watch: 对象被回收时标记弱表需要清理，同一个对象只注册一次清理函数
+func (self *weakState) watch(obj luaValue) {
+	ref := makeWeak(obj).(weakRef)
+	if _, ok := self.watched[ref]; ok {
+		return
+	}
+	if self.watched == nil {
+		self.watched = map[weakRef]struct{}{}
+	}
+	self.watched[ref] = struct{}{}
+	setDirty := func(w *weakState) { atomic.StoreInt32(&w.dirty, 1) }
+	switch x := obj.(type) {
+	case *luaTable:
+		runtime.AddCleanup(x, setDirty, self)
+	case *closure:
+		runtime.AddCleanup(x, setDirty, self)
+	}
+}
+
+// store: 把键值转换为存放形式
+func (self *weakState) store(key, val luaValue) (luaValue, luaValue) {
+	if self.weakK && isCollectable(key) {
+		self.watch(key)
+		if !self.weakV { /* ephemeron */
+			m := ephemeronsOf(key)
+			if val == nil {
+				delete(*m, self.self)
+			} else {
+				if *m == nil {
+					*m = make(map[weak.Pointer[luaTable]]luaValue, 1)
+				}
+				(*m)[self.self] = val
+				val = ephemeronMark{}
+			}
+		}
+		key = makeWeak(key)
+	}
+	if self.weakV && isCollectable(val) {
+		self.watch(val)
+		val = makeWeak(val)
+	}
+	return key, val
+}
+
+// mapKey: 在哈希部分查找key时使用的键
+func (self *luaTable) mapKey(key luaValue) luaValue {
+	if self.weak != nil && self.weak.weakK {
+		return makeWeak(key)
+	}
+	return key
+}
+
+// load: 把key对应的存放形式转换回Lua值
+func (self *luaTable) load(key, stored luaValue) luaValue {
+	if self.weak == nil {
+		return stored
+	}
+	if _, ok := stored.(ephemeronMark); ok {
+		if m := ephemeronsOf(key); m != nil {
+			return (*m)[self.weak.self]
+		}
+		return nil
+	}
+	return strongValue(stored)
+}
+
+// setMode: 根据__mode设置表的弱引用模式，模式改变时按新的模式重新存放全部项
+// q接收被回收的ephemeron表
+func (self *luaTable) setMode(mode string, q *weakQueue) {
+	weakK := strings.Contains(mode, "k")
+	weakV := strings.Contains(mode, "v")
+	if old := self.weak; old == nil && !weakK && !weakV ||
+		old != nil && old.weakK == weakK && old.weakV == weakV {
+		return
+	}
+
+	var keys, vals []luaValue
+	for i, v := range self.arr {
+		if v = self.load(nil, v); v != nil {
+			keys = append(keys, int64(i+1))
+			vals = append(vals, v)
+		}
+	}
+	for k, v := range self._map {
+		if k = strongValue(k); k != nil {
+			if v = self.load(k, v); v != nil {
+				keys = append(keys, k)
+				vals = append(vals, v)
+				if m := ephemeronsOf(k); m != nil && self.weak != nil {
+					delete(*m, self.weak.self)
+				}
+			}
+		}
+	}
+
+	self.arr, self._map, self.keys = nil, nil, nil
+	if self.weak != nil { /* its ephemerons were removed above */
+		self.weak.cleanup.Stop()
+	}
+	self.weak = nil
+	if weakK || weakV {
+		w := &weakState{weakK: weakK, weakV: weakV, self: weak.Make(self)}
+		if weakK && !weakV { /* ephemeron table */
+			w.cleanup = runtime.AddCleanup(self, q.push, w)
+		}
+		self.weak = w
+	}
+	for i, k := range keys {
+		self.put(k, vals[i])
+	}
+}
+
+// sweep: 清除对象已被回收的项
+func (self *luaTable) sweep() {
+	if !atomic.CompareAndSwapInt32(&self.weak.dirty, 1, 0) {
+		return
+	}
+	for i, v := range self.arr {
+		if v != nil && strongValue(v) == nil {
+			self.arr[i] = nil
+		}
+	}
+	self._shrinkArray()
+	for k, v := range self._map {
+		if strongValue(k) == nil || strongValue(v) == nil {
+			delete(self._map, k)
+		}
+	}
+	for ref := range self.weak.watched {
+		if ref.value() == nil {
+			delete(self.weak.watched, ref)
+		}
+	}
+	self.keys = nil
+}
+
+// trimDead: 去掉数组部分末尾已被回收的值，使#的结果不依赖清理函数何时执行
+func (self *luaTable) trimDead() {
+	n := len(self.arr)
+	for n > 0 && strongValue(self.arr[n-1]) == nil {
+		n--
+	}
+	self.arr = self.arr[:n]
+}
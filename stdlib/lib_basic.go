@@ -2,8 +2,8 @@ package stdlib
 
 import (
 	"fmt"
+	"io"
 	. "luago/api"
-	"strconv"
 	"strings"
 )
 
@@ -34,6 +34,8 @@ var baseFuncs = map[string]GoFunction{
 	"type":     baseType,     // 获取栈顶元素类型
 	"tostring": baseToString, // 转化为字符串
 	"tonumber": baseToNumber, // 转化为数字
+	// 垃圾回收
+	"collectgarbage": baseCollectGarbage, // 控制垃圾回收
 	/* placeholders */
 	"_G":       nil,
 	"_VERSION": nil,
@@ -49,11 +51,36 @@ func OpenBaseLib(ls LuaState) int {
 	ls.PushValue(-1)
 	ls.SetField(-2, "_G")
 	/* set global _VERSION */
-	ls.PushString("Lua 5.3") // todo
-	ls.SetField(-2, "_VERSION")
+	if ls.Version() >= LUA_VERSION_NUM_54 {
+		ls.PushString(LUA_VERSION_54)
+		ls.SetField(-2, "_VERSION")
+		ls.PushGoFunction(baseWarn)
+		ls.SetField(-2, "warn")
+	} else {
+		ls.PushString(LUA_VERSION)
+		ls.SetField(-2, "_VERSION")
+	}
 	return 1
 }
 
+// warn (msg1, ···)
+// http://www.lua.org/manual/5.4/manual.html#pdf-warn
+// lua-5.4.6/src/lbaselib.c#luaB_warn()
+func baseWarn(ls LuaState) int {
+	n := ls.GetTop()  /* number of arguments */
+	ls.CheckString(1) /* at least one argument */
+	for i := 2; i <= n; i++ {
+		ls.CheckString(i) /* make sure all arguments are strings */
+	}
+	for i := 1; i < n; i++ { /* compose warning */
+		s, _ := ls.ToStringX(i)
+		ls.Warning(s, true)
+	}
+	s, _ := ls.ToStringX(n)
+	ls.Warning(s, false) /* close warning */
+	return 0
+}
+
 // print (···)
 // http://www.lua.org/manual/5.3/manual.html#pdf-print
 // lua-5.3.4/src/lbaselib.c#luaB_print()
@@ -69,12 +96,12 @@ func basePrint(ls LuaState) int {
 			return ls.Error2("'tostring' must return a string to 'print'")
 		}
 		if i > 1 {
-			fmt.Print("\t")
+			io.WriteString(ls.Stdout(), "\t")
 		}
-		fmt.Print(s)
+		io.WriteString(ls.Stdout(), s)
 		ls.Pop(1) /* pop result */
 	}
-	fmt.Println()
+	io.WriteString(ls.Stdout(), "\n")
 	return 0
 }
 
@@ -100,9 +127,9 @@ func baseError(ls LuaState) int {
 	level := int(ls.OptInteger(2, 1))
 	ls.SetTop(1)
 	if ls.Type(1) == LUA_TSTRING && level > 0 {
-		// ls.Where(level) /* add extra information */
-		// ls.PushValue(1)
-		// ls.Concat(2)
+		ls.Where(level) /* add extra information */
+		ls.PushValue(1)
+		ls.Concat(2)
 	}
 	return ls.Error()
 }
@@ -241,18 +268,36 @@ func baseDoFile(ls LuaState) int {
 
 // pcall (f [, arg1, ···])
 // http://www.lua.org/manual/5.3/manual.html#pdf-pcall
+// lua-5.3.4/src/lbaselib.c#luaB_pcall()
 func basePCall(ls LuaState) int {
-	nArgs := ls.GetTop() - 1
-	status := ls.PCall(nArgs, -1, 0)
-	ls.PushBoolean(status == LUA_OK)
-	ls.Insert(1)
-	return ls.GetTop()
+	ls.CheckAny(1)
+	ls.PushBoolean(true) /* first result if no errors */
+	ls.Insert(1)         /* put it in place */
+	status := ls.PCall(ls.GetTop()-2, LUA_MULTRET, 0)
+	return finishPCall(ls, status, 0)
 }
 
 // xpcall (f, msgh [, arg1, ···])
 // http://www.lua.org/manual/5.3/manual.html#pdf-xpcall
+// lua-5.3.4/src/lbaselib.c#luaB_xpcall()
 func baseXPCall(ls LuaState) int {
-	panic("todo!")
+	n := ls.GetTop()
+	ls.CheckType(2, LUA_TFUNCTION) /* check error function */
+	ls.PushBoolean(true)           /* first result */
+	ls.PushValue(1)                /* function */
+	ls.Rotate(3, 2)                /* move them below function's arguments */
+	status := ls.PCall(n-2, LUA_MULTRET, 2)
+	return finishPCall(ls, status, 2)
+}
+
+// lua-5.3.4/src/lbaselib.c#finishpcall()
+func finishPCall(ls LuaState, status, extra int) int {
+	if status != LUA_OK { /* error? */
+		ls.PushBoolean(false) /* first result (false) */
+		ls.PushValue(-2)      /* error message */
+		return 2              /* return false, msg */
+	}
+	return ls.GetTop() - extra /* return all results */
 }
 
 // getmetatable (object)
@@ -365,11 +410,11 @@ func baseToNumber(ls LuaState) int {
 			}
 		}
 	} else {
+		base := ls.CheckInteger(2)
 		ls.CheckType(1, LUA_TSTRING) /* no numbers as strings */
-		s := strings.TrimSpace(ls.ToString(1))
-		base := int(ls.CheckInteger(2))
+		s := ls.ToString(1)
 		ls.ArgCheck(2 <= base && base <= 36, 2, "base out of range")
-		if n, err := strconv.ParseInt(s, base, 64); err == nil {
+		if n, ok := _bStr2Int(s, int(base)); ok {
 			ls.PushInteger(n)
 			return 1
 		} /* else not a number */
@@ -377,3 +422,76 @@ func baseToNumber(ls LuaState) int {
 	ls.PushNil() /* not a number */
 	return 1
 }
+
+// 按给定进制解析整数，允许前后空白，溢出时回绕
+// lua-5.3.4/src/lbaselib.c#b_str2int()
+func _bStr2Int(s string, base int) (int64, bool) {
+	s = strings.Trim(s, " \f\n\r\t\v")
+	neg := false
+	if strings.HasPrefix(s, "-") {
+		s = s[1:]
+		neg = true
+	} else if strings.HasPrefix(s, "+") {
+		s = s[1:]
+	}
+	if s == "" {
+		return 0, false /* no digit? */
+	}
+	var n uint64
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		var digit int
+		switch {
+		case '0' <= c && c <= '9':
+			digit = int(c - '0')
+		case 'a' <= c && c <= 'z':
+			digit = int(c-'a') + 10
+		case 'A' <= c && c <= 'Z':
+			digit = int(c-'A') + 10
+		default:
+			return 0, false
+		}
+		if digit >= base {
+			return 0, false /* invalid numeral */
+		}
+		n = n*uint64(base) + uint64(digit)
+	}
+	if neg {
+		n = 0 - n
+	}
+	return int64(n), true
+}
+
+var gcOptions = map[string]int{
+	"stop":       LUA_GCSTOP,
+	"restart":    LUA_GCRESTART,
+	"collect":    LUA_GCCOLLECT,
+	"count":      LUA_GCCOUNT,
+	"step":       LUA_GCSTEP,
+	"setpause":   LUA_GCSETPAUSE,
+	"setstepmul": LUA_GCSETSTEPMUL,
+	"isrunning":  LUA_GCISRUNNING,
+}
+
+// collectgarbage ([opt [, arg]])
+// http://www.lua.org/manual/5.3/manual.html#pdf-collectgarbage
+// lua-5.3.4/src/lbaselib.c#luaB_collectgarbage()
+func baseCollectGarbage(ls LuaState) int {
+	opt := ls.OptString(1, "collect")
+	o, ok := gcOptions[opt]
+	if !ok {
+		return ls.ArgError(1, fmt.Sprintf("invalid option '%s'", opt))
+	}
+	ex := int(ls.OptInteger(2, 0))
+	res := ls.GC(o, ex)
+	switch o {
+	case LUA_GCCOUNT:
+		b := ls.GC(LUA_GCCOUNTB, 0)
+		ls.PushNumber(float64(res) + float64(b)/1024)
+	case LUA_GCSTEP, LUA_GCISRUNNING:
+		ls.PushBoolean(res != 0)
+	default:
+		ls.PushInteger(int64(res))
+	}
+	return 1
+}
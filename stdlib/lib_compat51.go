@@ -0,0 +1,316 @@
+package stdlib
+
+import (
+	. "luago/api"
+	"math"
+	"strings"
+)
+
+// Lua 5.1兼容库
+// 默认不打开，用state.WithOptionalLibs("compat51")或RequireF打开。
+// 函数的环境用名为_ENV的upvalue实现：getfenv返回它的值，setfenv让函数使用一个新的_ENV，
+// 不影响共享原来_ENV的其他函数。打开之后加载的chunk中，vararg函数按5.1的规则带有局部变量arg。
+
+var compatFuncs = map[string]GoFunction{
+	"setfenv":    compatSetFEnv,
+	"getfenv":    compatGetFEnv,
+	"unpack":     tabUnpack,
+	"loadstring": compatLoadString,
+	"module":     compatModule,
+}
+
+var compatTabFuncs = map[string]GoFunction{
+	"getn": compatGetN,
+	"maxn": compatMaxN,
+}
+
+var compatMathFuncs = map[string]GoFunction{
+	"pow":   compatPow,
+	"ldexp": compatLdexp,
+	"frexp": compatFrexp,
+}
+
+var compatStrFuncs = map[string]GoFunction{
+	"gfind": strGmatch,
+}
+
+var compatPkgFuncs = map[string]GoFunction{
+	"seeall": compatSeeAll,
+}
+
+// OpenCompat51Lib: 把5.1的函数加入全局表和已经打开的table、math、string、package库
+func OpenCompat51Lib(ls LuaState) int {
+	ls.PushBoolean(true)
+	ls.SetField(LUA_REGISTRYINDEX, LUA_COMPAT51) /* compile 'arg' for vararg functions */
+	_addFuncs(ls, "table", compatTabFuncs)
+	_addFuncs(ls, "math", compatMathFuncs)
+	_addFuncs(ls, "string", compatStrFuncs)
+	_addFuncs(ls, "package", compatPkgFuncs)
+	ls.PushGlobalTable()
+	ls.SetFuncs(compatFuncs, 0)
+	return 1
+}
+
+// _addFuncs: 全局变量libName是表时把l中的函数加入其中
+func _addFuncs(ls LuaState, libName string, l FuncReg) {
+	if ls.GetGlobal(libName) == LUA_TTABLE {
+		ls.SetFuncs(l, 0)
+	}
+	ls.Pop(1)
+}
+
+/* environments */
+
+// _getFunc: 把参数1指定的函数推入栈顶，参数1可以是函数或者调用层次
+// lua-5.1.5/src/lbaselib.c#getfunc()
+func _getFunc(ls LuaState, opt bool) {
+	if ls.IsFunction(1) {
+		ls.PushValue(1)
+		return
+	}
+	var level int64
+	if opt {
+		level = ls.OptInteger(1, 1)
+	} else {
+		level = ls.CheckInteger(1)
+	}
+	ls.ArgCheck(level >= 0, 1, "level must be non-negative")
+	if !ls.GetStackFunc(int(level)) {
+		ls.ArgError(1, "invalid level")
+	}
+}
+
+// _envUpvalue: idx处Lua函数的_ENV是第几个upvalue，没有时返回0
+func _envUpvalue(ls LuaState, idx int) int {
+	for n := 1; ; n++ {
+		name, ok := ls.GetUpvalue(idx, n)
+		if !ok {
+			return 0
+		}
+		ls.Pop(1)
+		if name == "_ENV" {
+			return n
+		}
+	}
+}
+
+// _setFEnv: 让idx处的Lua函数使用栈顶的表作为环境，弹出栈顶的表
+// 函数得到一个新的_ENV upvalue，原来的_ENV仍然被其他函数共享
+func _setFEnv(ls LuaState, idx int) {
+	idx = ls.AbsIndex(idx)
+	if n := _envUpvalue(ls, idx); n == 0 { /* function does not use globals */
+		ls.Pop(1)
+	} else {
+		ls.PushGoClosure(_envHolder, 1) /* fresh upvalue holding the table */
+		ls.UpvalueJoin(idx, n, -1, 1)
+		ls.Pop(1)
+	}
+}
+
+// _envHolder: 只用来持有新的_ENV upvalue
+func _envHolder(ls LuaState) int {
+	return 0
+}
+
+// getfenv ([f])
+// http://www.lua.org/manual/5.1/manual.html#pdf-getfenv
+// lua-5.1.5/src/lbaselib.c#luaB_getfenv()
+func compatGetFEnv(ls LuaState) int {
+	_getFunc(ls, true)
+	if ls.IsGoFunction(-1) { /* is a Go function? */
+		ls.PushGlobalTable() /* return the thread's global env. */
+	} else if n := _envUpvalue(ls, -1); n == 0 {
+		ls.PushGlobalTable()
+	} else {
+		ls.GetUpvalue(-1, n)
+	}
+	return 1
+}
+
+// setfenv (f, table)
+// http://www.lua.org/manual/5.1/manual.html#pdf-setfenv
+// lua-5.1.5/src/lbaselib.c#luaB_setfenv()
+func compatSetFEnv(ls LuaState) int {
+	ls.CheckType(2, LUA_TTABLE)
+	_getFunc(ls, false)
+	if ls.IsNumber(1) && ls.ToNumber(1) == 0 {
+		/* change environment of current thread */
+		ls.PushValue(2)
+		ls.RawSetI(LUA_REGISTRYINDEX, LUA_RIDX_GLOBALS)
+		return 0
+	} else if ls.IsGoFunction(-1) {
+		ls.Error2("'setfenv' cannot change environment of given object")
+	}
+	ls.PushValue(2)
+	_setFEnv(ls, -2)
+	return 1
+}
+
+/* loading */
+
+// loadstring (string [, chunkname])
+// http://www.lua.org/manual/5.1/manual.html#pdf-loadstring
+// lua-5.1.5/src/lbaselib.c#luaB_loadstring()
+func compatLoadString(ls LuaState) int {
+	s := ls.CheckString(1)
+	chunkname := ls.OptString(2, s)
+	return loadAux(ls, ls.Load([]byte(s), chunkname, "bt"), 0)
+}
+
+// module (name [, ···])
+// http://www.lua.org/manual/5.1/manual.html#pdf-module
+// lua-5.1.5/src/loadlib.c#ll_module()
+func compatModule(ls LuaState) int {
+	modname := ls.CheckString(1)
+	loaded := ls.GetTop() + 1 /* index of _LOADED table */
+	ls.GetField(LUA_REGISTRYINDEX, LUA_LOADED_TABLE)
+	if ls.GetField(loaded, modname) != LUA_TTABLE { /* not found? */
+		ls.Pop(1) /* remove previous result */
+		/* try global variable (and create one if it does not exist) */
+		if !_findTable(ls, modname) {
+			ls.Error2("name conflict for module '%s'", modname)
+		}
+		ls.PushValue(-1)
+		ls.SetField(loaded, modname) /* _LOADED[modname] = new table */
+	}
+	/* check whether table already has a _NAME field */
+	if ls.GetField(-1, "_NAME") != LUA_TNIL { /* is table an initialized module? */
+		ls.Pop(1)
+	} else { /* no; initialize it */
+		ls.Pop(1)
+		_modInit(ls, modname)
+	}
+	ls.PushValue(-1)
+	_setCallerEnv(ls)
+	/* apply options */
+	for i := 2; i < loaded; i++ {
+		ls.PushValue(i)  /* get option (a function) */
+		ls.PushValue(-2) /* module */
+		ls.Call(1, 0)
+	}
+	return 0
+}
+
+// _findTable: 在全局表中按带点的名字查找表，不存在的部分创建为新表，找到的表留在栈顶
+// 名字中某一部分的值不是表时返回false，不推入任何值
+// lua-5.1.5/src/lauxlib.c#luaL_findtable()
+func _findTable(ls LuaState, fname string) bool {
+	ls.PushGlobalTable()
+	for _, part := range strings.Split(fname, ".") {
+		ls.PushString(part)
+		ls.RawGet(-2)
+		if ls.IsNil(-1) { /* no such field? */
+			ls.Pop(1)     /* remove this nil */
+			ls.NewTable() /* new table for field */
+			ls.PushString(part)
+			ls.PushValue(-2)
+			ls.SetTable(-4) /* set new table into field */
+		} else if !ls.IsTable(-1) { /* field has a non-table value? */
+			ls.Pop(2) /* remove table and value */
+			return false
+		}
+		ls.Remove(-2) /* remove previous table */
+	}
+	return true
+}
+
+// _modInit: 设置模块表的_M、_NAME和_PACKAGE字段
+// lua-5.1.5/src/loadlib.c#modinit()
+func _modInit(ls LuaState, modname string) {
+	ls.PushValue(-1)
+	ls.SetField(-2, "_M") /* module._M = module */
+	ls.PushString(modname)
+	ls.SetField(-2, "_NAME")
+	/* set _PACKAGE as package name (full module name minus last part) */
+	dot := strings.LastIndexByte(modname, '.') + 1
+	ls.PushString(modname[:dot])
+	ls.SetField(-2, "_PACKAGE")
+}
+
+// _setCallerEnv: 让调用module的Lua函数使用栈顶的表作为环境，弹出栈顶的表
+// lua-5.1.5/src/loadlib.c#setfenv()
+func _setCallerEnv(ls LuaState) {
+	if !ls.GetStackFunc(1) || ls.IsGoFunction(-1) { /* get calling function */
+		ls.Error2("'module' not called from a Lua function")
+	}
+	ls.Insert(-2)
+	_setFEnv(ls, -2)
+	ls.Pop(1)
+}
+
+// package.seeall (module)
+// http://www.lua.org/manual/5.1/manual.html#pdf-package.seeall
+// lua-5.1.5/src/loadlib.c#ll_seeall()
+func compatSeeAll(ls LuaState) int {
+	ls.CheckType(1, LUA_TTABLE)
+	if !ls.GetMetatable(1) {
+		ls.CreateTable(0, 1) /* create new metatable */
+		ls.PushValue(-1)
+		ls.SetMetatable(1)
+	}
+	ls.PushGlobalTable()
+	ls.SetField(-2, "__index") /* mt.__index = _G */
+	return 0
+}
+
+/* table */
+
+// table.getn (table)
+// http://www.lua.org/manual/5.1/manual.html#pdf-table.getn
+// lua-5.1.5/src/ltablib.c#getn()
+func compatGetN(ls LuaState) int {
+	ls.CheckType(1, LUA_TTABLE)
+	ls.PushInteger(int64(ls.RawLen(1)))
+	return 1
+}
+
+// table.maxn (table)
+// http://www.lua.org/manual/5.1/manual.html#pdf-table.maxn
+// lua-5.1.5/src/ltablib.c#maxn()
+func compatMaxN(ls LuaState) int {
+	max := 0.0
+	ls.CheckType(1, LUA_TTABLE)
+	ls.PushNil() /* first key */
+	for ls.Next(1) {
+		ls.Pop(1) /* remove value */
+		if ls.Type(-1) == LUA_TNUMBER {
+			if v := ls.ToNumber(-1); v > max {
+				max = v
+			}
+		}
+	}
+	_pushNumInt(ls, max)
+	return 1
+}
+
+/* math */
+
+// math.pow (x, y)
+// http://www.lua.org/manual/5.1/manual.html#pdf-math.pow
+// lua-5.1.5/src/lmathlib.c#math_pow()
+func compatPow(ls LuaState) int {
+	x := ls.CheckNumber(1)
+	y := ls.CheckNumber(2)
+	ls.PushNumber(math.Pow(x, y))
+	return 1
+}
+
+// math.ldexp (m, e)
+// http://www.lua.org/manual/5.1/manual.html#pdf-math.ldexp
+// lua-5.3.4/src/lmathlib.c#math_ldexp()
+func compatLdexp(ls LuaState) int {
+	x := ls.CheckNumber(1)
+	ep := ls.CheckInteger(2)
+	ls.PushNumber(math.Ldexp(x, int(ep)))
+	return 1
+}
+
+// math.frexp (x)
+// http://www.lua.org/manual/5.1/manual.html#pdf-math.frexp
+// lua-5.3.4/src/lmathlib.c#math_frexp()
+func compatFrexp(ls LuaState) int {
+	m, e := math.Frexp(ls.CheckNumber(1))
+	ls.PushNumber(m)
+	ls.PushInteger(int64(e))
+	return 2
+}
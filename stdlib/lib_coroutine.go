@@ -0,0 +1,202 @@
+package stdlib
+
+import . "luago/api"
+
+var coFuncs = map[string]GoFunction{
+	"create":      coCreate,
+	"resume":      coResume,
+	"running":     coRunning,
+	"status":      coStatus,
+	"wrap":        coWrap,
+	"yield":       coYield,
+	"isyieldable": coYieldable,
+}
+
+// 5.4的版本：增加close，isyieldable可以检查任意协程
+var coFuncs54 = map[string]GoFunction{
+	"close":       coClose,
+	"isyieldable": coYieldable54,
+}
+
+// lua-5.3.4/src/lcorolib.c#luaopen_coroutine()
+func OpenCoroutineLib(ls LuaState) int {
+	ls.NewLib(coFuncs)
+	if ls.Version() >= LUA_VERSION_NUM_54 {
+		ls.SetFuncs(coFuncs54, 0)
+	}
+	return 1
+}
+
+// lua-5.3.4/src/lcorolib.c#getco()
+func getCo(ls LuaState) LuaState {
+	co := ls.ToThread(1)
+	ls.ArgCheck(co != nil, 1, "coroutine expected")
+	return co
+}
+
+// auxResume: 把n个参数交给co并resume，返回co交回的值的个数，出错时把错误信息压栈并返回-1
+// lua-5.3.4/src/lcorolib.c#auxresume()
+func auxResume(ls, co LuaState, n int) int {
+	if !co.CheckStack(n) {
+		ls.PushString("too many arguments to resume")
+		return -1 /* error flag */
+	}
+	if co.Status() == LUA_OK && co.GetTop() == 0 {
+		ls.PushString("cannot resume dead coroutine")
+		return -1 /* error flag */
+	}
+	ls.XMove(co, n)
+	status := co.Resume(ls, n)
+	if status == LUA_OK || status == LUA_YIELD {
+		nRes := co.GetTop()
+		if !ls.CheckStack(nRes + 1) {
+			co.Pop(nRes) /* remove results anyway */
+			ls.PushString("too many results to resume")
+			return -1 /* error flag */
+		}
+		co.XMove(ls, nRes) /* move yielded values */
+		return nRes
+	} else {
+		co.XMove(ls, 1) /* move error message */
+		return -1       /* error flag */
+	}
+}
+
+// coroutine.create (f)
+// http://www.lua.org/manual/5.3/manual.html#pdf-coroutine.create
+// lua-5.3.4/src/lcorolib.c#luaB_cocreate()
+func coCreate(ls LuaState) int {
+	ls.CheckType(1, LUA_TFUNCTION)
+	co := ls.NewThread()
+	ls.PushValue(1) /* move function to top */
+	ls.XMove(co, 1) /* move function from ls to co */
+	return 1
+}
+
+// coroutine.resume (co [, val1, ···])
+// http://www.lua.org/manual/5.3/manual.html#pdf-coroutine.resume
+// lua-5.3.4/src/lcorolib.c#luaB_coresume()
+func coResume(ls LuaState) int {
+	co := getCo(ls)
+	r := auxResume(ls, co, ls.GetTop()-1)
+	if r < 0 {
+		ls.PushBoolean(false)
+		ls.Insert(-2)
+		return 2 /* return false + error message */
+	} else {
+		ls.PushBoolean(true)
+		ls.Insert(-(r + 1))
+		return r + 1 /* return true + 'resume' returns */
+	}
+}
+
+// coroutine.wrap (f)
+// http://www.lua.org/manual/5.3/manual.html#pdf-coroutine.wrap
+// lua-5.3.4/src/lcorolib.c#luaB_cowrap()
+func coWrap(ls LuaState) int {
+	coCreate(ls)
+	ls.PushGoClosure(auxWrap, 1)
+	return 1
+}
+
+// lua-5.3.4/src/lcorolib.c#auxwrap()
+func auxWrap(ls LuaState) int {
+	co := ls.ToThread(LuaUpvalueIndex(1))
+	r := auxResume(ls, co, ls.GetTop())
+	if r < 0 {
+		if ls.Type(-1) == LUA_TSTRING { /* error object is a string? */
+			ls.Where(1) /* get extra info */
+			ls.Insert(-2)
+			ls.Concat(2)
+		}
+		return ls.Error() /* propagate error */
+	}
+	return r
+}
+
+// coroutine.yield (···)
+// http://www.lua.org/manual/5.3/manual.html#pdf-coroutine.yield
+// lua-5.3.4/src/lcorolib.c#luaB_yield()
+func coYield(ls LuaState) int {
+	return ls.Yield(ls.GetTop())
+}
+
+// coroutine.status (co)
+// http://www.lua.org/manual/5.3/manual.html#pdf-coroutine.status
+// lua-5.3.4/src/lcorolib.c#luaB_costatus()
+func coStatus(ls LuaState) int {
+	co := getCo(ls)
+	ls.PushString(auxStatus(ls, co))
+	return 1
+}
+
+// lua-5.4.6/src/lcorolib.c#auxstatus()
+func auxStatus(ls, co LuaState) string {
+	if ls == co {
+		return "running"
+	}
+	switch co.Status() {
+	case LUA_YIELD:
+		return "suspended"
+	case LUA_OK:
+		if co.GetStackFunc(0) { /* does it have frames? */
+			co.Pop(1)
+			return "normal" /* it is running */
+		} else if co.GetTop() == 0 {
+			return "dead"
+		} else {
+			return "suspended" /* initial state */
+		}
+	default: /* some error occurred */
+		return "dead"
+	}
+}
+
+// coroutine.isyieldable ()
+// http://www.lua.org/manual/5.3/manual.html#pdf-coroutine.isyieldable
+// lua-5.3.4/src/lcorolib.c#luaB_yieldable()
+func coYieldable(ls LuaState) int {
+	ls.PushBoolean(ls.IsYieldable())
+	return 1
+}
+
+// coroutine.isyieldable ([co])
+// http://www.lua.org/manual/5.4/manual.html#pdf-coroutine.isyieldable
+// lua-5.4.6/src/lcorolib.c#luaB_yieldable()
+func coYieldable54(ls LuaState) int {
+	co := ls
+	if !ls.IsNone(1) {
+		co = getCo(ls)
+	}
+	ls.PushBoolean(co.IsYieldable())
+	return 1
+}
+
+// coroutine.running ()
+// http://www.lua.org/manual/5.3/manual.html#pdf-coroutine.running
+// lua-5.3.4/src/lcorolib.c#luaB_corunning()
+func coRunning(ls LuaState) int {
+	isMain := ls.PushThread()
+	ls.PushBoolean(isMain)
+	return 2
+}
+
+// coroutine.close (co)
+// http://www.lua.org/manual/5.4/manual.html#pdf-coroutine.close
+// lua-5.4.6/src/lcorolib.c#luaB_close()
+func coClose(ls LuaState) int {
+	co := getCo(ls)
+	switch status := auxStatus(ls, co); status {
+	case "dead", "suspended":
+		if co.CloseThread(ls) == LUA_OK {
+			ls.PushBoolean(true)
+			return 1
+		} else {
+			ls.PushBoolean(false)
+			co.XMove(ls, 1) /* move error message */
+			return 2
+		}
+	default: /* normal or running coroutine */
+		return ls.Error2("cannot close a %s coroutine", status)
+	}
+}
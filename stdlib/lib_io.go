@@ -0,0 +1,93 @@
+package stdlib
+
+import (
+	"io"
+	. "luago/api"
+	"luago/number"
+)
+
+/* key, in the registry, for the default output file */
+const IO_OUTPUT = "_IO_output"
+
+// 只提供向标准输出和标准错误写入的部分，输出目标是state的Stdout()和Stderr()，
+// 可以通过SetStdout/SetStderr重定向
+var ioLib = map[string]GoFunction{
+	"write": ioWrite,
+}
+
+func OpenIOLib(ls LuaState) int {
+	ls.NewLib(ioLib) /* new module */
+	_createStdFile(ls, "stdout", IO_OUTPUT)
+	_createStdFile(ls, "stderr", "")
+	return 1
+}
+
+// _createStdFile: 创建标准文件对象，file:write写入对应的流
+// lua-5.3.4/src/liolib.c#createstdfile()
+func _createStdFile(ls LuaState, fname, regKey string) {
+	ls.CreateTable(0, 1)
+	ls.PushString(fname)
+	ls.PushGoClosure(fileWrite, 1)
+	ls.SetField(-2, "write")
+	if regKey != "" {
+		ls.PushValue(-1)
+		ls.SetField(LUA_REGISTRYINDEX, regKey) /* add file to registry */
+	}
+	ls.SetField(-2, fname) /* add file to module */
+}
+
+// _stream: 文件对象对应的输出流
+func _stream(ls LuaState, fname string) io.Writer {
+	if fname == "stderr" {
+		return ls.Stderr()
+	}
+	return ls.Stdout()
+}
+
+// io.write (···)
+// http://www.lua.org/manual/5.3/manual.html#pdf-io.write
+// lua-5.3.4/src/liolib.c#io_write()
+func ioWrite(ls LuaState) int {
+	if err := _gWrite(ls, ls.Stdout(), 1); err != nil {
+		return _fileResult(ls, err)
+	}
+	ls.GetField(LUA_REGISTRYINDEX, IO_OUTPUT) /* file handle is returned on success */
+	return 1
+}
+
+// file:write (···)
+// http://www.lua.org/manual/5.3/manual.html#pdf-file:write
+// lua-5.3.4/src/liolib.c#f_write()
+func fileWrite(ls LuaState) int {
+	ls.CheckType(1, LUA_TTABLE)
+	w := _stream(ls, ls.ToString(LuaUpvalueIndex(1)))
+	if err := _gWrite(ls, w, 2); err != nil {
+		return _fileResult(ls, err)
+	}
+	ls.PushValue(1) /* file handle is returned on success */
+	return 1
+}
+
+// lua-5.3.4/src/liolib.c#g_write()
+func _gWrite(ls LuaState, w io.Writer, arg int) (err error) {
+	for n := ls.GetTop(); arg <= n && err == nil; arg++ {
+		if ls.Type(arg) == LUA_TNUMBER {
+			/* optimization: could be done exactly as for strings */
+			if ls.IsInteger(arg) {
+				_, err = io.WriteString(w, number.IntegerToString(ls.ToInteger(arg)))
+			} else {
+				_, err = io.WriteString(w, number.FloatToString(ls.ToNumber(arg)))
+			}
+		} else {
+			_, err = io.WriteString(w, ls.CheckString(arg))
+		}
+	}
+	return
+}
+
+// lua-5.3.4/src/lauxlib.c#luaL_fileresult()
+func _fileResult(ls LuaState, err error) int {
+	ls.PushNil()
+	ls.PushString(err.Error())
+	return 2
+}
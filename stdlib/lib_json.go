@@ -0,0 +1,576 @@
+package stdlib
+
+import (
+	. "luago/api"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+/* upvalue holding the json.null sentinel */
+var jsonNullIdx = LuaUpvalueIndex(1)
+
+var jsonLib = map[string]GoFunction{
+	"encode": jsonEncode,
+	"decode": jsonDecode,
+}
+
+func OpenJSONLib(ls LuaState) int {
+	ls.NewLibTable(jsonLib)
+	ls.CreateTable(0, 0) /* json.null sentinel */
+	ls.CreateTable(0, 1) /* metatable for json.null */
+	ls.PushGoFunction(jsonNullToString)
+	ls.SetField(-2, "__tostring")
+	ls.SetMetatable(-2)
+	ls.PushValue(-1)
+	ls.SetField(-3, "null")
+	ls.SetFuncs(jsonLib, 1) /* share the sentinel as upvalue */
+	return 1
+}
+
+func jsonNullToString(ls LuaState) int {
+	ls.PushString("null")
+	return 1
+}
+
+/* encoder state */
+type jsonEncoder struct {
+	ls         LuaState
+	buf        strings.Builder
+	sortKeys   bool
+	indent     string
+	cycleError bool
+	visiting   map[interface{}]bool
+}
+
+// json.encode (value [, opts])
+// opts.sort_keys:   按键名排序输出对象成员
+// opts.indent:      缩进（空格数或字符串），缺省时输出紧凑格式
+// opts.cycle_error: 遇到循环引用时报错（默认true），为false时输出null
+func jsonEncode(ls LuaState) int {
+	ls.CheckAny(1)
+	enc := &jsonEncoder{
+		ls:         ls,
+		cycleError: true,
+		visiting:   map[interface{}]bool{},
+	}
+	if !ls.IsNoneOrNil(2) {
+		ls.CheckType(2, LUA_TTABLE)
+		enc.sortKeys = _jsonOptBool(ls, "sort_keys", false)
+		enc.cycleError = _jsonOptBool(ls, "cycle_error", true)
+		switch ls.GetField(2, "indent") {
+		case LUA_TNIL:
+		case LUA_TNUMBER:
+			n := ls.ToInteger(-1)
+			ls.ArgCheck(n >= 0, 2, "'indent' must be non-negative")
+			enc.indent = strings.Repeat(" ", int(n))
+		case LUA_TSTRING:
+			enc.indent = ls.ToString(-1)
+		default:
+			ls.ArgError(2, "'indent' must be a number or a string")
+		}
+		ls.Pop(1)
+	}
+	ls.SetTop(1)
+	enc.encode(1, 0)
+	ls.PushString(enc.buf.String())
+	return 1
+}
+
+func _jsonOptBool(ls LuaState, name string, d bool) bool {
+	if ls.GetField(2, name) == LUA_TNIL {
+		ls.Pop(1)
+		return d
+	}
+	b := ls.ToBoolean(-1)
+	ls.Pop(1)
+	return b
+}
+
+func (self *jsonEncoder) encode(idx, depth int) {
+	ls := self.ls
+	switch ls.Type(idx) {
+	case LUA_TNIL:
+		self.buf.WriteString("null")
+	case LUA_TBOOLEAN:
+		if ls.ToBoolean(idx) {
+			self.buf.WriteString("true")
+		} else {
+			self.buf.WriteString("false")
+		}
+	case LUA_TNUMBER:
+		self.encodeNumber(idx)
+	case LUA_TSTRING:
+		self.encodeString(ls.ToString(idx))
+	case LUA_TTABLE:
+		self.encodeTable(idx, depth)
+	default:
+		ls.Error2("cannot encode value of type %s", ls.TypeName2(idx))
+	}
+}
+
+func (self *jsonEncoder) encodeNumber(idx int) {
+	ls := self.ls
+	if ls.IsInteger(idx) {
+		self.buf.WriteString(strconv.FormatInt(ls.ToInteger(idx), 10))
+		return
+	}
+	self.buf.WriteString(self.formatFloat(ls.ToNumber(idx)))
+}
+
+/* 浮点数总是带小数点或指数，以便解码时还原为float */
+func (self *jsonEncoder) formatFloat(f float64) string {
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		self.ls.Error2("cannot encode non-finite number")
+	}
+	s := strconv.FormatFloat(f, 'g', -1, 64)
+	if !strings.ContainsAny(s, ".e") {
+		s += ".0"
+	}
+	return s
+}
+
+func (self *jsonEncoder) encodeString(s string) {
+	buf := &self.buf
+	buf.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case '"':
+			buf.WriteString(`\"`)
+		case '\\':
+			buf.WriteString(`\\`)
+		case '\b':
+			buf.WriteString(`\b`)
+		case '\f':
+			buf.WriteString(`\f`)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\r':
+			buf.WriteString(`\r`)
+		case '\t':
+			buf.WriteString(`\t`)
+		default:
+			if c < 0x20 || c == 0x7f {
+				buf.WriteString(`\u00`)
+				buf.WriteByte("0123456789abcdef"[c>>4])
+				buf.WriteByte("0123456789abcdef"[c&0xf])
+			} else {
+				buf.WriteByte(c)
+			}
+		}
+	}
+	buf.WriteByte('"')
+}
+
+/* 对象成员的键：原始键值及其JSON字符串形式 */
+type jsonKey struct {
+	key  interface{}
+	name string
+}
+
+func (self *jsonEncoder) encodeTable(idx, depth int) {
+	ls := self.ls
+	if ls.RawEqual(idx, jsonNullIdx) {
+		self.buf.WriteString("null")
+		return
+	}
+
+	p := ls.ToPointer(idx)
+	if self.visiting[p] {
+		if self.cycleError {
+			ls.Error2("cannot encode table with cycles")
+		}
+		self.buf.WriteString("null")
+		return
+	}
+	self.visiting[p] = true
+	defer delete(self.visiting, p)
+	ls.CheckStack2(3, "json nesting too deep")
+
+	keys, isArray := self.collectKeys(idx)
+	if isArray && len(keys) > 0 {
+		self.buf.WriteByte('[')
+		for i := 1; i <= len(keys); i++ {
+			if i > 1 {
+				self.buf.WriteByte(',')
+			}
+			self.newline(depth + 1)
+			ls.RawGetI(idx, int64(i))
+			self.encode(ls.AbsIndex(-1), depth+1)
+			ls.Pop(1)
+		}
+		self.newline(depth)
+		self.buf.WriteByte(']')
+		return
+	}
+
+	if self.sortKeys {
+		sort.Slice(keys, func(i, j int) bool {
+			return keys[i].name < keys[j].name
+		})
+	}
+	self.buf.WriteByte('{')
+	for i, k := range keys {
+		if i > 0 {
+			self.buf.WriteByte(',')
+		}
+		self.newline(depth + 1)
+		self.encodeString(k.name)
+		self.buf.WriteByte(':')
+		if self.indent != "" {
+			self.buf.WriteByte(' ')
+		}
+		_jsonPushKey(ls, k.key)
+		ls.RawGet(idx)
+		self.encode(ls.AbsIndex(-1), depth+1)
+		ls.Pop(1)
+	}
+	if len(keys) > 0 {
+		self.newline(depth)
+	}
+	self.buf.WriteByte('}')
+}
+
+/*
+** 收集表的全部键。键恰好是1..n的整数时按数组编码，
+** 否则按对象编码，数字键转换为字符串。
+ */
+func (self *jsonEncoder) collectKeys(idx int) ([]jsonKey, bool) {
+	ls := self.ls
+	var keys []jsonKey
+	isArray := true
+	var maxIdx int64
+
+	ls.PushNil()
+	for ls.Next(idx) {
+		ls.Pop(1) /* pop value */
+		var k jsonKey
+		switch ls.Type(-1) {
+		case LUA_TSTRING:
+			isArray = false
+			k.key = ls.ToString(-1)
+			k.name = k.key.(string)
+		case LUA_TNUMBER:
+			if ls.IsInteger(-1) {
+				i := ls.ToInteger(-1)
+				if i < 1 {
+					isArray = false
+				} else if i > maxIdx {
+					maxIdx = i
+				}
+				k.key = i
+				k.name = strconv.FormatInt(i, 10)
+			} else {
+				isArray = false
+				f := ls.ToNumber(-1)
+				k.key = f
+				k.name = self.formatFloat(f)
+			}
+		default:
+			ls.Error2("cannot encode table key of type %s", ls.TypeName2(-1))
+		}
+		keys = append(keys, k)
+	}
+	return keys, isArray && maxIdx == int64(len(keys))
+}
+
+func _jsonPushKey(ls LuaState, key interface{}) {
+	switch k := key.(type) {
+	case string:
+		ls.PushString(k)
+	case int64:
+		ls.PushInteger(k)
+	case float64:
+		ls.PushNumber(k)
+	}
+}
+
+func (self *jsonEncoder) newline(depth int) {
+	if self.indent != "" {
+		self.buf.WriteByte('\n')
+		for i := 0; i < depth; i++ {
+			self.buf.WriteString(self.indent)
+		}
+	}
+}
+
+/* decoder state */
+type jsonDecoder struct {
+	ls        LuaState
+	s         string
+	pos       int
+	nullAsNil bool
+}
+
+// json.decode (str [, opts])
+// opts.null_as_nil: 将null解码为nil而不是json.null
+func jsonDecode(ls LuaState) int {
+	dec := &jsonDecoder{ls: ls, s: ls.CheckString(1)}
+	if !ls.IsNoneOrNil(2) {
+		ls.CheckType(2, LUA_TTABLE)
+		dec.nullAsNil = _jsonOptBool(ls, "null_as_nil", false)
+	}
+	ls.SetTop(1)
+	dec.decodeValue()
+	dec.skipSpace()
+	if dec.pos < len(dec.s) {
+		dec.error("trailing garbage")
+	}
+	return 1
+}
+
+func (self *jsonDecoder) error(msg string) {
+	if self.pos >= len(self.s) {
+		if strings.HasSuffix(msg, "end of input") { /* message already names the position */
+			self.ls.Error2("%s", msg)
+		}
+		self.ls.Error2("%s at end of input", msg)
+	}
+	self.ls.Error2("%s at position %d", msg, self.pos+1)
+}
+
+func (self *jsonDecoder) skipSpace() {
+	for self.pos < len(self.s) {
+		switch self.s[self.pos] {
+		case ' ', '\t', '\n', '\r':
+			self.pos++
+		default:
+			return
+		}
+	}
+}
+
+/* 解码一个值并压入栈顶 */
+func (self *jsonDecoder) decodeValue() {
+	ls := self.ls
+	ls.CheckStack2(3, "json nesting too deep")
+	self.skipSpace()
+	if self.pos >= len(self.s) {
+		self.error("unexpected end of input")
+	}
+	switch c := self.s[self.pos]; {
+	case c == '{':
+		self.decodeObject()
+	case c == '[':
+		self.decodeArray()
+	case c == '"':
+		ls.PushString(self.decodeString())
+	case c == '-' || (c >= '0' && c <= '9'):
+		self.decodeNumber()
+	case self.literal("true"):
+		ls.PushBoolean(true)
+	case self.literal("false"):
+		ls.PushBoolean(false)
+	case self.literal("null"):
+		if self.nullAsNil {
+			ls.PushNil()
+		} else {
+			ls.PushValue(jsonNullIdx)
+		}
+	default:
+		self.error("unexpected character '" + string(c) + "'")
+	}
+}
+
+func (self *jsonDecoder) literal(word string) bool {
+	if strings.HasPrefix(self.s[self.pos:], word) {
+		self.pos += len(word)
+		return true
+	}
+	return false
+}
+
+func (self *jsonDecoder) decodeObject() {
+	ls := self.ls
+	self.pos++ /* skip '{' */
+	ls.NewTable()
+	self.skipSpace()
+	if self.pos < len(self.s) && self.s[self.pos] == '}' {
+		self.pos++
+		return
+	}
+	for {
+		self.skipSpace()
+		if self.pos >= len(self.s) || self.s[self.pos] != '"' {
+			self.error("expected string key")
+		}
+		ls.PushString(self.decodeString())
+		self.skipSpace()
+		self.expect(':')
+		self.decodeValue()
+		ls.RawSet(-3)
+		self.skipSpace()
+		if self.pos < len(self.s) && self.s[self.pos] == ',' {
+			self.pos++
+			continue
+		}
+		self.expect('}')
+		return
+	}
+}
+
+func (self *jsonDecoder) decodeArray() {
+	ls := self.ls
+	self.pos++ /* skip '[' */
+	ls.NewTable()
+	self.skipSpace()
+	if self.pos < len(self.s) && self.s[self.pos] == ']' {
+		self.pos++
+		return
+	}
+	for i := int64(1); ; i++ {
+		self.decodeValue()
+		ls.RawSetI(-2, i)
+		self.skipSpace()
+		if self.pos < len(self.s) && self.s[self.pos] == ',' {
+			self.pos++
+			continue
+		}
+		self.expect(']')
+		return
+	}
+}
+
+func (self *jsonDecoder) expect(c byte) {
+	if self.pos >= len(self.s) || self.s[self.pos] != c {
+		self.error("expected '" + string(c) + "'")
+	}
+	self.pos++
+}
+
+/* 没有小数部分和指数且不溢出的数字解码为整数，其余解码为浮点数 */
+func (self *jsonDecoder) decodeNumber() {
+	s, start := self.s, self.pos
+	isFloat := false
+	if s[self.pos] == '-' {
+		self.pos++
+	}
+	switch {
+	case self.pos < len(s) && s[self.pos] == '0':
+		self.pos++
+	case self.pos < len(s) && isDigit(s[self.pos]):
+		self.skipDigits()
+	default:
+		self.error("malformed number")
+	}
+	if self.pos < len(s) && s[self.pos] == '.' {
+		isFloat = true
+		self.pos++
+		if self.pos >= len(s) || !isDigit(s[self.pos]) {
+			self.error("malformed number")
+		}
+		self.skipDigits()
+	}
+	if self.pos < len(s) && (s[self.pos] == 'e' || s[self.pos] == 'E') {
+		isFloat = true
+		self.pos++
+		if self.pos < len(s) && (s[self.pos] == '+' || s[self.pos] == '-') {
+			self.pos++
+		}
+		if self.pos >= len(s) || !isDigit(s[self.pos]) {
+			self.error("malformed number")
+		}
+		self.skipDigits()
+	}
+
+	text := s[start:self.pos]
+	if !isFloat {
+		if i, err := strconv.ParseInt(text, 10, 64); err == nil {
+			self.ls.PushInteger(i)
+			return
+		}
+	}
+	f, _ := strconv.ParseFloat(text, 64) /* 溢出时得到±Inf */
+	self.ls.PushNumber(f)
+}
+
+func (self *jsonDecoder) skipDigits() {
+	for self.pos < len(self.s) && isDigit(self.s[self.pos]) {
+		self.pos++
+	}
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func (self *jsonDecoder) decodeString() string {
+	s := self.s
+	self.pos++ /* skip '"' */
+	var buf strings.Builder
+	for {
+		if self.pos >= len(s) {
+			self.error("unterminated string")
+		}
+		c := s[self.pos]
+		switch {
+		case c == '"':
+			self.pos++
+			return buf.String()
+		case c < 0x20:
+			self.error("control character in string")
+		case c == '\\':
+			self.pos++
+			if self.pos >= len(s) {
+				self.error("unterminated string")
+			}
+			switch s[self.pos] {
+			case '"', '\\', '/':
+				buf.WriteByte(s[self.pos])
+			case 'b':
+				buf.WriteByte('\b')
+			case 'f':
+				buf.WriteByte('\f')
+			case 'n':
+				buf.WriteByte('\n')
+			case 'r':
+				buf.WriteByte('\r')
+			case 't':
+				buf.WriteByte('\t')
+			case 'u':
+				buf.WriteRune(self.decodeEscapedRune())
+				continue
+			default:
+				self.error("invalid escape sequence")
+			}
+			self.pos++
+		default:
+			buf.WriteByte(c)
+			self.pos++
+		}
+	}
+}
+
+/* \uXXXX，可能是UTF-16代理对；pos指向'u' */
+func (self *jsonDecoder) decodeEscapedRune() rune {
+	r := self.decodeHex4()
+	if utf16.IsSurrogate(r) {
+		if strings.HasPrefix(self.s[self.pos:], `\u`) {
+			save := self.pos
+			self.pos++
+			if r2 := utf16.DecodeRune(r, self.decodeHex4()); r2 != utf8.RuneError {
+				return r2
+			}
+			self.pos = save
+		}
+		return utf8.RuneError
+	}
+	return r
+}
+
+func (self *jsonDecoder) decodeHex4() rune {
+	self.pos++ /* skip 'u' */
+	if self.pos+4 > len(self.s) {
+		self.error("invalid unicode escape")
+	}
+	n, err := strconv.ParseUint(self.s[self.pos:self.pos+4], 16, 32)
+	if err != nil {
+		self.error("invalid unicode escape")
+	}
+	self.pos += 4
+	return rune(n)
+}
@@ -4,7 +4,6 @@ import (
 	. "luago/api"
 	"luago/number"
 	"math"
-	"math/rand"
 )
 
 var mathLib = map[string]GoFunction{
@@ -44,10 +43,13 @@ func OpenMathLib(ls LuaState) int {
 	ls.SetField(-2, "pi")
 	ls.PushNumber(math.Inf(1))
 	ls.SetField(-2, "huge")
-	ls.PushNumber(math.MaxInt64)
+	ls.PushInteger(math.MaxInt64)
 	ls.SetField(-2, "maxinteger")
-	ls.PushNumber(math.MinInt64)
+	ls.PushInteger(math.MinInt64)
 	ls.SetField(-2, "mininteger")
+	if ls.Version() >= LUA_VERSION_NUM_54 {
+		_setRandFuncs54(ls)
+	}
 	return 1
 }
 
@@ -58,7 +60,7 @@ func mathRandom(ls LuaState) int {
 	var low, up int64
 	switch ls.GetTop() { /* check number of arguments */
 	case 0: /* no arguments */
-		ls.PushNumber(rand.Float64()) /* Number between 0 and 1 */
+		ls.PushNumber(ls.Rand().Float64()) /* Number between 0 and 1 */
 		return 1
 	case 1: /* only upper limit */
 		low = 1
@@ -75,9 +77,9 @@ func mathRandom(ls LuaState) int {
 	ls.ArgCheck(low >= 0 || up <= math.MaxInt64+low, 1,
 		"interval too large")
 	if up-low == math.MaxInt64 {
-		ls.PushInteger(low + rand.Int63())
+		ls.PushInteger(low + ls.Rand().Int63())
 	} else {
-		ls.PushInteger(low + rand.Int63n(up-low+1))
+		ls.PushInteger(low + ls.Rand().Int63n(up-low+1))
 	}
 	return 1
 }
@@ -87,10 +89,121 @@ func mathRandom(ls LuaState) int {
 // lua-5.3.4/src/lmathlib.c#math_randomseed()
 func mathRandomSeed(ls LuaState) int {
 	x := ls.CheckNumber(1)
-	rand.Seed(int64(x))
+	ls.Rand().Seed(int64(x))
 	return 0
 }
 
+/* Lua 5.4 pseudo-random number generator: xoshiro256** */
+
+// ranState: xoshiro256**的状态，每个state的math库各有一个
+type ranState [4]uint64
+
+func _rotl(x uint64, n int) uint64 {
+	return (x << n) | (x >> (64 - n))
+}
+
+// lua-5.4.6/src/lmathlib.c#nextrand()
+func (self *ranState) next() uint64 {
+	state0, state1 := self[0], self[1]
+	state2, state3 := self[2]^state0, self[3]^state1
+	res := _rotl(state1*5, 7) * 9
+	self[0] = state0 ^ state3
+	self[1] = state1 ^ state2
+	self[2] = state2 ^ (state1 << 17)
+	self[3] = _rotl(state3, 45)
+	return res
+}
+
+// lua-5.4.6/src/lmathlib.c#setseed()
+func (self *ranState) seed(n1, n2 uint64) {
+	*self = ranState{n1, 0xff, n2, 0} /* avoid a zero state */
+	for i := 0; i < 16; i++ {
+		self.next() /* discard initial values to "spread" seed */
+	}
+}
+
+// project: 把随机数投影到[0, n]区间，n+1不是2的幂时丢弃超出范围的值重新生成
+// lua-5.4.6/src/lmathlib.c#project()
+func (self *ranState) project(ran, n uint64) uint64 {
+	if n&(n+1) == 0 { /* is 'n + 1' a power of 2? */
+		return ran & n /* no bias */
+	}
+	lim := n
+	/* compute the smallest (2^b - 1) not smaller than n */
+	lim |= lim >> 1
+	lim |= lim >> 2
+	lim |= lim >> 4
+	lim |= lim >> 8
+	lim |= lim >> 16
+	lim |= lim >> 32
+	for ran &= lim; ran > n; ran &= lim { /* project 'ran' into [0, lim] */
+		ran = self.next() /* not inside [0, n]? Try again */
+	}
+	return ran
+}
+
+// _setRandFuncs54: 用5.4的math.random和math.randomseed替换5.3的版本
+// 初始种子取自state的随机数生成器，因此WithRandSource仍然可以让结果可重复
+// lua-5.4.6/src/lmathlib.c#setrandfunc()
+func _setRandFuncs54(ls LuaState) {
+	g := new(ranState)
+	g.seed(ls.Rand().Uint64(), ls.Rand().Uint64())
+	ls.PushGoFunction(func(ls LuaState) int { return mathRandom54(ls, g) })
+	ls.SetField(-2, "random")
+	ls.PushGoFunction(func(ls LuaState) int { return mathRandomSeed54(ls, g) })
+	ls.SetField(-2, "randomseed")
+}
+
+// math.random ([m [, n]])
+// http://www.lua.org/manual/5.4/manual.html#pdf-math.random
+// lua-5.4.6/src/lmathlib.c#math_random()
+func mathRandom54(ls LuaState, g *ranState) int {
+	rv := g.next() /* next pseudo-random value */
+	var low, up int64
+	switch ls.GetTop() { /* check number of arguments */
+	case 0: /* no arguments */
+		ls.PushNumber(float64(rv>>11) * (0.5 / (1 << 52))) /* float between 0 and 1 */
+		return 1
+	case 1: /* only upper limit */
+		low = 1
+		up = ls.CheckInteger(1)
+		if up == 0 { /* single 0 as argument? */
+			ls.PushInteger(int64(rv)) /* full random integer */
+			return 1
+		}
+	case 2: /* lower and upper limits */
+		low = ls.CheckInteger(1)
+		up = ls.CheckInteger(2)
+	default:
+		return ls.Error2("wrong number of arguments")
+	}
+
+	/* random integer in the interval [low, up] */
+	ls.ArgCheck(low <= up, 1, "interval is empty")
+	/* project random integer into the interval [0, up - low] */
+	p := g.project(rv, uint64(up)-uint64(low))
+	ls.PushInteger(int64(p + uint64(low)))
+	return 1
+}
+
+// math.randomseed ([x [, y]])
+// 不带参数时随机选择种子，返回实际使用的两个种子
+// http://www.lua.org/manual/5.4/manual.html#pdf-math.randomseed
+// lua-5.4.6/src/lmathlib.c#math_randomseed()
+func mathRandomSeed54(ls LuaState, g *ranState) int {
+	var n1, n2 int64
+	if ls.IsNone(1) {
+		n1, n2 = int64(ls.Rand().Uint64()), int64(ls.Rand().Uint64())
+	} else {
+		n1 = ls.CheckInteger(1)
+		n2 = ls.OptInteger(2, 0)
+	}
+	g.seed(uint64(n1), uint64(n2))
+	ls.PushInteger(n1)
+	ls.PushInteger(n2)
+	return 2
+}
+
 /* max & min */
 
 // math.max (x, ···)
@@ -345,7 +458,14 @@ func mathUlt(ls LuaState) int {
 // math.tointeger (x)
 // http://www.lua.org/manual/5.3/manual.html#pdf-math.tointeger
 // lua-5.3.4/src/lmathlib.c#math_toint()
+// 5.4中只转换数字，字符串返回fail
+// http://www.lua.org/manual/5.4/manual.html#pdf-math.tointeger
 func mathToInt(ls LuaState) int {
+	if ls.Version() >= LUA_VERSION_NUM_54 && ls.Type(1) != LUA_TNUMBER {
+		ls.CheckAny(1)
+		ls.PushNil() /* fail */
+		return 1
+	}
 	if i, ok := ls.ToIntegerX(1); ok {
 		ls.PushInteger(i)
 	} else {
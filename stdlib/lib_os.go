@@ -1,11 +1,18 @@
 package stdlib
 
+//#include <stdlib.h>
 //#include <time.h>
 import "C"
 import (
+	"errors"
+	"fmt"
 	. "luago/api"
+	"math"
 	"os"
-	"time"
+	"os/exec"
+	"strings"
+	"syscall"
+	"unsafe"
 )
 
 var sysLib = map[string]GoFunction{
@@ -40,9 +47,9 @@ func osClock(ls LuaState) int {
 // http://www.lua.org/manual/5.3/manual.html#pdf-os.difftime
 // lua-5.3.4/src/loslib.c#os_difftime()
 func osDiffTime(ls LuaState) int {
-	t2 := ls.CheckInteger(1)
-	t1 := ls.CheckInteger(2)
-	ls.PushInteger(t2 - t1)
+	t1 := _checkTime(ls, 1)
+	t2 := _checkTime(ls, 2)
+	ls.PushNumber(float64(C.difftime(C.time_t(t1), C.time_t(t2))))
 	return 1
 }
 
@@ -50,77 +57,167 @@ func osDiffTime(ls LuaState) int {
 // http://www.lua.org/manual/5.3/manual.html#pdf-os.time
 // lua-5.3.4/src/loslib.c#os_time()
 func osTime(ls LuaState) int {
+	var t C.time_t
 	if ls.IsNoneOrNil(1) { /* called without args? */
-		t := time.Now().Unix() /* get current time */
-		ls.PushInteger(t)
+		t = C.time_t(ls.Now().Unix()) /* get current time */
 	} else {
+		var ts C.struct_tm
 		ls.CheckType(1, LUA_TTABLE)
-		sec := _getField(ls, "sec", 0)
-		min := _getField(ls, "min", 0)
-		hour := _getField(ls, "hour", 12)
-		day := _getField(ls, "day", -1)
-		month := _getField(ls, "month", -1)
-		year := _getField(ls, "year", -1)
-		// todo: isdst
-		t := time.Date(year, time.Month(month), day,
-			hour, min, sec, 0, time.Local).Unix()
-		ls.PushInteger(t)
+		ls.SetTop(1) /* make sure table is at the top */
+		ts.tm_sec = C.int(_getField(ls, "sec", 0, 0))
+		ts.tm_min = C.int(_getField(ls, "min", 0, 0))
+		ts.tm_hour = C.int(_getField(ls, "hour", 12, 0))
+		ts.tm_mday = C.int(_getField(ls, "day", -1, 0))
+		ts.tm_mon = C.int(_getField(ls, "month", -1, 1))
+		ts.tm_year = C.int(_getField(ls, "year", -1, 1900))
+		ts.tm_isdst = C.int(_getBoolField(ls, "isdst"))
+		t = C.mktime(&ts)
+		_setAllFields(ls, &ts) /* update fields with normalized values */
 	}
+	if t == -1 {
+		return ls.Error2("time result cannot be represented in this installation")
+	}
+	ls.PushInteger(int64(t))
 	return 1
 }
 
+/* maximum value for date fields (to avoid arithmetic overflows with 'int') */
+const L_MAXDATEFIELD = math.MaxInt32 / 2
+
 // lua-5.3.4/src/loslib.c#getfield()
-func _getField(ls LuaState, key string, dft int64) int {
+func _getField(ls LuaState, key string, d, delta int64) int {
 	t := ls.GetField(-1, key) /* get field and its type */
 	res, isNum := ls.ToIntegerX(-1)
 	if !isNum { /* field is not an integer? */
 		if t != LUA_TNIL { /* some other value? */
 			return ls.Error2("field '%s' is not an integer", key)
-		} else if dft < 0 { /* absent field; no default? */
+		} else if d < 0 { /* absent field; no default? */
 			return ls.Error2("field '%s' missing in date table", key)
 		}
-		res = dft
+		res = d
+	} else {
+		if !(-L_MAXDATEFIELD <= res && res <= L_MAXDATEFIELD) {
+			return ls.Error2("field '%s' out-of-bound", key)
+		}
+		res -= delta
 	}
 	ls.Pop(1)
 	return int(res)
 }
 
+// lua-5.3.4/src/loslib.c#getboolfield()
+func _getBoolField(ls LuaState, key string) int {
+	res := -1 /* undefined */
+	if ls.GetField(-1, key) != LUA_TNIL {
+		if ls.ToBoolean(-1) {
+			res = 1
+		} else {
+			res = 0
+		}
+	}
+	ls.Pop(1)
+	return res
+}
+
+// lua-5.3.4/src/loslib.c#l_checktime()
+func _checkTime(ls LuaState, arg int) int64 {
+	t := ls.CheckInteger(arg)
+	ls.ArgCheck(int64(C.time_t(t)) == t, arg, "time out-of-bounds")
+	return t
+}
+
+/* options for ANSI C 89 (only 1-char options) plus C99 and POSIX */
+var strftimeOptions = []string{
+	"a", "A", "b", "B", "c", "C", "d", "D", "e", "F", "g", "G", "h", "H",
+	"I", "j", "m", "M", "n", "p", "r", "R", "S", "t", "T", "u", "U", "V",
+	"w", "W", "x", "X", "y", "Y", "z", "Z", "%",
+	"Ec", "EC", "Ex", "EX", "Ey", "EY",
+	"Od", "Oe", "OH", "OI", "Om", "OM", "OS", "Ou", "OU", "OV", "Ow", "OW", "Oy",
+}
+
+/* size for buffer where 'strftime' writes each conversion */
+const SIZETIMEFMT = 250
+
 // os.date ([format [, time]])
 // http://www.lua.org/manual/5.3/manual.html#pdf-os.date
 // lua-5.3.4/src/loslib.c#os_date()
 func osDate(ls LuaState) int {
-	format := ls.OptString(1, "%c")
-	var t time.Time
-	if ls.IsInteger(2) {
-		t = time.Unix(ls.ToInteger(2), 0)
+	s := ls.OptString(1, "%c")
+	t := C.time_t(0)
+	if ls.IsNoneOrNil(2) {
+		t = C.time_t(ls.Now().Unix())
 	} else {
-		t = time.Now()
+		t = C.time_t(_checkTime(ls, 2))
 	}
 
-	if format != "" && format[0] == '!' { /* UTC? */
-		format = format[1:] /* skip '!' */
-		t = t.In(time.UTC)
+	var tmr C.struct_tm
+	var stm *C.struct_tm
+	if s != "" && s[0] == '!' { /* UTC? */
+		stm = C.gmtime_r(&t, &tmr)
+		s = s[1:] /* skip '!' */
+	} else {
+		stm = C.localtime_r(&t, &tmr)
+	}
+	if stm == nil { /* invalid date? */
+		return ls.Error2("time result cannot be represented in this installation")
 	}
 
-	if format == "*t" {
+	if s == "*t" {
 		ls.CreateTable(0, 9) /* 9 = number of fields */
-		_setField(ls, "sec", t.Second())
-		_setField(ls, "min", t.Minute())
-		_setField(ls, "hour", t.Hour())
-		_setField(ls, "day", t.Day())
-		_setField(ls, "month", int(t.Month()))
-		_setField(ls, "year", t.Year())
-		_setField(ls, "wday", int(t.Weekday())+1)
-		_setField(ls, "yday", t.YearDay())
-	} else if format == "%c" {
-		ls.PushString(t.Format(time.ANSIC))
-	} else {
-		ls.PushString(format) // TODO
+		_setAllFields(ls, stm)
+		return 1
 	}
 
+	var b strings.Builder
+	var buf [SIZETIMEFMT]C.char
+	for len(s) > 0 {
+		if s[0] != '%' {
+			b.WriteByte(s[0])
+			s = s[1:]
+			continue
+		}
+		s = s[1:] /* skip '%' */
+		conv := _checkOption(ls, s)
+		s = s[len(conv):]
+		cc := C.CString("%" + conv)
+		n := C.strftime(&buf[0], SIZETIMEFMT, cc, stm)
+		C.free(unsafe.Pointer(cc))
+		b.WriteString(C.GoStringN(&buf[0], C.int(n)))
+	}
+	ls.PushString(b.String())
 	return 1
 }
 
+// lua-5.3.4/src/loslib.c#checkoption()
+func _checkOption(ls LuaState, conv string) string {
+	for _, opt := range strftimeOptions {
+		if strings.HasPrefix(conv, opt) {
+			return opt
+		}
+	}
+	if len(conv) > 1 {
+		conv = conv[:1]
+	}
+	ls.ArgError(1, fmt.Sprintf("invalid conversion specifier '%%%s'", conv))
+	return ""
+}
+
+// lua-5.3.4/src/loslib.c#setallfields()
+func _setAllFields(ls LuaState, stm *C.struct_tm) {
+	_setField(ls, "sec", int(stm.tm_sec))
+	_setField(ls, "min", int(stm.tm_min))
+	_setField(ls, "hour", int(stm.tm_hour))
+	_setField(ls, "day", int(stm.tm_mday))
+	_setField(ls, "month", int(stm.tm_mon)+1)
+	_setField(ls, "year", int(stm.tm_year)+1900)
+	_setField(ls, "wday", int(stm.tm_wday)+1)
+	_setField(ls, "yday", int(stm.tm_yday)+1)
+	if stm.tm_isdst >= 0 { /* undefined? */
+		ls.PushBoolean(stm.tm_isdst != 0)
+		ls.SetField(-2, "isdst")
+	}
+}
+
 func _setField(ls LuaState, key string, value int) {
 	ls.PushInteger(int64(value))
 	ls.SetField(-2, key)
@@ -157,8 +254,15 @@ func osRename(ls LuaState) int {
 
 // os.tmpname ()
 // http://www.lua.org/manual/5.3/manual.html#pdf-os.tmpname
+// lua-5.3.4/src/loslib.c#os_tmpname()
 func osTmpName(ls LuaState) int {
-	panic("todo: osTmpName!")
+	f, err := os.CreateTemp("", "lua_")
+	if err != nil {
+		return ls.Error2("unable to generate a unique filename")
+	}
+	f.Close()
+	ls.PushString(f.Name())
+	return 1
 }
 
 // os.getenv (varname)
@@ -176,32 +280,94 @@ func osGetEnv(ls LuaState) int {
 
 // os.execute ([command])
 // http://www.lua.org/manual/5.3/manual.html#pdf-os.execute
+// lua-5.3.4/src/loslib.c#os_execute()
 func osExecute(ls LuaState) int {
-	panic("todo: osExecute!")
+	if ls.IsNoneOrNil(1) {
+		_, err := os.Stat("/bin/sh")
+		ls.PushBoolean(err == nil) /* true if there is a shell */
+		return 1
+	}
+
+	cmd := exec.Command("/bin/sh", "-c", ls.CheckString(1))
+	cmd.Stdin = ls.Stdin()
+	cmd.Stdout = ls.Stdout()
+	cmd.Stderr = ls.Stderr()
+	err := cmd.Run()
+	if err != nil && cmd.ProcessState == nil { /* could not run the shell */
+		ls.PushNil()
+		ls.PushString(err.Error())
+		var errno syscall.Errno
+		if errors.As(err, &errno) {
+			ls.PushInteger(int64(errno))
+		} else {
+			ls.PushInteger(0)
+		}
+		return 3
+	}
+
+	/* lua-5.3.4/src/lauxlib.c#luaL_execresult() */
+	what, stat := "exit", cmd.ProcessState.ExitCode()
+	if ws, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		what, stat = "signal", int(ws.Signal())
+	}
+	if what == "exit" && stat == 0 {
+		ls.PushBoolean(true)
+	} else {
+		ls.PushNil()
+	}
+	ls.PushString(what)
+	ls.PushInteger(int64(stat))
+	return 3 /* return true/nil,what,code */
 }
 
 // os.exit ([code [, close]])
 // http://www.lua.org/manual/5.3/manual.html#pdf-os.exit
 // lua-5.3.4/src/loslib.c#os_exit()
 func osExit(ls LuaState) int {
+	var status int
 	if ls.IsBoolean(1) {
 		if ls.ToBoolean(1) {
-			os.Exit(0)
+			status = 0 /* EXIT_SUCCESS */
 		} else {
-			os.Exit(1) // todo
+			status = 1 /* EXIT_FAILURE */
 		}
 	} else {
-		code := ls.OptInteger(1, 1)
-		os.Exit(int(code))
+		status = int(ls.OptInteger(1, 0))
 	}
 	if ls.ToBoolean(2) {
-		//ls.Close()
+		ls.Close()
 	}
+	os.Exit(status)
 	return 0
 }
 
+var localeCategories = []string{
+	"all", "collate", "ctype", "monetary", "numeric", "time",
+}
+
 // os.setlocale (locale [, category])
 // http://www.lua.org/manual/5.3/manual.html#pdf-os.setlocale
+// lua-5.3.4/src/loslib.c#os_setlocale()
+// 只支持"C"（即"POSIX"）locale，查询时总是返回"C"
 func osSetLocale(ls LuaState) int {
-	panic("todo: osSetLocale!")
+	category := ls.OptString(2, "all")
+	valid := false
+	for _, name := range localeCategories {
+		valid = valid || name == category
+	}
+	if !valid {
+		return ls.ArgError(2, fmt.Sprintf("invalid option '%s'", category))
+	}
+
+	if ls.IsNoneOrNil(1) { /* query? */
+		ls.PushString("C")
+		return 1
+	}
+	switch ls.CheckString(1) {
+	case "", "C", "POSIX":
+		ls.PushString("C")
+	default:
+		ls.PushNil() /* locale not available */
+	}
+	return 1
 }
@@ -0,0 +1,260 @@
+package stdlib
+
+import (
+	"fmt"
+	. "luago/api"
+	"os"
+	"strings"
+)
+
+const (
+	LUA_LOADED_TABLE  = "_LOADED"
+	LUA_PRELOAD_TABLE = "_PRELOAD"
+
+	LUA_DIRSEP    = string(os.PathSeparator)
+	LUA_PATH_SEP  = ";"
+	LUA_PATH_MARK = "?"
+	LUA_EXEC_DIR  = "!"
+	LUA_IGMARK    = "-"
+
+	LUA_PATH_VAR  = "LUA_PATH"
+	LUA_CPATH_VAR = "LUA_CPATH"
+
+	LUA_ROOT = "/usr/local/"
+	LUA_LDIR = LUA_ROOT + "share/lua/5.3/"
+	LUA_CDIR = LUA_ROOT + "lib/lua/5.3/"
+
+	LUA_PATH_DEFAULT = LUA_LDIR + "?.lua;" + LUA_LDIR + "?/init.lua;" +
+		LUA_CDIR + "?.lua;" + LUA_CDIR + "?/init.lua;" +
+		"./?.lua;" + "./?/init.lua"
+	LUA_CPATH_DEFAULT = LUA_CDIR + "?.so;" + LUA_CDIR + "loadall.so;" + "./?.so"
+)
+
+/* marks the place in a path to insert the default path */
+const AUXMARK = "\x01"
+
+var pkgFuncs = map[string]GoFunction{
+	"loadlib":    pkgLoadLib,
+	"searchpath": pkgSearchPath,
+	/* placeholders */
+	"preload":   nil,
+	"cpath":     nil,
+	"path":      nil,
+	"searchers": nil,
+	"loaded":    nil,
+}
+
+var llFuncs = map[string]GoFunction{
+	"require": pkgRequire,
+}
+
+// lua-5.3.4/src/loadlib.c#luaopen_package()
+func OpenPackageLib(ls LuaState) int {
+	ls.NewLib(pkgFuncs) /* create 'package' table */
+	createSearchersTable(ls)
+	/* set paths */
+	setPath(ls, "path", LUA_PATH_VAR, LUA_PATH_DEFAULT)
+	setPath(ls, "cpath", LUA_CPATH_VAR, LUA_CPATH_DEFAULT)
+	/* store config information */
+	ls.PushString(LUA_DIRSEP + "\n" + LUA_PATH_SEP + "\n" + LUA_PATH_MARK + "\n" +
+		LUA_EXEC_DIR + "\n" + LUA_IGMARK + "\n")
+	ls.SetField(-2, "config")
+	/* set field 'loaded' */
+	ls.GetSubTable(LUA_REGISTRYINDEX, LUA_LOADED_TABLE)
+	ls.SetField(-2, "loaded")
+	/* set field 'preload' */
+	ls.GetSubTable(LUA_REGISTRYINDEX, LUA_PRELOAD_TABLE)
+	ls.SetField(-2, "preload")
+	ls.PushGlobalTable()
+	ls.PushValue(-2)        /* set 'package' as upvalue for next lib */
+	ls.SetFuncs(llFuncs, 1) /* open lib into global table */
+	ls.Pop(1)               /* pop global table */
+	return 1                /* return 'package' table */
+}
+
+// lua-5.3.4/src/loadlib.c#createsearcherstable()
+func createSearchersTable(ls LuaState) {
+	searchers := []GoFunction{preloadSearcher, luaSearcher}
+	/* create 'searchers' table */
+	ls.CreateTable(len(searchers), 0)
+	/* fill it with predefined searchers */
+	for i, searcher := range searchers {
+		ls.PushValue(-2) /* set 'package' as upvalue for all searchers */
+		ls.PushGoClosure(searcher, 1)
+		ls.RawSetI(-2, int64(i+1))
+	}
+	ls.SetField(-2, "searchers") /* put it in field 'searchers' */
+}
+
+// 路径取自环境变量LUA_PATH_5_3或LUA_PATH，其中的";;"替换为默认路径
+// lua-5.3.4/src/loadlib.c#setpath()
+func setPath(ls LuaState, fieldName, envName, dft string) {
+	path, ok := os.LookupEnv(envName + "_5_3")
+	if !ok {
+		path, ok = os.LookupEnv(envName)
+	}
+	if !ok || noEnv(ls) { /* no environment variable? */
+		ls.PushString(dft) /* use default */
+	} else {
+		/* replace ";;" by ";AUXMARK;" and then AUXMARK by default path */
+		path = strings.Replace(path, LUA_PATH_SEP+LUA_PATH_SEP,
+			LUA_PATH_SEP+AUXMARK+LUA_PATH_SEP, -1)
+		ls.PushString(strings.Replace(path, AUXMARK, dft, -1))
+	}
+	ls.SetField(-2, fieldName)
+}
+
+/*
+** return registry.LUA_NOENV as a boolean
+ */
+func noEnv(ls LuaState) bool {
+	ls.GetField(LUA_REGISTRYINDEX, "LUA_NOENV")
+	b := ls.ToBoolean(-1)
+	ls.Pop(1) /* remove value */
+	return b
+}
+
+// require (modname)
+// http://www.lua.org/manual/5.3/manual.html#pdf-require
+// lua-5.3.4/src/loadlib.c#ll_require()
+func pkgRequire(ls LuaState) int {
+	name := ls.CheckString(1)
+	ls.SetTop(1) /* LOADED table will be at index 2 */
+	ls.GetField(LUA_REGISTRYINDEX, LUA_LOADED_TABLE)
+	ls.GetField(2, name)  /* LOADED[name] */
+	if ls.ToBoolean(-1) { /* is it there? */
+		return 1 /* package is already loaded */
+	}
+	/* else must load package */
+	ls.Pop(1) /* remove 'getfield' result */
+	findLoader(ls, name)
+	ls.PushString(name) /* pass name as argument to module loader */
+	ls.Insert(-2)       /* name is 1st argument (before search data) */
+	ls.Call(2, 1)       /* run loader to load module */
+	if !ls.IsNil(-1) {  /* non-nil return? */
+		ls.SetField(2, name) /* LOADED[name] = returned value */
+	}
+	if ls.GetField(2, name) == LUA_TNIL { /* module set no value? */
+		ls.PushBoolean(true) /* use true as result */
+		ls.PushValue(-1)     /* extra copy to be returned */
+		ls.SetField(2, name) /* LOADED[name] = true */
+	}
+	return 1
+}
+
+// lua-5.3.4/src/loadlib.c#findloader()
+func findLoader(ls LuaState, name string) {
+	var msg strings.Builder /* to build error message */
+	/* push 'package.searchers' to index 3 in the stack */
+	if ls.GetField(LuaUpvalueIndex(1), "searchers") != LUA_TTABLE {
+		ls.Error2("'package.searchers' must be a table")
+	}
+	/*  iterate over available searchers to find a loader */
+	for i := int64(1); ; i++ {
+		if ls.RawGetI(3, i) == LUA_TNIL { /* no more searchers? */
+			ls.Pop(1) /* remove nil */
+			ls.Error2("module '%s' not found:%s", name, msg.String())
+		}
+		ls.PushString(name)
+		ls.Call(1, 2)          /* call it */
+		if ls.IsFunction(-2) { /* did it find a loader? */
+			return /* module loader found */
+		} else if ls.IsString(-2) { /* searcher returned error message? */
+			ls.Pop(1) /* remove extra return */
+			msg.WriteString(ls.ToString(-1))
+			ls.Pop(1)
+		} else {
+			ls.Pop(2) /* remove both returns */
+		}
+	}
+}
+
+// lua-5.3.4/src/loadlib.c#searcher_preload()
+func preloadSearcher(ls LuaState) int {
+	name := ls.CheckString(1)
+	ls.GetField(LUA_REGISTRYINDEX, LUA_PRELOAD_TABLE)
+	if ls.GetField(-1, name) == LUA_TNIL { /* not found? */
+		ls.PushString(fmt.Sprintf("\n\tno field package.preload['%s']", name))
+	}
+	return 1
+}
+
+// lua-5.3.4/src/loadlib.c#searcher_Lua()
+func luaSearcher(ls LuaState) int {
+	name := ls.CheckString(1)
+	ls.GetField(LuaUpvalueIndex(1), "path")
+	path, ok := ls.ToStringX(-1)
+	if !ok {
+		ls.Error2("'package.path' must be a string")
+	}
+	filename, errMsg := searchPath(ls, name, path, ".", LUA_DIRSEP)
+	if filename == "" {
+		ls.PushString(errMsg)
+		return 1 /* module not found in this path */
+	}
+	if ls.LoadFile(filename) == LUA_OK { /* module loaded successfully? */
+		ls.PushString(filename) /* will be 2nd argument to module */
+		return 2                /* return open function and file name */
+	}
+	return ls.Error2("error loading module '%s' from file '%s':\n\t%s",
+		ls.ToString(1), filename, ls.ToString(-1))
+}
+
+// 在path的各个模板中查找可读的文件，找不到时返回拼接好的错误信息
+// lua-5.3.4/src/loadlib.c#searchpath()
+func searchPath(ls LuaState, name, path, sep, dirSep string) (filename, errMsg string) {
+	var msg strings.Builder
+	if sep != "" {
+		name = strings.Replace(name, sep, dirSep, -1) /* replace it by 'dirsep' */
+	}
+	for _, template := range strings.Split(path, LUA_PATH_SEP) {
+		if template == "" {
+			continue /* empty template */
+		}
+		filename := strings.Replace(template, LUA_PATH_MARK, name, -1)
+		if readable(ls, filename) { /* does it exist and is readable? */
+			return filename, "" /* return that file name */
+		}
+		msg.WriteString(fmt.Sprintf("\n\tno file '%s'", filename))
+	}
+	return "", msg.String() /* not found */
+}
+
+func readable(ls LuaState, filename string) bool {
+	f, err := ls.FS().Open(filename)
+	if err != nil {
+		return false
+	}
+	f.Close()
+	return true
+}
+
+// package.searchpath (name, path [, sep [, rep]])
+// http://www.lua.org/manual/5.3/manual.html#pdf-package.searchpath
+// lua-5.3.4/src/loadlib.c#ll_searchpath()
+func pkgSearchPath(ls LuaState) int {
+	name := ls.CheckString(1)
+	path := ls.CheckString(2)
+	sep := ls.OptString(3, ".")
+	rep := ls.OptString(4, LUA_DIRSEP)
+	if filename, errMsg := searchPath(ls, name, path, sep, rep); filename != "" {
+		ls.PushString(filename)
+		return 1
+	} else { /* error message is on top of the stack */
+		ls.PushNil()
+		ls.PushString(errMsg)
+		return 2 /* return nil + error message */
+	}
+}
+
+// package.loadlib (libname, funcname)
+// http://www.lua.org/manual/5.3/manual.html#pdf-package.loadlib
+// 不支持加载C库，总是返回nil加错误信息
+func pkgLoadLib(ls LuaState) int {
+	ls.CheckString(1)
+	ls.CheckString(2)
+	ls.PushNil()
+	ls.PushString("dynamic libraries not enabled; check your Lua installation")
+	ls.PushString("absent")
+	return 3 /* return nil, error message, and where */
+}
@@ -16,6 +16,10 @@ var strLib = map[string]GoFunction{
 	"byte":    strByte,
 	"char":    strChar,
 	"format":  strFormat,
+	"find":    strFind,
+	"match":   strMatch,
+	"gmatch":  strGmatch,
+	"gsub":    strGsub,
 }
 
 func OpenStringLib(ls LuaState) int {
@@ -32,7 +36,67 @@ func createMetatable(ls LuaState) {
 	ls.Pop(1)                  // 弹出dummy
 	ls.PushValue(-2)           // 获取string库
 	ls.SetField(-2, "__index") // metatable.__index = string
-	ls.Pop(1)                  // 弹出元表
+	if ls.Version() >= LUA_VERSION_NUM_54 {
+		_setArithMetamethods(ls)
+	}
+	ls.Pop(1) // 弹出元表
+}
+
+/* string arithmetic metamethods (Lua 5.4) */
+
+// 5.4中虚拟机不再把字符串转换为数字，字符串的算术运算由这些元方法完成
+// lua-5.4.6/src/lstrlib.c#stringmetamethods
+var strArithMetamethods = map[string]ArithOp{
+	"__add":  LUA_OPADD,
+	"__sub":  LUA_OPSUB,
+	"__mul":  LUA_OPMUL,
+	"__mod":  LUA_OPMOD,
+	"__pow":  LUA_OPPOW,
+	"__div":  LUA_OPDIV,
+	"__idiv": LUA_OPIDIV,
+	"__unm":  LUA_OPUNM,
+}
+
+func _setArithMetamethods(ls LuaState) {
+	for name, op := range strArithMetamethods {
+		name, op := name, op
+		ls.PushGoFunction(func(ls LuaState) int {
+			return _strArith(ls, op, name)
+		})
+		ls.SetField(-2, name)
+	}
+}
+
+// lua-5.4.6/src/lstrlib.c#arith()
+func _strArith(ls LuaState, op ArithOp, mtName string) int {
+	if _toNum(ls, 1) && _toNum(ls, 2) {
+		ls.Arith(op) /* result will be on the top */
+	} else {
+		_tryMetamethod(ls, mtName)
+	}
+	return 1
+}
+
+// _toNum: 把参数转换为数字压栈，不是数字也不是数字字符串时返回false
+// lua-5.4.6/src/lstrlib.c#tonum()
+func _toNum(ls LuaState, arg int) bool {
+	if ls.Type(arg) == LUA_TNUMBER { /* already a number? */
+		ls.PushValue(arg)
+		return true
+	}
+	s, ok := ls.ToStringX(arg) /* check whether it is a numerical string */
+	return ok && ls.StringToNumber(s)
+}
+
+// _tryMetamethod: 另一个操作数有对应的元方法时调用它，否则报错
+// lua-5.4.6/src/lstrlib.c#trymt()
+func _tryMetamethod(ls LuaState, mtName string) {
+	ls.SetTop(2) /* back to the original arguments */
+	if ls.Type(2) == LUA_TSTRING || ls.GetMetafield(2, mtName) == LUA_TNIL {
+		ls.Error2("attempt to perform arithmetic on a %s value", ls.TypeName2(-2)) /* no metamethod */
+	}
+	ls.Insert(-3) /* put metamethod before arguments */
+	ls.Call(2, 1) /* call metamethod */
 }
 
 /* Basic String Functions */
@@ -220,50 +284,97 @@ func strUnpack(ls LuaState) int {
 
 // string.format (formatstring, ···)
 // http://www.lua.org/manual/5.3/manual.html#pdf-string.format
+// lua-5.3.4/src/lstrlib.c#str_format()
 func strFormat(ls LuaState) int {
+	top := ls.GetTop()
 	fmtStr := ls.CheckString(1)
-	if len(fmtStr) <= 1 || strings.IndexByte(fmtStr, '%') < 0 {
-		ls.PushString(fmtStr)
-		return 1
+	arg := 1
+	var b strings.Builder
+	for i := 0; i < len(fmtStr); {
+		if fmtStr[i] != L_ESC {
+			b.WriteByte(fmtStr[i])
+			i++
+		} else if i+1 < len(fmtStr) && fmtStr[i+1] == L_ESC {
+			b.WriteByte(L_ESC) /* %% */
+			i += 2
+		} else { /* format item */
+			arg++
+			if arg > top { /* too many format specifiers? */
+				ls.ArgError(arg, "no value")
+			}
+			spec, n := scanFormat(ls, fmtStr[i+1:])
+			i += 1 + n
+			_addFormatItem(ls, &b, spec, arg)
+		}
 	}
+	ls.PushString(b.String())
+	return 1
+}
 
-	argIdx := 1
-	arr := parseFmtStr(fmtStr)
-	for i, s := range arr {
-		if s[0] == '%' {
-			if s == "%%" {
-				arr[i] = "%"
-			} else {
-				argIdx += 1
-				arr[i] = _fmtArg(s, ls, argIdx)
+func _addFormatItem(ls LuaState, b *strings.Builder, spec *fmtSpec, arg int) {
+	switch spec.conv {
+	case 'c':
+		c := byte(ls.CheckInteger(arg))
+		b.WriteString(spec.pad("", string([]byte{c})))
+	case 'd', 'i':
+		n := ls.CheckInteger(arg)
+		b.WriteString(fmt.Sprintf(spec.goFormat('d'), n))
+	case 'u':
+		n := uint64(ls.CheckInteger(arg))
+		b.WriteString(fmt.Sprintf(spec.unsigned().goFormat('d'), n))
+	case 'o', 'x', 'X':
+		n := uint64(ls.CheckInteger(arg))
+		s := spec.unsigned()
+		if n == 0 && s.conv != 'o' {
+			s.flags = strings.Replace(s.flags, "#", "", -1) /* C不为0加前缀 */
+		}
+		b.WriteString(fmt.Sprintf(s.goFormat(s.conv), n))
+	case 'a', 'A':
+		n := ls.CheckNumber(arg)
+		b.WriteString(spec.formatHexFloat(n))
+	case 'e', 'E', 'f', 'F', 'g', 'G':
+		n := ls.CheckNumber(arg)
+		b.WriteString(spec.formatFloat(n))
+	case 'q':
+		_addLiteral(ls, b, arg)
+	case 's':
+		s := ls.ToString2(arg)
+		ls.Pop(1)
+		if spec.flags == "" && spec.width < 0 && spec.prec < 0 {
+			b.WriteString(s) /* keep entire string */
+		} else {
+			ls.ArgCheck(strings.IndexByte(s, 0) < 0, arg, "string contains zeros")
+			if spec.prec >= 0 && spec.prec < len(s) {
+				s = s[:spec.prec]
 			}
+			b.WriteString(spec.pad("", s))
 		}
+	default: /* also treat cases 'pnLlh' */
+		ls.Error2("invalid option '%%%c' to 'format'", spec.conv)
 	}
-
-	ls.PushString(strings.Join(arr, ""))
-	return 1
 }
 
-func _fmtArg(tag string, ls LuaState, argIdx int) string {
-	switch tag[len(tag)-1] { // specifier
-	case 'c': // character
-		return string([]byte{byte(ls.ToInteger(argIdx))})
-	case 'i':
-		tag = tag[:len(tag)-1] + "d" // %i -> %d
-		return fmt.Sprintf(tag, ls.ToInteger(argIdx))
-	case 'd', 'o': // integer, octal
-		return fmt.Sprintf(tag, ls.ToInteger(argIdx))
-	case 'u': // unsigned integer
-		tag = tag[:len(tag)-1] + "d" // %u -> %d
-		return fmt.Sprintf(tag, uint(ls.ToInteger(argIdx)))
-	case 'x', 'X': // hex integer
-		return fmt.Sprintf(tag, uint(ls.ToInteger(argIdx)))
-	case 'f': // float
-		return fmt.Sprintf(tag, ls.ToNumber(argIdx))
-	case 's', 'q': // string
-		return fmt.Sprintf(tag, ls.ToString2(argIdx))
+// lua-5.3.4/src/lstrlib.c#addliteral()
+func _addLiteral(ls LuaState, b *strings.Builder, arg int) {
+	switch ls.Type(arg) {
+	case LUA_TSTRING:
+		addQuoted(b, ls.ToString(arg))
+	case LUA_TNUMBER:
+		if ls.IsInteger(arg) {
+			n := ls.ToInteger(arg)
+			if n == LUA_MININTEGER { /* corner case? */
+				b.WriteString(fmt.Sprintf("0x%x", uint64(n))) /* use hexa */
+			} else {
+				b.WriteString(fmt.Sprintf("%d", n))
+			}
+		} else {
+			b.WriteString(quoteFloat(ls.ToNumber(arg)))
+		}
+	case LUA_TNIL, LUA_TBOOLEAN:
+		b.WriteString(ls.ToString2(arg))
+		ls.Pop(1)
 	default:
-		panic("todo! tag=" + tag)
+		ls.ArgError(arg, "value has no literal form")
 	}
 }
 
@@ -272,32 +383,17 @@ func _fmtArg(tag string, ls LuaState, argIdx int) string {
 // string.find (s, pattern [, init [, plain]])
 // http://www.lua.org/manual/5.3/manual.html#pdf-string.find
 func strFind(ls LuaState) int {
-	s := ls.CheckString(1)
-	sLen := len(s)
-	pattern := ls.CheckString(2)
-	init := posRelat(ls.OptInteger(3, 1), sLen)
-	if init < 1 {
-		init = 1
-	} else if init > sLen+1 { /* start after string's end? */
-		ls.PushNil()
-		return 1
-	}
-	plain := ls.ToBoolean(4)
-
-	start, end := find(s, pattern, init, plain)
-
-	if start < 0 {
-		ls.PushNil()
-		return 1
-	}
-	ls.PushInteger(int64(start))
-	ls.PushInteger(int64(end))
-	return 2
+	return strFindAux(ls, true)
 }
 
 // string.match (s, pattern [, init])
 // http://www.lua.org/manual/5.3/manual.html#pdf-string.match
 func strMatch(ls LuaState) int {
+	return strFindAux(ls, false)
+}
+
+// lua-5.3.4/src/lstrlib.c#str_find_aux()
+func strFindAux(ls LuaState, find bool) int {
 	s := ls.CheckString(1)
 	sLen := len(s)
 	pattern := ls.CheckString(2)
@@ -305,62 +401,160 @@ func strMatch(ls LuaState) int {
 	if init < 1 {
 		init = 1
 	} else if init > sLen+1 { /* start after string's end? */
-		ls.PushNil()
+		ls.PushNil() /* cannot find anything */
 		return 1
 	}
 
-	captures := match(s, pattern, init)
-
-	if captures == nil {
-		ls.PushNil()
-		return 1
+	/* explicit request or no special characters? */
+	if find && (ls.ToBoolean(4) || noSpecials(pattern)) {
+		/* do a plain search */
+		if idx := strings.Index(s[init-1:], pattern); idx >= 0 {
+			ls.PushInteger(int64(init + idx))
+			ls.PushInteger(int64(init + idx + len(pattern) - 1))
+			return 2
+		}
 	} else {
-		for i := 0; i < len(captures); i += 2 {
-			capture := s[captures[i]:captures[i+1]]
-			ls.PushString(capture)
+		ms := newMatchState(ls, s, pattern)
+		p, anchor := 0, len(pattern) > 0 && pattern[0] == '^'
+		if anchor {
+			p = 1 /* skip anchor character */
+		}
+		for s1 := init - 1; ; s1++ {
+			ms.reprepstate()
+			if e := ms.doMatch(s1, p); e != _NO_MATCH {
+				if find {
+					ls.PushInteger(int64(s1 + 1)) /* start */
+					ls.PushInteger(int64(e))      /* end */
+					return ms.pushCaptures(_NO_MATCH, 0) + 2
+				}
+				return ms.pushCaptures(s1, e)
+			}
+			if s1 >= sLen || anchor {
+				break
+			}
 		}
-		return len(captures) / 2
 	}
-}
-
-// string.gsub (s, pattern, repl [, n])
-// http://www.lua.org/manual/5.3/manual.html#pdf-string.gsub
-func strGsub(ls LuaState) int {
-	s := ls.CheckString(1)
-	pattern := ls.CheckString(2)
-	repl := ls.CheckString(3) // todo
-	n := int(ls.OptInteger(4, -1))
-
-	newStr, nMatches := gsub(s, pattern, repl, n)
-	ls.PushString(newStr)
-	ls.PushInteger(int64(nMatches))
-	return 2
+	ls.PushNil() /* not found */
+	return 1
 }
 
 // string.gmatch (s, pattern)
 // http://www.lua.org/manual/5.3/manual.html#pdf-string.gmatch
+// lua-5.3.4/src/lstrlib.c#gmatch()
 func strGmatch(ls LuaState) int {
 	s := ls.CheckString(1)
 	pattern := ls.CheckString(2)
+	src, lastMatch := 0, _NO_MATCH
 
 	gmatchAux := func(ls LuaState) int {
-		captures := match(s, pattern, 1)
-		if captures != nil {
-			for i := 0; i < len(captures); i += 2 {
-				capture := s[captures[i]:captures[i+1]]
-				ls.PushString(capture)
+		ms := newMatchState(ls, s, pattern)
+		for ; src <= len(s); src++ {
+			ms.reprepstate()
+			if e := ms.doMatch(src, 0); e != _NO_MATCH && e != lastMatch {
+				start := src
+				src, lastMatch = e, e
+				return ms.pushCaptures(start, e)
 			}
-			s = s[captures[len(captures)-1]:]
-			return len(captures) / 2
-		} else {
-			return 0
 		}
+		return 0 /* not found */
 	}
 
 	ls.PushGoFunction(gmatchAux)
 	return 1
 }
 
+// string.gsub (s, pattern, repl [, n])
+// http://www.lua.org/manual/5.3/manual.html#pdf-string.gsub
+// lua-5.3.4/src/lstrlib.c#str_gsub()
+func strGsub(ls LuaState) int {
+	s := ls.CheckString(1)
+	pattern := ls.CheckString(2)
+	tr := ls.Type(3)                          /* replacement type */
+	maxS := ls.OptInteger(4, int64(len(s))+1) /* max replacements */
+	ls.ArgCheck(tr == LUA_TNUMBER || tr == LUA_TSTRING ||
+		tr == LUA_TFUNCTION || tr == LUA_TTABLE, 3,
+		"string/function/table expected")
+
+	p, anchor := 0, len(pattern) > 0 && pattern[0] == '^'
+	if anchor {
+		p = 1 /* skip anchor character */
+	}
+	ms := newMatchState(ls, s, pattern)
+	var b strings.Builder
+	src, lastMatch, n := 0, _NO_MATCH, int64(0)
+	for n < maxS {
+		ms.reprepstate()
+		if e := ms.doMatch(src, p); e != _NO_MATCH && e != lastMatch { /* match? */
+			n++
+			ms.addValue(&b, src, e, tr) /* add replacement to buffer */
+			src, lastMatch = e, e
+		} else if src < len(s) { /* otherwise, skip one character */
+			b.WriteByte(s[src])
+			src++
+		} else {
+			break /* end of subject */
+		}
+		if anchor {
+			break
+		}
+	}
+	b.WriteString(s[src:])
+	ls.PushString(b.String())
+	ls.PushInteger(n) /* number of substitutions */
+	return 2
+}
+
+// lua-5.3.4/src/lstrlib.c#add_s()
+func (self *matchState) addS(b *strings.Builder, s, e int) {
+	ls := self.ls
+	news := ls.ToString(3)
+	for i := 0; i < len(news); i++ {
+		if news[i] != L_ESC {
+			b.WriteByte(news[i])
+			continue
+		}
+		i++ /* skip ESC */
+		if i == len(news) || !_isDigit(news[i]) {
+			if i == len(news) || news[i] != L_ESC {
+				ls.Error2("invalid use of '%c' in replacement string", L_ESC)
+			}
+			b.WriteByte(news[i])
+		} else if news[i] == '0' {
+			b.WriteString(self.src[s:e])
+		} else {
+			self.pushOneCapture(int(news[i]-'1'), s, e)
+			b.WriteString(ls.ToString2(-1)) /* if number, convert it to string */
+			ls.Pop(2)                       /* remove original value and string */
+		}
+	}
+}
+
+// lua-5.3.4/src/lstrlib.c#add_value()
+func (self *matchState) addValue(b *strings.Builder, s, e int, tr LuaType) {
+	ls := self.ls
+	switch tr {
+	case LUA_TFUNCTION:
+		ls.PushValue(3)
+		n := self.pushCaptures(s, e)
+		ls.Call(n, 1)
+	case LUA_TTABLE:
+		self.pushOneCapture(0, s, e)
+		ls.GetTable(3)
+	default: /* LUA_TNUMBER or LUA_TSTRING */
+		self.addS(b, s, e)
+		return
+	}
+	if !ls.ToBoolean(-1) { /* nil or false? */
+		ls.Pop(1)
+		b.WriteString(self.src[s:e]) /* keep original text */
+		return
+	} else if !ls.IsString(-1) {
+		ls.Error2("invalid replacement value (a %s)", ls.TypeName2(-1))
+	}
+	b.WriteString(ls.ToString(-1)) /* add result to accumulator */
+	ls.Pop(1)
+}
+
 /* helper */
 
 /* translate a relative string position: negative means back from end */
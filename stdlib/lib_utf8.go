@@ -2,12 +2,22 @@ package stdlib
 
 import (
 	. "luago/api"
+	"luago/number"
+	"strings"
 	"unicode/utf8"
 )
 
 /* pattern to match a single UTF-8 character */
 const UTF8PATT = "[\x00-\x7F\xC2-\xF4][\x80-\xBF]*"
 
+/* Lua 5.4 also matches the 5- and 6-byte sequences accepted in lax mode */
+const UTF8PATT_54 = "[\x00-\x7F\xC2-\xFD][\x80-\xBF]*"
+
+const (
+	MAXUNICODE = 0x10FFFF
+	MAXUTF     = 0x7FFFFFFF
+)
+
 var utf8Lib = map[string]GoFunction{
 	"len":       utfLen,
 	"offset":    utfByteOffset,
@@ -16,9 +26,23 @@ var utf8Lib = map[string]GoFunction{
 	"codes":     utfIterCodes,
 }
 
+// 5.4的版本：增加lax参数，严格模式下拒绝代理项和超过MAXUNICODE的码点，
+// lax模式接受最大MAXUTF的码点（最长6字节）
+var utf8Lib54 = map[string]GoFunction{
+	"len":       utfLen54,
+	"codepoint": utfCodePoint54,
+	"char":      utfChar54,
+	"codes":     utfIterCodes54,
+}
+
 func OpenUTF8Lib(ls LuaState) int {
 	ls.NewLib(utf8Lib)
-	ls.PushString(UTF8PATT)
+	if ls.Version() >= LUA_VERSION_NUM_54 {
+		ls.SetFuncs(utf8Lib54, 0)
+		ls.PushString(UTF8PATT_54)
+	} else {
+		ls.PushString(UTF8PATT)
+	}
 	ls.SetField(-2, "charpattern")
 	return 1
 }
@@ -203,3 +227,156 @@ func _iterAux(ls LuaState) int {
 func _isCont(b byte) bool {
 	return b&0xC0 == 0x80
 }
+
+/* Lua 5.4 */
+
+// _utf8Decode: 解码s开头的一个字符，返回码点和字节数，不是合法的序列时字节数为0
+// strict为true时拒绝超过MAXUNICODE的码点和代理项
+// lua-5.4.6/src/lutf8lib.c#utf8_decode()
+func _utf8Decode(s string, strict bool) (code rune, size int) {
+	limits := [...]uint32{^uint32(0), 0x80, 0x800, 0x10000, 0x200000, 0x4000000}
+	c := uint32(s[0])
+	res := uint32(0) /* final result */
+	count := 0       /* to count number of continuation bytes */
+	if c < 0x80 {    /* ascii? */
+		res = c
+	} else {
+		for ; c&0x40 != 0; c <<= 1 { /* while it needs continuation bytes... */
+			count++
+			if count >= len(s) || !_isCont(s[count]) { /* not a continuation byte? */
+				return 0, 0 /* invalid byte sequence */
+			}
+			res = res<<6 | uint32(s[count])&0x3F /* add lower 6 bits from cont. byte */
+		}
+		if count > 5 {
+			return 0, 0
+		}
+		res |= (c & 0x7F) << (count * 5) /* add first byte */
+		if res > MAXUTF || res < limits[count] {
+			return 0, 0 /* invalid byte sequence */
+		}
+	}
+	if strict {
+		/* check for invalid code points; too large or surrogates */
+		if res > MAXUNICODE || 0xD800 <= res && res <= 0xDFFF {
+			return 0, 0
+		}
+	}
+	return rune(res), count + 1 /* +1 to include first byte */
+}
+
+// utf8.len (s [, i [, j [, lax]]])
+// http://www.lua.org/manual/5.4/manual.html#pdf-utf8.len
+// lua-5.4.6/src/lutf8lib.c#utflen()
+func utfLen54(ls LuaState) int {
+	n := int64(0) /* counter for the number of characters */
+	s := ls.CheckString(1)
+	sLen := len(s)
+	posi := posRelat(ls.OptInteger(2, 1), sLen)
+	posj := posRelat(ls.OptInteger(3, -1), sLen)
+	lax := ls.ToBoolean(4)
+	ls.ArgCheck(1 <= posi && posi-1 <= sLen, 2,
+		"initial position out of bounds")
+	ls.ArgCheck(posj-1 < sLen, 3,
+		"final position out of bounds")
+	for posi--; posi < posj; n++ {
+		_, size := _utf8Decode(s[posi:], !lax)
+		if size == 0 { /* conversion error? */
+			ls.PushNil()                    /* return fail ... */
+			ls.PushInteger(int64(posi + 1)) /* ... and current position */
+			return 2
+		}
+		posi += size
+	}
+	ls.PushInteger(n)
+	return 1
+}
+
+// utf8.codepoint (s [, i [, j [, lax]]])
+// http://www.lua.org/manual/5.4/manual.html#pdf-utf8.codepoint
+// lua-5.4.6/src/lutf8lib.c#codepoint()
+func utfCodePoint54(ls LuaState) int {
+	s := ls.CheckString(1)
+	sLen := len(s)
+	posi := posRelat(ls.OptInteger(2, 1), sLen)
+	pose := posRelat(ls.OptInteger(3, int64(posi)), sLen)
+	lax := ls.ToBoolean(4)
+	ls.ArgCheck(posi >= 1, 2, "out of bounds")
+	ls.ArgCheck(pose <= sLen, 3, "out of bounds")
+	if posi > pose {
+		return 0 /* empty interval; return no values */
+	}
+	ls.CheckStack2(pose-posi+1, "string slice too long")
+	n := 0 /* count the number of returns */
+	for i := posi - 1; i < pose; n++ {
+		code, size := _utf8Decode(s[i:], !lax)
+		if size == 0 {
+			return ls.Error2("invalid UTF-8 code")
+		}
+		ls.PushInteger(int64(code))
+		i += size
+	}
+	return n
+}
+
+// utf8.char (···)
+// http://www.lua.org/manual/5.4/manual.html#pdf-utf8.char
+// lua-5.4.6/src/lutf8lib.c#utfchar()
+func utfChar54(ls LuaState) int {
+	n := ls.GetTop() /* number of arguments */
+	var sb strings.Builder
+	for i := 1; i <= n; i++ {
+		code := uint64(ls.CheckInteger(i))
+		ls.ArgCheck(code <= MAXUTF, i, "value out of range")
+		sb.WriteString(number.UTF8Esc(uint32(code)))
+	}
+	ls.PushString(sb.String())
+	return 1
+}
+
+// utf8.codes (s [, lax])
+// http://www.lua.org/manual/5.4/manual.html#pdf-utf8.codes
+// lua-5.4.6/src/lutf8lib.c#iter_codes()
+func utfIterCodes54(ls LuaState) int {
+	lax := ls.ToBoolean(2)
+	s := ls.CheckString(1)
+	ls.ArgCheck(!_isContAt(s, 0), 1, "invalid UTF-8 code")
+	if lax {
+		ls.PushGoFunction(_iterAuxLax)
+	} else {
+		ls.PushGoFunction(_iterAuxStrict)
+	}
+	ls.PushValue(1)
+	ls.PushInteger(0)
+	return 3
+}
+
+func _iterAuxStrict(ls LuaState) int { return _iterAux54(ls, true) }
+func _iterAuxLax(ls LuaState) int    { return _iterAux54(ls, false) }
+
+// lua-5.4.6/src/lutf8lib.c#iter_aux()
+func _iterAux54(ls LuaState, strict bool) int {
+	s := ls.CheckString(1)
+	sLen := uint64(len(s))
+	n := uint64(ls.ToInteger(2))
+	if n < sLen {
+		for _isContAt(s, int(n)) {
+			n++ /* go to next character */
+		}
+	}
+	if n >= sLen { /* (also handles original 'n' being negative) */
+		return 0 /* no more codepoints */
+	}
+	code, size := _utf8Decode(s[n:], strict)
+	if size == 0 || _isContAt(s, int(n)+size) {
+		return ls.Error2("invalid UTF-8 code")
+	}
+	ls.PushInteger(int64(n + 1))
+	ls.PushInteger(int64(code))
+	return 2
+}
+
+// _isContAt: s[i]是否是后续字节，超出字符串时为false（相当于C字符串结尾的'\0'）
+func _isContAt(s string, i int) bool {
+	return i < len(s) && _isCont(s[i])
+}
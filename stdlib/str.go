@@ -1,115 +1,665 @@
 package stdlib
 
-import "regexp"
-import "strings"
+import (
+	"fmt"
+	. "luago/api"
+	"math"
+	"strconv"
+	"strings"
+)
 
-// tag = %[flags][width][.precision]specifier
-var tagPattern = regexp.MustCompile(`%[ #+-0]?[0-9]*(\.[0-9]+)?[cdeEfgGioqsuxX%]`)
+const L_ESC = '%'
 
-func parseFmtStr(fmt string) []string {
-	if fmt == "" || strings.IndexByte(fmt, '%') < 0 {
-		return []string{fmt}
+/* valid flags in a format specification */
+const FMT_FLAGS = "-+ #0"
+
+// 格式说明符：%[flags][width][.precision]conversion
+type fmtSpec struct {
+	flags string
+	width int // -1表示未指定
+	prec  int // -1表示未指定
+	conv  byte
+}
+
+// lua-5.3.4/src/lstrlib.c#scanformat()
+// 解析'%'之后的格式说明符，返回说明符及其消耗的字节数
+func scanFormat(ls LuaState, strfrmt string) (*fmtSpec, int) {
+	spec := &fmtSpec{width: -1, prec: -1}
+	p := 0
+	for p < len(strfrmt) && strings.IndexByte(FMT_FLAGS, strfrmt[p]) >= 0 {
+		p++ /* skip flags */
 	}
+	if p > len(FMT_FLAGS) {
+		ls.Error2("invalid format (repeated flags)")
+	}
+	spec.flags = strfrmt[:p]
+	spec.width, p = _scanDigits(strfrmt, p) /* skip width */
+	if p < len(strfrmt) && strfrmt[p] == '.' {
+		p++
+		spec.prec, p = _scanDigits(strfrmt, p) /* skip precision */
+		if spec.prec < 0 {
+			spec.prec = 0
+		}
+	}
+	if p < len(strfrmt) && isDigit(strfrmt[p]) {
+		ls.Error2("invalid format (width or precision too long)")
+	}
+	if p < len(strfrmt) {
+		spec.conv = strfrmt[p]
+		p++
+	}
+	return spec, p
+}
 
-	parsed := make([]string, 0, len(fmt)/2)
-	for {
-		if fmt == "" {
-			break
+/* 最多读取2位数字 */
+func _scanDigits(s string, p int) (int, int) {
+	n := -1
+	for i := 0; i < 2 && p < len(s) && isDigit(s[p]); i++ {
+		if n < 0 {
+			n = 0
 		}
+		n = n*10 + int(s[p]-'0')
+		p++
+	}
+	return n, p
+}
+
+func (self *fmtSpec) hasFlag(c byte) bool {
+	return strings.IndexByte(self.flags, c) >= 0
+}
+
+// 转换为等价的Go格式串
+func (self *fmtSpec) goFormat(verb byte) string {
+	f := "%" + self.flags
+	if self.width >= 0 {
+		f += strconv.Itoa(self.width)
+	}
+	if self.prec >= 0 {
+		f += "." + strconv.Itoa(self.prec)
+	}
+	return f + string(verb)
+}
 
-		loc := tagPattern.FindStringIndex(fmt)
-		if loc == nil {
-			parsed = append(parsed, fmt)
-			break
+// C的无符号转换忽略'+'和' '标志
+func (self *fmtSpec) unsigned() *fmtSpec {
+	s := *self
+	s.flags = strings.Map(func(r rune) rune {
+		if r == '+' || r == ' ' {
+			return -1
 		}
+		return r
+	}, s.flags)
+	return &s
+}
+
+// 按宽度用空格填充
+func (self *fmtSpec) pad(prefix, body string) string {
+	n := self.width - len(prefix) - len(body)
+	if n <= 0 {
+		return prefix + body
+	}
+	if self.hasFlag('-') {
+		return prefix + body + strings.Repeat(" ", n)
+	}
+	return strings.Repeat(" ", n) + prefix + body
+}
+
+// 数字的填充：'0'标志在符号和前缀之后补0
+func (self *fmtSpec) padNumber(prefix, digits string) string {
+	n := self.width - len(prefix) - len(digits)
+	if n > 0 && self.hasFlag('0') && !self.hasFlag('-') {
+		return prefix + strings.Repeat("0", n) + digits
+	}
+	return self.pad(prefix, digits)
+}
+
+func (self *fmtSpec) signPrefix(neg bool) string {
+	switch {
+	case neg:
+		return "-"
+	case self.hasFlag('+'):
+		return "+"
+	case self.hasFlag(' '):
+		return " "
+	default:
+		return ""
+	}
+}
 
-		head := fmt[:loc[0]]
-		tag := fmt[loc[0]:loc[1]]
-		tail := fmt[loc[1]:]
+func (self *fmtSpec) isUpper() bool {
+	return self.conv >= 'A' && self.conv <= 'Z'
+}
 
-		if head != "" {
-			parsed = append(parsed, head)
+/* inf和nan按C的格式输出，不补0 */
+func (self *fmtSpec) formatNonFinite(n float64) string {
+	s := "inf"
+	if math.IsNaN(n) {
+		s = "nan"
+	}
+	if self.isUpper() {
+		s = strings.ToUpper(s)
+	}
+	return self.pad(self.signPrefix(math.Signbit(n)), s)
+}
+
+// %e %E %f %F %g %G
+func (self *fmtSpec) formatFloat(n float64) string {
+	if math.IsInf(n, 0) || math.IsNaN(n) {
+		return self.formatNonFinite(n)
+	}
+	s := *self
+	verb := s.conv
+	switch verb {
+	case 'F':
+		verb = 'f'
+	case 'g', 'G':
+		if s.prec < 0 {
+			s.prec = 6 /* C的默认精度 */
 		}
-		parsed = append(parsed, tag)
-		fmt = tail
 	}
-	return parsed
+	return fmt.Sprintf(s.goFormat(verb), n)
 }
 
-func find(s, pattern string, init int, plain bool) (start, end int) {
-	tail := s
-	if init > 1 {
-		tail = s[init-1:]
+// %a %A
+// lua-5.3.4/src/lstrlib.c#lua_number2strx()
+func (self *fmtSpec) formatHexFloat(n float64) string {
+	if math.IsInf(n, 0) || math.IsNaN(n) {
+		return self.formatNonFinite(n)
+	}
+	sign := self.signPrefix(math.Signbit(n))
+	body := _hexFloat(math.Abs(n), self.prec, self.hasFlag('#'))
+	if self.isUpper() {
+		body = strings.ToUpper(body)
 	}
+	return self.padNumber(sign+body[:2], body[2:])
+}
 
-	if plain {
-		start = strings.Index(tail, pattern)
-		end = start + len(pattern) - 1
+/* 格式化非负有限浮点数为十六进制，形如0x1.8p+1 */
+func _hexFloat(f float64, prec int, alt bool) string {
+	bits := math.Float64bits(f)
+	exp := int(bits>>52) & 0x7ff
+	mant := bits & (1<<52 - 1)
+	e := 0
+	if exp == 0 {
+		if mant != 0 { /* subnormal */
+			e = -1022
+		}
 	} else {
-		re, err := _compile(pattern)
-		if err != "" {
-			panic(err) // todo
-		} else {
-			loc := re.FindStringIndex(tail)
-			if loc == nil {
-				start, end = -1, -1
+		mant |= 1 << 52
+		e = exp - 1023
+	}
+
+	nd := 13 /* hex digits after the point */
+	if prec >= 0 && prec < nd {
+		shift := uint(nd-prec) * 4
+		rem := mant & (1<<shift - 1)
+		half := uint64(1) << (shift - 1)
+		mant >>= shift
+		if rem > half || rem == half && mant&1 == 1 {
+			mant++ /* round half to even */
+		}
+		nd = prec
+	}
+	lead := mant >> (uint(nd) * 4)
+	digits := ""
+	if nd > 0 {
+		digits = fmt.Sprintf("%0*x", nd, mant&(1<<(uint(nd)*4)-1))
+	}
+	if prec < 0 {
+		digits = strings.TrimRight(digits, "0")
+	} else if prec > nd {
+		digits += strings.Repeat("0", prec-nd)
+	}
+
+	s := "0x" + strconv.FormatUint(lead, 16)
+	if digits != "" || alt {
+		s += "." + digits
+	}
+	if e >= 0 {
+		return s + "p+" + strconv.Itoa(e)
+	}
+	return s + "p" + strconv.Itoa(e)
+}
+
+// lua-5.3.4/src/lstrlib.c#addquoted()
+func addQuoted(b *strings.Builder, s string) {
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '"' || c == '\\' || c == '\n' {
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		} else if c < 0x20 || c == 0x7f { /* iscntrl */
+			if i+1 < len(s) && isDigit(s[i+1]) {
+				fmt.Fprintf(b, "\\%03d", c)
 			} else {
-				start, end = loc[0], loc[1]-1
+				fmt.Fprintf(b, "\\%d", c)
 			}
+		} else {
+			b.WriteByte(c)
 		}
 	}
-	if start >= 0 {
-		start += len(s) - len(tail) + 1
-		end += len(s) - len(tail) + 1
+	b.WriteByte('"')
+}
+
+// %q对浮点数使用十六进制，保证读回的值完全相同
+func quoteFloat(n float64) string {
+	switch {
+	case math.IsInf(n, 1):
+		return "1e9999"
+	case math.IsInf(n, -1):
+		return "-1e9999"
+	case math.IsNaN(n):
+		return "(0/0)"
 	}
+	spec := &fmtSpec{width: -1, prec: -1, conv: 'a'}
+	return spec.formatHexFloat(n)
+}
 
-	return
+/* PATTERN MATCHING */
+
+/* maximum number of captures that a pattern can do during pattern-matching */
+const LUA_MAXCAPTURES = 32
+
+/* maximum recursion depth for 'match' */
+const MAXCCALLS = 200
+
+const (
+	CAP_UNFINISHED = -1
+	CAP_POSITION   = -2
+)
+
+/* 匹配失败时返回的位置（相当于C代码中的NULL） */
+const _NO_MATCH = -1
+
+// 模式匹配的状态，位置都是src和pat中的下标
+// lua-5.3.4/src/lstrlib.c#MatchState
+type matchState struct {
+	ls         LuaState
+	src        string
+	pat        string
+	level      int /* total number of captures (finished or unfinished) */
+	matchdepth int /* control for recursive depth (to avoid C stack overflow) */
+	capture    [LUA_MAXCAPTURES]struct {
+		init int
+		len  int
+	}
+}
+
+func newMatchState(ls LuaState, src, pat string) *matchState {
+	return &matchState{ls: ls, src: src, pat: pat}
 }
 
-func match(s, pattern string, init int) []int {
-	tail := s
-	if init > 1 {
-		tail = s[init-1:]
+// lua-5.3.4/src/lstrlib.c#reprepstate()
+func (self *matchState) reprepstate() {
+	self.level = 0
+	self.matchdepth = MAXCCALLS
+}
+
+// lua-5.3.4/src/lstrlib.c#check_capture()
+func (self *matchState) checkCapture(l byte) int {
+	idx := int(l) - '1'
+	if idx < 0 || idx >= self.level || self.capture[idx].len == CAP_UNFINISHED {
+		self.ls.Error2("invalid capture index %%%d", idx+1)
 	}
+	return idx
+}
 
-	re, err := _compile(pattern)
-	if err != "" {
-		panic(err) // todo
-	} else {
-		found := re.FindStringSubmatchIndex(tail)
-		if len(found) > 2 {
-			return found[2:]
-		} else {
-			return found
+// lua-5.3.4/src/lstrlib.c#capture_to_close()
+func (self *matchState) captureToClose() int {
+	for level := self.level - 1; level >= 0; level-- {
+		if self.capture[level].len == CAP_UNFINISHED {
+			return level
 		}
 	}
+	self.ls.Error2("invalid pattern capture")
+	return 0
 }
 
-// todo
-func gsub(s, pattern, repl string, n int) (string, int) {
-	re, err := _compile(pattern)
-	if err != "" {
-		panic(err) // todo
-	} else {
-		indexes := re.FindAllStringIndex(s, n)
-		if indexes == nil {
-			return s, 0
+// 返回字符类之后的位置
+// lua-5.3.4/src/lstrlib.c#classEnd()
+func (self *matchState) classEnd(p int) int {
+	pat := self.pat
+	c := pat[p]
+	p++
+	if c == L_ESC {
+		if p >= len(pat) {
+			self.ls.Error2("malformed pattern (ends with '%%')")
+		}
+		return p + 1
+	}
+	if c == '[' {
+		if p < len(pat) && pat[p] == '^' {
+			p++
+		}
+		for { /* look for a ']' */
+			if p >= len(pat) {
+				self.ls.Error2("malformed pattern (missing ']')")
+			}
+			c := pat[p]
+			p++
+			if c == L_ESC && p < len(pat) {
+				p++ /* skip escapes (e.g. '%]') */
+			}
+			if p < len(pat) && pat[p] == ']' {
+				break
+			}
+		}
+		return p + 1
+	}
+	return p
+}
+
+// lua-5.3.4/src/lstrlib.c#match_class()
+func matchClass(c, cl byte) bool {
+	var res bool
+	switch cl | 0x20 { /* tolower */
+	case 'a':
+		res = _isAlpha(c)
+	case 'c':
+		res = c < 0x20 || c == 0x7f
+	case 'd':
+		res = _isDigit(c)
+	case 'g':
+		res = _isGraph(c)
+	case 'l':
+		res = 'a' <= c && c <= 'z'
+	case 'p':
+		res = _isGraph(c) && !_isAlpha(c) && !_isDigit(c)
+	case 's':
+		res = c == ' ' || '\t' <= c && c <= '\r'
+	case 'u':
+		res = 'A' <= c && c <= 'Z'
+	case 'w':
+		res = _isAlpha(c) || _isDigit(c)
+	case 'x':
+		res = _isDigit(c) || 'a' <= c|0x20 && c|0x20 <= 'f'
+	default:
+		return cl == c
+	}
+	if 'A' <= cl && cl <= 'Z' {
+		return !res
+	}
+	return res
+}
+
+/* 和C库一样只认ASCII字符（C locale） */
+func _isAlpha(c byte) bool { return 'a' <= c|0x20 && c|0x20 <= 'z' }
+func _isDigit(c byte) bool { return '0' <= c && c <= '9' }
+func _isGraph(c byte) bool { return 0x21 <= c && c <= 0x7e }
+
+// p指向'['，ec指向']'
+// lua-5.3.4/src/lstrlib.c#matchbracketclass()
+func (self *matchState) matchBracketClass(c byte, p, ec int) bool {
+	pat := self.pat
+	sig := true
+	if pat[p+1] == '^' {
+		sig = false
+		p++ /* skip the '^' */
+	}
+	for p++; p < ec; p++ {
+		if pat[p] == L_ESC {
+			p++
+			if matchClass(c, pat[p]) {
+				return sig
+			}
+		} else if pat[p+1] == '-' && p+2 < ec {
+			p += 2
+			if pat[p-2] <= c && c <= pat[p] {
+				return sig
+			}
+		} else if pat[p] == c {
+			return sig
+		}
+	}
+	return !sig
+}
+
+// lua-5.3.4/src/lstrlib.c#singlematch()
+func (self *matchState) singleMatch(s, p, ep int) bool {
+	if s >= len(self.src) {
+		return false
+	}
+	c := self.src[s]
+	switch self.pat[p] {
+	case '.':
+		return true /* matches any char */
+	case L_ESC:
+		return matchClass(c, self.pat[p+1])
+	case '[':
+		return self.matchBracketClass(c, p, ep-1)
+	default:
+		return self.pat[p] == c
+	}
+}
+
+// lua-5.3.4/src/lstrlib.c#matchbalance()
+func (self *matchState) matchBalance(s, p int) int {
+	if p+1 >= len(self.pat) {
+		self.ls.Error2("malformed pattern (missing arguments to '%%b')")
+	}
+	src := self.src
+	if s >= len(src) || src[s] != self.pat[p] {
+		return _NO_MATCH
+	}
+	b, e := self.pat[p], self.pat[p+1]
+	cont := 1
+	for s++; s < len(src); s++ {
+		if src[s] == e {
+			if cont--; cont == 0 {
+				return s + 1
+			}
+		} else if src[s] == b {
+			cont++
 		}
+	}
+	return _NO_MATCH /* string ends out of balance */
+}
 
-		nMatches := len(indexes)
-		lastEnd := indexes[nMatches-1][1]
-		head, tail := s[:lastEnd], s[lastEnd:]
+// lua-5.3.4/src/lstrlib.c#max_expand()
+func (self *matchState) maxExpand(s, p, ep int) int {
+	i := 0 /* counts maximum expand for item */
+	for self.singleMatch(s+i, p, ep) {
+		i++
+	}
+	/* keeps trying to match with the maximum repetitions */
+	for ; i >= 0; i-- {
+		if res := self.doMatch(s+i, ep+1); res != _NO_MATCH {
+			return res
+		}
+	}
+	return _NO_MATCH
+}
 
-		newHead := re.ReplaceAllString(head, repl)
-		return newHead + tail, nMatches
+// lua-5.3.4/src/lstrlib.c#min_expand()
+func (self *matchState) minExpand(s, p, ep int) int {
+	for {
+		if res := self.doMatch(s, ep+1); res != _NO_MATCH {
+			return res
+		} else if self.singleMatch(s, p, ep) {
+			s++ /* try with one more repetition */
+		} else {
+			return _NO_MATCH
+		}
 	}
 }
 
-func _compile(pattern string) (*regexp.Regexp, string) {
-	re, err := regexp.Compile(pattern)
-	if err != nil {
-		return nil, err.Error() // todo
+// lua-5.3.4/src/lstrlib.c#start_capture()
+func (self *matchState) startCapture(s, p, what int) int {
+	if self.level >= LUA_MAXCAPTURES {
+		self.ls.Error2("too many captures")
+	}
+	self.capture[self.level].init = s
+	self.capture[self.level].len = what
+	self.level++
+	res := self.doMatch(s, p)
+	if res == _NO_MATCH { /* match failed? */
+		self.level-- /* undo capture */
+	}
+	return res
+}
+
+// lua-5.3.4/src/lstrlib.c#end_capture()
+func (self *matchState) endCapture(s, p int) int {
+	l := self.captureToClose()
+	self.capture[l].len = s - self.capture[l].init /* close capture */
+	res := self.doMatch(s, p)
+	if res == _NO_MATCH { /* match failed? */
+		self.capture[l].len = CAP_UNFINISHED /* undo capture */
+	}
+	return res
+}
+
+// lua-5.3.4/src/lstrlib.c#match_capture()
+func (self *matchState) matchCapture(s int, l byte) int {
+	idx := self.checkCapture(l)
+	init, n := self.capture[idx].init, self.capture[idx].len
+	if len(self.src)-s >= n && self.src[init:init+n] == self.src[s:s+n] {
+		return s + n
+	}
+	return _NO_MATCH
+}
+
+// 从src[s]开始匹配pat[p:]，返回匹配结束的位置，失败时返回_NO_MATCH
+// lua-5.3.4/src/lstrlib.c#match()
+func (self *matchState) doMatch(s, p int) int {
+	if self.matchdepth--; self.matchdepth == 0 {
+		self.ls.Error2("pattern too complex")
+	}
+	s = self._doMatch(s, p)
+	self.matchdepth++
+	return s
+}
+
+func (self *matchState) _doMatch(s, p int) int {
+	pat := self.pat
+	for p < len(pat) { /* end of pattern? */
+		switch pat[p] {
+		case '(': /* start capture */
+			if p+1 < len(pat) && pat[p+1] == ')' { /* position capture? */
+				return self.startCapture(s, p+2, CAP_POSITION)
+			}
+			return self.startCapture(s, p+1, CAP_UNFINISHED)
+		case ')': /* end capture */
+			return self.endCapture(s, p+1)
+		case '$':
+			if p+1 == len(pat) { /* is the '$' the last char in pattern? */
+				if s != len(self.src) { /* check end of string */
+					return _NO_MATCH
+				}
+				return s
+			}
+		case L_ESC: /* escaped sequences not in the format class[*+?-]? */
+			if p+1 < len(pat) {
+				switch pat[p+1] {
+				case 'b': /* balanced string? */
+					if s = self.matchBalance(s, p+2); s == _NO_MATCH {
+						return s
+					}
+					p += 4
+					continue
+				case 'f': /* frontier? */
+					p += 2
+					if p >= len(pat) || pat[p] != '[' {
+						self.ls.Error2("missing '[' after '%%f' in pattern")
+					}
+					ep := self.classEnd(p) /* points to what is next */
+					var prev, cur byte
+					if s > 0 {
+						prev = self.src[s-1]
+					}
+					if s < len(self.src) {
+						cur = self.src[s]
+					}
+					if !self.matchBracketClass(prev, p, ep-1) &&
+						self.matchBracketClass(cur, p, ep-1) {
+						p = ep
+						continue
+					}
+					return _NO_MATCH /* match failed */
+				case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9': /* capture results (%0-%9)? */
+					if s = self.matchCapture(s, pat[p+1]); s == _NO_MATCH {
+						return s
+					}
+					p += 2
+					continue
+				}
+			}
+		}
+		/* default: pattern class plus optional suffix */
+		ep := self.classEnd(p) /* points to optional suffix */
+		var epc byte
+		if ep < len(pat) {
+			epc = pat[ep]
+		}
+		if !self.singleMatch(s, p, ep) { /* does not match at least once? */
+			if epc == '*' || epc == '?' || epc == '-' { /* accept empty? */
+				p = ep + 1
+				continue
+			}
+			return _NO_MATCH
+		}
+		/* matched once */
+		switch epc { /* handle optional suffix */
+		case '?': /* optional */
+			if res := self.doMatch(s+1, ep+1); res != _NO_MATCH {
+				return res
+			}
+			p = ep + 1
+		case '+': /* 1 or more repetitions */
+			return self.maxExpand(s+1, p, ep) /* 1 match already done */
+		case '*': /* 0 or more repetitions */
+			return self.maxExpand(s, p, ep)
+		case '-': /* 0 or more repetitions (minimum) */
+			return self.minExpand(s, p, ep)
+		default: /* no suffix */
+			s++
+			p = ep
+		}
+	}
+	return s
+}
+
+// 把第i个捕获压栈，没有捕获时i=0表示整个匹配
+// lua-5.3.4/src/lstrlib.c#push_onecapture()
+func (self *matchState) pushOneCapture(i, s, e int) {
+	if i >= self.level {
+		if i == 0 { /* ms->level == 0, too */
+			self.ls.PushString(self.src[s:e]) /* add whole match */
+		} else {
+			self.ls.Error2("invalid capture index %%%d", i+1)
+		}
+		return
+	}
+	init, l := self.capture[i].init, self.capture[i].len
+	if l == CAP_UNFINISHED {
+		self.ls.Error2("unfinished capture")
+	}
+	if l == CAP_POSITION {
+		self.ls.PushInteger(int64(init + 1))
 	} else {
-		return re, ""
+		self.ls.PushString(self.src[init : init+l])
+	}
+}
+
+// s为_NO_MATCH时，没有捕获也不压入整个匹配（string.find）
+// lua-5.3.4/src/lstrlib.c#push_captures()
+func (self *matchState) pushCaptures(s, e int) int {
+	nLevels := self.level
+	if nLevels == 0 && s != _NO_MATCH {
+		nLevels = 1
 	}
+	self.ls.CheckStack2(nLevels, "too many captures")
+	for i := 0; i < nLevels; i++ {
+		self.pushOneCapture(i, s, e)
+	}
+	return nLevels /* number of strings pushed */
+}
+
+/* check whether pattern has no special characters */
+// lua-5.3.4/src/lstrlib.c#nospecials()
+func noSpecials(pattern string) bool {
+	return !strings.ContainsAny(pattern, SPECIALS)
 }
+
+const SPECIALS = "^$*+?.([%-"
@@ -29,6 +29,7 @@ func call(i Instruction, vm LuaVM) {
 func _return(i Instruction, vm LuaVM) {
 	a, b, _ := i.ABC()
 	a += 1
+	vm.CloseUpvalues(1) // 返回前关闭全部待关闭变量
 	if b == 1 {
 		// 无返回值
 	} else if b > 1 {
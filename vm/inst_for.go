@@ -1,7 +1,10 @@
 package vm
 
 import (
+	"fmt"
 	. "luago/api"
+	"luago/number"
+	"math"
 )
 
 // forPrep:R(A) -= R(A+2); pc += sBx
@@ -9,6 +12,10 @@ import (
 func forPrep(i Instruction, vm LuaVM) {
 	a, sBx := i.AsBx()
 	a += 1
+	if vm.Version() >= LUA_VERSION_NUM_54 {
+		_forPrep54(a, sBx, vm)
+		return
+	}
 
 	if vm.Type(a) == LUA_TSTRING {
 		vm.PushNumber(vm.ToNumber(a))
@@ -37,6 +44,10 @@ func forPrep(i Instruction, vm LuaVM) {
 func forLoop(i Instruction, vm LuaVM) {
 	a, sBx := i.AsBx()
 	a += 1
+	if vm.Version() >= LUA_VERSION_NUM_54 {
+		_forLoop54(a, sBx, vm)
+		return
+	}
 
 	// R(A) += R(A+2)
 	vm.PushValue(a + 2)
@@ -52,3 +63,131 @@ func forLoop(i Instruction, vm LuaVM) {
 		vm.Copy(a, a+3)
 	}
 }
+
+// _forPrep54: Lua 5.4的数值for循环，进入循环前先判断是否一次也不执行，是则跳过FORLOOP
+// 初值和步长都是整数时是整数循环：预先算出还要执行的次数代替R(A+1)中的上限，循环变量不会溢出；
+// 否则三个值都转换为浮点数。要执行循环时设置R(A+3)后直接进入循环体
+// lua-5.4.6/src/lvm.c#forprep()
+func _forPrep54(a, sBx int, vm LuaVM) {
+	if vm.IsInteger(a) && vm.IsInteger(a+2) { /* integer loop? */
+		init, _ := vm.ToIntegerX(a)
+		step, _ := vm.ToIntegerX(a + 2)
+		if step == 0 {
+			_forError(vm, "'for' step is zero")
+		}
+		limit, skip := _forLimit(a+1, init, step, vm)
+		if skip { /* skip the loop */
+			vm.AddPC(sBx + 1)
+			return
+		}
+		/* prepare loop counter */
+		var count uint64
+		if step > 0 { /* ascending loop? */
+			count = uint64(limit) - uint64(init)
+			if step != 1 { /* avoid division in the too common case */
+				count /= uint64(step)
+			}
+		} else { /* step < 0; descending loop */
+			count = uint64(init) - uint64(limit)
+			/* 'step+1' avoids negating 'mininteger' */
+			count /= uint64(-(step + 1)) + 1
+		}
+		vm.PushInteger(int64(count)) /* store the counter in place of the limit */
+		vm.Replace(a + 1)
+	} else { /* try making all control values floats */
+		init := _forNumber(a, "initial value", vm)
+		limit := _forNumber(a+1, "limit", vm)
+		step := _forNumber(a+2, "step", vm)
+		if step == 0 {
+			_forError(vm, "'for' step is zero")
+		}
+		if 0 < step && limit < init || !(0 < step) && init < limit {
+			vm.AddPC(sBx + 1) /* skip the loop */
+			return
+		}
+		for i, n := range []float64{init, limit, step} {
+			vm.PushNumber(n)
+			vm.Replace(a + i)
+		}
+	}
+	vm.Copy(a, a+3) /* control variable */
+}
+
+// _forLimit: 整数循环的上限，上限是超出整数范围的浮点数时截断；skip为true表示循环一次也不执行
+// lua-5.4.6/src/lvm.c#forlimit()
+func _forLimit(idx int, init, step int64, vm LuaVM) (limit int64, skip bool) {
+	if n, ok := vm.ToIntegerX(idx); ok {
+		limit = n
+	} else {
+		f := _forNumber(idx, "limit", vm)
+		if step < 0 {
+			f = math.Ceil(f)
+		} else {
+			f = math.Floor(f)
+		}
+		if n, ok := number.FloatToInteger(f); ok {
+			limit = n
+		} else if 0 < f { /* if it is positive, it is too large */
+			if step < 0 {
+				return 0, true /* initial value must be less than it */
+			}
+			limit = LUA_MAXINTEGER /* truncate */
+		} else { /* it is less than min integer */
+			if step > 0 {
+				return 0, true /* initial value must be greater than it */
+			}
+			limit = LUA_MININTEGER /* truncate */
+		}
+	}
+	if step > 0 {
+		return limit, init > limit
+	}
+	return limit, init < limit
+}
+
+// _forNumber: 把循环的控制值转换为浮点数，不是数字时报错
+// lua-5.4.6/src/ldebug.c#luaG_forerror()
+func _forNumber(idx int, what string, vm LuaVM) float64 {
+	n, ok := vm.ToNumberX(idx)
+	if !ok {
+		_forError(vm, "'for' %s must be a number", what)
+	}
+	return n
+}
+
+// _forLoop54: 整数循环在计数器不为0时减1并更新循环变量，浮点数循环和5.3一样比较上限
+// lua-5.4.6/src/lvm.c#OP_FORLOOP
+func _forLoop54(a, sBx int, vm LuaVM) {
+	if vm.IsInteger(a + 2) { /* integer loop? */
+		count, _ := vm.ToIntegerX(a + 1)
+		if count == 0 { /* no more iterations */
+			return
+		}
+		vm.PushInteger(count - 1)
+		vm.Replace(a + 1)
+		vm.PushValue(a)
+		vm.PushValue(a + 2)
+		vm.Arith(LUA_OPADD) /* increment index, wrapping around like 'l_castU2S' */
+		vm.Replace(a)
+	} else { /* floating loop */
+		step, _ := vm.ToNumberX(a + 2)
+		limit, _ := vm.ToNumberX(a + 1)
+		idx, _ := vm.ToNumberX(a)
+		idx += step /* increment index */
+		if 0 < step && !(idx <= limit) || !(0 < step) && !(limit <= idx) {
+			return /* end of the loop */
+		}
+		vm.PushNumber(idx)
+		vm.Replace(a)
+	}
+	vm.Copy(a, a+3) /* update control variable */
+	vm.AddPC(sBx)   /* jump back */
+}
+
+// _forError: 抛出带有当前位置"源文件:行号:"的错误
+func _forError(vm LuaVM, format string, a ...interface{}) {
+	vm.Where(0) /* the running Lua function */
+	vm.PushString(fmt.Sprintf(format, a...))
+	vm.Concat(2)
+	vm.Error()
+}
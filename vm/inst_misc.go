@@ -20,3 +20,9 @@ func jmp(i Instruction, vm LuaVM) {
 		vm.CloseUpvalues(a)
 	}
 }
+
+// tbc: 把R(A)标记为待关闭变量（local x <close> = ...），离开作用域时调用它的__close元方法
+func tbc(i Instruction, vm LuaVM) {
+	a, _, _ := i.ABC()
+	vm.ToClose(a + 1)
+}
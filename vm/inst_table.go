@@ -40,12 +40,12 @@ func setTable(i Instruction, vm LuaVM) {
 func setList(i Instruction, vm LuaVM) {
 	a, b, c := i.ABC()
 	a += 1
-	// c表示批次数，一批的大小是50，最大索引为512*50 = 25600
-	// 如果数组长度>25600，c会小于等于0
+	// c表示批次数，一批的大小是50，C最大为511
+	// 批次数超过511时C为0，批次数放在下一条EXTRAARG指令里
 	if c > 0 {
 		c = c - 1
 	} else {
-		c = Instruction(vm.Fetch()).Ax()
+		c = Instruction(vm.Fetch()).Ax() - 1
 	}
 
 	bIsZero := b == 0
@@ -2,11 +2,15 @@ package vm
 
 import (
 	"luago/api"
+	"strings"
 )
 
 const (
 	MAXARG_Bx  = 1<<18 - 1      // 2^18 - 1 = 262143
 	MAXARG_sBx = MAXARG_Bx >> 1 // 262143 / 2 = 131071
+	MAXARG_Ax  = 1<<26 - 1      // 2^26 - 1 = 67108863
+	MAXARG_C   = 1<<9 - 1       // 2^9 - 1 = 511
+	MAXINDEXRK = 0xFF           // 能直接作为RK操作数的最大常量索引
 )
 
 type Instruction uint32
@@ -63,6 +67,11 @@ func (self Instruction) CMode() byte {
 	return opcodes[self.Opcode()].argCMode
 }
 
+// TestAMode: 指令是否会修改寄存器A
+func (self Instruction) TestAMode() bool {
+	return opcodes[self.Opcode()].setAFlag == 1
+}
+
 func (self Instruction) Execute(vm api.LuaVM) {
 	action := opcodes[self.Opcode()].action
 	if action != nil {
@@ -71,3 +80,23 @@ func (self Instruction) Execute(vm api.LuaVM) {
 		panic(self.OpName())
 	}
 }
+
+// IsValid: 操作码是否存在
+func (self Instruction) IsValid() bool {
+	return self.Opcode() < len(opcodes)
+}
+
+// TestTMode: 指令是否是测试指令（下一条指令必须是跳转）
+func (self Instruction) TestTMode() bool {
+	return opcodes[self.Opcode()].testFlag == 1
+}
+
+// OpcodeByName: 按指令名（如"MOVE"，不区分大小写）查找操作码
+func OpcodeByName(name string) (int, bool) {
+	for op := range opcodes {
+		if strings.EqualFold(strings.TrimSpace(opcodes[op].name), name) {
+			return op, true
+		}
+	}
+	return 0, false
+}
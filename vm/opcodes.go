@@ -67,6 +67,7 @@ const (
 	OP_CLOSURE
 	OP_VARARG
 	OP_EXTRAARG
+	OP_TBC
 )
 
 type opcode struct {
@@ -128,4 +129,5 @@ var opcodes = []opcode{
 	opcode{0, 1, OpArgU, OpArgN, IABx /* */, "CLOSURE ", closure},  // R(A) := closure(KPROTO[Bx])
 	opcode{0, 1, OpArgU, OpArgN, IABC /* */, "VARARG  ", vararg},   // R(A), R(A+1), ..., R(A+B-2) = vararg
 	opcode{0, 0, OpArgU, OpArgU, IAx /*  */, "EXTRAARG", nil},      // extra (larger) argument for previous opcode
+	opcode{0, 0, OpArgN, OpArgN, IABC /* */, "TBC     ", tbc},      // mark R(A) as to-be-closed (Lua 5.4)
 }